@@ -0,0 +1,86 @@
+package auth
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/jmoiron/monet/app"
+	"github.com/jmoiron/monet/db"
+	"github.com/jmoiron/monet/mtr"
+)
+
+// Admin manages the logged in user's API tokens.
+type Admin struct {
+	db       db.DB
+	tokens   *TokenService
+	sessions *SessionManager
+}
+
+func NewAdmin(db db.DB, sessions *SessionManager) *Admin {
+	return &Admin{db: db, tokens: NewTokenService(db), sessions: sessions}
+}
+
+func (a *Admin) Bind(r chi.Router) {
+	r.Get("/users/", a.users)
+	r.Post("/users/tokens/", a.createToken)
+	r.Post("/users/tokens/revoke/{id:[0-9]+}", a.revokeToken)
+}
+
+// Panels returns nothing; users are reached from the admin footer.
+func (a *Admin) Panels(r *http.Request) ([]string, error) {
+	return nil, nil
+}
+
+// username returns the name of the logged in user.
+func (a *Admin) username(r *http.Request) string {
+	return fmt.Sprint(a.sessions.Session(r).Values["user"])
+}
+
+func (a *Admin) users(w http.ResponseWriter, r *http.Request) {
+	a.showUsers(w, r, "")
+}
+
+func (a *Admin) showUsers(w http.ResponseWriter, r *http.Request, newToken string) {
+	username := a.username(r)
+	tokens, err := a.tokens.List(username)
+	if err != nil {
+		app.Http500("listing tokens", w, err)
+		return
+	}
+
+	reg := mtr.RegistryFromContext(r.Context())
+	err = reg.RenderWithBase(w, "admin-base", "auth/admin/users.html", mtr.Ctx{
+		"title":    "Users",
+		"username": username,
+		"tokens":   tokens,
+		"newToken": newToken,
+	})
+	if err != nil {
+		slog.Error("rendering users", "err", err)
+	}
+}
+
+func (a *Admin) createToken(w http.ResponseWriter, r *http.Request) {
+	name := r.FormValue("name")
+	if len(name) == 0 {
+		name = "api"
+	}
+	token, _, err := a.tokens.Create(a.username(r), name)
+	if err != nil {
+		app.Http500("creating token", w, err)
+		return
+	}
+	a.showUsers(w, r, token)
+}
+
+func (a *Admin) revokeToken(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.ParseUint(chi.URLParam(r, "id"), 10, 64)
+	if err := a.tokens.Revoke(a.username(r), id); err != nil {
+		app.Http500("revoking token", w, err)
+		return
+	}
+	http.Redirect(w, r, "/admin/users/", http.StatusSeeOther)
+}
@@ -9,6 +9,7 @@ import (
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
+	"github.com/go-sprout/sprout"
 	"github.com/jmoiron/monet/app"
 	"github.com/jmoiron/monet/conf"
 	"github.com/jmoiron/monet/db"
@@ -22,7 +23,7 @@ const (
 	loginUrl = "/login/"
 )
 
-//go:embed auth/*.html
+//go:embed auth/*.html auth/admin/*.html
 var authTemplates embed.FS
 
 type App struct {
@@ -61,16 +62,27 @@ func (a *App) Migrate() error {
 	if err != nil {
 		return err
 	}
-	return m.Upgrade(userMigration)
+	for _, set := range []monarch.Set{userMigration, tokenMigration} {
+		if err := m.Upgrade(set); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (a *App) Register(r *mtr.Registry) {
+	r.Handler.AddRegistry(
+		mtr.NewSproutRegistry("auth", sprout.FunctionMap{
+			"fmtTimestamp": app.FmtTimestamp,
+		}),
+	)
 	r.AddPathFS("auth/login.html", authTemplates)
+	r.AddPathFS("auth/admin/users.html", authTemplates)
 }
 
-// GetAdmin returns nil
+// GetAdmin returns the admin for managing API tokens.
 func (a *App) GetAdmin() (app.Admin, error) {
-	return nil, nil
+	return NewAdmin(a.db, a.Sessions), nil
 }
 
 func (a *App) login(w http.ResponseWriter, req *http.Request) {
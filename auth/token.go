@@ -0,0 +1,149 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/monet/db"
+	"github.com/jmoiron/monet/db/monarch"
+)
+
+var tokenMigration = monarch.Set{
+	Name: "api_token",
+	Migrations: []monarch.Migration{
+		{
+			Up: `CREATE TABLE IF NOT EXISTS api_token (
+				id integer NOT NULL PRIMARY KEY,
+				user_id integer NOT NULL,
+				name text NOT NULL DEFAULT '',
+				token_hash text NOT NULL UNIQUE,
+				created_at integer NOT NULL DEFAULT (strftime('%s', 'now')),
+				last_used_at integer NOT NULL DEFAULT 0,
+				FOREIGN KEY (user_id) REFERENCES user(id) ON DELETE CASCADE
+			);`,
+			Down: `DROP TABLE api_token;`,
+		},
+	},
+}
+
+// A Token is a per-user API token.  Only a hash of the token is stored; the
+// token itself is shown once, when it is created.
+type Token struct {
+	ID         uint64
+	UserID     uint64 `db:"user_id"`
+	Name       string
+	TokenHash  string `db:"token_hash"`
+	CreatedAt  int64  `db:"created_at"`
+	LastUsedAt int64  `db:"last_used_at"`
+}
+
+type userKey struct{}
+
+// UserFromContext returns the user authenticated by RequireToken, or nil.
+func UserFromContext(ctx context.Context) *User {
+	u, _ := ctx.Value(userKey{}).(*User)
+	return u
+}
+
+type TokenService struct {
+	db db.DB
+}
+
+func NewTokenService(conn db.DB) *TokenService {
+	return &TokenService{db: conn}
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Create a new token called name for username.  The returned string is the
+// token itself, which cannot be recovered later.
+func (s *TokenService) Create(username, name string) (string, *Token, error) {
+	var u User
+	if err := s.db.Get(&u, `SELECT * FROM user WHERE username=?`, username); err != nil {
+		return "", nil, fmt.Errorf("user %q: %w", username, err)
+	}
+
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		return "", nil, err
+	}
+	token := hex.EncodeToString(buf)
+
+	t := &Token{UserID: u.ID, Name: name, TokenHash: hashToken(token), CreatedAt: time.Now().Unix()}
+	res, err := s.db.Exec(`INSERT INTO api_token (user_id, name, token_hash, created_at) VALUES (?, ?, ?, ?)`,
+		t.UserID, t.Name, t.TokenHash, t.CreatedAt)
+	if err != nil {
+		return "", nil, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return "", nil, err
+	}
+	t.ID = uint64(id)
+	return token, t, nil
+}
+
+// Authenticate returns the user that owns token.
+func (s *TokenService) Authenticate(token string) (*User, error) {
+	if len(token) == 0 {
+		return nil, fmt.Errorf("no token")
+	}
+	hash := hashToken(token)
+
+	var u User
+	q := `SELECT user.* FROM user JOIN api_token t ON t.user_id = user.id WHERE t.token_hash=?`
+	if err := s.db.Get(&u, q, hash); err != nil {
+		return nil, fmt.Errorf("invalid token")
+	}
+	s.db.Exec(`UPDATE api_token SET last_used_at=? WHERE token_hash=?`, time.Now().Unix(), hash)
+	return &u, nil
+}
+
+// List the tokens that belong to username.
+func (s *TokenService) List(username string) ([]Token, error) {
+	var tokens []Token
+	q := `SELECT t.* FROM api_token t JOIN user ON t.user_id = user.id
+		WHERE user.username=? ORDER BY t.created_at DESC`
+	err := s.db.Select(&tokens, q, username)
+	return tokens, err
+}
+
+// Revoke the token id if it belongs to username.
+func (s *TokenService) Revoke(username string, id uint64) error {
+	_, err := s.db.Exec(`DELETE FROM api_token WHERE id=? AND user_id=(SELECT id FROM user WHERE username=?)`, id, username)
+	return err
+}
+
+// TokenFromRequest returns the token sent as a bearer token in the
+// Authorization header, or in the "token" form value.
+func TokenFromRequest(r *http.Request) string {
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(h, "Bearer "))
+	}
+	return r.FormValue("token")
+}
+
+// RequireToken is middleware that rejects requests without a valid API
+// token.  The token's user is available via UserFromContext.
+func (s *TokenService) RequireToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u, err := s.Authenticate(TokenFromRequest(r))
+		if err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(map[string]any{"success": false, "error": err.Error()})
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userKey{}, u)))
+	})
+}
@@ -0,0 +1,74 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/jmoiron/monet/conf"
+	"github.com/jmoiron/sqlx"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTokens(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	conn, err := sqlx.Connect("sqlite3", ":memory:")
+	require.NoError(err)
+	require.NoError(NewApp(conf.Default(), conn).Migrate())
+	require.NoError(NewUserService(conn).CreateUser("reader", "pw"))
+
+	serv := NewTokenService(conn)
+	_, _, err = serv.Create("nobody", "api")
+	assert.Error(err)
+
+	token, tok, err := serv.Create("reader", "api")
+	require.NoError(err)
+	assert.NotEqual(token, tok.TokenHash, "token stored in plain text")
+
+	u, err := serv.Authenticate(token)
+	require.NoError(err)
+	assert.Equal("reader", u.Username)
+
+	_, err = serv.Authenticate("bogus")
+	assert.Error(err)
+	_, err = serv.Authenticate("")
+	assert.Error(err)
+
+	tokens, err := serv.List("reader")
+	require.NoError(err)
+	require.Len(tokens, 1)
+	assert.NotZero(tokens[0].LastUsedAt)
+
+	// RequireToken accepts bearer tokens and form values
+	var seen *User
+	h := serv.RequireToken(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = UserFromContext(r.Context())
+	}))
+
+	req := httptest.NewRequest("POST", "/", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	assert.Equal(http.StatusOK, rec.Code)
+	require.NotNil(seen)
+	assert.Equal("reader", seen.Username)
+
+	req = httptest.NewRequest("POST", "/?token="+token, nil)
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	assert.Equal(http.StatusOK, rec.Code)
+
+	req = httptest.NewRequest("POST", "/?token=nope", nil)
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	assert.Equal(http.StatusUnauthorized, rec.Code)
+
+	// revoked tokens no longer authenticate
+	require.NoError(serv.Revoke("reader", tok.ID))
+	_, err = serv.Authenticate(token)
+	assert.Error(err)
+}
@@ -3,17 +3,16 @@ package blog
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"log/slog"
 	"net/http"
-	"os"
-	"path/filepath"
 	"strconv"
 	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/jmoiron/monet/app"
+	"github.com/jmoiron/monet/conf"
 	"github.com/jmoiron/monet/db"
 	"github.com/jmoiron/monet/mtr"
 	"github.com/jmoiron/monet/pkg/autosave"
@@ -30,10 +29,22 @@ type Admin struct {
 	db       db.DB
 	BaseURL  string
 	registry vfs.Registry
+	uploads  conf.UploadsConfig
 }
 
 func NewBlogAdmin(db db.DB, registry vfs.Registry) *Admin {
-	return &Admin{db: db, registry: registry}
+	return &Admin{db: db, registry: registry, uploads: conf.Default().Uploads}
+}
+
+// withUploads sets the config of files uploaded to posts.
+func (a *Admin) withUploads(cfg conf.UploadsConfig) *Admin {
+	a.uploads = cfg
+	return a
+}
+
+// uploadService returns an upload service with the admin's uploads config.
+func (a *Admin) uploadService() *uploads.UploadService {
+	return uploads.NewUploadService(a.db).WithConfig(a.uploads)
 }
 
 func (a *Admin) Bind(r chi.Router) {
@@ -360,8 +371,21 @@ func (a *Admin) uploadFile(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Files are put in the post's folder, eg. "2024/my-post"
+	var dir string
+	if post, err := NewPostService(a.db).Get(int(postId)); err == nil {
+		dir = uploads.FolderFor(a.uploads.PostFolder, post.Slug, post.CreatedAt)
+	}
+
 	// Use uploads package as library with "blog-files" filesystem
-	upload, err := a.handleFileUpload(r, "blog-files")
+	upload, err := a.handleFileUpload(r, "blog-files", dir)
+	if vfs.WritePolicyError(w, err) {
+		return
+	}
+	if errors.Is(err, uploads.ErrNameTaken) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
 	if err != nil {
 		slog.Error("Failed to upload file", "err", err)
 		http.Error(w, "Failed to upload file: "+err.Error(), http.StatusInternalServerError)
@@ -397,61 +421,40 @@ func (a *Admin) uploadFile(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(response)
 }
 
-// handleFileUpload processes a file upload using uploads package as a library
-func (a *Admin) handleFileUpload(r *http.Request, filesystemName string) (*uploads.Upload, error) {
-	// Parse the multipart form
-	err := r.ParseMultipartForm(64 << 20) // 64MiB max
-	if err != nil {
-		return nil, fmt.Errorf("failed to parse form: %w", err)
-	}
-
-	file, header, err := r.FormFile("file")
+// handleFileUpload processes a file upload into the folder dir using
+// uploads package as a library
+func (a *Admin) handleFileUpload(r *http.Request, filesystemName, dir string) (*uploads.Upload, error) {
+	// Stream the file from the form rather than buffering it
+	file, name, err := vfs.FormFile(r, "file")
 	if err != nil {
 		return nil, fmt.Errorf("failed to get file from form: %w", err)
 	}
 	defer file.Close()
 
-	// Clean the filename
-	filename := filepath.Base(header.Filename)
-	if filename == "" || filename == "." {
-		return nil, fmt.Errorf("invalid filename")
-	}
-
 	// Get the filesystem
-	fs, err := a.registry.Get(filesystemName)
+	fsys, err := a.registry.GetWritable(filesystemName)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get filesystem: %w", err)
 	}
 
-	// Get the base path - the fs.FS type is read-only, to be writable, it needs to be a PathFS
-	var basePath string
-	if pfs, ok := fs.(vfs.PathFS); ok {
-		basePath = pfs.Path()
-	} else {
-		return nil, fmt.Errorf("filesystem %s is not writable", filesystemName)
-	}
-
-	// Create the full path for the new file
-	destPath := filepath.Join(basePath, filename)
-
-	// Create the destination file
-	destFile, err := os.Create(destPath)
+	// Clean the filename and check the file against the policy
+	uploadService := a.uploadService()
+	filename, body, err := uploadService.Policy(a.registry, filesystemName).ApplyIn(fsys, dir, name, file)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create file: %w", err)
+		return nil, err
 	}
-	defer destFile.Close()
 
-	// Copy the uploaded file to the destination and track size
-	bytesWritten, err := io.Copy(destFile, file)
+	// Save the file, reusing an existing upload with the same content
+	upload, existing, err := uploadService.Store(fsys, filesystemName, filename, body)
 	if err != nil {
-		return nil, fmt.Errorf("failed to save file: %w", err)
+		return nil, err
 	}
 
-	// Create database record with file size using uploads service
-	uploadService := uploads.NewUploadService(a.db)
-	upload, err := uploadService.Create(filesystemName, filename, bytesWritten)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create upload record: %w", err)
+	// Make smaller copies of images for srcset; posts can use the original without them
+	if !existing {
+		if _, err := uploadService.GenerateDerivatives(upload, fsys); err != nil {
+			slog.Warn("Failed to generate derivatives", "filename", upload.Filename, "err", err)
+		}
 	}
 
 	return upload, nil
@@ -475,7 +478,7 @@ func (a *Admin) deleteAttachedFile(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Get upload info first for file deletion
-	uploadService := uploads.NewUploadService(a.db)
+	uploadService := a.uploadService()
 	upload, err := uploadService.GetByID(uploadId)
 	if err != nil {
 		slog.Error("Failed to get upload record", "upload_id", uploadId, "err", err)
@@ -491,7 +494,20 @@ func (a *Admin) deleteAttachedFile(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Delete the actual file from filesystem
+	// Uploads are shared when the same file is attached again; keep it
+	// while other posts still use it
+	if n, err := postService.CountFileAttachments(uploadId); err != nil || n > 0 {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]bool{"success": true})
+		return
+	}
+
+	// Delete the derivatives and the actual file from filesystem
+	if fsys, err := a.registry.GetWritable(upload.FilesystemName); err == nil {
+		if err := uploadService.DeleteDerivativeFiles(uploadId, fsys); err != nil {
+			slog.Warn("Failed to delete derivatives", "upload_id", uploadId, "err", err)
+		}
+	}
 	if err := a.deleteFile(upload.FilesystemName, upload.Filename); err != nil {
 		slog.Warn("Failed to delete file from filesystem", "filesystem", upload.FilesystemName, "filename", upload.Filename, "err", err)
 		// Don't fail the request - the detachment succeeded
@@ -510,22 +526,13 @@ func (a *Admin) deleteAttachedFile(w http.ResponseWriter, r *http.Request) {
 // deleteFile removes a file from the specified filesystem
 func (a *Admin) deleteFile(filesystemName, filename string) error {
 	// Get the filesystem
-	fs, err := a.registry.Get(filesystemName)
+	fsys, err := a.registry.GetWritable(filesystemName)
 	if err != nil {
 		return fmt.Errorf("failed to get filesystem: %w", err)
 	}
 
-	// Get the base path
-	var basePath string
-	if pfs, ok := fs.(vfs.PathFS); ok {
-		basePath = pfs.Path()
-	} else {
-		return fmt.Errorf("filesystem %s is not writable", filesystemName)
-	}
-
 	// Delete the file
-	filePath := filepath.Join(basePath, filename)
-	return os.Remove(filePath)
+	return fsys.Remove(filename)
 }
 
 // saveAutosave creates an autosave for a blog post
@@ -17,6 +17,7 @@ import (
 	"github.com/go-sprout/sprout"
 	"github.com/gorilla/feeds"
 	"github.com/jmoiron/monet/app"
+	"github.com/jmoiron/monet/conf"
 	"github.com/jmoiron/monet/db"
 	"github.com/jmoiron/monet/db/monarch"
 	"github.com/jmoiron/monet/mtr"
@@ -31,8 +32,9 @@ var blogTemplates embed.FS
 const defaultPageSize = 15
 
 type App struct {
-	db  db.DB
-	fss vfs.Registry
+	db      db.DB
+	fss     vfs.Registry
+	uploads conf.UploadsConfig
 
 	BaseURL     string
 	FeedRSSURL  string
@@ -43,7 +45,13 @@ type App struct {
 
 // NewApp instantiates a new blog app.
 func NewApp(db db.DB, fss vfs.Registry) *App {
-	return &App{db: db, fss: fss, PageSize: defaultPageSize}
+	return &App{db: db, fss: fss, uploads: conf.Default().Uploads, PageSize: defaultPageSize}
+}
+
+// WithUploads sets the config of files uploaded to posts.
+func (a *App) WithUploads(cfg conf.UploadsConfig) *App {
+	a.uploads = cfg
+	return a
 }
 
 func (a *App) WithBaseURL(url string) *App {
@@ -114,7 +122,7 @@ func (a *App) Migrate() error {
 // Return an Admin object that can render admin homepage panels
 // and register all of the administrative pages.
 func (a *App) GetAdmin() (app.Admin, error) {
-	return NewBlogAdmin(a.db, a.fss), nil
+	return NewBlogAdmin(a.db, a.fss).withUploads(a.uploads), nil
 }
 
 func (a *App) feed() *feeds.Feed {
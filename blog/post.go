@@ -480,7 +480,7 @@ func (p *Post) preSave() {
 // GetAttachedFiles returns all uploads attached to this post
 func (s *PostService) GetAttachedFiles(postID uint64) ([]*uploads.Upload, error) {
 	var uploadList []*uploads.Upload
-	query := `SELECT u.id, u.filesystem_name, u.filename, u.size, u.created_at
+	query := `SELECT u.id, u.filesystem_name, u.filename, u.size, u.created_at, u.width, u.height, u.sha256
 			  FROM upload u
 			  JOIN post_file pf ON u.id = pf.upload_id
 			  WHERE pf.post_id = ?
@@ -494,9 +494,10 @@ func (s *PostService) GetAttachedFiles(postID uint64) ([]*uploads.Upload, error)
 	return uploadList, nil
 }
 
-// AttachFile associates an upload with a post
+// AttachFile associates an upload with a post.  Attaching a file twice
+// does nothing.
 func (s *PostService) AttachFile(postID, uploadID uint64) error {
-	query := `INSERT INTO post_file (post_id, upload_id) VALUES (?, ?)`
+	query := `INSERT OR IGNORE INTO post_file (post_id, upload_id) VALUES (?, ?)`
 	_, err := s.db.Exec(query, postID, uploadID)
 	if err != nil {
 		return fmt.Errorf("failed to attach file %d to post %d: %w", uploadID, postID, err)
@@ -504,6 +505,16 @@ func (s *PostService) AttachFile(postID, uploadID uint64) error {
 	return nil
 }
 
+// CountFileAttachments returns the number of posts an upload is attached to.
+func (s *PostService) CountFileAttachments(uploadID uint64) (int, error) {
+	var count int
+	err := s.db.Get(&count, `SELECT COUNT(*) FROM post_file WHERE upload_id = ?`, uploadID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to count attachments of file %d: %w", uploadID, err)
+	}
+	return count, nil
+}
+
 // DetachFile removes the association between an upload and a post
 func (s *PostService) DetachFile(postID, uploadID uint64) error {
 	query := `DELETE FROM post_file WHERE post_id = ? AND upload_id = ?`
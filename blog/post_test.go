@@ -4,6 +4,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/jmoiron/monet/uploads"
 	"github.com/jmoiron/sqlx"
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/stretchr/testify/assert"
@@ -15,7 +16,9 @@ func TestPost(t *testing.T) {
 	db, err := sqlx.Connect("sqlite3", ":memory:")
 	assert.NoError(err)
 
-	assert.NoError(NewApp(db).Migrate())
+	// posts can have uploads attached
+	assert.NoError(uploads.NewApp(db, nil).Migrate())
+	assert.NoError(NewApp(db, nil).Migrate())
 
 	serv := NewPostService(db)
 
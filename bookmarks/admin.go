@@ -3,7 +3,9 @@ package bookmarks
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"net/http"
 	"strconv"
@@ -12,40 +14,61 @@ import (
 
 	"github.com/go-chi/chi/v5"
 	"github.com/jmoiron/monet/app"
+	"github.com/jmoiron/monet/conf"
 	"github.com/jmoiron/monet/db"
 	"github.com/jmoiron/monet/mtr"
+	"github.com/jmoiron/monet/pkg/jobs"
 	"github.com/jmoiron/monet/pkg/vfs"
 )
 
 const (
 	panelListSize = 6
 	adminPageSize = 20
+	// maxImportSize is the largest bookmarks file that can be imported
+	maxImportSize = 32 << 20
 )
 
 type Admin struct {
-	db      db.DB
-	fss     vfs.Registry
-	BaseURL string
+	db       db.DB
+	fss      vfs.Registry
+	jobs     *jobs.Pool
+	cfg      conf.BookmarksConfig
+	metadata *MetadataFetcher
+	BaseURL  string
 }
 
 func NewBookmarkAdmin(db db.DB, fss vfs.Registry) *Admin {
-	return &Admin{db: db, fss: fss}
+	return &Admin{db: db, fss: fss, cfg: conf.Default().Bookmarks, metadata: NewMetadataFetcher()}
 }
 
-// newBookmarkServiceWithScreenshots creates a BookmarkService with screenshot capabilities
+// service returns a BookmarkService that normalizes urls as configured.
+func (a *Admin) service() *BookmarkService {
+	return NewBookmarkService(a.db).WithTrackingParams(a.cfg.TrackingParams)
+}
+
+// withConfig sets the screenshot and url normalization configuration.
+func (a *Admin) withConfig(cfg conf.BookmarksConfig) *Admin {
+	a.cfg = cfg
+	return a
+}
+
+// withJobs sets the pool that screenshots and archives are taken on.
+func (a *Admin) withJobs(pool *jobs.Pool) *Admin {
+	a.jobs = pool
+	return a
+}
+
+// newBookmarkServiceWithScreenshots creates a BookmarkService with screenshot
+// capabilities, using the same backend as the screenshot jobs.
 func (a *Admin) newBookmarkServiceWithScreenshots() *BookmarkService {
-	serv := NewBookmarkService(a.db)
+	serv := a.service()
 
-	// Get screenshots directory path from FSS
-	screenshotsPath, err := a.fss.GetPath("screenshots")
+	// Return service without screenshot support if it is not available
+	ss, err := newScreenshotService(a.cfg, a.fss)
 	if err != nil {
-		// Return service without screenshot support if path is not available
 		return serv
 	}
-
-	// Create and set screenshot service
-	screenshotService := NewScreenshotService(screenshotsPath, "gowitness", true)
-	serv.SetScreenshotService(screenshotService)
+	serv.SetScreenshotService(ss)
 
 	return serv
 }
@@ -54,15 +77,33 @@ func (a *Admin) Bind(r chi.Router) {
 	r.Get("/bookmarks/", a.bookmarkList)
 	r.Get("/bookmarks/{page:[0-9]+}", a.bookmarkList)
 	r.Get("/bookmarks/edit/{id:[^/]+}", a.edit)
+	r.Get("/bookmarks/bookmarklet", a.bookmarklet)
+	r.Post("/bookmarks/bookmarklet", a.bookmarklet)
+	r.Get("/bookmarks/import", a.importBookmarks)
+	r.Post("/bookmarks/import", a.importBookmarks)
+	r.Get("/bookmarks/export", a.exportBookmarks)
+	r.Get("/bookmarks/tags", a.tagSuggestions)
+	r.Get("/bookmarks/reading", a.readingList)
+	r.Post("/bookmarks/reading/{state}/{id:[^/]+}", a.setReadState)
+	r.Get("/bookmarks/reading/publish/{id:[^/]+}", a.publishRead)
+	r.Post("/bookmarks/reading/publish/{id:[^/]+}", a.publishRead)
+	r.Get("/bookmarks/archive/{id:[^/]+}", a.viewArchive)
+	r.Post("/bookmarks/archive/{id:[^/]+}", a.archive)
+	r.Post("/bookmarks/metadata/{id:[^/]+}", a.refreshMetadata)
+	r.Get("/bookmarks/jobs", a.jobList)
+	r.Get("/bookmarks/jobs/{id:[0-9]+}", a.jobStatus)
+	r.Post("/bookmarks/jobs/retry/{id:[0-9]+}", a.retryJob)
+	r.Post("/bookmarks/jobs/delete/{id:[0-9]+}", a.deleteJob)
+	r.Post("/bookmarks/jobs/missing/{queue}", a.enqueueMissing)
 
 	r.Post("/bookmarks/create/", a.create)
 	r.Post("/bookmarks/edit/{id:[^/]+}", a.save)
-	r.Get("/bookmarks/ss/{id:[^/]+}", a.screenshot)
+	r.Post("/bookmarks/ss/{id:[^/]+}", a.screenshot)
 	r.Get("/bookmarks/delete/{id:[^/]+}", a.delete)
 }
 
 func (a *Admin) Panels(r *http.Request) ([]string, error) {
-	serv := NewBookmarkService(a.db)
+	serv := a.service()
 	bookmarks, err := serv.Select(fmt.Sprintf("ORDER BY created_at DESC LIMIT %d;", panelListSize))
 	if err != nil {
 		return nil, err
@@ -99,7 +140,7 @@ func (a *Admin) bookmarkList(w http.ResponseWriter, r *http.Request) {
 
 	q := fmt.Sprintf(`ORDER BY created_at DESC LIMIT %d OFFSET %d`, adminPageSize, page.StartOffset)
 
-	serv := NewBookmarkService(a.db)
+	serv := a.service()
 	bookmarks, err := serv.Select(q)
 	if err != nil {
 		slog.Error("looking up bookmark", "error", err)
@@ -120,7 +161,7 @@ func (a *Admin) bookmarkList(w http.ResponseWriter, r *http.Request) {
 
 func (a *Admin) edit(w http.ResponseWriter, r *http.Request) {
 	id := chi.URLParam(r, "id")
-	serv := NewBookmarkService(a.db)
+	serv := a.service()
 
 	b, err := serv.GetByID(id)
 	if err != nil {
@@ -131,9 +172,21 @@ func (a *Admin) edit(w http.ResponseWriter, r *http.Request) {
 }
 
 func (a *Admin) showEdit(w http.ResponseWriter, r *http.Request, b *Bookmark) {
+	a.showEditErr(w, r, b, nil)
+}
+
+func (a *Admin) showEditErr(w http.ResponseWriter, r *http.Request, b *Bookmark, formErr error) {
+	var msg string
+	if formErr != nil {
+		msg = formErr.Error()
+	}
+
 	reg := mtr.RegistryFromContext(r.Context())
 	err := reg.RenderWithBase(w, "admin-base", "bookmarks/admin/bookmark-edit.html", mtr.Ctx{
-		"bookmark": b,
+		"bookmark":   b,
+		"tags":       strings.Join(b.Tags, ", "),
+		"readStates": ReadStates,
+		"error":      msg,
 	})
 	if err != nil {
 		slog.Error("rendering edit", "err", err)
@@ -157,6 +210,11 @@ func (a *Admin) save(w http.ResponseWriter, r *http.Request) {
 	b.URL = r.Form.Get("url")
 	b.Title = r.Form.Get("title")
 	b.Description = r.Form.Get("description")
+	b.Tags = ParseTags(r.Form.Get("tags"))
+	b.Notes = r.Form.Get("notes")
+	if state := r.Form.Get("read_state"); validReadState(state) {
+		b.setReadState(state)
+	}
 
 	formPub, _ := strconv.Atoi(r.Form.Get("published"))
 	if b.Published != formPub {
@@ -170,6 +228,10 @@ func (a *Admin) save(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if err := serv.Save(b); err != nil {
+		if errors.Is(err, ErrDuplicateURL) {
+			a.showEditErr(w, r, b, err)
+			return
+		}
 		app.Http500("saving bookmark", w, err)
 		return
 	}
@@ -189,7 +251,7 @@ func (a *Admin) create(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	serv := a.newBookmarkServiceWithScreenshots()
+	serv := a.service()
 
 	// Check if URL already exists
 	existing, err := serv.GetByURL(url)
@@ -206,10 +268,20 @@ func (a *Admin) create(w http.ResponseWriter, r *http.Request) {
 	b.Title = r.Form.Get("title")
 
 	err = serv.Save(&b)
+	if errors.Is(err, ErrDuplicateURL) {
+		// saved by another request since we checked
+		if existing, err := serv.GetByURL(url); err == nil {
+			http.Redirect(w, r, fmt.Sprintf("/admin/bookmarks/edit/%s", existing.ID), http.StatusFound)
+			return
+		}
+	}
 	if err != nil {
 		app.Http500("saving bookmark", w, err)
 		return
 	}
+	// the page's metadata, archive and screenshot are fetched in the
+	// background, like for bookmarks added with the API
+	enqueueNew(a.jobs, a.cfg, b.ID)
 
 	// Redirect to edit page
 	editUrl := fmt.Sprintf("/admin/bookmarks/edit/%s", b.ID)
@@ -230,115 +302,208 @@ func (a *Admin) delete(w http.ResponseWriter, r *http.Request) {
 	}
 
 	slog.Info("deleting bookmark", "id", id)
-	_, err := a.db.Exec("DELETE FROM bookmark WHERE id=?", id)
-	if err != nil {
+	if err := a.service().DeleteByID(id); err != nil {
 		app.Http500("deleting bookmark", w, err)
 		return
 	}
 	http.Redirect(w, r, referer, http.StatusFound)
 }
 
+// viewArchive serves the archived copy of any bookmark.
+func (a *Admin) viewArchive(w http.ResponseWriter, r *http.Request) {
+	b, err := a.service().GetByID(chi.URLParam(r, "id"))
+	if err != nil {
+		app.Http404(w)
+		return
+	}
+	serveArchive(w, a.fss, b)
+}
+
+// archive queues the bookmark to be archived again.
+func (a *Admin) archive(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	if _, err := a.enqueue(jobArchive, id); err != nil {
+		app.Http500("queueing archive", w, err)
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("/admin/bookmarks/edit/%s", id), http.StatusFound)
+}
+
+// refreshMetadata fetches the bookmark's page again and updates its metadata.
+func (a *Admin) refreshMetadata(w http.ResponseWriter, r *http.Request) {
+	serv := a.service()
+	b, err := serv.GetByID(chi.URLParam(r, "id"))
+	if err != nil {
+		app.Http404(w)
+		return
+	}
+	if err := fetchMetadata(r.Context(), a.metadata, b); err != nil {
+		a.showEditErr(w, r, b, fmt.Errorf("fetching metadata: %w", err))
+		return
+	}
+	if err := serv.Save(b); err != nil {
+		app.Http500("saving bookmark", w, err)
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("/admin/bookmarks/edit/%s", b.ID), http.StatusFound)
+}
+
+// tagSuggestions returns the tags that start with the query as JSON, for
+// autocompleting tags.
+func (a *Admin) tagSuggestions(w http.ResponseWriter, r *http.Request) {
+	tags, err := a.service().TagsWithPrefix(r.FormValue("q"), 10)
+	if err != nil {
+		app.Http500("loading tags", w, err)
+		return
+	}
+	if tags == nil {
+		tags = []string{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tags)
+}
+
 type ScreenshotResponse struct {
-	Success     bool   `json:"success"`
-	Filename    string `json:"filename,omitempty"`
-	Title       string `json:"title,omitempty"`
-	Description string `json:"description,omitempty"`
-	Error       string `json:"error,omitempty"`
+	Success bool   `json:"success"`
+	Job     int64  `json:"job,omitempty"`
+	Status  string `json:"status,omitempty"`
+	Error   string `json:"error,omitempty"`
 }
 
+// screenshot enqueues a screenshot of the bookmark.  The response has the id
+// of the job, whose progress can be followed with jobStatus.
 func (a *Admin) screenshot(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
 	id := chi.URLParam(r, "id")
-	if id == "" {
-		response := ScreenshotResponse{
-			Success: false,
-			Error:   "bookmark ID is required",
-		}
-		json.NewEncoder(w).Encode(response)
+	if _, err := a.service().GetByID(id); err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(ScreenshotResponse{Error: "bookmark not found"})
 		return
 	}
 
-	// Get the bookmark
-	serv := NewBookmarkService(a.db)
-	bookmark, err := serv.GetByID(id)
-	if err != nil {
-		response := ScreenshotResponse{
-			Success: false,
-			Error:   "bookmark not found",
-		}
-		w.WriteHeader(http.StatusNotFound)
-		json.NewEncoder(w).Encode(response)
+	if _, err := newScreenshotService(a.cfg, a.fss); err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(ScreenshotResponse{Error: err.Error()})
 		return
 	}
 
-	// Get screenshots directory path from FSS
-	screenshotsPath, err := a.fss.GetPath("screenshots")
+	job, err := a.enqueue(jobScreenshot, id)
 	if err != nil {
-		response := ScreenshotResponse{
-			Success: false,
-			Error:   "screenshots directory not configured",
-		}
 		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(response)
+		json.NewEncoder(w).Encode(ScreenshotResponse{Error: fmt.Sprintf("failed to queue screenshot: %v", err)})
 		return
 	}
 
-	// Create screenshot service with FSS-managed directory
-	screenshotService := NewScreenshotService(screenshotsPath, "gowitness", true)
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(ScreenshotResponse{Success: true, Job: job.ID, Status: job.Status})
+}
 
-	// Take screenshot
-	result, err := screenshotService.TakeScreenshot(bookmark.URL, bookmark.ID)
-	if err != nil {
-		response := ScreenshotResponse{
-			Success: false,
-			Error:   fmt.Sprintf("failed to take screenshot: %v", err),
+// importBookmarks imports an uploaded bookmarks file.  With dryrun set, the
+// file is parsed and checked for duplicates and a preview is shown with the
+// option to import it.
+func (a *Admin) importBookmarks(w http.ResponseWriter, r *http.Request) {
+	ctx := mtr.Ctx{"title": "Import Bookmarks", "formats": Formats}
+	if r.Method == http.MethodGet {
+		a.showImport(w, r, ctx)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxImportSize)
+	if err := r.ParseMultipartForm(maxImportSize); err != nil && err != http.ErrNotMultipart {
+		ctx["error"] = fmt.Sprintf("reading upload: %s", err)
+		a.showImport(w, r, ctx)
+		return
+	}
+
+	// a previewed import posts the file's contents back as data
+	data := []byte(r.FormValue("data"))
+	if file, _, err := r.FormFile("file"); err == nil {
+		data, err = io.ReadAll(file)
+		file.Close()
+		if err != nil {
+			app.Http500("reading upload", w, err)
+			return
 		}
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(response)
+	}
+	if len(bytes.TrimSpace(data)) == 0 {
+		ctx["error"] = "choose a bookmarks file to import"
+		a.showImport(w, r, ctx)
 		return
 	}
 
-	if result == nil {
-		response := ScreenshotResponse{
-			Success: false,
-			Error:   "screenshot service is disabled",
+	format := DetectFormat(data)
+	if f := r.FormValue("format"); f != "" && f != "auto" {
+		var err error
+		if format, err = ParseFormat(f); err != nil {
+			ctx["error"] = err.Error()
+			a.showImport(w, r, ctx)
+			return
 		}
-		w.WriteHeader(http.StatusServiceUnavailable)
-		json.NewEncoder(w).Encode(response)
+	}
+	ctx["format"] = format
+
+	parsed, err := Parse(format, bytes.NewReader(data))
+	if err != nil {
+		ctx["error"] = err.Error()
+		a.showImport(w, r, ctx)
 		return
 	}
 
-	// Update bookmark with screenshot path, icon path, and title
-	bookmark.ScreenshotPath = result.ScreenshotPath
-	bookmark.IconPath = result.IconPath
-	if bookmark.Title == "" || bookmark.Title == bookmark.URL {
-		bookmark.Title = result.Title
+	serv := a.service()
+	plan, err := serv.PlanImport(parsed)
+	if err != nil {
+		app.Http500("checking for duplicates", w, err)
+		return
 	}
+	ctx["plan"] = plan
 
-	// If description is empty, try to extract it from the screenshot's JSON file
-	var extractedDescription string
-	if bookmark.Description == "" {
-		if desc, err := serv.GetDescription(bookmark); err != nil {
-			slog.Warn("failed to extract meta description", "error", err)
-		} else if desc != "" {
-			bookmark.Description = desc
-			extractedDescription = desc
-			slog.Info("auto-filled description from meta tag", "bookmark_id", bookmark.ID, "description", desc)
+	if r.FormValue("dryrun") != "" {
+		ctx["dryrun"] = true
+		ctx["data"] = string(data)
+		a.showImport(w, r, ctx)
+		return
+	}
+
+	count, err := serv.Import(plan)
+	if err != nil {
+		ctx["error"] = err.Error()
+		a.showImport(w, r, ctx)
+		return
+	}
+	slog.Info("imported bookmarks", "format", format, "count", count)
+	ctx["imported"] = count
+	a.showImport(w, r, ctx)
+}
+
+func (a *Admin) showImport(w http.ResponseWriter, r *http.Request, ctx mtr.Ctx) {
+	reg := mtr.RegistryFromContext(r.Context())
+	if err := reg.RenderWithBase(w, "admin-base", "bookmarks/admin/bookmark-import.html", ctx); err != nil {
+		slog.Error("rendering import", "err", err)
+	}
+}
+
+// exportBookmarks downloads every bookmark in the requested format.
+func (a *Admin) exportBookmarks(w http.ResponseWriter, r *http.Request) {
+	format := FormatNetscape
+	if f := r.FormValue("format"); f != "" {
+		var err error
+		if format, err = ParseFormat(f); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
 		}
 	}
 
-	if err := serv.Save(bookmark); err != nil {
-		slog.Error("failed to save bookmark with screenshot info", "error", err)
-		// Continue anyway, screenshot was taken successfully
+	bookmarks, err := a.service().Select("ORDER BY created_at DESC")
+	if err != nil {
+		app.Http500("loading bookmarks", w, err)
+		return
 	}
 
-	// Return success response
-	response := ScreenshotResponse{
-		Success:     true,
-		Filename:    result.Filename,
-		Title:       result.Title,
-		Description: extractedDescription,
+	filename := fmt.Sprintf("bookmarks-%s.%s", time.Now().Format("2006-01-02"), format.Ext())
+	w.Header().Set("Content-Type", format.ContentType())
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+	if err := Export(format, w, bookmarks); err != nil {
+		slog.Error("exporting bookmarks", "format", format, "err", err)
 	}
-	json.NewEncoder(w).Encode(response)
 }
@@ -0,0 +1,134 @@
+package bookmarks
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/jmoiron/monet/auth"
+	"github.com/jmoiron/monet/mtr"
+)
+
+// APIResponse is the response to a bookmark created via the API.
+type APIResponse struct {
+	Success  bool   `json:"success"`
+	ID       string `json:"id,omitempty"`
+	URL      string `json:"url,omitempty"`
+	Title    string `json:"title,omitempty"`
+	Edit     string `json:"edit,omitempty"`
+	Existing bool   `json:"existing,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// bindAPI binds the token authenticated bookmark API.  It lives outside of
+// the app's BaseURL so that it can be used by the bookmarklet and by other
+// tools without an admin session.
+func (a *App) bindAPI(r chi.Router) {
+	tokens := auth.NewTokenService(a.db)
+	r.With(apiCORS).Options("/api/bookmarks", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	r.With(apiCORS, tokens.RequireToken).Post("/api/bookmarks", a.apiCreate)
+}
+
+// apiCORS allows the API to be called from any page, which is where the
+// bookmarklet runs.  Requests are authenticated by token, not cookie.
+func apiCORS(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := w.Header()
+		h.Set("Access-Control-Allow-Origin", "*")
+		h.Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+		h.Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+		next.ServeHTTP(w, r)
+	})
+}
+
+// apiCreate adds an unpublished bookmark from the url, title, selection and
+// tags form values.  The selection, if any, is quoted in the description.  If
+// the url is already bookmarked, the existing bookmark is returned.
+//
+// The response is JSON unless format=html, which renders a short page for
+// the bookmarklet's window.
+func (a *App) apiCreate(w http.ResponseWriter, r *http.Request) {
+	url := strings.TrimSpace(r.FormValue("url"))
+	if url == "" {
+		a.apiRespond(w, r, http.StatusBadRequest, APIResponse{Error: "url is required"})
+		return
+	}
+
+	serv := a.service()
+	if existing, err := serv.GetByURL(url); err == nil {
+		a.apiRespond(w, r, http.StatusOK, apiResponse(existing, true))
+		return
+	}
+
+	b := &Bookmark{
+		URL:         url,
+		Title:       strings.TrimSpace(r.FormValue("title")),
+		Description: quote(r.FormValue("selection")),
+		Tags:        ParseTags(r.FormValue("tags")),
+		// saved pages go on the reading list
+		ReadState: ReadUnread,
+	}
+	err := serv.Insert(b)
+	if errors.Is(err, ErrDuplicateURL) {
+		// saved by another request since we checked
+		if existing, err := serv.GetByURL(url); err == nil {
+			a.apiRespond(w, r, http.StatusOK, apiResponse(existing, true))
+			return
+		}
+	}
+	if err != nil {
+		slog.Error("inserting bookmark", "url", url, "err", err)
+		a.apiRespond(w, r, http.StatusInternalServerError, APIResponse{Error: "could not save bookmark"})
+		return
+	}
+
+	// the page's metadata, archive and screenshot are fetched in the
+	// background so that saving doesn't wait on the page
+	enqueueNew(a.jobs, a.cfg, b.ID)
+	a.apiRespond(w, r, http.StatusCreated, apiResponse(b, false))
+}
+
+func apiResponse(b *Bookmark, existing bool) APIResponse {
+	return APIResponse{
+		Success:  true,
+		ID:       b.ID,
+		URL:      b.URL,
+		Title:    b.Title,
+		Edit:     fmt.Sprintf("/admin/bookmarks/edit/%s", b.ID),
+		Existing: existing,
+	}
+}
+
+func (a *App) apiRespond(w http.ResponseWriter, r *http.Request, status int, resp APIResponse) {
+	if r.FormValue("format") == "html" {
+		w.WriteHeader(status)
+		reg := mtr.RegistryFromContext(r.Context())
+		if err := reg.Render(w, "bookmarks/api-saved.html", mtr.Ctx{"resp": resp}); err != nil {
+			slog.Error("rendering template", "err", err)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// quote formats text as a markdown blockquote.
+func quote(text string) string {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return ""
+	}
+	lines := strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight("> "+line, " ")
+	}
+	return strings.Join(lines, "\n")
+}
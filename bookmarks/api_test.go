@@ -0,0 +1,152 @@
+package bookmarks
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/jmoiron/monet/auth"
+	"github.com/jmoiron/monet/conf"
+	"github.com/jmoiron/monet/pkg/jobs"
+	"github.com/jmoiron/monet/pkg/vfs"
+	"github.com/jmoiron/sqlx"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAPICreate(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	conn, err := sqlx.Connect("sqlite3", ":memory:")
+	require.NoError(err)
+	require.NoError(auth.NewApp(conf.Default(), conn).Migrate())
+	require.NoError(NewApp(conn).Migrate())
+	require.NoError(auth.NewUserService(conn).CreateUser("reader", "pw"))
+
+	token, _, err := auth.NewTokenService(conn).Create("reader", "test")
+	require.NoError(err)
+
+	r := chi.NewRouter()
+	NewApp(conn).WithBaseURL("/bookmarks/").Bind(r)
+
+	post := func(token string, form url.Values) (*httptest.ResponseRecorder, APIResponse) {
+		req := httptest.NewRequest("POST", "/api/bookmarks", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		var resp APIResponse
+		json.Unmarshal(rec.Body.Bytes(), &resp)
+		return rec, resp
+	}
+
+	form := url.Values{
+		"url":       {"https://example.com/article"},
+		"title":     {"An Article"},
+		"selection": {"first line\nsecond line"},
+	}
+
+	rec, _ := post("", form)
+	assert.Equal(http.StatusUnauthorized, rec.Code)
+	assert.Equal("*", rec.Header().Get("Access-Control-Allow-Origin"))
+
+	rec, resp := post(token, url.Values{})
+	assert.Equal(http.StatusBadRequest, rec.Code)
+	assert.False(resp.Success)
+
+	rec, resp = post(token, form)
+	require.Equal(http.StatusCreated, rec.Code)
+	assert.True(resp.Success)
+	assert.False(resp.Existing)
+
+	b, err := NewBookmarkService(conn).GetByID(resp.ID)
+	require.NoError(err)
+	assert.Equal("An Article", b.Title)
+	assert.Equal("> first line\n> second line", b.Description)
+	assert.Equal(0, b.Published)
+	assert.Equal(ReadUnread, b.ReadState)
+
+	// the same url returns the existing bookmark
+	rec, again := post(token, form)
+	assert.Equal(http.StatusOK, rec.Code)
+	assert.True(again.Existing)
+	assert.Equal(resp.ID, again.ID)
+
+	// as does the same url with tracking parameters
+	rec, again = post(token, url.Values{"url": {"https://EXAMPLE.com/article/?utm_source=rss"}})
+	assert.Equal(http.StatusOK, rec.Code)
+	assert.True(again.Existing)
+	assert.Equal(resp.ID, again.ID)
+
+	// preflight requests are allowed without a token
+	req := httptest.NewRequest("OPTIONS", "/api/bookmarks", nil)
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	assert.Equal(http.StatusNoContent, rec.Code)
+	assert.Contains(rec.Header().Get("Access-Control-Allow-Headers"), "Authorization")
+}
+
+func TestAPICreateJobs(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	srv := newMetadataServer(t)
+	conn, err := sqlx.Connect("sqlite3", ":memory:")
+	require.NoError(err)
+	require.NoError(auth.NewApp(conf.Default(), conn).Migrate())
+	require.NoError(NewApp(conn).Migrate())
+	require.NoError(auth.NewUserService(conn).CreateUser("reader", "pw"))
+	token, _, err := auth.NewTokenService(conn).Create("reader", "test")
+	require.NoError(err)
+
+	cfg := conf.Default().Bookmarks
+	cfg.ScreenshotBackend = ""
+	a := NewApp(conn).WithFSS(vfs.NewRegistry(vfs.NewURLMapper(nil))).WithConfig(cfg)
+	r := chi.NewRouter()
+	a.bindAPI(r)
+
+	// the bookmark is saved before its page is fetched
+	req := httptest.NewRequest("POST", "/api/bookmarks", strings.NewReader(url.Values{"url": {srv.URL + "/rich"}}.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	require.Equal(http.StatusCreated, rec.Code)
+	var resp APIResponse
+	require.NoError(json.Unmarshal(rec.Body.Bytes(), &resp))
+	assert.Empty(resp.Title)
+
+	counts, err := a.jobs.Queue().Counts()
+	require.NoError(err)
+	assert.Contains(counts, jobs.Count{Queue: jobMetadata, Status: jobs.StatusPending, Count: 1})
+	assert.Contains(counts, jobs.Count{Queue: jobArchive, Status: jobs.StatusPending, Count: 1})
+	assert.NotContains(counts, jobs.Count{Queue: jobScreenshot, Status: jobs.StatusPending, Count: 1})
+
+	for {
+		ran, err := a.jobs.RunOne(context.Background())
+		require.NoError(err)
+		if !ran {
+			break
+		}
+	}
+	b, err := NewBookmarkService(conn).GetByID(resp.ID)
+	require.NoError(err)
+	assert.Equal("OG Title", b.Title)
+	assert.Equal("Example News", b.SiteName)
+}
+
+func TestBookmarklet(t *testing.T) {
+	js := string(Bookmarklet("https://example.com", "abc123"))
+	assert.True(t, strings.HasPrefix(js, "javascript:"))
+	assert.Contains(t, js, `"https://example.com/api/bookmarks"`)
+	assert.Contains(t, js, `"abc123"`)
+}
@@ -1,21 +1,25 @@
 package bookmarks
 
 import (
+	"context"
 	"embed"
 	"fmt"
 	"html/template"
 	"log/slog"
 	"net/http"
 	"path"
+	"strings"
 	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/go-sprout/sprout"
 	"github.com/jmoiron/monet/app"
+	"github.com/jmoiron/monet/conf"
 	"github.com/jmoiron/monet/db"
 	"github.com/jmoiron/monet/db/monarch"
 	"github.com/jmoiron/monet/mtr"
+	"github.com/jmoiron/monet/pkg/jobs"
 	"github.com/jmoiron/monet/pkg/vfs"
 )
 
@@ -28,13 +32,32 @@ type App struct {
 	db                db.DB
 	screenshotService *ScreenshotService
 	fss               vfs.Registry
+	archiver          *Archiver
+	metadata          *MetadataFetcher
+	jobs              *jobs.Pool
+	cfg               conf.BookmarksConfig
 
 	BaseURL  string
 	PageSize int
 }
 
 func NewApp(db db.DB) *App {
-	return &App{db: db, PageSize: defaultPageSize}
+	return &App{
+		db:       db,
+		archiver: NewArchiver(),
+		metadata: NewMetadataFetcher(),
+		cfg:      conf.Default().Bookmarks,
+		PageSize: defaultPageSize,
+	}
+}
+
+// WithConfig sets the screenshot and url normalization configuration.
+func (a *App) WithConfig(cfg conf.BookmarksConfig) *App {
+	a.cfg = cfg
+	if a.fss != nil {
+		a.jobs = newJobPool(a.db, a.fss, a.archiver, a.metadata, a.cfg)
+	}
+	return a
 }
 
 func (a *App) WithScreenshotService(service *ScreenshotService) *App {
@@ -44,6 +67,7 @@ func (a *App) WithScreenshotService(service *ScreenshotService) *App {
 
 func (a *App) WithFSS(fss vfs.Registry) *App {
 	a.fss = fss
+	a.jobs = newJobPool(a.db, a.fss, a.archiver, a.metadata, a.cfg)
 	return a
 }
 
@@ -54,11 +78,25 @@ func (a *App) WithBaseURL(url string) *App {
 
 func (a *App) Name() string { return "bookmarks" }
 
+// service returns a BookmarkService that normalizes urls as configured.
+func (a *App) service() *BookmarkService {
+	return NewBookmarkService(a.db).WithTrackingParams(a.cfg.TrackingParams)
+}
+
 func (a *App) Bind(r chi.Router) {
+	if a.jobs != nil {
+		a.jobs.Start(context.Background())
+	}
+	a.bindAPI(r)
+
 	r.Route(a.BaseURL, func(r chi.Router) {
 		r.Use(middleware.StripSlashes)
 		r.Get("/page/{page:[0-9]+}", a.list)
+		r.Get("/tag", a.tags)
+		r.Get("/tag/{tag}", a.tag)
+		r.Get("/tag/{tag}/page/{page:[0-9]+}", a.tag)
 		r.Get("/{id:[^/]+}", a.detail)
+		r.Get("/{id:[^/]+}/archive", a.archived)
 		r.Get("/", a.index)
 	})
 }
@@ -110,18 +148,29 @@ func (a *App) Migrate() error {
 		return fmt.Errorf("error running %s migration: %w", bookmarkMigrations.Name, err)
 	}
 
+	jobMigrations := jobs.Migrations()
+	if err := manager.Upgrade(jobMigrations); err != nil {
+		return fmt.Errorf("error running %s migration: %w", jobMigrations.Name, err)
+	}
+
+	if n, err := a.service().NormalizeURLs(); err != nil {
+		return fmt.Errorf("normalizing bookmark urls: %w", err)
+	} else if n > 0 {
+		slog.Info("normalized bookmark urls", "count", n)
+	}
+
 	return nil
 }
 
 func (a *App) GetAdmin() (app.Admin, error) {
-	return NewBookmarkAdmin(a.db, a.fss), nil
+	return NewBookmarkAdmin(a.db, a.fss).withConfig(a.cfg).withJobs(a.jobs), nil
 }
 
 func (a *App) detail(w http.ResponseWriter, req *http.Request) {
 	id := chi.URLParam(req, "id")
 	slog.Debug("bookmark detail", "id", id)
 
-	b, err := NewBookmarkService(a.db).GetByID(id)
+	b, err := a.service().GetByID(id)
 	if err != nil {
 		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
 		return
@@ -134,11 +183,27 @@ func (a *App) detail(w http.ResponseWriter, req *http.Request) {
 	})
 }
 
-func (a *App) search(w http.ResponseWriter, req *http.Request, query string) {
-	query = db.SafeQuery(query)
+// archived serves the archived copy of a bookmark.
+func (a *App) archived(w http.ResponseWriter, req *http.Request) {
+	b, err := a.service().GetByID(chi.URLParam(req, "id"))
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	serveArchive(w, a.fss, b)
+}
 
-	serv := NewBookmarkService(a.db)
-	count, err := serv.SearchCount(query)
+// search renders published bookmarks matching query and tags.  Pagination
+// links are relative to pageBase.
+func (a *App) search(w http.ResponseWriter, req *http.Request, query string, tags []string, pageBase string) {
+	// tag pages have no query, which SafeQuery can't handle
+	if query = strings.TrimSpace(query); query != "" {
+		query = db.SafeQuery(query)
+	}
+	tags = NormalizeTags(tags)
+
+	serv := a.service()
+	count, err := serv.SearchCount(query, tags)
 	if err != nil {
 		app.Http500("counting results", w, err)
 		return
@@ -149,6 +214,7 @@ func (a *App) search(w http.ResponseWriter, req *http.Request, query string) {
 	if count == 0 {
 		reg.RenderWithBase(w, "base", "bookmarks/index.html", mtr.Ctx{
 			"query": query,
+			"tags":  tags,
 		})
 		return
 	}
@@ -156,11 +222,10 @@ func (a *App) search(w http.ResponseWriter, req *http.Request, query string) {
 	pageNum := app.GetIntParam(req, "page", 1)
 	slog.Debug("loading search page", "page", pageNum)
 
-	pageBase := path.Join(a.BaseURL, "page")
 	paginator := mtr.NewPaginator(a.PageSize, count).WithLinkFn(mtr.SlashLinkFn(pageBase))
 	page := paginator.Page(pageNum)
 
-	bookmarks, err := serv.Search(query, a.PageSize, page.StartOffset)
+	bookmarks, err := serv.Search(query, tags, a.PageSize, page.StartOffset)
 	if err != nil {
 		app.Http500("fetching search results", w, err)
 		return
@@ -168,6 +233,7 @@ func (a *App) search(w http.ResponseWriter, req *http.Request, query string) {
 
 	err = reg.RenderWithBase(w, "base", "bookmarks/index.html", mtr.Ctx{
 		"query":      query,
+		"tags":       tags,
 		"bookmarks":  bookmarks,
 		"pagination": paginator.Render(reg, page),
 	})
@@ -178,10 +244,11 @@ func (a *App) search(w http.ResponseWriter, req *http.Request, query string) {
 }
 
 func (a *App) list(w http.ResponseWriter, req *http.Request) {
-	serv := NewBookmarkService(a.db)
+	serv := a.service()
 	req.ParseForm()
-	if query := req.Form.Get("q"); len(query) > 0 {
-		a.search(w, req, query)
+	query, tags := req.Form.Get("q"), req.Form["tag"]
+	if len(query) > 0 || len(tags) > 0 {
+		a.search(w, req, query, tags, path.Join(a.BaseURL, "page"))
 		return
 	}
 
@@ -220,3 +287,30 @@ func (a *App) list(w http.ResponseWriter, req *http.Request) {
 func (a *App) index(w http.ResponseWriter, req *http.Request) {
 	a.list(w, req)
 }
+
+// tag lists the published bookmarks with a tag, which can be narrowed by a
+// search query or more tags.
+func (a *App) tag(w http.ResponseWriter, req *http.Request) {
+	req.ParseForm()
+	tag := NormalizeTag(chi.URLParam(req, "tag"))
+	tags := append([]string{tag}, req.Form["tag"]...)
+	a.search(w, req, req.Form.Get("q"), tags, path.Join(a.BaseURL, "tag", tag, "page"))
+}
+
+// tags lists every tag used by a published bookmark.
+func (a *App) tags(w http.ResponseWriter, req *http.Request) {
+	tags, err := a.service().Tags(true)
+	if err != nil {
+		app.Http500("loading tags", w, err)
+		return
+	}
+
+	reg := mtr.RegistryFromContext(req.Context())
+	err = reg.RenderWithBase(w, "base", "bookmarks/tags.html", mtr.Ctx{
+		"title": "Bookmark Tags",
+		"tags":  tags,
+	})
+	if err != nil {
+		slog.Error("rendering template", "err", err)
+	}
+}
@@ -0,0 +1,519 @@
+package bookmarks
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/monet/db"
+	"github.com/jmoiron/monet/pkg/vfs"
+	"github.com/jmoiron/sqlx"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// Archive statuses recorded on a bookmark.
+const (
+	ArchiveNone   = ""
+	ArchiveOK     = "ok"
+	ArchiveFailed = "failed"
+)
+
+const (
+	// archiveTimeout is how long archiving a page and its assets may take
+	archiveTimeout = 2 * time.Minute
+	// maxArchiveText is the most page text that is indexed for search
+	maxArchiveText = 64 << 10
+)
+
+// An Archiver fetches a page and the stylesheets and images it uses, and
+// produces a self-contained copy of it with those assets inlined as data
+// urls.  Scripts, frames and event handlers are removed.
+type Archiver struct {
+	Client    *http.Client
+	UserAgent string
+	// MaxPageSize is the largest page that will be archived.
+	MaxPageSize int64
+	// MaxAssetSize is the largest stylesheet or image that will be inlined.
+	MaxAssetSize int64
+	// MaxAssets is the most assets that will be inlined into one page.
+	MaxAssets int
+}
+
+// NewArchiver returns an Archiver with sensible limits.
+func NewArchiver() *Archiver {
+	return &Archiver{
+		Client:       &http.Client{Timeout: 30 * time.Second},
+		UserAgent:    "monet-archiver/1.0",
+		MaxPageSize:  5 << 20,
+		MaxAssetSize: 2 << 20,
+		MaxAssets:    200,
+	}
+}
+
+// A Snapshot is an archived copy of a page.
+type Snapshot struct {
+	URL   string
+	Title string
+	HTML  []byte
+	// Text is the visible text of the page, used for search.
+	Text string
+}
+
+// Archive fetches the page at pageURL and returns a self-contained snapshot.
+func (a *Archiver) Archive(ctx context.Context, pageURL string) (*Snapshot, error) {
+	body, final, ctype, err := a.fetch(ctx, pageURL, a.MaxPageSize)
+	if err != nil {
+		return nil, err
+	}
+	if mt, _, _ := mime.ParseMediaType(ctype); mt != "text/html" && mt != "application/xhtml+xml" {
+		return nil, fmt.Errorf("cannot archive %s content", ctype)
+	}
+
+	doc, err := html.Parse(bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("parsing page: %w", err)
+	}
+
+	s := &snapshotter{Archiver: a, ctx: ctx, base: final, cache: map[string]string{}}
+	if href := findBase(doc); href != "" {
+		s.base = s.resolve(href)
+	}
+	s.inline(doc)
+
+	var buf bytes.Buffer
+	if err := html.Render(&buf, doc); err != nil {
+		return nil, err
+	}
+
+	return &Snapshot{
+		URL:   final.String(),
+		Title: s.title,
+		HTML:  buf.Bytes(),
+		Text:  pageText(doc, maxArchiveText),
+	}, nil
+}
+
+// fetch GETs u, returning at most max bytes of its body, the url it was
+// fetched from after redirects and its content type.
+func (a *Archiver) fetch(ctx context.Context, u string, max int64) ([]byte, *url.URL, string, error) {
+	return fetchURL(ctx, a.Client, a.UserAgent, u, max)
+}
+
+// fetchURL GETs u with client; see Archiver.fetch.
+func fetchURL(ctx context.Context, client *http.Client, userAgent, u string, max int64) ([]byte, *url.URL, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	req.Header.Set("User-Agent", userAgent)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		return nil, nil, "", fmt.Errorf("fetching %s: %s", u, resp.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, max+1))
+	if err != nil {
+		return nil, nil, "", err
+	}
+	if int64(len(body)) > max {
+		return nil, nil, "", fmt.Errorf("%s is larger than %d bytes", u, max)
+	}
+
+	ctype := resp.Header.Get("Content-Type")
+	if len(ctype) == 0 {
+		ctype = http.DetectContentType(body)
+	}
+	return body, resp.Request.URL, ctype, nil
+}
+
+// A snapshotter inlines the assets of a single page.
+type snapshotter struct {
+	*Archiver
+	ctx    context.Context
+	base   *url.URL
+	title  string
+	assets int
+	// cache maps asset urls to their data urls
+	cache map[string]string
+}
+
+// removedElements are dropped from snapshots.
+var removedElements = map[atom.Atom]bool{
+	atom.Script: true,
+	atom.Iframe: true,
+	atom.Frame:  true,
+	atom.Object: true,
+	atom.Embed:  true,
+	atom.Base:   true,
+}
+
+// removedLinks are link rels that are dropped from snapshots, since they
+// only make sense on the original site.
+var removedLinks = map[string]bool{
+	"preload":       true,
+	"modulepreload": true,
+	"prefetch":      true,
+	"dns-prefetch":  true,
+	"preconnect":    true,
+	"manifest":      true,
+}
+
+func (s *snapshotter) inline(n *html.Node) {
+	for c := n.FirstChild; c != nil; {
+		next := c.NextSibling
+		if s.remove(c) {
+			n.RemoveChild(c)
+		} else {
+			s.inline(c)
+		}
+		c = next
+	}
+}
+
+// remove rewrites the node n for the snapshot, returning true if it should be
+// removed instead.
+func (s *snapshotter) remove(n *html.Node) bool {
+	if n.Type != html.ElementNode {
+		return false
+	}
+	if removedElements[n.DataAtom] {
+		return true
+	}
+
+	// drop event handlers
+	attrs := n.Attr[:0]
+	for _, a := range n.Attr {
+		if !strings.HasPrefix(strings.ToLower(a.Key), "on") {
+			attrs = append(attrs, a)
+		}
+	}
+	n.Attr = attrs
+
+	switch n.DataAtom {
+	case atom.Title:
+		if n.FirstChild != nil && len(s.title) == 0 {
+			s.title = strings.TrimSpace(n.FirstChild.Data)
+		}
+	case atom.Meta:
+		return strings.EqualFold(getAttr(n, "http-equiv"), "refresh")
+	case atom.Link:
+		return s.link(n)
+	case atom.Style:
+		if n.FirstChild != nil && n.FirstChild.Type == html.TextNode {
+			n.FirstChild.Data = s.css(n.FirstChild.Data, s.base)
+		}
+	case atom.Img:
+		src := getAttr(n, "src")
+		if len(src) == 0 || strings.HasPrefix(src, "data:") {
+			// lazily loaded images often keep their source elsewhere
+			src = getAttr(n, "data-src")
+		}
+		delAttr(n, "srcset", "sizes", "loading", "data-src", "data-srcset")
+		if len(src) > 0 {
+			setAttr(n, "src", s.asset(s.resolve(src).String()))
+		}
+	case atom.Source:
+		// without srcset, <picture> falls back to its <img>
+		return n.Parent != nil && n.Parent.DataAtom == atom.Picture
+	case atom.A:
+		if href := getAttr(n, "href"); len(href) > 0 && !strings.HasPrefix(href, "#") {
+			setAttr(n, "href", s.resolve(href).String())
+		}
+	}
+	if style := getAttr(n, "style"); strings.Contains(style, "url(") {
+		setAttr(n, "style", s.css(style, s.base))
+	}
+	return false
+}
+
+// link inlines stylesheets and icons, returning true if n should be removed.
+func (s *snapshotter) link(n *html.Node) bool {
+	rels := strings.Fields(strings.ToLower(getAttr(n, "rel")))
+	href := getAttr(n, "href")
+	for _, rel := range rels {
+		switch {
+		case removedLinks[rel]:
+			return true
+		case rel == "stylesheet":
+			if len(href) == 0 {
+				return true
+			}
+			u := s.resolve(href)
+			body, _, _, err := s.fetch(s.ctx, u.String(), s.MaxAssetSize)
+			if err != nil {
+				slog.Debug("archive: skipping stylesheet", "url", u, "err", err)
+				return true
+			}
+			// replace the link with a <style> holding the stylesheet
+			media := getAttr(n, "media")
+			n.DataAtom, n.Data = atom.Style, "style"
+			n.Attr = nil
+			if len(media) > 0 {
+				setAttr(n, "media", media)
+			}
+			n.AppendChild(&html.Node{Type: html.TextNode, Data: s.css(string(body), u)})
+			return false
+		case rel == "icon":
+			if len(href) > 0 {
+				setAttr(n, "href", s.asset(s.resolve(href).String()))
+			}
+			return false
+		}
+	}
+	if len(href) > 0 {
+		setAttr(n, "href", s.resolve(href).String())
+	}
+	return false
+}
+
+var cssURL = regexp.MustCompile(`url\(\s*(['"]?)([^'")]+)(['"]?)\s*\)`)
+
+// css inlines the urls referenced by the stylesheet text, which is relative
+// to base.
+func (s *snapshotter) css(text string, base *url.URL) string {
+	return cssURL.ReplaceAllStringFunc(text, func(m string) string {
+		ref := strings.TrimSpace(cssURL.FindStringSubmatch(m)[2])
+		if strings.HasPrefix(ref, "data:") || strings.HasPrefix(ref, "#") {
+			return m
+		}
+		u, err := base.Parse(ref)
+		if err != nil {
+			return m
+		}
+		return fmt.Sprintf(`url("%s")`, s.asset(u.String()))
+	})
+}
+
+// asset returns the data url for the asset at u, or u itself if it can't be
+// fetched.
+func (s *snapshotter) asset(u string) string {
+	if !strings.HasPrefix(u, "http://") && !strings.HasPrefix(u, "https://") {
+		return u
+	}
+	if data, ok := s.cache[u]; ok {
+		return data
+	}
+	if s.assets >= s.MaxAssets {
+		return u
+	}
+	s.assets++
+
+	body, _, ctype, err := s.fetch(s.ctx, u, s.MaxAssetSize)
+	if err != nil {
+		slog.Debug("archive: skipping asset", "url", u, "err", err)
+		s.cache[u] = u
+		return u
+	}
+	if mt, _, err := mime.ParseMediaType(ctype); err == nil {
+		ctype = mt
+	}
+	data := fmt.Sprintf("data:%s;base64,%s", ctype, base64.StdEncoding.EncodeToString(body))
+	s.cache[u] = data
+	return data
+}
+
+func (s *snapshotter) resolve(ref string) *url.URL {
+	u, err := s.base.Parse(strings.TrimSpace(ref))
+	if err != nil {
+		return s.base
+	}
+	return u
+}
+
+// findBase returns the href of the document's <base>, if any.
+func findBase(n *html.Node) string {
+	if n.Type == html.ElementNode && n.DataAtom == atom.Base {
+		return getAttr(n, "href")
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if href := findBase(c); href != "" {
+			return href
+		}
+	}
+	return ""
+}
+
+// pageText returns up to max bytes of the visible text in doc's body.
+func pageText(doc *html.Node, max int) string {
+	var b strings.Builder
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		if b.Len() >= max {
+			return
+		}
+		switch {
+		case n.Type == html.TextNode:
+			for _, f := range strings.Fields(n.Data) {
+				if b.Len() > 0 {
+					b.WriteByte(' ')
+				}
+				b.WriteString(f)
+			}
+			return
+		case n.Type == html.ElementNode:
+			switch n.DataAtom {
+			case atom.Head, atom.Script, atom.Style, atom.Noscript, atom.Template:
+				return
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(doc)
+
+	text := b.String()
+	if len(text) > max {
+		text = strings.ToValidUTF8(text[:max], "")
+	}
+	return text
+}
+
+func getAttr(n *html.Node, key string) string {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+func setAttr(n *html.Node, key, val string) {
+	for i, a := range n.Attr {
+		if a.Key == key {
+			n.Attr[i].Val = val
+			return
+		}
+	}
+	n.Attr = append(n.Attr, html.Attribute{Key: key, Val: val})
+}
+
+func delAttr(n *html.Node, keys ...string) {
+	attrs := n.Attr[:0]
+outer:
+	for _, a := range n.Attr {
+		for _, k := range keys {
+			if a.Key == k {
+				continue outer
+			}
+		}
+		attrs = append(attrs, a)
+	}
+	n.Attr = attrs
+}
+
+// SetArchive records the result of archiving the bookmark id.  The archive's
+// text is indexed for full text search.
+func (s *BookmarkService) SetArchive(id, path, status, archiveErr, text string) error {
+	return db.With(s.db, func(tx *sqlx.Tx) error {
+		_, err := tx.Exec(`UPDATE bookmark SET archive_path=?, archive_status=?, archive_error=?,
+			archive_text=?, archived_at=? WHERE id=?`,
+			path, status, archiveErr, text, time.Now().Unix(), id)
+		if err != nil {
+			return err
+		}
+		// see Save
+		tx.Exec(`insert into bookmark_fts(bookmark_fts) values ('rebuild')`)
+		return nil
+	})
+}
+
+// SetArchiveURL records url as the copy of the bookmark id's page kept
+// elsewhere.  The bookmark's own url is left alone.
+func (s *BookmarkService) SetArchiveURL(id, url string) error {
+	_, err := s.db.Exec(`UPDATE bookmark SET archive_url=? WHERE id=?`, url, id)
+	return err
+}
+
+// archiveBookmark archives the page for the bookmark id into the "archives"
+// filesystem, and records the result on the bookmark.
+func archiveBookmark(ctx context.Context, conn db.DB, fss vfs.Registry, archiver *Archiver, id string) error {
+	serv := NewBookmarkService(conn)
+	b, err := serv.GetByID(id)
+	if err != nil {
+		return err
+	}
+
+	dir, err := archiveDir(fss)
+	if err != nil {
+		return err
+	}
+
+	snap, err := archiver.Archive(ctx, b.URL)
+	if err == nil {
+		name := b.ID + ".html"
+		if err = os.MkdirAll(dir, 0755); err == nil {
+			err = os.WriteFile(filepath.Join(dir, name), snap.HTML, 0644)
+		}
+		if err == nil {
+			slog.Info("archived bookmark", "id", b.ID, "url", b.URL, "size", len(snap.HTML))
+			return serv.SetArchive(b.ID, name, ArchiveOK, "", snap.Text)
+		}
+	}
+
+	// keep any earlier archive if this attempt failed
+	if serr := serv.SetArchive(b.ID, b.ArchivePath, ArchiveFailed, err.Error(), b.ArchiveText); serr != nil {
+		slog.Error("recording archive failure", "id", b.ID, "err", serr)
+	}
+	return err
+}
+
+func archiveDir(fss vfs.Registry) (string, error) {
+	if fss == nil {
+		return "", fmt.Errorf("archives directory not configured")
+	}
+	dir, err := fss.GetPath("archives")
+	if err != nil {
+		return "", fmt.Errorf("archives directory not configured")
+	}
+	return dir, nil
+}
+
+// archiveCSP prevents archived pages from running scripts, submitting forms
+// or loading anything that was not inlined when they were archived.
+const archiveCSP = "sandbox; default-src 'none'; img-src data:; style-src 'unsafe-inline' data:; font-src data:; media-src data:"
+
+// serveArchive serves the archived copy of b from fss.
+func serveArchive(w http.ResponseWriter, fss vfs.Registry, b *Bookmark) {
+	if len(b.ArchivePath) == 0 || fss == nil {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	fsys, err := fss.Get("archives")
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	data, err := fs.ReadFile(fsys, b.ArchivePath)
+	if err != nil {
+		slog.Error("reading archive", "id", b.ID, "path", b.ArchivePath, "err", err)
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	h := w.Header()
+	h.Set("Content-Type", "text/html; charset=utf-8")
+	h.Set("Content-Security-Policy", archiveCSP)
+	h.Set("X-Content-Type-Options", "nosniff")
+	h.Set("Referrer-Policy", "no-referrer")
+	w.Write(data)
+}
@@ -0,0 +1,143 @@
+package bookmarks
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jmoiron/monet/pkg/vfs"
+	"github.com/jmoiron/sqlx"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const archivePage = `<!DOCTYPE html>
+<html><head>
+<title>Archived Page</title>
+<link rel="stylesheet" href="/style.css">
+<link rel="preload" href="/font.woff2">
+<script src="/app.js"></script>
+<meta http-equiv="refresh" content="5; url=/elsewhere">
+</head>
+<body onload="track()">
+<h1>Hello archive</h1>
+<p>Some <b>searchable</b> text.</p>
+<img src="img/pic.png" srcset="img/pic-2x.png 2x">
+<a href="/other">other page</a>
+<script>alert("hi")</script>
+<iframe src="https://ads.example.com/"></iframe>
+</body></html>`
+
+func newArchiveServer(t *testing.T) *httptest.Server {
+	png := []byte("\x89PNG\r\n\x1a\nfakepng")
+	mux := http.NewServeMux()
+	mux.HandleFunc("/page", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprint(w, archivePage)
+	})
+	mux.HandleFunc("/style.css", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/css")
+		fmt.Fprint(w, `body { background: url('img/bg.png'); }`)
+	})
+	mux.HandleFunc("/img/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(png)
+	})
+	mux.HandleFunc("/file.pdf", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/pdf")
+		fmt.Fprint(w, "%PDF-1.4")
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestArchiver(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	srv := newArchiveServer(t)
+	snap, err := NewArchiver().Archive(context.Background(), srv.URL+"/page")
+	require.NoError(err)
+
+	page := string(snap.HTML)
+	assert.Equal("Archived Page", snap.Title)
+	assert.NotContains(page, "<script")
+	assert.NotContains(page, "<iframe")
+	assert.NotContains(page, "onload")
+	assert.NotContains(page, "refresh")
+	assert.NotContains(page, "preload")
+	assert.NotContains(page, "srcset")
+	assert.Contains(page, `<style>body { background: url("data:image/png;base64,`)
+	assert.Contains(page, `<img src="data:image/png;base64,`)
+	assert.Contains(page, `href="`+srv.URL+`/other"`)
+
+	assert.Equal("Hello archive Some searchable text. other page", snap.Text)
+
+	_, err = NewArchiver().Archive(context.Background(), srv.URL+"/file.pdf")
+	assert.Error(err)
+	_, err = NewArchiver().Archive(context.Background(), srv.URL+"/missing")
+	assert.Error(err)
+}
+
+func TestArchiveBookmark(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	srv := newArchiveServer(t)
+	conn, err := sqlx.Connect("sqlite3", ":memory:")
+	require.NoError(err)
+	require.NoError(NewApp(conn).Migrate())
+
+	dir := t.TempDir()
+	fss := vfs.NewRegistry(vfs.NewURLMapper(nil))
+	require.NoError(fss.AddPath("archives", dir))
+
+	serv := NewBookmarkService(conn)
+	b := &Bookmark{URL: srv.URL + "/page", Title: "page", Published: 1}
+	require.NoError(serv.Insert(b))
+	require.NoError(archiveBookmark(context.Background(), conn, fss, NewArchiver(), b.ID))
+
+	b, err = serv.GetByID(b.ID)
+	require.NoError(err)
+	assert.Equal(ArchiveOK, b.ArchiveStatus)
+	assert.Equal(b.ID+".html", b.ArchivePath)
+	assert.False(b.ArchivedAt.IsZero())
+	_, err = os.Stat(filepath.Join(dir, b.ArchivePath))
+	assert.NoError(err)
+
+	// the archived text is searchable
+	count, err := serv.SearchCount(`"searchable"`, nil)
+	require.NoError(err)
+	assert.Equal(1, count)
+
+	// saving the bookmark keeps its archive
+	b.Title = "renamed"
+	require.NoError(serv.Save(b))
+	count, err = serv.SearchCount(`"searchable"`, nil)
+	require.NoError(err)
+	assert.Equal(1, count)
+
+	// archives are served sandboxed
+	rec := httptest.NewRecorder()
+	serveArchive(rec, fss, b)
+	assert.Equal(http.StatusOK, rec.Code)
+	assert.True(strings.HasPrefix(rec.Header().Get("Content-Security-Policy"), "sandbox"))
+	assert.Contains(rec.Body.String(), "Hello archive")
+
+	// a failed attempt keeps the earlier archive
+	b.URL = srv.URL + "/missing"
+	require.NoError(serv.Save(b))
+	assert.Error(archiveBookmark(context.Background(), conn, fss, NewArchiver(), b.ID))
+	b, err = serv.GetByID(b.ID)
+	require.NoError(err)
+	assert.Equal(ArchiveFailed, b.ArchiveStatus)
+	assert.NotEmpty(b.ArchiveError)
+	assert.Equal(b.ID+".html", b.ArchivePath)
+}
@@ -0,0 +1,282 @@
+package bookmarks
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"html"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/jmoiron/monet/conf"
+)
+
+// A ScreenshotBackend renders a web page to an image.
+type ScreenshotBackend interface {
+	// Name identifies the backend in logs and metadata.
+	Name() string
+	// Capture renders url to an image file in dir, which is removed once
+	// the screenshot has been saved.  It must stop when ctx is cancelled.
+	Capture(ctx context.Context, url, dir string) (*Capture, error)
+}
+
+// A Capture is a rendered page.  Title and HTML are optional.
+type Capture struct {
+	// ImagePath is the image written by the backend.  Formats other than
+	// jpeg are converted.
+	ImagePath string
+	Title     string
+	HTML      string
+}
+
+// NewScreenshotBackend returns the backend selected by cfg, or nil if
+// screenshots are disabled.
+func NewScreenshotBackend(cfg conf.BookmarksConfig) (ScreenshotBackend, error) {
+	switch cfg.ScreenshotBackend {
+	case "":
+		return nil, nil
+	case "gowitness":
+		return NewGoWitnessBackend(cfg), nil
+	case "command":
+		if len(cfg.ScreenshotCommand) == 0 {
+			return nil, fmt.Errorf("screenshot command not configured")
+		}
+		return NewCommandBackend(cfg), nil
+	case "fake":
+		return &FakeBackend{Width: cfg.WindowWidth, Height: cfg.WindowHeight}, nil
+	default:
+		return nil, fmt.Errorf("unknown screenshot backend %q", cfg.ScreenshotBackend)
+	}
+}
+
+// GoWitnessOutput represents the JSON structure output by gowitness
+type GoWitnessOutput struct {
+	URL           string `json:"url"`
+	Title         string `json:"title"`
+	FinalURL      string `json:"final_url"`
+	StatusCode    int    `json:"status_code"`
+	ContentLength int    `json:"content_length"`
+	HTML          string `json:"html"`
+	Technologies  []struct {
+		Name       string   `json:"name"`
+		Version    string   `json:"version"`
+		Categories []string `json:"categories"`
+	} `json:"technologies"`
+}
+
+// GoWitnessBackend takes screenshots with the gowitness binary.
+type GoWitnessBackend struct {
+	Bin    string
+	Width  int
+	Height int
+	Script string
+}
+
+// NewGoWitnessBackend returns a gowitness backend configured by cfg.
+func NewGoWitnessBackend(cfg conf.BookmarksConfig) *GoWitnessBackend {
+	return &GoWitnessBackend{
+		Bin:    cfg.GowitnessPath,
+		Width:  cfg.WindowWidth,
+		Height: cfg.WindowHeight,
+		Script: cfg.ScriptPath,
+	}
+}
+
+func (g *GoWitnessBackend) Name() string { return "gowitness" }
+
+func (g *GoWitnessBackend) Capture(ctx context.Context, url, dir string) (*Capture, error) {
+	if g.Bin == "" {
+		return nil, fmt.Errorf("gowitness binary not configured")
+	}
+
+	jsonPath := filepath.Join(dir, "gowitness.jsonl")
+	args := []string{"scan", "single",
+		"--url", url,
+		"--screenshot-path", dir,
+		"--screenshot-format", "jpeg",
+		"--chrome-window-x", strconv.Itoa(g.Width),
+		"--chrome-window-y", strconv.Itoa(g.Height),
+	}
+	if g.Script != "" {
+		args = append(args, "--javascript-file", g.Script)
+	}
+	args = append(args,
+		// without this some scanning errors will be completely silent
+		// we aren't making the output of this command available but maybe we should
+		"--log-scan-errors",
+		"--write-jsonl",
+		"--write-jsonl-file", jsonPath)
+
+	if err := runScreenshotCommand(ctx, g.Bin, args...); err != nil {
+		return nil, err
+	}
+
+	// Find the generated screenshot file (gowitness generates its own filename)
+	files, err := filepath.Glob(filepath.Join(dir, "*.jpeg"))
+	if err != nil || len(files) == 0 {
+		return nil, fmt.Errorf("no screenshot file generated in temp directory")
+	}
+	capture := &Capture{ImagePath: files[0]}
+
+	// Parse the first line of JSON output to extract metadata
+	if f, err := os.Open(jsonPath); err != nil {
+		slog.Warn("gowitness wrote no JSON output", "error", err)
+	} else {
+		defer f.Close()
+		var out GoWitnessOutput
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(nil, 64<<20)
+		if scanner.Scan() {
+			if err := json.Unmarshal(scanner.Bytes(), &out); err != nil {
+				slog.Error("failed to parse JSON output", "error", err)
+			}
+		}
+		capture.Title, capture.HTML = out.Title, out.HTML
+	}
+	return capture, nil
+}
+
+// CommandBackend runs any command that can screenshot a page, such as a
+// headless browser's CLI.  In each argument, {url}, {output}, {width},
+// {height} and {script} are replaced with the page's url, the image file
+// that the command should write, the window size and the script path.
+type CommandBackend struct {
+	Command []string
+	Format  string
+	Width   int
+	Height  int
+	Script  string
+}
+
+// NewCommandBackend returns a command backend configured by cfg.
+func NewCommandBackend(cfg conf.BookmarksConfig) *CommandBackend {
+	return &CommandBackend{
+		Command: cfg.ScreenshotCommand,
+		Format:  cfg.ScreenshotFormat,
+		Width:   cfg.WindowWidth,
+		Height:  cfg.WindowHeight,
+		Script:  cfg.ScriptPath,
+	}
+}
+
+func (c *CommandBackend) Name() string { return "command" }
+
+// Args returns the command line for url, writing its image to output.
+func (c *CommandBackend) Args(url, output string) []string {
+	r := strings.NewReplacer(
+		"{url}", url,
+		"{output}", output,
+		"{width}", strconv.Itoa(c.Width),
+		"{height}", strconv.Itoa(c.Height),
+		"{script}", c.Script,
+	)
+	args := make([]string, len(c.Command))
+	for i, arg := range c.Command {
+		args[i] = r.Replace(arg)
+	}
+	return args
+}
+
+func (c *CommandBackend) Capture(ctx context.Context, url, dir string) (*Capture, error) {
+	if len(c.Command) == 0 {
+		return nil, fmt.Errorf("screenshot command not configured")
+	}
+	format := strings.TrimPrefix(c.Format, ".")
+	if format == "" {
+		format = "png"
+	}
+	output := filepath.Join(dir, "screenshot."+format)
+
+	args := c.Args(url, output)
+	if err := runScreenshotCommand(ctx, args[0], args[1:]...); err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(output); err != nil {
+		return nil, fmt.Errorf("command did not write a screenshot: %w", err)
+	}
+	return &Capture{ImagePath: output}, nil
+}
+
+func runScreenshotCommand(ctx context.Context, bin string, args ...string) error {
+	cmd := exec.CommandContext(ctx, bin, args...)
+
+	// Log the exact command being executed for debugging
+	slog.Info("executing screenshot command", "binary", bin, "args", cmd.Args)
+
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		slog.Error("screenshot command failed",
+			"error", err,
+			"output", string(output),
+			"command", cmd.String())
+		return fmt.Errorf("%s: %w", filepath.Base(bin), err)
+	}
+	return nil
+}
+
+// FakeBackend renders a solid image whose colour is derived from the url,
+// without loading the page.  It is deterministic, for tests and development
+// without a browser.
+type FakeBackend struct {
+	Width  int
+	Height int
+	// Title and Description are reported for every page.  An empty Title
+	// falls back to the url.
+	Title       string
+	Description string
+	// Err, if set, is returned by every capture.
+	Err error
+}
+
+func (f *FakeBackend) Name() string { return "fake" }
+
+func (f *FakeBackend) Capture(ctx context.Context, url, dir string) (*Capture, error) {
+	if f.Err != nil {
+		return nil, f.Err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	w, h := f.Width, f.Height
+	if w <= 0 || h <= 0 {
+		w, h = 640, 400
+	}
+	sum := fnv.New32a()
+	sum.Write([]byte(url))
+	v := sum.Sum32()
+	c := color.RGBA{uint8(v >> 16), uint8(v >> 8), uint8(v), 255}
+
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(img, img.Bounds(), &image.Uniform{c}, image.Point{}, draw.Src)
+
+	path := filepath.Join(dir, "fake.jpg")
+	out, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := jpeg.Encode(out, img, nil); err != nil {
+		out.Close()
+		return nil, err
+	}
+	if err := out.Close(); err != nil {
+		return nil, err
+	}
+
+	capture := &Capture{ImagePath: path, Title: f.Title}
+	if f.Description != "" {
+		capture.HTML = fmt.Sprintf(`<html><head><meta name="description" content="%s"></head></html>`,
+			html.EscapeString(f.Description))
+	}
+	return capture, nil
+}
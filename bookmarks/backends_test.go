@@ -0,0 +1,185 @@
+package bookmarks
+
+import (
+	"context"
+	"errors"
+	"image"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jmoiron/monet/conf"
+	"github.com/jmoiron/monet/pkg/vfs"
+	"github.com/jmoiron/sqlx"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewScreenshotBackend(t *testing.T) {
+	assert := assert.New(t)
+	cfg := conf.Default().Bookmarks
+
+	b, err := NewScreenshotBackend(cfg)
+	assert.NoError(err)
+	assert.Equal(&GoWitnessBackend{Bin: "gowitness", Width: 1280, Height: 939, Script: "./bookmarks/accept.js"}, b)
+
+	cfg.ScreenshotBackend = ""
+	b, err = NewScreenshotBackend(cfg)
+	assert.NoError(err)
+	assert.Nil(b)
+
+	cfg.ScreenshotBackend = "command"
+	_, err = NewScreenshotBackend(cfg)
+	assert.Error(err, "command backend needs a command")
+
+	cfg.ScreenshotBackend = "fake"
+	b, err = NewScreenshotBackend(cfg)
+	assert.NoError(err)
+	assert.Equal("fake", b.Name())
+
+	cfg.ScreenshotBackend = "netscape"
+	_, err = NewScreenshotBackend(cfg)
+	assert.Error(err)
+}
+
+func TestTakeScreenshotFake(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	dir := t.TempDir()
+	fake := &FakeBackend{Width: 320, Height: 200, Title: "Fake Page", Description: "a fake page"}
+	ss := NewScreenshotServiceWithBackend(dir, fake)
+
+	result, err := ss.TakeScreenshot(context.Background(), "https://example.com/", "42")
+	require.NoError(err)
+	assert.Equal("Fake Page", result.Title)
+	assert.Equal(filepath.Join(dir, "42.jpg"), result.ScreenshotPath)
+
+	for _, path := range []string{result.ScreenshotPath, result.IconPath, result.JSONPath} {
+		_, err := os.Stat(path)
+		assert.NoError(err, path)
+	}
+	// the temp directory is removed
+	_, err = os.Stat(filepath.Join(dir, "42"))
+	assert.True(os.IsNotExist(err))
+
+	desc, err := GetDescriptionFromPath(result.JSONPath)
+	require.NoError(err)
+	assert.Equal("a fake page", desc)
+
+	// the same url always renders the same image
+	a, _ := os.ReadFile(result.ScreenshotPath)
+	result, err = ss.TakeScreenshot(context.Background(), "https://example.com/", "43")
+	require.NoError(err)
+	b, _ := os.ReadFile(result.ScreenshotPath)
+	assert.Equal(a, b)
+
+	fake.Err = errors.New("boom")
+	_, err = ss.TakeScreenshot(context.Background(), "https://example.com/", "44")
+	assert.ErrorContains(err, "boom")
+
+	// a nil backend is disabled
+	result, err = NewScreenshotServiceWithBackend(dir, nil).TakeScreenshot(context.Background(), "https://example.com/", "45")
+	assert.NoError(err)
+	assert.Nil(result)
+}
+
+func TestCommandBackend(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	cmd := &CommandBackend{
+		Command: []string{"shot", "--url={url}", "-o", "{output}", "{width}x{height}", "{script}"},
+		Width:   800,
+		Height:  600,
+		Script:  "accept.js",
+	}
+	assert.Equal([]string{"shot", "--url=https://example.com/", "-o", "/tmp/out.png", "800x600", "accept.js"},
+		cmd.Args("https://example.com/", "/tmp/out.png"))
+
+	// a command that writes a png is converted to jpeg
+	src := filepath.Join(t.TempDir(), "src.png")
+	f, err := os.Create(src)
+	require.NoError(err)
+	require.NoError(png.Encode(f, image.NewRGBA(image.Rect(0, 0, 400, 300))))
+	f.Close()
+
+	dir := t.TempDir()
+	ss := NewScreenshotServiceWithBackend(dir, &CommandBackend{Command: []string{"cp", src, "{output}"}, Format: "png"})
+	result, err := ss.TakeScreenshot(context.Background(), "https://example.com/", "1")
+	require.NoError(err)
+	assert.Equal("https://example.com/", result.Title)
+
+	out, err := os.Open(result.ScreenshotPath)
+	require.NoError(err)
+	defer out.Close()
+	_, format, err := image.DecodeConfig(out)
+	require.NoError(err)
+	assert.Equal("jpeg", format)
+
+	ss = NewScreenshotServiceWithBackend(dir, &CommandBackend{Command: []string{"false"}})
+	_, err = ss.TakeScreenshot(context.Background(), "https://example.com/", "2")
+	assert.Error(err)
+}
+
+func TestScreenshotJob(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	conn, err := sqlx.Connect("sqlite3", ":memory:")
+	require.NoError(err)
+	require.NoError(NewApp(conn).Migrate())
+
+	cfg := conf.Default().Bookmarks
+	cfg.ScreenshotBackend = "fake"
+
+	serv := NewBookmarkService(conn)
+	b := &Bookmark{URL: "https://example.com/page"}
+	require.NoError(serv.Insert(b))
+
+	fss := vfs.NewRegistry(vfs.NewURLMapper(nil))
+	require.NoError(fss.AddPath("screenshots", t.TempDir()))
+
+	require.NoError(captureScreenshot(context.Background(), conn, fss, cfg, b.ID))
+	b, err = serv.GetByID(b.ID)
+	require.NoError(err)
+	assert.NotEmpty(b.ScreenshotPath)
+	assert.NotEmpty(b.IconPath)
+
+	missing, err := serv.MissingScreenshots()
+	require.NoError(err)
+	assert.Empty(missing)
+}
+
+func TestAdminScreenshotBackend(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	conn, err := sqlx.Connect("sqlite3", ":memory:")
+	require.NoError(err)
+	require.NoError(NewApp(conn).Migrate())
+
+	fss := vfs.NewRegistry(vfs.NewURLMapper(nil))
+	require.NoError(fss.AddPath("screenshots", t.TempDir()))
+
+	cfg := conf.Default().Bookmarks
+	cfg.ScreenshotBackend = "command"
+	cfg.ScreenshotCommand = []string{"shot", "{url}", "{output}"}
+	serv := NewBookmarkAdmin(conn, fss).withConfig(cfg).newBookmarkServiceWithScreenshots()
+	require.NotNil(serv.screenshotService)
+	cmd, ok := serv.screenshotService.backend.(*CommandBackend)
+	require.True(ok)
+	assert.Equal(cfg.ScreenshotCommand, cmd.Command)
+
+	cfg.ScreenshotBackend = "fake"
+	serv = NewBookmarkAdmin(conn, fss).withConfig(cfg).newBookmarkServiceWithScreenshots()
+	require.NotNil(serv.screenshotService)
+	assert.Equal("fake", serv.screenshotService.backend.Name())
+
+	// a disabled backend leaves the service without screenshots
+	cfg.ScreenshotBackend = ""
+	serv = NewBookmarkAdmin(conn, fss).withConfig(cfg).newBookmarkServiceWithScreenshots()
+	assert.Nil(serv.screenshotService)
+}
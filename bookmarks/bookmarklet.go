@@ -0,0 +1,57 @@
+package bookmarks
+
+import (
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+
+	"github.com/jmoiron/monet/app"
+	"github.com/jmoiron/monet/auth"
+	"github.com/jmoiron/monet/mtr"
+)
+
+// bookmarkletJS posts the current page's url, title and selected text to the
+// bookmark API in a new window.
+const bookmarkletJS = `javascript:(function(){` +
+	`var f=document.createElement('form'),d={url:location.href,title:document.title,` +
+	`selection:String(window.getSelection()),token:%q,format:'html'};` +
+	`f.method='POST';f.action=%q;f.target='_blank';` +
+	`for(var k in d){var i=document.createElement('input');i.type='hidden';i.name=k;i.value=d[k];f.appendChild(i);}` +
+	`document.body.appendChild(f);f.submit();f.remove();})()`
+
+// Bookmarklet returns a bookmarklet that adds pages to the bookmark API at
+// origin, authenticated with token.
+func Bookmarklet(origin, token string) template.URL {
+	return template.URL(fmt.Sprintf(bookmarkletJS, token, origin+"/api/bookmarks"))
+}
+
+// requestOrigin returns the scheme and host that r was sent to.
+func requestOrigin(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+// bookmarklet shows how to install the bookmarklet.  Posting creates a new
+// API token for the logged in user and renders a bookmarklet that uses it.
+func (a *Admin) bookmarklet(w http.ResponseWriter, r *http.Request) {
+	ctx := mtr.Ctx{"title": "Bookmarklet"}
+
+	if r.Method == http.MethodPost {
+		user := auth.SessionFromContext(r.Context()).Session(r).Values["user"]
+		token, _, err := auth.NewTokenService(a.db).Create(fmt.Sprint(user), "bookmarklet")
+		if err != nil {
+			app.Http500("creating token", w, err)
+			return
+		}
+		ctx["bookmarklet"] = Bookmarklet(requestOrigin(r), token)
+	}
+
+	reg := mtr.RegistryFromContext(r.Context())
+	if err := reg.RenderWithBase(w, "admin-base", "bookmarks/admin/bookmarklet.html", ctx); err != nil {
+		slog.Error("rendering bookmarklet", "err", err)
+	}
+}
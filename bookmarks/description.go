@@ -16,6 +16,9 @@ func (s *BookmarkService) GetDescription(b *Bookmark) (string, error) {
 	if b.ScreenshotPath == "" {
 		return "", nil // No screenshot path means no JSON file
 	}
+	if s.screenshotService != nil {
+		return s.screenshotService.GetDescription(b.ScreenshotPath)
+	}
 
 	// Construct JSON file path from screenshot path
 	// Screenshot path is like "/path/to/screenshot.jpg", JSON is "/path/to/screenshot.json"
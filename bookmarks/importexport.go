@@ -0,0 +1,489 @@
+package bookmarks
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/monet/db"
+	"github.com/jmoiron/sqlx"
+	xhtml "golang.org/x/net/html"
+)
+
+// A Format is a file format that bookmarks can be imported from and
+// exported to.
+type Format string
+
+const (
+	// FormatNetscape is the bookmarks.html format that browsers export.
+	FormatNetscape Format = "netscape"
+	// FormatPinboard is Pinboard's JSON export.
+	FormatPinboard Format = "pinboard"
+	// FormatRaindrop is Raindrop.io's CSV export.
+	FormatRaindrop Format = "raindrop"
+)
+
+// Formats are the supported import and export formats.
+var Formats = []Format{FormatNetscape, FormatPinboard, FormatRaindrop}
+
+// ParseFormat returns the Format named s.
+func ParseFormat(s string) (Format, error) {
+	for _, f := range Formats {
+		if string(f) == s {
+			return f, nil
+		}
+	}
+	return "", fmt.Errorf("unknown bookmark format %q", s)
+}
+
+// DetectFormat guesses the format of an exported bookmarks file.
+func DetectFormat(data []byte) Format {
+	data = bytes.TrimSpace(bytes.TrimPrefix(data, []byte("\xef\xbb\xbf")))
+	switch {
+	case bytes.HasPrefix(data, []byte("[")):
+		return FormatPinboard
+	case bytes.HasPrefix(data, []byte("<")):
+		return FormatNetscape
+	default:
+		return FormatRaindrop
+	}
+}
+
+// ContentType is the mime type of files in this format.
+func (f Format) ContentType() string {
+	switch f {
+	case FormatPinboard:
+		return "application/json"
+	case FormatRaindrop:
+		return "text/csv; charset=utf-8"
+	default:
+		return "text/html; charset=utf-8"
+	}
+}
+
+// Ext is the file extension for files in this format.
+func (f Format) Ext() string {
+	switch f {
+	case FormatPinboard:
+		return "json"
+	case FormatRaindrop:
+		return "csv"
+	default:
+		return "html"
+	}
+}
+
+// Parse reads bookmarks in format f from r.  Bookmarks that are not
+// explicitly public in the file are unpublished.
+func Parse(f Format, r io.Reader) ([]*Bookmark, error) {
+	switch f {
+	case FormatNetscape:
+		return parseNetscape(r)
+	case FormatPinboard:
+		return parsePinboard(r)
+	case FormatRaindrop:
+		return parseRaindrop(r)
+	}
+	return nil, fmt.Errorf("unknown bookmark format %q", f)
+}
+
+// Export writes bookmarks to w in format f.
+func Export(f Format, w io.Writer, bookmarks []Bookmark) error {
+	switch f {
+	case FormatNetscape:
+		return exportNetscape(w, bookmarks)
+	case FormatPinboard:
+		return exportPinboard(w, bookmarks)
+	case FormatRaindrop:
+		return exportRaindrop(w, bookmarks)
+	}
+	return fmt.Errorf("unknown bookmark format %q", f)
+}
+
+// setPublished publishes b at its creation time if public is true.
+func setPublished(b *Bookmark, public bool) {
+	b.Published = 0
+	b.PublishedAt = time.Time{}
+	if public {
+		b.Published = 1
+		b.PublishedAt = b.CreatedAt
+	}
+}
+
+// splitTags splits s on sep, dropping empty tags.
+func splitTags(s, sep string) []string {
+	var tags []string
+	for _, t := range strings.Split(s, sep) {
+		if t = strings.TrimSpace(t); len(t) > 0 {
+			tags = append(tags, t)
+		}
+	}
+	return tags
+}
+
+func parseUnix(s string) time.Time {
+	n, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+	if err != nil || n <= 0 {
+		return time.Time{}
+	}
+	return time.Unix(n, 0)
+}
+
+func parseTime(s string) time.Time {
+	t, err := time.Parse(time.RFC3339, strings.TrimSpace(s))
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+// parseNetscape parses the Netscape bookmark file format.  Each bookmark is
+// an <A> in a <DT>, optionally followed by a <DD> with its description:
+//
+//	<DT><A HREF="..." ADD_DATE="1600000000" PRIVATE="1" TAGS="a,b">Title</A>
+//	<DD>Description
+//
+// Folders are ignored.  Bookmarks are public only if PRIVATE="0".
+func parseNetscape(r io.Reader) ([]*Bookmark, error) {
+	var (
+		bookmarks []*Bookmark
+		cur       *Bookmark // bookmark whose title is being read
+		desc      *Bookmark // bookmark whose description is being read
+		text      strings.Builder
+	)
+
+	endDesc := func() {
+		if desc != nil {
+			desc.Description = strings.TrimSpace(text.String())
+			desc = nil
+		}
+	}
+
+	z := xhtml.NewTokenizer(r)
+	for {
+		switch z.Next() {
+		case xhtml.ErrorToken:
+			if z.Err() == io.EOF {
+				endDesc()
+				return bookmarks, nil
+			}
+			return nil, z.Err()
+		case xhtml.StartTagToken:
+			name, hasAttr := z.TagName()
+			switch string(name) {
+			case "a":
+				endDesc()
+				b := &Bookmark{}
+				public := false
+				for hasAttr {
+					var k, v []byte
+					k, v, hasAttr = z.TagAttr()
+					switch string(k) {
+					case "href":
+						b.URL = strings.TrimSpace(string(v))
+					case "add_date":
+						b.CreatedAt = parseUnix(string(v))
+					case "private":
+						public = string(v) == "0"
+					case "tags":
+						b.Tags = splitTags(string(v), ",")
+					}
+				}
+				setPublished(b, public)
+				cur = b
+				text.Reset()
+			case "dd":
+				if len(bookmarks) > 0 {
+					desc = bookmarks[len(bookmarks)-1]
+					text.Reset()
+				}
+			case "br":
+				text.WriteString("\n")
+			default:
+				endDesc()
+			}
+		case xhtml.EndTagToken:
+			name, _ := z.TagName()
+			switch string(name) {
+			case "a":
+				if cur != nil {
+					cur.Title = strings.TrimSpace(text.String())
+					bookmarks = append(bookmarks, cur)
+					cur = nil
+				}
+			case "dl":
+				endDesc()
+			}
+		case xhtml.TextToken:
+			if cur != nil || desc != nil {
+				text.Write(z.Text())
+			}
+		}
+	}
+}
+
+func exportNetscape(w io.Writer, bookmarks []Bookmark) error {
+	var b bytes.Buffer
+	b.WriteString(`<!DOCTYPE NETSCAPE-Bookmark-file-1>
+<META HTTP-EQUIV="Content-Type" CONTENT="text/html; charset=UTF-8">
+<TITLE>Bookmarks</TITLE>
+<H1>Bookmarks</H1>
+<DL><p>
+`)
+	for _, bm := range bookmarks {
+		private := 1
+		if bm.Published > 0 {
+			private = 0
+		}
+		fmt.Fprintf(&b, `<DT><A HREF="%s" ADD_DATE="%d" PRIVATE="%d" TAGS="%s">%s</A>`+"\n",
+			html.EscapeString(bm.URL), bm.CreatedAt.Unix(), private,
+			html.EscapeString(strings.Join(bm.Tags, ",")), html.EscapeString(bm.Title))
+		if len(bm.Description) > 0 {
+			fmt.Fprintf(&b, "<DD>%s\n", html.EscapeString(bm.Description))
+		}
+	}
+	b.WriteString("</DL><p>\n")
+	_, err := b.WriteTo(w)
+	return err
+}
+
+// A pinboardPost is a bookmark in Pinboard's JSON export.  Pinboard calls
+// the title "description", and the description "extended".
+type pinboardPost struct {
+	Href        string `json:"href"`
+	Description string `json:"description"`
+	Extended    string `json:"extended"`
+	Time        string `json:"time"`
+	Shared      string `json:"shared"`
+	ToRead      string `json:"toread"`
+	Tags        string `json:"tags"`
+}
+
+func parsePinboard(r io.Reader) ([]*Bookmark, error) {
+	var posts []pinboardPost
+	if err := json.NewDecoder(r).Decode(&posts); err != nil {
+		return nil, fmt.Errorf("parsing pinboard json: %w", err)
+	}
+
+	bookmarks := make([]*Bookmark, 0, len(posts))
+	for _, p := range posts {
+		b := &Bookmark{
+			URL:         strings.TrimSpace(p.Href),
+			Title:       strings.TrimSpace(p.Description),
+			Description: strings.TrimSpace(p.Extended),
+			CreatedAt:   parseTime(p.Time),
+			Tags:        strings.Fields(p.Tags),
+		}
+		setPublished(b, p.Shared == "yes")
+		bookmarks = append(bookmarks, b)
+	}
+	return bookmarks, nil
+}
+
+func exportPinboard(w io.Writer, bookmarks []Bookmark) error {
+	posts := make([]pinboardPost, 0, len(bookmarks))
+	for _, b := range bookmarks {
+		shared := "no"
+		if b.Published > 0 {
+			shared = "yes"
+		}
+		posts = append(posts, pinboardPost{
+			Href:        b.URL,
+			Description: b.Title,
+			Extended:    b.Description,
+			Time:        b.CreatedAt.UTC().Format(time.RFC3339),
+			Shared:      shared,
+			ToRead:      "no",
+			Tags:        strings.Join(b.Tags, " "),
+		})
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(posts)
+}
+
+// raindropColumns are the columns of Raindrop's CSV export that are read
+// and written.  Raindrop has no per-bookmark privacy, so imported bookmarks
+// are unpublished.
+var raindropColumns = []string{"id", "title", "note", "excerpt", "url", "folder", "tags", "created"}
+
+func parseRaindrop(r io.Reader) ([]*Bookmark, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.LazyQuotes = true
+
+	header, err := cr.Read()
+	if err != nil {
+		return nil, fmt.Errorf("reading raindrop csv header: %w", err)
+	}
+	cols := make(map[string]int, len(header))
+	for i, h := range header {
+		cols[strings.ToLower(strings.TrimSpace(strings.TrimPrefix(h, "\xef\xbb\xbf")))] = i
+	}
+	if _, ok := cols["url"]; !ok {
+		return nil, fmt.Errorf("raindrop csv has no url column")
+	}
+
+	var bookmarks []*Bookmark
+	for {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			return bookmarks, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading raindrop csv: %w", err)
+		}
+		get := func(col string) string {
+			if i, ok := cols[col]; ok && i < len(rec) {
+				return strings.TrimSpace(rec[i])
+			}
+			return ""
+		}
+
+		b := &Bookmark{
+			URL:         get("url"),
+			Title:       get("title"),
+			Description: get("note"),
+			CreatedAt:   parseTime(get("created")),
+			Tags:        splitTags(get("tags"), ","),
+		}
+		if len(b.Description) == 0 {
+			b.Description = get("excerpt")
+		}
+		setPublished(b, false)
+		bookmarks = append(bookmarks, b)
+	}
+}
+
+func exportRaindrop(w io.Writer, bookmarks []Bookmark) error {
+	cw := csv.NewWriter(w)
+	cw.Write(raindropColumns)
+	for _, b := range bookmarks {
+		cw.Write([]string{
+			b.ID, b.Title, b.Description, "", b.URL, "",
+			strings.Join(b.Tags, ", "),
+			b.CreatedAt.UTC().Format(time.RFC3339),
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// Import statuses for the bookmarks in an ImportPlan.
+const (
+	ImportNew       = "new"
+	ImportDuplicate = "duplicate"
+	ImportInvalid   = "invalid"
+)
+
+// An ImportItem is a parsed bookmark and what importing it would do.
+type ImportItem struct {
+	Bookmark *Bookmark
+	Status   string
+	// ExistingID is the id of the bookmark that a duplicate matches, if it
+	// is already saved.  Duplicates within the imported file have none.
+	ExistingID string
+	Error      string
+}
+
+// An ImportPlan is the result of checking parsed bookmarks against the
+// bookmarks that are already saved.
+type ImportPlan struct {
+	Items      []ImportItem
+	New        int
+	Duplicates int
+	Invalid    int
+}
+
+// PlanImport checks bookmarks for invalid urls and for duplicates, both of
+// saved bookmarks and of earlier bookmarks in the same import, by normalized
+// url.  Nothing is written to the database.
+func (s *BookmarkService) PlanImport(bookmarks []*Bookmark) (*ImportPlan, error) {
+	var saved []struct {
+		ID            string
+		NormalizedURL string `db:"normalized_url"`
+	}
+	if err := s.db.Select(&saved, `SELECT id, normalized_url FROM bookmark WHERE normalized_url != ''`); err != nil {
+		return nil, err
+	}
+
+	existing := make(map[string]string, len(saved))
+	for _, b := range saved {
+		existing[b.NormalizedURL] = b.ID
+	}
+
+	plan := &ImportPlan{}
+	seen := map[string]bool{}
+	for _, b := range bookmarks {
+		item := ImportItem{Bookmark: b, Status: ImportNew}
+		norm, err := NormalizeURL(b.URL, s.trackingParams)
+		switch {
+		case err != nil:
+			item.Status, item.Error = ImportInvalid, err.Error()
+			plan.Invalid++
+		case existing[norm] != "":
+			item.Status, item.ExistingID = ImportDuplicate, existing[norm]
+			plan.Duplicates++
+		case seen[norm]:
+			item.Status = ImportDuplicate
+			plan.Duplicates++
+		default:
+			plan.New++
+		}
+		seen[norm] = true
+		plan.Items = append(plan.Items, item)
+	}
+	return plan, nil
+}
+
+// Import saves the new bookmarks in plan in a single transaction, keeping
+// their original creation times, and returns how many were saved.
+func (s *BookmarkService) Import(plan *ImportPlan) (int, error) {
+	q := `INSERT INTO bookmark
+		(id, url, normalized_url, title, description, description_rendered, screenshot_path, icon_path,
+		published, created_at, updated_at, published_at, tags)
+		VALUES (?, ?, ?, ?, ?, ?, '', '', ?, ?, ?, ?, ?)`
+
+	var count int
+	err := db.With(s.db, func(tx *sqlx.Tx) error {
+		now := time.Now()
+		for _, item := range plan.Items {
+			if item.Status != ImportNew {
+				continue
+			}
+			b := item.Bookmark
+			b.preSave(s.trackingParams)
+			if b.CreatedAt.IsZero() {
+				b.CreatedAt = now
+			}
+			b.UpdatedAt = b.CreatedAt
+			var publishedAt int64
+			if b.Published > 0 {
+				publishedAt = b.CreatedAt.Unix()
+			}
+
+			_, err := tx.Exec(q, b.ID, b.URL, b.NormalizedURL, b.Title, b.Description, b.DescriptionRendered,
+				b.Published, b.CreatedAt.Unix(), b.UpdatedAt.Unix(), publishedAt, b.TagsText)
+			if err != nil {
+				return fmt.Errorf("importing %s: %w", b.URL, err)
+			}
+			if err := updateTags(tx, b); err != nil {
+				return fmt.Errorf("importing tags for %s: %w", b.URL, err)
+			}
+			count++
+		}
+
+		_, err := tx.Exec(`insert into bookmark_fts(bookmark_fts) values ('rebuild')`)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
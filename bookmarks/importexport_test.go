@@ -0,0 +1,149 @@
+package bookmarks
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const netscapeFile = `<!DOCTYPE NETSCAPE-Bookmark-file-1>
+<META HTTP-EQUIV="Content-Type" CONTENT="text/html; charset=UTF-8">
+<TITLE>Bookmarks</TITLE>
+<H1>Bookmarks</H1>
+<DL><p>
+    <DT><H3 ADD_DATE="1500000000">Reading</H3>
+    <DL><p>
+        <DT><A HREF="https://example.com/a" ADD_DATE="1600000000" PRIVATE="0" TAGS="go,db">Article &amp; more</A>
+        <DD>A long
+description
+        <DT><A HREF="https://example.com/b" ADD_DATE="1600000100" PRIVATE="1">Private</A>
+    </DL><p>
+    <DT><A HREF="javascript:alert(1)">Bookmarklet</A>
+</DL><p>
+`
+
+const pinboardFile = `[
+{"href":"https://example.com/a","description":"Article","extended":"notes","meta":"x","hash":"y",
+ "time":"2020-09-13T12:26:40Z","shared":"yes","toread":"no","tags":"go db"},
+{"href":"https://example.com/c","description":"Other","extended":"",
+ "time":"2021-01-01T00:00:00Z","shared":"no","toread":"yes","tags":""}
+]`
+
+const raindropFile = `id,title,note,excerpt,url,folder,tags,created,cover,highlights,favorite
+1,Article,,An excerpt,https://example.com/a,Unsorted,"go, db",2020-09-13T12:26:40.000Z,,,false
+2,Other,A note,,https://example.com/c,Unsorted,,2021-01-01T00:00:00.000Z,,,false
+`
+
+func TestParse(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	assert.Equal(FormatNetscape, DetectFormat([]byte(netscapeFile)))
+	assert.Equal(FormatPinboard, DetectFormat([]byte(pinboardFile)))
+	assert.Equal(FormatRaindrop, DetectFormat([]byte(raindropFile)))
+
+	bs, err := Parse(FormatNetscape, strings.NewReader(netscapeFile))
+	require.NoError(err)
+	require.Len(bs, 3)
+	assert.Equal("https://example.com/a", bs[0].URL)
+	assert.Equal("Article & more", bs[0].Title)
+	assert.Equal("A long\ndescription", bs[0].Description)
+	assert.Equal([]string{"go", "db"}, bs[0].Tags)
+	assert.Equal(int64(1600000000), bs[0].CreatedAt.Unix())
+	assert.Equal(1, bs[0].Published)
+	assert.Equal(0, bs[1].Published)
+	assert.Equal("", bs[1].Description)
+	assert.Equal(0, bs[2].Published, "bookmarks without PRIVATE are not published")
+
+	bs, err = Parse(FormatPinboard, strings.NewReader(pinboardFile))
+	require.NoError(err)
+	require.Len(bs, 2)
+	assert.Equal("Article", bs[0].Title)
+	assert.Equal("notes", bs[0].Description)
+	assert.Equal([]string{"go", "db"}, bs[0].Tags)
+	assert.Equal(int64(1600000000), bs[0].CreatedAt.Unix())
+	assert.Equal(1, bs[0].Published)
+	assert.Equal(0, bs[1].Published)
+
+	bs, err = Parse(FormatRaindrop, strings.NewReader(raindropFile))
+	require.NoError(err)
+	require.Len(bs, 2)
+	assert.Equal("An excerpt", bs[0].Description)
+	assert.Equal("A note", bs[1].Description)
+	assert.Equal([]string{"go", "db"}, bs[0].Tags)
+	assert.Equal(int64(1600000000), bs[0].CreatedAt.Unix())
+}
+
+func TestExportRoundTrip(t *testing.T) {
+	created := time.Unix(1600000000, 0)
+	bookmarks := []Bookmark{
+		{URL: "https://example.com/a?x=1&y=2", Title: `A "quoted" <title>`, Description: "desc",
+			Published: 1, CreatedAt: created, Tags: []string{"go", "db"}},
+		{URL: "https://example.com/b", Title: "B", CreatedAt: created},
+	}
+
+	for _, f := range Formats {
+		var buf bytes.Buffer
+		require.NoError(t, Export(f, &buf, bookmarks), f)
+		assert.Equal(t, f, DetectFormat(buf.Bytes()), f)
+
+		parsed, err := Parse(f, &buf)
+		require.NoError(t, err, f)
+		require.Len(t, parsed, 2, f)
+		assert.Equal(t, bookmarks[0].URL, parsed[0].URL, f)
+		assert.Equal(t, bookmarks[0].Title, parsed[0].Title, f)
+		assert.Equal(t, bookmarks[0].Description, parsed[0].Description, f)
+		assert.Equal(t, bookmarks[0].Tags, parsed[0].Tags, f)
+		assert.Equal(t, created.Unix(), parsed[0].CreatedAt.Unix(), f)
+		if f != FormatRaindrop {
+			assert.Equal(t, 1, parsed[0].Published, f)
+		}
+		assert.Equal(t, 0, parsed[1].Published, f)
+	}
+}
+
+func TestImport(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	conn, err := sqlx.Connect("sqlite3", ":memory:")
+	require.NoError(err)
+	require.NoError(NewApp(conn).Migrate())
+
+	serv := NewBookmarkService(conn)
+	require.NoError(serv.Insert(&Bookmark{URL: "https://EXAMPLE.com/a/#top", Title: "Existing"}))
+
+	bs, err := Parse(FormatNetscape, strings.NewReader(netscapeFile+netscapeFile))
+	require.NoError(err)
+
+	plan, err := serv.PlanImport(bs)
+	require.NoError(err)
+	assert.Equal(1, plan.New)
+	assert.Equal(3, plan.Duplicates)
+	assert.Equal(2, plan.Invalid)
+	assert.Equal(ImportDuplicate, plan.Items[0].Status)
+	assert.NotEmpty(plan.Items[0].ExistingID)
+	assert.Equal(ImportNew, plan.Items[1].Status)
+	assert.Equal(ImportInvalid, plan.Items[2].Status)
+
+	n, err := serv.Import(plan)
+	require.NoError(err)
+	assert.Equal(1, n)
+
+	b, err := serv.GetByURL("https://example.com/b")
+	require.NoError(err)
+	assert.Equal("Private", b.Title)
+	assert.Equal(int64(1600000100), b.CreatedAt.Unix())
+	assert.Equal(0, b.Published)
+
+	// importing again finds only duplicates
+	plan, err = serv.PlanImport(bs)
+	require.NoError(err)
+	assert.Equal(0, plan.New)
+}
@@ -0,0 +1,147 @@
+package bookmarks
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/jmoiron/monet/app"
+	"github.com/jmoiron/monet/mtr"
+	"github.com/jmoiron/monet/pkg/jobs"
+)
+
+// jobListSize is how many jobs are shown on the admin jobs page
+const jobListSize = 100
+
+// MissingScreenshots returns the ids of bookmarks without a screenshot.
+func (s *BookmarkService) MissingScreenshots() ([]string, error) {
+	var ids []string
+	err := s.db.Select(&ids, `SELECT id FROM bookmark WHERE screenshot_path = '' ORDER BY created_at DESC`)
+	return ids, err
+}
+
+// MissingArchives returns the ids of bookmarks without an archived copy.
+func (s *BookmarkService) MissingArchives() ([]string, error) {
+	var ids []string
+	err := s.db.Select(&ids, `SELECT id FROM bookmark WHERE archive_path = '' ORDER BY created_at DESC`)
+	return ids, err
+}
+
+// enqueue a job for the bookmark id on queue.
+func (a *Admin) enqueue(queue, id string) (*jobs.Job, error) {
+	if a.jobs == nil {
+		return nil, fmt.Errorf("job queue unavailable")
+	}
+	return a.jobs.Enqueue(queue, id)
+}
+
+// jobList shows the status of screenshot and archive jobs.
+func (a *Admin) jobList(w http.ResponseWriter, r *http.Request) {
+	if a.jobs == nil {
+		app.Http500("listing jobs", w, fmt.Errorf("job queue unavailable"))
+		return
+	}
+	q := a.jobs.Queue()
+
+	status := r.FormValue("status")
+	list, err := q.List(status, jobListSize, 0)
+	if err != nil {
+		app.Http500("listing jobs", w, err)
+		return
+	}
+	counts, err := q.Counts()
+	if err != nil {
+		app.Http500("counting jobs", w, err)
+		return
+	}
+
+	reg := mtr.RegistryFromContext(r.Context())
+	err = reg.RenderWithBase(w, "admin-base", "bookmarks/admin/jobs.html", mtr.Ctx{
+		"jobs":     list,
+		"counts":   counts,
+		"status":   status,
+		"statuses": []string{jobs.StatusPending, jobs.StatusRunning, jobs.StatusDone, jobs.StatusFailed},
+		"queued":   r.FormValue("queued"),
+	})
+	if err != nil {
+		slog.Error("rendering jobs", "err", err)
+	}
+}
+
+// jobStatus returns the job as JSON.
+func (a *Admin) jobStatus(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if a.jobs == nil {
+		app.Http404(w)
+		return
+	}
+	job, err := a.jobs.Queue().Get(id)
+	if err != nil {
+		app.Http404(w)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(job)
+}
+
+func (a *Admin) retryJob(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if a.jobs == nil {
+		app.Http404(w)
+		return
+	}
+	if err := a.jobs.Queue().Retry(id); err != nil {
+		app.Http500("retrying job", w, err)
+		return
+	}
+	a.jobs.Notify()
+	http.Redirect(w, r, "/admin/bookmarks/jobs", http.StatusFound)
+}
+
+func (a *Admin) deleteJob(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if a.jobs == nil {
+		app.Http404(w)
+		return
+	}
+	if err := a.jobs.Queue().Delete(id); err != nil {
+		app.Http500("deleting job", w, err)
+		return
+	}
+	http.Redirect(w, r, "/admin/bookmarks/jobs", http.StatusFound)
+}
+
+// enqueueMissing enqueues a screenshot or archive job for every bookmark that
+// does not have one.
+func (a *Admin) enqueueMissing(w http.ResponseWriter, r *http.Request) {
+	serv := a.service()
+
+	var ids []string
+	var err error
+	queue := chi.URLParam(r, "queue")
+	switch queue {
+	case jobScreenshot:
+		ids, err = serv.MissingScreenshots()
+	case jobArchive:
+		ids, err = serv.MissingArchives()
+	default:
+		app.Http404(w)
+		return
+	}
+	if err != nil {
+		app.Http500("finding bookmarks", w, err)
+		return
+	}
+
+	for _, id := range ids {
+		if _, err := a.enqueue(queue, id); err != nil {
+			app.Http500("queueing jobs", w, err)
+			return
+		}
+	}
+	slog.Info("queued missing", "queue", queue, "count", len(ids))
+	http.Redirect(w, r, fmt.Sprintf("/admin/bookmarks/jobs?queued=%d", len(ids)), http.StatusFound)
+}
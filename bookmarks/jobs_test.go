@@ -0,0 +1,102 @@
+package bookmarks
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/jmoiron/monet/conf"
+	"github.com/jmoiron/monet/pkg/jobs"
+	"github.com/jmoiron/monet/pkg/vfs"
+	"github.com/jmoiron/sqlx"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJobPool(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	srv := newArchiveServer(t)
+	conn, err := sqlx.Connect("sqlite3", ":memory:")
+	require.NoError(err)
+	require.NoError(NewApp(conn).Migrate())
+
+	fss := vfs.NewRegistry(vfs.NewURLMapper(nil))
+	require.NoError(fss.AddPath("archives", t.TempDir()))
+
+	serv := NewBookmarkService(conn)
+	ok := &Bookmark{URL: srv.URL + "/page", Title: "ok"}
+	bad := &Bookmark{URL: srv.URL + "/missing", Title: "missing"}
+	require.NoError(serv.Insert(ok))
+	require.NoError(serv.Insert(bad))
+
+	missing, err := serv.MissingArchives()
+	require.NoError(err)
+	assert.ElementsMatch([]string{ok.ID, bad.ID}, missing)
+
+	pool := newJobPool(conn, fss, NewArchiver(), NewMetadataFetcher(), conf.Default().Bookmarks)
+	for _, id := range missing {
+		_, err := pool.Enqueue(jobArchive, id)
+		require.NoError(err)
+	}
+	// without a screenshots directory, screenshot jobs fail and are retried
+	shot, err := pool.Enqueue(jobScreenshot, ok.ID)
+	require.NoError(err)
+
+	for {
+		ran, err := pool.RunOne(context.Background())
+		require.NoError(err)
+		if !ran {
+			break
+		}
+	}
+
+	missing, err = serv.MissingArchives()
+	require.NoError(err)
+	assert.Equal([]string{bad.ID}, missing)
+
+	counts, err := pool.Queue().Counts()
+	require.NoError(err)
+	assert.Contains(counts, jobs.Count{Queue: jobArchive, Status: jobs.StatusDone, Count: 1})
+	assert.Contains(counts, jobs.Count{Queue: jobArchive, Status: jobs.StatusPending, Count: 1})
+
+	job, err := pool.Queue().Get(shot.ID)
+	require.NoError(err)
+	assert.Equal(jobs.StatusPending, job.Status)
+	assert.Equal(1, job.Attempts)
+	assert.Contains(job.LastError, "screenshots directory not configured")
+}
+
+func TestAdminCreateJobs(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	conn, err := sqlx.Connect("sqlite3", ":memory:")
+	require.NoError(err)
+	require.NoError(NewApp(conn).Migrate())
+
+	cfg := conf.Default().Bookmarks
+	cfg.ScreenshotBackend = "fake"
+	fss := vfs.NewRegistry(vfs.NewURLMapper(nil))
+	pool := newJobPool(conn, fss, NewArchiver(), NewMetadataFetcher(), cfg)
+	a := NewBookmarkAdmin(conn, fss).withConfig(cfg).withJobs(pool)
+
+	// creating a bookmark doesn't wait for its page
+	form := url.Values{"url": {"https://example.com/article"}}
+	req := httptest.NewRequest("POST", "/bookmarks/create/", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	a.create(rec, req)
+	require.Equal(http.StatusFound, rec.Code)
+
+	counts, err := pool.Queue().Counts()
+	require.NoError(err)
+	for _, queue := range []string{jobMetadata, jobArchive, jobScreenshot} {
+		assert.Contains(counts, jobs.Count{Queue: queue, Status: jobs.StatusPending, Count: 1})
+	}
+}
@@ -0,0 +1,328 @@
+package bookmarks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/html"
+)
+
+// metadataTimeout is how long fetching a page's metadata may take when a
+// bookmark is created.
+const metadataTimeout = 10 * time.Second
+
+// Metadata describes a page.  It's gathered from the page's title, meta
+// tags, OpenGraph and Twitter card properties, link tags and JSON-LD.
+// Urls are absolute.
+type Metadata struct {
+	Title        string
+	Description  string
+	SiteName     string
+	ImageURL     string
+	CanonicalURL string
+	FaviconURL   string
+	Author       string
+	PublishedAt  time.Time
+}
+
+// A MetadataFetcher fetches pages and extracts their Metadata.
+type MetadataFetcher struct {
+	Client    *http.Client
+	UserAgent string
+	// MaxPageSize is the most of a page that is read.
+	MaxPageSize int64
+}
+
+// NewMetadataFetcher returns a MetadataFetcher with sensible limits.
+func NewMetadataFetcher() *MetadataFetcher {
+	return &MetadataFetcher{
+		Client:      &http.Client{Timeout: metadataTimeout},
+		UserAgent:   "monet-bookmarks/1.0",
+		MaxPageSize: 2 << 20,
+	}
+}
+
+// Fetch the page at pageURL and return its metadata.
+func (f *MetadataFetcher) Fetch(ctx context.Context, pageURL string) (*Metadata, error) {
+	body, final, ctype, err := fetchURL(ctx, f.Client, f.UserAgent, pageURL, f.MaxPageSize)
+	if err != nil {
+		return nil, err
+	}
+	if mt, _, _ := mime.ParseMediaType(ctype); mt != "text/html" && mt != "application/xhtml+xml" {
+		return nil, fmt.Errorf("no metadata in %s content", ctype)
+	}
+	return ParseMetadata(bytes.NewReader(body), final)
+}
+
+// ParseMetadata extracts metadata from the html page in r, which was fetched
+// from base.  When a field is found in more than one place, OpenGraph is
+// preferred, then Twitter cards, then JSON-LD, then plain html.
+func ParseMetadata(r io.Reader, base *url.URL) (*Metadata, error) {
+	doc, err := html.Parse(r)
+	if err != nil {
+		return nil, fmt.Errorf("parsing page: %w", err)
+	}
+
+	p := &metaParser{base: base, meta: map[string]string{}}
+	p.walk(doc)
+	if href := findBase(doc); href != "" {
+		p.base = p.resolveURL(href)
+	}
+
+	m := &Metadata{
+		Title:        firstNonEmpty(p.meta["og:title"], p.meta["twitter:title"], p.ld.Headline, p.title),
+		Description:  firstNonEmpty(p.meta["og:description"], p.meta["twitter:description"], p.ld.Description, p.meta["description"]),
+		SiteName:     firstNonEmpty(p.meta["og:site_name"], p.meta["application-name"]),
+		ImageURL:     p.resolve(firstNonEmpty(p.meta["og:image"], p.meta["og:image:url"], p.meta["twitter:image"], p.meta["twitter:image:src"], p.ld.Image)),
+		CanonicalURL: p.resolve(firstNonEmpty(p.canonical, p.meta["og:url"])),
+		FaviconURL:   p.resolve(firstNonEmpty(p.icon, "/favicon.ico")),
+		Author:       firstNonEmpty(p.meta["author"], p.meta["article:author"], p.ld.Author, p.meta["twitter:creator"]),
+	}
+	for _, date := range []string{p.meta["article:published_time"], p.ld.DatePublished, p.meta["date"], p.meta["pubdate"]} {
+		if t, ok := parseDate(date); ok {
+			m.PublishedAt = t
+			break
+		}
+	}
+	// article:author is often a profile url rather than a name
+	if strings.HasPrefix(m.Author, "http://") || strings.HasPrefix(m.Author, "https://") {
+		m.Author = firstNonEmpty(p.ld.Author, p.meta["twitter:creator"])
+	}
+	return m, nil
+}
+
+type metaParser struct {
+	base *url.URL
+	// meta maps lowercase meta names and properties to their content; the
+	// first value for each wins.
+	meta      map[string]string
+	title     string
+	canonical string
+	icon      string
+	iconRank  int
+	ld        ldArticle
+}
+
+func (p *metaParser) walk(n *html.Node) {
+	if n.Type == html.ElementNode {
+		switch n.Data {
+		case "title":
+			if p.title == "" && n.FirstChild != nil {
+				p.title = collapseSpace(n.FirstChild.Data)
+			}
+		case "meta":
+			key := strings.ToLower(firstNonEmpty(getAttr(n, "property"), getAttr(n, "name"), getAttr(n, "itemprop")))
+			content := strings.TrimSpace(getAttr(n, "content"))
+			if key != "" && content != "" && p.meta[key] == "" {
+				p.meta[key] = content
+			}
+		case "link":
+			p.link(n)
+		case "script":
+			if strings.EqualFold(getAttr(n, "type"), "application/ld+json") && n.FirstChild != nil {
+				p.jsonLD(n.FirstChild.Data)
+			}
+		}
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		p.walk(c)
+	}
+}
+
+// iconRels ranks the link rels that name a favicon.
+var iconRels = map[string]int{"icon": 3, "shortcut icon": 2, "apple-touch-icon": 1}
+
+func (p *metaParser) link(n *html.Node) {
+	rel := strings.ToLower(strings.TrimSpace(getAttr(n, "rel")))
+	href := strings.TrimSpace(getAttr(n, "href"))
+	if href == "" {
+		return
+	}
+	if rel == "canonical" && p.canonical == "" {
+		p.canonical = href
+	}
+	if rank := iconRels[rel]; rank > p.iconRank {
+		p.icon, p.iconRank = href, rank
+	}
+}
+
+func (p *metaParser) resolveURL(ref string) *url.URL {
+	u, err := url.Parse(ref)
+	if err != nil {
+		return p.base
+	}
+	if p.base == nil {
+		return u
+	}
+	return p.base.ResolveReference(u)
+}
+
+// resolve returns ref as an absolute http(s) url, or "" if it isn't one.
+func (p *metaParser) resolve(ref string) string {
+	if ref == "" {
+		return ""
+	}
+	u := p.resolveURL(ref)
+	if u == nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return ""
+	}
+	return u.String()
+}
+
+// ldArticle is the subset of a JSON-LD Article used for metadata.
+type ldArticle struct {
+	Headline      string
+	Description   string
+	Image         string
+	Author        string
+	DatePublished string
+}
+
+// articleTypes are the JSON-LD types that describe an article.
+var articleTypes = map[string]bool{
+	"article": true, "newsarticle": true, "blogposting": true, "techarticle": true,
+	"scholarlyarticle": true,
+}
+
+// jsonLD reads the first Article in a JSON-LD script.  Scripts may hold an
+// object, an array of objects, or an object with a @graph.
+func (p *metaParser) jsonLD(text string) {
+	if p.ld.Headline != "" {
+		return
+	}
+	var data any
+	if err := json.Unmarshal([]byte(text), &data); err != nil {
+		return
+	}
+
+	var find func(v any) map[string]any
+	find = func(v any) map[string]any {
+		switch v := v.(type) {
+		case []any:
+			for _, item := range v {
+				if obj := find(item); obj != nil {
+					return obj
+				}
+			}
+		case map[string]any:
+			for _, t := range ldStrings(v["@type"]) {
+				if articleTypes[strings.ToLower(t)] {
+					return v
+				}
+			}
+			return find(v["@graph"])
+		}
+		return nil
+	}
+
+	obj := find(data)
+	if obj == nil {
+		return
+	}
+	p.ld = ldArticle{
+		Headline:      firstNonEmpty(ldStrings(obj["headline"])...),
+		Description:   firstNonEmpty(ldStrings(obj["description"])...),
+		Image:         firstNonEmpty(ldStrings(obj["image"])...),
+		Author:        strings.Join(ldStrings(obj["author"]), ", "),
+		DatePublished: firstNonEmpty(ldStrings(obj["datePublished"])...),
+	}
+}
+
+// ldStrings returns the strings in a JSON-LD value, which may be a string,
+// an object with a name or url, or an array of either.
+func ldStrings(v any) []string {
+	switch v := v.(type) {
+	case string:
+		if s := strings.TrimSpace(v); s != "" {
+			return []string{s}
+		}
+	case map[string]any:
+		for _, key := range []string{"name", "url", "@id"} {
+			if s, ok := v[key].(string); ok && strings.TrimSpace(s) != "" {
+				return []string{strings.TrimSpace(s)}
+			}
+		}
+	case []any:
+		var out []string
+		for _, item := range v {
+			out = append(out, ldStrings(item)...)
+		}
+		return out
+	}
+	return nil
+}
+
+var dateLayouts = []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02T15:04", "2006-01-02", time.RFC1123Z, time.RFC1123}
+
+func parseDate(s string) (time.Time, bool) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return time.Time{}, false
+	}
+	for _, layout := range dateLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t.UTC(), true
+		}
+	}
+	return time.Time{}, false
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v = strings.TrimSpace(v); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+func collapseSpace(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// ApplyMetadata fills in b from m.  The title and description are only set
+// if b doesn't have them already.
+func (b *Bookmark) ApplyMetadata(m *Metadata) {
+	if m.Title != "" && (b.Title == "" || b.Title == b.URL) {
+		b.Title = m.Title
+	}
+	if b.Description == "" {
+		b.Description = m.Description
+	}
+	b.SiteName = m.SiteName
+	b.ImageURL = m.ImageURL
+	b.CanonicalURL = m.CanonicalURL
+	b.FaviconURL = m.FaviconURL
+	b.Author = m.Author
+	b.PagePublishedAt = m.PublishedAt
+}
+
+// HasPagePublishedAt returns true if the page's publication date is known.
+func (b *Bookmark) HasPagePublishedAt() bool {
+	return b.PagePublishedAt.Unix() > 0
+}
+
+// fetchMetadata fills in b with the metadata of its page.  Failures are
+// not fatal to creating a bookmark, so they are only returned for logging.
+func fetchMetadata(ctx context.Context, fetcher *MetadataFetcher, b *Bookmark) error {
+	if fetcher == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, metadataTimeout)
+	defer cancel()
+
+	m, err := fetcher.Fetch(ctx, b.URL)
+	if err != nil {
+		return err
+	}
+	b.ApplyMetadata(m)
+	return nil
+}
@@ -0,0 +1,145 @@
+package bookmarks
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const richPage = `<!doctype html>
+<html><head>
+<title>Plain Title</title>
+<meta name="description" content="plain description">
+<meta property="og:title" content="OG Title">
+<meta property="og:description" content="og description">
+<meta property="og:site_name" content="Example News">
+<meta property="og:image" content="/images/lead.jpg">
+<meta name="twitter:title" content="Twitter Title">
+<meta name="twitter:creator" content="@writer">
+<meta property="article:published_time" content="2024-03-05T10:30:00+01:00">
+<link rel="canonical" href="/articles/42">
+<link rel="apple-touch-icon" href="/touch.png">
+<link rel="icon" href="/favicon.png">
+<script type="application/ld+json">
+{"@context": "https://schema.org", "@graph": [
+  {"@type": "WebSite", "name": "Example"},
+  {"@type": ["NewsArticle"], "headline": "LD Headline", "author": [{"@type": "Person", "name": "Ada Lovelace"}, {"name": "Charles Babbage"}]}
+]}
+</script>
+</head><body><p>Hello</p></body></html>`
+
+const ldPage = `<html><head>
+<title>
+  Only a
+  Title
+</title>
+<meta name="description" content="plain description">
+<script type="application/ld+json">[{"@type": "BlogPosting", "headline": "LD Headline",
+  "description": "ld description", "image": {"url": "https://cdn.example.com/a.png"},
+  "author": "Grace Hopper", "datePublished": "2023-11-02"}]</script>
+<script type="application/ld+json">not json</script>
+</head></html>`
+
+func newMetadataServer(t *testing.T) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/rich", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte(richPage))
+	})
+	mux.HandleFunc("/ld", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(ldPage))
+	})
+	mux.HandleFunc("/file.pdf", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/pdf")
+		w.Write([]byte("%PDF-1.4"))
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestFetchMetadata(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	srv := newMetadataServer(t)
+	f := NewMetadataFetcher()
+
+	m, err := f.Fetch(context.Background(), srv.URL+"/rich")
+	require.NoError(err)
+	assert.Equal("OG Title", m.Title)
+	assert.Equal("og description", m.Description)
+	assert.Equal("Example News", m.SiteName)
+	assert.Equal(srv.URL+"/images/lead.jpg", m.ImageURL)
+	assert.Equal(srv.URL+"/articles/42", m.CanonicalURL)
+	assert.Equal(srv.URL+"/favicon.png", m.FaviconURL)
+	assert.Equal("Ada Lovelace, Charles Babbage", m.Author)
+	assert.Equal(time.Date(2024, 3, 5, 9, 30, 0, 0, time.UTC), m.PublishedAt)
+
+	m, err = f.Fetch(context.Background(), srv.URL+"/ld")
+	require.NoError(err)
+	assert.Equal("LD Headline", m.Title)
+	assert.Equal("ld description", m.Description)
+	assert.Equal("https://cdn.example.com/a.png", m.ImageURL)
+	assert.Equal("Grace Hopper", m.Author)
+	assert.Equal("", m.CanonicalURL)
+	assert.Equal(srv.URL+"/favicon.ico", m.FaviconURL)
+	assert.Equal(time.Date(2023, 11, 2, 0, 0, 0, 0, time.UTC), m.PublishedAt)
+
+	_, err = f.Fetch(context.Background(), srv.URL+"/file.pdf")
+	assert.Error(err)
+	_, err = f.Fetch(context.Background(), srv.URL+"/missing")
+	assert.Error(err)
+}
+
+func TestParseMetadataTitle(t *testing.T) {
+	base, _ := url.Parse("https://example.com/a/b")
+	m, err := ParseMetadata(strings.NewReader(`<title> A   spaced
+		title </title><link rel="shortcut icon" href="icon.ico">`), base)
+	require.NoError(t, err)
+	assert.Equal(t, "A spaced title", m.Title)
+	assert.Equal(t, "https://example.com/a/icon.ico", m.FaviconURL)
+	assert.Equal(t, "", m.Description)
+}
+
+func TestApplyMetadata(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	srv := newMetadataServer(t)
+	conn, err := sqlx.Connect("sqlite3", ":memory:")
+	require.NoError(err)
+	require.NoError(NewApp(conn).Migrate())
+
+	// titles and descriptions that were given are kept
+	b := &Bookmark{URL: srv.URL + "/rich", Title: "My Title"}
+	require.NoError(fetchMetadata(context.Background(), NewMetadataFetcher(), b))
+	assert.Equal("My Title", b.Title)
+	assert.Equal("og description", b.Description)
+
+	serv := NewBookmarkService(conn)
+	require.NoError(serv.Insert(b))
+	saved, err := serv.GetByID(b.ID)
+	require.NoError(err)
+	assert.Equal("Example News", saved.SiteName)
+	assert.Equal("Ada Lovelace, Charles Babbage", saved.Author)
+	assert.Equal(srv.URL+"/articles/42", saved.CanonicalURL)
+	assert.True(saved.HasPagePublishedAt())
+	assert.Equal(b.PagePublishedAt.Unix(), saved.PagePublishedAt.Unix())
+
+	other := &Bookmark{URL: "https://example.com/"}
+	require.NoError(serv.Insert(other))
+	other, err = serv.GetByID(other.ID)
+	require.NoError(err)
+	assert.False(other.HasPagePublishedAt())
+}
@@ -6,6 +6,7 @@ import (
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/jmoiron/monet/conf"
 	"github.com/jmoiron/monet/db"
 	"github.com/jmoiron/monet/db/monarch"
 	"github.com/jmoiron/monet/mtr"
@@ -77,12 +78,181 @@ var bookmarkMigrations = monarch.Set{
 			Up:   `ALTER TABLE bookmark ADD COLUMN icon_path text DEFAULT '';`,
 			Down: `ALTER TABLE bookmark DROP COLUMN icon_path;`,
 		},
+		{
+			Up: `CREATE TABLE IF NOT EXISTS bookmark_tag (
+				bookmark_id text NOT NULL,
+				tag text NOT NULL,
+				PRIMARY KEY (bookmark_id, tag)
+			);
+			CREATE INDEX IF NOT EXISTS idx_bookmark_tag_tag ON bookmark_tag(tag);
+			CREATE TRIGGER bookmark_tag_d AFTER DELETE ON bookmark BEGIN
+				DELETE FROM bookmark_tag WHERE bookmark_id = old.id;
+			END;`,
+			Down: `DROP TRIGGER bookmark_tag_d; DROP TABLE bookmark_tag;`,
+		},
+		{
+			// tags are denormalized onto the bookmark so that they can be
+			// indexed for full text search
+			Up:   `ALTER TABLE bookmark ADD COLUMN tags text NOT NULL DEFAULT '';`,
+			Down: `ALTER TABLE bookmark DROP COLUMN tags;`,
+		},
+		{
+			Up: `DROP TRIGGER bookmark_i;
+			DROP TRIGGER bookmark_d;
+			DROP TRIGGER bookmark_u;
+			DROP TABLE bookmark_fts;
+			CREATE VIRTUAL TABLE bookmark_fts USING fts5(
+				id UNINDEXED, title, url, description, tags, published,
+				content='bookmark',
+				tokenize="trigram"
+			);
+			INSERT INTO bookmark_fts(bookmark_fts) VALUES ('rebuild');
+			CREATE TRIGGER bookmark_i AFTER INSERT ON bookmark BEGIN
+				INSERT INTO bookmark_fts (id, title, url, description, tags, published) VALUES
+					(new.id, new.title, new.url, new.description, new.tags, new.published);
+			END;
+			CREATE TRIGGER bookmark_d AFTER DELETE ON bookmark BEGIN
+				INSERT INTO bookmark_fts (bookmark_fts, id, title, url, description, tags, published) VALUES
+					('delete', old.id, old.title, old.url, old.description, old.tags, old.published);
+			END;
+			CREATE TRIGGER bookmark_u AFTER UPDATE ON bookmark BEGIN
+				INSERT INTO bookmark_fts (bookmark_fts, id, title, url, description, tags, published) VALUES
+					('delete', old.id, old.title, old.url, old.description, old.tags, old.published);
+				INSERT INTO bookmark_fts (id, title, url, description, tags, published) VALUES
+					(new.id, new.title, new.url, new.description, new.tags, new.published);
+			END;`,
+			Down: `DROP TRIGGER bookmark_i;
+			DROP TRIGGER bookmark_d;
+			DROP TRIGGER bookmark_u;
+			DROP TABLE bookmark_fts;
+			CREATE VIRTUAL TABLE bookmark_fts USING fts5(
+				id UNINDEXED, title, url, description, published,
+				content='bookmark',
+				tokenize="trigram"
+			);
+			INSERT INTO bookmark_fts(bookmark_fts) VALUES ('rebuild');
+			CREATE TRIGGER bookmark_i AFTER INSERT ON bookmark BEGIN
+				INSERT INTO bookmark_fts (id, title, url, description, published) VALUES
+					(new.id, new.title, new.url, new.description, new.published);
+			END;
+			CREATE TRIGGER bookmark_d AFTER DELETE ON bookmark BEGIN
+				INSERT INTO bookmark_fts (bookmark_fts, id, title, url, description, published) VALUES
+					('delete', old.id, old.title, old.url, old.description, old.published);
+			END;
+			CREATE TRIGGER bookmark_u AFTER UPDATE ON bookmark BEGIN
+				INSERT INTO bookmark_fts (bookmark_fts, id, title, url, description, published) VALUES
+					('delete', old.id, old.title, old.url, old.description, old.published);
+				INSERT INTO bookmark_fts (id, title, url, description, published) VALUES
+					(new.id, new.title, new.url, new.description, new.published);
+			END;`,
+		},
+		{
+			Up: `ALTER TABLE bookmark ADD COLUMN archive_path text NOT NULL DEFAULT '';
+			ALTER TABLE bookmark ADD COLUMN archive_status text NOT NULL DEFAULT '';
+			ALTER TABLE bookmark ADD COLUMN archive_error text NOT NULL DEFAULT '';
+			ALTER TABLE bookmark ADD COLUMN archive_text text NOT NULL DEFAULT '';
+			ALTER TABLE bookmark ADD COLUMN archived_at datetime DEFAULT 0;`,
+			Down: `ALTER TABLE bookmark DROP COLUMN archive_path;
+			ALTER TABLE bookmark DROP COLUMN archive_status;
+			ALTER TABLE bookmark DROP COLUMN archive_error;
+			ALTER TABLE bookmark DROP COLUMN archive_text;
+			ALTER TABLE bookmark DROP COLUMN archived_at;`,
+		},
+		{
+			// index the text of archived pages
+			Up: `DROP TRIGGER bookmark_i;
+			DROP TRIGGER bookmark_d;
+			DROP TRIGGER bookmark_u;
+			DROP TABLE bookmark_fts;
+			CREATE VIRTUAL TABLE bookmark_fts USING fts5(
+				id UNINDEXED, title, url, description, tags, archive_text, published,
+				content='bookmark',
+				tokenize="trigram"
+			);
+			INSERT INTO bookmark_fts(bookmark_fts) VALUES ('rebuild');
+			CREATE TRIGGER bookmark_i AFTER INSERT ON bookmark BEGIN
+				INSERT INTO bookmark_fts (id, title, url, description, tags, archive_text, published) VALUES
+					(new.id, new.title, new.url, new.description, new.tags, new.archive_text, new.published);
+			END;
+			CREATE TRIGGER bookmark_d AFTER DELETE ON bookmark BEGIN
+				INSERT INTO bookmark_fts (bookmark_fts, id, title, url, description, tags, archive_text, published) VALUES
+					('delete', old.id, old.title, old.url, old.description, old.tags, old.archive_text, old.published);
+			END;
+			CREATE TRIGGER bookmark_u AFTER UPDATE ON bookmark BEGIN
+				INSERT INTO bookmark_fts (bookmark_fts, id, title, url, description, tags, archive_text, published) VALUES
+					('delete', old.id, old.title, old.url, old.description, old.tags, old.archive_text, old.published);
+				INSERT INTO bookmark_fts (id, title, url, description, tags, archive_text, published) VALUES
+					(new.id, new.title, new.url, new.description, new.tags, new.archive_text, new.published);
+			END;`,
+			Down: `DROP TRIGGER bookmark_i;
+			DROP TRIGGER bookmark_d;
+			DROP TRIGGER bookmark_u;
+			DROP TABLE bookmark_fts;
+			CREATE VIRTUAL TABLE bookmark_fts USING fts5(
+				id UNINDEXED, title, url, description, tags, published,
+				content='bookmark',
+				tokenize="trigram"
+			);
+			INSERT INTO bookmark_fts(bookmark_fts) VALUES ('rebuild');
+			CREATE TRIGGER bookmark_i AFTER INSERT ON bookmark BEGIN
+				INSERT INTO bookmark_fts (id, title, url, description, tags, published) VALUES
+					(new.id, new.title, new.url, new.description, new.tags, new.published);
+			END;
+			CREATE TRIGGER bookmark_d AFTER DELETE ON bookmark BEGIN
+				INSERT INTO bookmark_fts (bookmark_fts, id, title, url, description, tags, published) VALUES
+					('delete', old.id, old.title, old.url, old.description, old.tags, old.published);
+			END;
+			CREATE TRIGGER bookmark_u AFTER UPDATE ON bookmark BEGIN
+				INSERT INTO bookmark_fts (bookmark_fts, id, title, url, description, tags, published) VALUES
+					('delete', old.id, old.title, old.url, old.description, old.tags, old.published);
+				INSERT INTO bookmark_fts (id, title, url, description, tags, published) VALUES
+					(new.id, new.title, new.url, new.description, new.tags, new.published);
+			END;`,
+		},
+		{
+			// existing bookmarks are normalized by NormalizeURLs after migrating
+			Up: `ALTER TABLE bookmark ADD COLUMN normalized_url text NOT NULL DEFAULT '';
+			CREATE UNIQUE INDEX IF NOT EXISTS bookmark_normalized_url ON bookmark(normalized_url)
+				WHERE normalized_url != '';`,
+			Down: `DROP INDEX bookmark_normalized_url;
+			ALTER TABLE bookmark DROP COLUMN normalized_url;`,
+		},
+		{
+			Up: `ALTER TABLE bookmark ADD COLUMN site_name text NOT NULL DEFAULT '';
+			ALTER TABLE bookmark ADD COLUMN image_url text NOT NULL DEFAULT '';
+			ALTER TABLE bookmark ADD COLUMN canonical_url text NOT NULL DEFAULT '';
+			ALTER TABLE bookmark ADD COLUMN favicon_url text NOT NULL DEFAULT '';
+			ALTER TABLE bookmark ADD COLUMN author text NOT NULL DEFAULT '';
+			ALTER TABLE bookmark ADD COLUMN page_published_at datetime DEFAULT 0;`,
+			Down: `ALTER TABLE bookmark DROP COLUMN site_name;
+			ALTER TABLE bookmark DROP COLUMN image_url;
+			ALTER TABLE bookmark DROP COLUMN canonical_url;
+			ALTER TABLE bookmark DROP COLUMN favicon_url;
+			ALTER TABLE bookmark DROP COLUMN author;
+			ALTER TABLE bookmark DROP COLUMN page_published_at;`,
+		},
+		{
+			Up: `ALTER TABLE bookmark ADD COLUMN read_state text NOT NULL DEFAULT '';
+			ALTER TABLE bookmark ADD COLUMN read_at datetime DEFAULT 0;
+			ALTER TABLE bookmark ADD COLUMN notes text NOT NULL DEFAULT '';
+			CREATE INDEX IF NOT EXISTS bookmark_read_state ON bookmark(read_state, created_at);`,
+			Down: `DROP INDEX bookmark_read_state;
+			ALTER TABLE bookmark DROP COLUMN read_state;
+			ALTER TABLE bookmark DROP COLUMN read_at;
+			ALTER TABLE bookmark DROP COLUMN notes;`,
+		},
+		{
+			// a copy of the page kept elsewhere, eg. on archive.org
+			Up:   `ALTER TABLE bookmark ADD COLUMN archive_url text NOT NULL DEFAULT '';`,
+			Down: `ALTER TABLE bookmark DROP COLUMN archive_url;`,
+		},
 	},
 }
 
 type Bookmark struct {
 	ID                  string
 	URL                 string
+	NormalizedURL       string `db:"normalized_url"`
 	Title               string
 	Description         string
 	DescriptionRendered string `db:"description_rendered"`
@@ -92,11 +262,40 @@ type Bookmark struct {
 	CreatedAt           time.Time `db:"created_at"`
 	UpdatedAt           time.Time `db:"updated_at"`
 	PublishedAt         time.Time `db:"published_at"`
+	// Tags are stored in the bookmark_tag table, and space separated in
+	// TagsText so that they can be searched.
+	Tags     []string `db:"-"`
+	TagsText string   `db:"tags"`
+	// An archived copy of the page, and the result of the last attempt to
+	// archive it.  ArchiveText is indexed for search.
+	ArchivePath   string    `db:"archive_path"`
+	ArchiveStatus string    `db:"archive_status"`
+	ArchiveError  string    `db:"archive_error"`
+	ArchiveText   string    `db:"archive_text"`
+	ArchivedAt    time.Time `db:"archived_at"`
+	// ArchiveURL is a copy of the page kept elsewhere, such as on
+	// archive.org, for when the page itself is gone.
+	ArchiveURL string `db:"archive_url"`
+	// Metadata from the page itself; see ApplyMetadata.
+	SiteName        string    `db:"site_name"`
+	ImageURL        string    `db:"image_url"`
+	CanonicalURL    string    `db:"canonical_url"`
+	FaviconURL      string    `db:"favicon_url"`
+	Author          string    `db:"author"`
+	PagePublishedAt time.Time `db:"page_published_at"`
+	// The bookmark's place on the private reading list, and private notes
+	// or highlights about it.
+	ReadState string    `db:"read_state"`
+	ReadAt    time.Time `db:"read_at"`
+	Notes     string
 }
 
-func (b *Bookmark) preSave() {
+func (b *Bookmark) preSave(trackingParams []string) {
 	b.DescriptionRendered = mtr.RenderMarkdown(b.Description)
 	b.URL = strings.TrimSpace(b.URL)
+	b.NormalizedURL = normalizedURL(b.URL, trackingParams)
+	b.Tags = NormalizeTags(b.Tags)
+	b.TagsText = strings.Join(b.Tags, " ")
 	if !b.UpdatedAt.IsZero() {
 		b.UpdatedAt = time.Now()
 	}
@@ -108,10 +307,20 @@ func (b *Bookmark) preSave() {
 type BookmarkService struct {
 	db                db.DB
 	screenshotService *ScreenshotService
+	trackingParams    []string
 }
 
 func NewBookmarkService(db db.DB) *BookmarkService {
-	return &BookmarkService{db: db}
+	return &BookmarkService{db: db, trackingParams: conf.Default().Bookmarks.TrackingParams}
+}
+
+// WithTrackingParams sets the query parameters removed from urls when they
+// are normalized.  A nil list keeps the defaults.
+func (s *BookmarkService) WithTrackingParams(params []string) *BookmarkService {
+	if params != nil {
+		s.trackingParams = params
+	}
+	return s
 }
 
 func (s *BookmarkService) SetScreenshotService(ss *ScreenshotService) {
@@ -138,8 +347,11 @@ func (s *BookmarkService) createIconIfNeeded(b *Bookmark) {
 }
 
 func (s *BookmarkService) DeleteByID(id string) error {
-	_, err := s.db.Exec("DELETE FROM bookmark WHERE id=?", id)
-	return err
+	if _, err := s.db.Exec("DELETE FROM bookmark WHERE id=?", id); err != nil {
+		return err
+	}
+	s.syncStream(&Bookmark{ID: id})
+	return nil
 }
 
 func (s *BookmarkService) GetByID(id string) (*Bookmark, error) {
@@ -147,14 +359,19 @@ func (s *BookmarkService) GetByID(id string) (*Bookmark, error) {
 	if err := s.db.Get(&b, `SELECT * FROM bookmark WHERE id=?`, id); err != nil {
 		return nil, err
 	}
+	b.loadTags()
 	return &b, nil
 }
 
+// GetByURL returns the bookmark for url, or for any url that normalizes to
+// the same url.
 func (s *BookmarkService) GetByURL(url string) (*Bookmark, error) {
 	var b Bookmark
-	if err := s.db.Get(&b, `SELECT * FROM bookmark WHERE url=?`, url); err != nil {
+	q := `SELECT * FROM bookmark WHERE url=? OR (normalized_url != '' AND normalized_url=?) LIMIT 1`
+	if err := s.db.Get(&b, q, strings.TrimSpace(url), normalizedURL(url, s.trackingParams)); err != nil {
 		return nil, err
 	}
+	b.loadTags()
 	return &b, nil
 }
 
@@ -164,18 +381,23 @@ func (s *BookmarkService) Select(query string, args ...interface{}) ([]Bookmark,
 	if err := s.db.Select(&bookmarks, fullQuery, args...); err != nil {
 		return nil, err
 	}
+	for i := range bookmarks {
+		bookmarks[i].loadTags()
+	}
 	return bookmarks, nil
 }
 
 func (s *BookmarkService) Insert(b *Bookmark) error {
 	q := `INSERT INTO bookmark
-		(id, url, title, description, description_rendered, screenshot_path, icon_path, published) VALUES
-		(:id, :url, :title, :description, :description_rendered, :screenshot_path, :icon_path, :published);
+		(id, url, normalized_url, title, description, description_rendered, screenshot_path, icon_path, published, tags,
+		site_name, image_url, canonical_url, favicon_url, author, page_published_at, read_state, read_at, notes) VALUES
+		(:id, :url, :normalized_url, :title, :description, :description_rendered, :screenshot_path, :icon_path, :published, :tags,
+		:site_name, :image_url, :canonical_url, :favicon_url, :author, :page_published_at, :read_state, :read_at, :notes);
 	`
-	b.preSave()
+	b.preSave(s.trackingParams)
 	s.createIconIfNeeded(b)
 
-	return db.With(s.db, func(tx *sqlx.Tx) error {
+	err := db.With(s.db, func(tx *sqlx.Tx) error {
 		stmt, err := tx.PrepareNamed(q)
 		if err != nil {
 			return err
@@ -183,14 +405,25 @@ func (s *BookmarkService) Insert(b *Bookmark) error {
 		defer stmt.Close()
 
 		_, err = stmt.Exec(b)
+		if isDuplicateURL(err) {
+			return fmt.Errorf("%w: %s", ErrDuplicateURL, b.URL)
+		}
 		if err != nil {
 			return fmt.Errorf("insert %w", err)
 		}
+		if err := updateTags(tx, b); err != nil {
+			return fmt.Errorf("updateTags %w", err)
+		}
 
 		tx.Exec(`insert into bookmark_fts(bookmark_fts) values ('rebuild')`)
 
 		return nil
 	})
+	if err != nil {
+		return err
+	}
+	s.syncStream(b)
+	return nil
 }
 
 func (s *BookmarkService) Save(b *Bookmark) error {
@@ -198,14 +431,16 @@ func (s *BookmarkService) Save(b *Bookmark) error {
 		return s.Insert(b)
 	}
 
-	b.preSave()
+	b.preSave(s.trackingParams)
 	s.createIconIfNeeded(b)
 
-	return db.With(s.db, func(tx *sqlx.Tx) error {
+	err := db.With(s.db, func(tx *sqlx.Tx) error {
 		q := `UPDATE bookmark SET
-			url=:url, title=:title, description=:description, description_rendered=:description_rendered,
+			url=:url, normalized_url=:normalized_url, title=:title, description=:description, description_rendered=:description_rendered,
 			screenshot_path=:screenshot_path, icon_path=:icon_path, published=:published, updated_at=:updated_at,
-			published_at=:published_at
+			published_at=:published_at, tags=:tags, site_name=:site_name, image_url=:image_url,
+			canonical_url=:canonical_url, favicon_url=:favicon_url, author=:author, page_published_at=:page_published_at,
+			read_state=:read_state, read_at=:read_at, notes=:notes
 		WHERE id=:id`
 		update, err := tx.PrepareNamed(q)
 		if err != nil {
@@ -213,6 +448,15 @@ func (s *BookmarkService) Save(b *Bookmark) error {
 		}
 		defer update.Close()
 		_, err = update.Exec(b)
+		if isDuplicateURL(err) {
+			return fmt.Errorf("%w: %s", ErrDuplicateURL, b.URL)
+		}
+		if err != nil {
+			return err
+		}
+		if err = updateTags(tx, b); err != nil {
+			return fmt.Errorf("updateTags %w", err)
+		}
 
 		// attempt to re-build the full text search index, which seems to
 		// get corrupted by our update triggers for some reason
@@ -220,14 +464,29 @@ func (s *BookmarkService) Save(b *Bookmark) error {
 
 		return err
 	})
+	if err != nil {
+		return err
+	}
+	s.syncStream(b)
+	return nil
 }
 
-func (s *BookmarkService) Search(query string, pageSize, offset int) ([]Bookmark, error) {
+// Search returns published bookmarks that match query and have all of tags.
+// Either may be empty.  Results matching a query are ranked by relevance.
+func (s *BookmarkService) Search(query string, tags []string, pageSize, offset int) ([]Bookmark, error) {
 	var ids []string
-	searchq := fmt.Sprintf(`SELECT id FROM bookmark_fts WHERE published > 0 AND bookmark_fts
-		MATCH ? ORDER BY rank LIMIT %d OFFSET %d`, pageSize, offset)
+	searchq, args, err := searchQuery("id", query, tags)
+	if err != nil {
+		return nil, err
+	}
+	if len(query) > 0 {
+		searchq += " ORDER BY rank"
+	} else {
+		searchq += " ORDER BY created_at DESC"
+	}
+	searchq += fmt.Sprintf(" LIMIT %d OFFSET %d", pageSize, offset)
 
-	if err := s.db.Select(&ids, searchq, query); err != nil {
+	if err := s.db.Select(&ids, searchq, args...); err != nil {
 		return nil, err
 	}
 
@@ -250,15 +509,49 @@ func (s *BookmarkService) Search(query string, pageSize, offset int) ([]Bookmark
 	if err := s.db.Select(&bookmarks, q, args...); err != nil {
 		return nil, err
 	}
+	for i := range bookmarks {
+		bookmarks[i].loadTags()
+	}
 
 	return bookmarks, nil
 }
 
-func (s *BookmarkService) SearchCount(query string) (int, error) {
+// SearchCount returns the number of results Search would find.
+func (s *BookmarkService) SearchCount(query string, tags []string) (int, error) {
 	var count int
-	countq := `SELECT count(*) FROM bookmark_fts WHERE published > 0 AND bookmark_fts MATCH ?`
-	if err := s.db.Get(&count, countq, query); err != nil {
+	countq, args, err := searchQuery("count(*)", query, tags)
+	if err != nil {
+		return 0, err
+	}
+	if err := s.db.Get(&count, countq, args...); err != nil {
 		return 0, err
 	}
 	return count, nil
 }
+
+// searchQuery selects cols from published bookmarks that match query and
+// have all of tags.  Queries are run against bookmark_fts, so the results
+// can be ordered by rank.
+func searchQuery(cols, query string, tags []string) (string, []any, error) {
+	var (
+		where []string
+		args  []any
+		table = "bookmark"
+	)
+	if len(query) > 0 {
+		table = "bookmark_fts"
+		where = append(where, "bookmark_fts MATCH ?")
+		args = append(args, query)
+	}
+	if len(tags) > 0 {
+		where = append(where, `id IN (SELECT bookmark_id FROM bookmark_tag
+			WHERE tag IN (?) GROUP BY bookmark_id HAVING count(*) = ?)`)
+		args = append(args, tags, len(tags))
+	}
+
+	q := fmt.Sprintf("SELECT %s FROM %s WHERE published > 0", cols, table)
+	if len(where) > 0 {
+		q += " AND " + strings.Join(where, " AND ")
+	}
+	return sqlx.In(q, args...)
+}
@@ -0,0 +1,124 @@
+package bookmarks
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// ErrDuplicateURL is returned when saving a bookmark whose normalized url
+// is already bookmarked.
+var ErrDuplicateURL = errors.New("url is already bookmarked")
+
+// NormalizeURL returns the canonical form of rawURL that is used to detect
+// duplicate bookmarks.  The scheme and host are lowercased, default ports,
+// fragments, trailing slashes and the query parameters in trackingParams
+// are removed, and the query is sorted.  A trailing * in trackingParams
+// matches any parameter with that prefix.  Only http and https urls can be
+// normalized.
+func NormalizeURL(rawURL string, trackingParams []string) (string, error) {
+	u, err := url.Parse(strings.TrimSpace(rawURL))
+	if err != nil {
+		return "", err
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", fmt.Errorf("unsupported url scheme %q", u.Scheme)
+	}
+	if len(u.Host) == 0 {
+		return "", fmt.Errorf("url has no host")
+	}
+
+	u.Host = strings.ToLower(u.Host)
+	if host, port, err := net.SplitHostPort(u.Host); err == nil {
+		if (u.Scheme == "http" && port == "80") || (u.Scheme == "https" && port == "443") {
+			u.Host = host
+		}
+	}
+	u.Fragment = ""
+	u.RawFragment = ""
+	u.Path = strings.TrimRight(u.Path, "/")
+	u.RawPath = ""
+
+	if u.RawQuery != "" {
+		query := u.Query()
+		for key := range query {
+			if isTrackingParam(key, trackingParams) {
+				query.Del(key)
+			}
+		}
+		// Encode sorts by key
+		u.RawQuery = query.Encode()
+	}
+	u.ForceQuery = false
+	return u.String(), nil
+}
+
+func isTrackingParam(key string, trackingParams []string) bool {
+	key = strings.ToLower(key)
+	for _, p := range trackingParams {
+		p = strings.ToLower(p)
+		if prefix, ok := strings.CutSuffix(p, "*"); ok {
+			if strings.HasPrefix(key, prefix) {
+				return true
+			}
+		} else if key == p {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizedURL returns the normalized form of rawURL, or an empty string
+// if it cannot be normalized.  Bookmarks with an empty normalized url are
+// not checked for duplicates.
+func normalizedURL(rawURL string, trackingParams []string) string {
+	norm, err := NormalizeURL(rawURL, trackingParams)
+	if err != nil {
+		return ""
+	}
+	return norm
+}
+
+// isDuplicateURL returns true if err is a violation of the unique index on
+// normalized urls, the only unique index on bookmarks.
+func isDuplicateURL(err error) bool {
+	var serr sqlite3.Error
+	return errors.As(err, &serr) && serr.ExtendedCode == sqlite3.ErrConstraintUnique
+}
+
+// NormalizeURLs sets the normalized url of bookmarks that don't have one,
+// such as those saved before urls were normalized.  Bookmarks that are
+// duplicates of one that already has the normalized url are left alone.
+func (s *BookmarkService) NormalizeURLs() (int, error) {
+	var rows []struct {
+		ID  string
+		URL string
+	}
+	if err := s.db.Select(&rows, `SELECT id, url FROM bookmark WHERE normalized_url = '' ORDER BY created_at`); err != nil {
+		return 0, err
+	}
+
+	var count int
+	for _, row := range rows {
+		norm := normalizedURL(row.URL, s.trackingParams)
+		if norm == "" {
+			continue
+		}
+		_, err := s.db.Exec(`UPDATE bookmark SET normalized_url=? WHERE id=?`, norm, row.ID)
+		if isDuplicateURL(err) {
+			slog.Warn("duplicate bookmark", "id", row.ID, "url", row.URL)
+			continue
+		}
+		if err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
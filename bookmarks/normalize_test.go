@@ -0,0 +1,91 @@
+package bookmarks
+
+import (
+	"testing"
+
+	"github.com/jmoiron/monet/conf"
+	"github.com/jmoiron/sqlx"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNormalizeURL(t *testing.T) {
+	assert := assert.New(t)
+	params := conf.Default().Bookmarks.TrackingParams
+
+	tests := []struct {
+		in, out string
+	}{
+		{"https://Example.COM/Path/", "https://example.com/Path"},
+		{"HTTP://example.com:80/a#section", "http://example.com/a"},
+		{"https://example.com:443/", "https://example.com"},
+		{"https://example.com:8443/", "https://example.com:8443"},
+		{"https://example.com/a?b=2&a=1", "https://example.com/a?a=1&b=2"},
+		{"https://example.com/a?utm_source=x&utm_Medium=y&id=3&fbclid=z&GCLID=q", "https://example.com/a?id=3"},
+		{"https://example.com/a?utm_source=x", "https://example.com/a"},
+		{"https://example.com/a?", "https://example.com/a"},
+		{"  https://example.com/a  ", "https://example.com/a"},
+	}
+	for _, tc := range tests {
+		out, err := NormalizeURL(tc.in, params)
+		assert.NoError(err, tc.in)
+		assert.Equal(tc.out, out, tc.in)
+	}
+
+	for _, in := range []string{"ftp://example.com/", "javascript:alert(1)", "/relative", "https://"} {
+		_, err := NormalizeURL(in, params)
+		assert.Error(err, in)
+	}
+
+	out, _ := NormalizeURL("https://example.com/?ref=hn&utm_source=x", []string{"ref"})
+	assert.Equal("https://example.com?utm_source=x", out)
+}
+
+func TestDuplicateURLs(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	conn, err := sqlx.Connect("sqlite3", ":memory:")
+	require.NoError(err)
+	require.NoError(NewApp(conn).Migrate())
+	serv := NewBookmarkService(conn)
+
+	b := &Bookmark{URL: "https://example.com/article?id=1&utm_source=feed"}
+	require.NoError(serv.Insert(b))
+	assert.Equal("https://example.com/article?id=1", b.NormalizedURL)
+
+	found, err := serv.GetByURL("https://EXAMPLE.com/article/?utm_campaign=x&id=1#top")
+	require.NoError(err)
+	assert.Equal(b.ID, found.ID)
+
+	dupe := &Bookmark{URL: "https://example.com/article?id=1"}
+	assert.ErrorIs(serv.Insert(dupe), ErrDuplicateURL)
+
+	other := &Bookmark{URL: "https://example.com/other"}
+	require.NoError(serv.Insert(other))
+	other.URL = "https://example.com/article/?id=1"
+	assert.ErrorIs(serv.Save(other), ErrDuplicateURL)
+
+	// urls that can't be normalized aren't checked for duplicates
+	require.NoError(serv.Insert(&Bookmark{URL: "gopher://example.com/"}))
+	require.NoError(serv.Insert(&Bookmark{URL: "gopher://example.com/"}))
+
+	// bookmarks saved before normalization are backfilled, skipping duplicates
+	_, err = conn.Exec(`INSERT INTO bookmark (id, url, title, description, description_rendered, screenshot_path, icon_path) VALUES
+		('old1', 'https://old.example.com/?utm_source=x', '', '', '', '', ''),
+		('old2', 'https://OLD.example.com', '', '', '', '', '')`)
+	require.NoError(err)
+	n, err := serv.NormalizeURLs()
+	require.NoError(err)
+	assert.Equal(1, n)
+	old, err := serv.GetByID("old1")
+	require.NoError(err)
+	assert.Equal("https://old.example.com", old.NormalizedURL)
+
+	// each service removes its own tracking params
+	ref := &Bookmark{URL: "https://example.com/article?id=1&ref=hn"}
+	assert.ErrorIs(NewBookmarkService(conn).WithTrackingParams([]string{"ref"}).Insert(ref), ErrDuplicateURL)
+	require.NoError(serv.Insert(ref))
+	assert.Equal("https://example.com/article?id=1&ref=hn", ref.NormalizedURL)
+}
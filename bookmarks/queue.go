@@ -0,0 +1,158 @@
+package bookmarks
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/jmoiron/monet/conf"
+	"github.com/jmoiron/monet/db"
+	"github.com/jmoiron/monet/pkg/jobs"
+	"github.com/jmoiron/monet/pkg/vfs"
+)
+
+// Job queues that bookmark ids are enqueued on.
+const (
+	jobScreenshot = "screenshot"
+	jobArchive    = "archive"
+	jobMetadata   = "metadata"
+)
+
+// jobWorkers is how many screenshots, archives and metadata fetches can run
+// at once
+const jobWorkers = 2
+
+// newScreenshotService returns a ScreenshotService that uses the backend
+// configured in cfg and writes to the "screenshots" filesystem in fss.
+func newScreenshotService(cfg conf.BookmarksConfig, fss vfs.Registry) (*ScreenshotService, error) {
+	if fss == nil {
+		return nil, fmt.Errorf("screenshots directory not configured")
+	}
+	store, err := fss.GetWritable("screenshots")
+	if err != nil {
+		return nil, fmt.Errorf("screenshots directory not configured")
+	}
+	backend, err := NewScreenshotBackend(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if backend == nil {
+		return nil, fmt.Errorf("screenshots are disabled")
+	}
+	return NewScreenshotServiceWithStore(store, backend), nil
+}
+
+// CaptureScreenshot takes a screenshot of b with ss and saves its screenshot,
+// icon and title to b.  If b has no description, one is extracted from the
+// page's meta description and returned.
+func (s *BookmarkService) CaptureScreenshot(ctx context.Context, ss *ScreenshotService, b *Bookmark) (*ScreenshotResult, string, error) {
+	result, err := ss.TakeScreenshot(ctx, b.URL, b.ID)
+	if err != nil {
+		return result, "", err
+	}
+	if result == nil {
+		return nil, "", fmt.Errorf("screenshot service is disabled")
+	}
+	// the bookmark may have changed while the screenshot was taken, eg. by
+	// its metadata being fetched
+	if current, err := s.GetByID(b.ID); err == nil {
+		*b = *current
+	}
+
+	b.ScreenshotPath = result.ScreenshotPath
+	b.IconPath = result.IconPath
+	if b.Title == "" || b.Title == b.URL {
+		b.Title = result.Title
+	}
+
+	// If description is empty, try to extract it from the screenshot's JSON file
+	var extractedDescription string
+	if b.Description == "" {
+		if desc, err := ss.GetDescription(b.ScreenshotPath); err != nil {
+			slog.Warn("failed to extract meta description", "error", err)
+		} else if desc != "" {
+			b.Description = desc
+			extractedDescription = desc
+			slog.Info("auto-filled description from meta tag", "bookmark_id", b.ID, "description", desc)
+		}
+	}
+
+	if err := s.Save(b); err != nil {
+		slog.Error("failed to save bookmark with screenshot info", "error", err)
+		// Continue anyway, screenshot was taken successfully
+	}
+	return result, extractedDescription, nil
+}
+
+// newJobPool returns a pool that takes screenshots, archives bookmarks and
+// fetches their metadata in the background, so that requests which add
+// bookmarks don't wait on them.  Jobs are stored in the database and
+// retried with backoff if they fail.
+func newJobPool(conn db.DB, fss vfs.Registry, archiver *Archiver, fetcher *MetadataFetcher, cfg conf.BookmarksConfig) *jobs.Pool {
+	pool := jobs.NewPool(jobs.NewQueue(conn), jobWorkers)
+	timeout := time.Duration(cfg.ScreenshotTimeout) * time.Second
+	pool.Handle(jobScreenshot, timeout, func(ctx context.Context, job *jobs.Job) error {
+		return captureScreenshot(ctx, conn, fss, cfg, job.Payload)
+	})
+	pool.Handle(jobArchive, archiveTimeout, func(ctx context.Context, job *jobs.Job) error {
+		return archiveBookmark(ctx, conn, fss, archiver, job.Payload)
+	})
+	pool.Handle(jobMetadata, metadataTimeout, func(ctx context.Context, job *jobs.Job) error {
+		return updateMetadata(ctx, conn, fetcher, cfg, job.Payload)
+	})
+	return pool
+}
+
+// enqueueNew enqueues the jobs that fill in a bookmark that was just added:
+// fetching its metadata, archiving it and, if screenshots are enabled,
+// taking its screenshot.  Failures are only logged, since the bookmark is
+// saved either way.
+func enqueueNew(pool *jobs.Pool, cfg conf.BookmarksConfig, id string) {
+	if pool == nil {
+		return
+	}
+	queues := []string{jobMetadata, jobArchive}
+	if cfg.ScreenshotBackend != "" {
+		queues = append(queues, jobScreenshot)
+	}
+	for _, queue := range queues {
+		if _, err := pool.Enqueue(queue, id); err != nil {
+			slog.Error("enqueueing job", "queue", queue, "bookmark_id", id, "err", err)
+		}
+	}
+}
+
+// updateMetadata fetches the page of the bookmark id and saves its metadata.
+func updateMetadata(ctx context.Context, conn db.DB, fetcher *MetadataFetcher, cfg conf.BookmarksConfig, id string) error {
+	serv := NewBookmarkService(conn).WithTrackingParams(cfg.TrackingParams)
+	b, err := serv.GetByID(id)
+	if err != nil || fetcher == nil {
+		return err
+	}
+	m, err := fetcher.Fetch(ctx, b.URL)
+	if err != nil {
+		return err
+	}
+	// the bookmark may have changed while its page was fetched
+	if b, err = serv.GetByID(id); err != nil {
+		return err
+	}
+	b.ApplyMetadata(m)
+	return serv.Save(b)
+}
+
+// captureScreenshot takes a screenshot of the bookmark id.
+func captureScreenshot(ctx context.Context, db db.DB, fss vfs.Registry, cfg conf.BookmarksConfig, id string) error {
+	ss, err := newScreenshotService(cfg, fss)
+	if err != nil {
+		return err
+	}
+	serv := NewBookmarkService(db).WithTrackingParams(cfg.TrackingParams)
+	b, err := serv.GetByID(id)
+	if err != nil {
+		return err
+	}
+	_, _, err = serv.CaptureScreenshot(ctx, ss, b)
+	return err
+}
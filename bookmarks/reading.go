@@ -0,0 +1,225 @@
+package bookmarks
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/jmoiron/monet/app"
+	"github.com/jmoiron/monet/mtr"
+)
+
+// Reading states of a bookmark.  Bookmarks with no reading state aren't on
+// the reading list.  Reading states are private; they're never shown on the
+// public link blog.
+const (
+	ReadNone     = ""
+	ReadUnread   = "unread"
+	ReadReading  = "reading"
+	ReadRead     = "read"
+	ReadArchived = "archived"
+)
+
+// ReadStates are the reading states in the order they're shown.
+var ReadStates = []string{ReadUnread, ReadReading, ReadRead, ReadArchived}
+
+func validReadState(state string) bool {
+	if state == ReadNone {
+		return true
+	}
+	for _, s := range ReadStates {
+		if s == state {
+			return true
+		}
+	}
+	return false
+}
+
+// setReadState sets b's reading state, recording when it was read.
+func (b *Bookmark) setReadState(state string) {
+	if state == b.ReadState {
+		return
+	}
+	b.ReadState = state
+	switch state {
+	case ReadRead:
+		b.ReadAt = time.Now()
+	case ReadUnread, ReadReading, ReadNone:
+		b.ReadAt = time.Time{}
+	}
+}
+
+// HasReadAt returns true if b has been read.
+func (b *Bookmark) HasReadAt() bool {
+	return b.ReadAt.Unix() > 0
+}
+
+// SetReadState sets the reading state of the bookmark id.
+func (s *BookmarkService) SetReadState(id, state string) (*Bookmark, error) {
+	if !validReadState(state) {
+		return nil, fmt.Errorf("invalid reading state %q", state)
+	}
+	b, err := s.GetByID(id)
+	if err != nil {
+		return nil, err
+	}
+	b.setReadState(state)
+	return b, s.Save(b)
+}
+
+// ReadingList returns the bookmarks in any of states, oldest first.
+func (s *BookmarkService) ReadingList(states []string, limit, offset int) ([]Bookmark, error) {
+	q, args := readingQuery(states)
+	return s.Select(q+` ORDER BY created_at ASC LIMIT ? OFFSET ?`, append(args, limit, offset)...)
+}
+
+// ReadingCount returns the number of bookmarks in any of states.
+func (s *BookmarkService) ReadingCount(states []string) (int, error) {
+	q, args := readingQuery(states)
+	var count int
+	err := s.db.Get(&count, `SELECT count(*) FROM bookmark `+q, args...)
+	return count, err
+}
+
+// ReadingCounts returns the number of bookmarks in each reading state.
+func (s *BookmarkService) ReadingCounts() (map[string]int, error) {
+	var rows []struct {
+		State string `db:"read_state"`
+		Count int    `db:"count"`
+	}
+	err := s.db.Select(&rows, `SELECT read_state, count(*) AS count FROM bookmark
+		WHERE read_state != '' GROUP BY read_state`)
+	if err != nil {
+		return nil, err
+	}
+	counts := make(map[string]int, len(rows))
+	for _, r := range rows {
+		counts[r.State] = r.Count
+	}
+	return counts, nil
+}
+
+func readingQuery(states []string) (string, []any) {
+	if len(states) == 0 {
+		return `WHERE read_state != ''`, nil
+	}
+	args := make([]any, len(states))
+	for i, state := range states {
+		args[i] = state
+	}
+	return `WHERE read_state IN (?` + strings.Repeat(", ?", len(states)-1) + `)`, args
+}
+
+// PublishRead marks the bookmark id as read and publishes it with
+// commentary as its description.
+func (s *BookmarkService) PublishRead(id, commentary string) (*Bookmark, error) {
+	b, err := s.GetByID(id)
+	if err != nil {
+		return nil, err
+	}
+	b.setReadState(ReadRead)
+	b.Description = strings.TrimSpace(commentary)
+	if b.Published == 0 {
+		b.Published = 1
+		b.PublishedAt = time.Now()
+	}
+	return b, s.Save(b)
+}
+
+// readingList shows the reading queue, oldest first.  By default it shows
+// bookmarks that are unread or being read.
+func (a *Admin) readingList(w http.ResponseWriter, r *http.Request) {
+	state := r.FormValue("state")
+	states := []string{ReadUnread, ReadReading}
+	if state != "" {
+		if !validReadState(state) {
+			app.Http404(w)
+			return
+		}
+		states = []string{state}
+	}
+
+	serv := a.service()
+	count, err := serv.ReadingCount(states)
+	if err != nil {
+		app.Http500("counting reading list", w, err)
+		return
+	}
+	counts, err := serv.ReadingCounts()
+	if err != nil {
+		app.Http500("counting reading list", w, err)
+		return
+	}
+
+	paginator := mtr.NewPaginator(adminPageSize, count)
+	page := paginator.Page(app.GetIntParam(r, "page", 1))
+	bookmarks, err := serv.ReadingList(states, adminPageSize, page.StartOffset)
+	if err != nil {
+		app.Http500("loading reading list", w, err)
+		return
+	}
+
+	reg := mtr.RegistryFromContext(r.Context())
+	err = reg.RenderWithBase(w, "admin-base", "bookmarks/admin/reading.html", mtr.Ctx{
+		"bookmarks":  bookmarks,
+		"state":      state,
+		"states":     ReadStates,
+		"counts":     counts,
+		"pagination": paginator.Render(reg, page),
+	})
+	if err != nil {
+		slog.Error("rendering reading list", "err", err)
+	}
+}
+
+// setReadState moves a bookmark to another reading state and returns to
+// the page it was changed from.
+func (a *Admin) setReadState(w http.ResponseWriter, r *http.Request) {
+	state := chi.URLParam(r, "state")
+	if state == "none" {
+		state = ReadNone
+	}
+	if _, err := a.service().SetReadState(chi.URLParam(r, "id"), state); err != nil {
+		app.Http500("setting reading state", w, err)
+		return
+	}
+
+	referer := r.Header.Get("Referer")
+	if len(referer) == 0 {
+		referer = "/admin/bookmarks/reading"
+	}
+	http.Redirect(w, r, referer, http.StatusFound)
+}
+
+// publishRead shows a form to add commentary to a bookmark that has been
+// read, and publishes it with that commentary.
+func (a *Admin) publishRead(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	serv := a.service()
+
+	if r.Method == http.MethodPost {
+		b, err := serv.PublishRead(id, r.FormValue("commentary"))
+		if err != nil {
+			app.Http500("publishing bookmark", w, err)
+			return
+		}
+		http.Redirect(w, r, fmt.Sprintf("/admin/bookmarks/edit/%s", b.ID), http.StatusFound)
+		return
+	}
+
+	b, err := serv.GetByID(id)
+	if err != nil {
+		app.Http404(w)
+		return
+	}
+	reg := mtr.RegistryFromContext(r.Context())
+	err = reg.RenderWithBase(w, "admin-base", "bookmarks/admin/reading-publish.html", mtr.Ctx{
+		"bookmark": b,
+	})
+	if err != nil {
+		slog.Error("rendering publish", "err", err)
+	}
+}
@@ -0,0 +1,92 @@
+package bookmarks
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadingList(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	conn, err := sqlx.Connect("sqlite3", ":memory:")
+	require.NoError(err)
+	require.NoError(NewApp(conn).Migrate())
+	serv := NewBookmarkService(conn)
+
+	var ids []string
+	for i, u := range []string{"https://a.example.com", "https://b.example.com", "https://c.example.com"} {
+		b := &Bookmark{URL: u, ReadState: ReadUnread}
+		require.NoError(serv.Insert(b))
+		// order by age
+		_, err := conn.Exec(`UPDATE bookmark SET created_at=? WHERE id=?`, time.Now().Add(-time.Duration(3-i)*time.Hour).Unix(), b.ID)
+		require.NoError(err)
+		ids = append(ids, b.ID)
+	}
+	// bookmarks that aren't on the list
+	require.NoError(serv.Insert(&Bookmark{URL: "https://d.example.com", Published: 1}))
+
+	queue := []string{ReadUnread, ReadReading}
+	list, err := serv.ReadingList(queue, 10, 0)
+	require.NoError(err)
+	require.Len(list, 3)
+	assert.Equal(ids[0], list[0].ID, "oldest first")
+
+	b, err := serv.SetReadState(ids[1], ReadReading)
+	require.NoError(err)
+	assert.False(b.HasReadAt())
+
+	b, err = serv.SetReadState(ids[2], ReadRead)
+	require.NoError(err)
+	assert.True(b.HasReadAt())
+	b, err = serv.GetByID(ids[2])
+	require.NoError(err)
+	assert.True(b.HasReadAt())
+
+	_, err = serv.SetReadState(ids[0], "skimmed")
+	assert.Error(err)
+
+	count, err := serv.ReadingCount(queue)
+	require.NoError(err)
+	assert.Equal(2, count)
+
+	counts, err := serv.ReadingCounts()
+	require.NoError(err)
+	assert.Equal(map[string]int{ReadUnread: 1, ReadReading: 1, ReadRead: 1}, counts)
+
+	// going back to unread forgets when it was read
+	b, err = serv.SetReadState(ids[2], ReadUnread)
+	require.NoError(err)
+	assert.False(b.HasReadAt())
+}
+
+func TestPublishRead(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	conn, err := sqlx.Connect("sqlite3", ":memory:")
+	require.NoError(err)
+	require.NoError(NewApp(conn).Migrate())
+	serv := NewBookmarkService(conn)
+
+	b := &Bookmark{URL: "https://example.com/essay", Title: "Essay", ReadState: ReadReading, Notes: "> a highlight"}
+	require.NoError(serv.Insert(b))
+
+	b, err = serv.PublishRead(b.ID, "  Worth reading for the *second* half.  ")
+	require.NoError(err)
+
+	b, err = serv.GetByID(b.ID)
+	require.NoError(err)
+	assert.Equal(ReadRead, b.ReadState)
+	assert.True(b.HasReadAt())
+	assert.Equal(1, b.Published)
+	assert.False(b.PublishedAt.IsZero())
+	assert.Equal("Worth reading for the *second* half.", b.Description)
+	assert.Contains(b.DescriptionRendered, "<em>second</em>")
+	assert.Equal("> a highlight", b.Notes)
+}
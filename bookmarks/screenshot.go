@@ -1,31 +1,78 @@
 package bookmarks
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"image"
 	"image/jpeg"
+	_ "image/png"
+	"io"
+	"io/fs"
 	"log/slog"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strings"
 
+	"github.com/jmoiron/monet/conf"
+	"github.com/jmoiron/monet/pkg/vfs"
 	"golang.org/x/image/draw"
 )
 
+// A ScreenshotService takes screenshots and stores them, along with their
+// icons and metadata, in a vfs.WritableFS.
 type ScreenshotService struct {
+	// screenshotDir is the directory of store if it is on local disk, so
+	// that screenshot paths stay absolute for existing bookmarks.
 	screenshotDir string
-	gowitnessBin  string
+	store         vfs.WritableFS
+	backend       ScreenshotBackend
 	enabled       bool
 }
 
-func NewScreenshotService(screenshotDir, gowitnessBin string, enabled bool) *ScreenshotService {
-	return &ScreenshotService{
-		screenshotDir: screenshotDir,
-		gowitnessBin:  gowitnessBin,
-		enabled:       enabled,
+// NewScreenshotService returns a service that saves screenshots to
+// screenshotDir with the backend selected by cfg.
+func NewScreenshotService(screenshotDir string, cfg conf.BookmarksConfig) (*ScreenshotService, error) {
+	backend, err := NewScreenshotBackend(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return NewScreenshotServiceWithBackend(screenshotDir, backend), nil
+}
+
+// NewScreenshotServiceWithBackend returns a service that takes screenshots
+// with backend.  A nil backend disables screenshots.
+func NewScreenshotServiceWithBackend(screenshotDir string, backend ScreenshotBackend) *ScreenshotService {
+	var store vfs.WritableFS
+	if screenshotDir != "" {
+		store = vfs.NewOSFS(screenshotDir)
+	}
+	return NewScreenshotServiceWithStore(store, backend)
+}
+
+// NewScreenshotServiceWithStore returns a service that saves screenshots
+// taken with backend to store, which can be remote.  A nil backend disables
+// screenshots.
+func NewScreenshotServiceWithStore(store vfs.WritableFS, backend ScreenshotBackend) *ScreenshotService {
+	ss := &ScreenshotService{
+		store:   store,
+		backend: backend,
+		enabled: backend != nil,
+	}
+	if p, ok := store.(vfs.PathFS); ok {
+		ss.screenshotDir = p.Path()
 	}
+	return ss
+}
+
+// path returns the path saved on bookmarks for the file name in the store.
+func (s *ScreenshotService) path(name string) string {
+	if s.screenshotDir == "" {
+		return name
+	}
+	return filepath.Join(s.screenshotDir, name)
 }
 
 // ScreenshotResult contains the results of taking a screenshot
@@ -38,37 +85,29 @@ type ScreenshotResult struct {
 	IconFilename   string
 }
 
-// GoWitnessOutput represents the JSON structure output by gowitness
-type GoWitnessOutput struct {
-	URL           string `json:"url"`
-	Title         string `json:"title"`
-	FinalURL      string `json:"final_url"`
-	StatusCode    int    `json:"status_code"`
-	ContentLength int    `json:"content_length"`
-	Technologies  []struct {
-		Name       string   `json:"name"`
-		Version    string   `json:"version"`
-		Categories []string `json:"categories"`
-	} `json:"technologies"`
+// screenshotMeta is the metadata saved next to each screenshot.  Its html is
+// read by GetDescription.
+type screenshotMeta struct {
+	URL     string `json:"url"`
+	Title   string `json:"title"`
+	Backend string `json:"backend"`
+	HTML    string `json:"html,omitempty"`
 }
 
-// TakeScreenshot takes a screenshot of the given URL using gowitness binary
-func (s *ScreenshotService) TakeScreenshot(url, bookmarkID string) (*ScreenshotResult, error) {
-	if !s.enabled {
+// TakeScreenshot takes a screenshot of the given URL with the service's
+// backend.  The backend is stopped if ctx is cancelled.
+func (s *ScreenshotService) TakeScreenshot(ctx context.Context, url, bookmarkID string) (*ScreenshotResult, error) {
+	if !s.enabled || s.backend == nil {
 		slog.Debug("screenshot service disabled")
 		return nil, nil
 	}
 
-	if s.gowitnessBin == "" {
-		return nil, fmt.Errorf("gowitness binary not configured")
-	}
-
-	if s.screenshotDir == "" {
+	if s.store == nil {
 		return nil, fmt.Errorf("screenshot directory not configured")
 	}
 
 	// Ensure screenshot directory exists
-	if err := os.MkdirAll(s.screenshotDir, 0755); err != nil {
+	if err := s.store.MkdirAll(".", 0755); err != nil {
 		return nil, fmt.Errorf("failed to create screenshot directory: %w", err)
 	}
 
@@ -76,13 +115,11 @@ func (s *ScreenshotService) TakeScreenshot(url, bookmarkID string) (*ScreenshotR
 	filename := fmt.Sprintf("%s.jpg", bookmarkID)
 	iconFilename := fmt.Sprintf("%s-256x160.jpg", bookmarkID)
 	jsonFilename := fmt.Sprintf("%s.json", bookmarkID)
-	finalImagePath := filepath.Join(s.screenshotDir, filename)
-	finalIconPath := filepath.Join(s.screenshotDir, iconFilename)
-	finalJSONPath := filepath.Join(s.screenshotDir, jsonFilename)
 
-	// Create temporary directory for gowitness output
-	tempDir := filepath.Join(s.screenshotDir, bookmarkID)
-	if err := os.MkdirAll(tempDir, 0755); err != nil {
+	// Backends write to local disk, so capture into a temporary directory
+	// and copy the results to the store, which may be remote
+	tempDir, err := os.MkdirTemp("", "monet-screenshot-")
+	if err != nil {
 		return nil, fmt.Errorf("failed to create temp directory: %w", err)
 	}
 
@@ -93,90 +130,85 @@ func (s *ScreenshotService) TakeScreenshot(url, bookmarkID string) (*ScreenshotR
 		}
 	}()
 
-	// Run gowitness command with JSONL output for metadata
-	cmd := exec.Command(s.gowitnessBin, "scan", "single",
-		"--url", url,
-		"--screenshot-path", tempDir,
-		"--screenshot-format", "jpeg",
-		"--chrome-window-x", "1280",
-		"--chrome-window-y", "939", // this is how we get 800px height unfortunately
-		"--javascript-file", "./bookmarks/accept.js",
-		// without this some scanning errors will be completely silent
-		// we aren't making the output of this command available but maybe we should
-		"--log-scan-errors",
-		"--write-jsonl",
-		"--write-jsonl-file", finalJSONPath)
-
-	// Log the exact command being executed for debugging
-	slog.Info("executing gowitness command",
-		"binary", s.gowitnessBin,
-		"args", cmd.Args,
-		"url", url,
-		"tempDir", tempDir)
-
-	output, err := cmd.CombinedOutput()
+	capture, err := s.backend.Capture(ctx, url, tempDir)
 	if err != nil {
-		slog.Error("gowitness command failed",
-			"error", err,
-			"output", string(output),
-			"command", cmd.String(),
-			"args", cmd.Args)
 		return nil, fmt.Errorf("failed to take screenshot: %w", err)
 	}
 
-	// Find the generated screenshot file (gowitness generates its own filename)
-	tempFiles, err := filepath.Glob(filepath.Join(tempDir, "*.jpeg"))
-	if err != nil || len(tempFiles) == 0 {
-		return nil, fmt.Errorf("no screenshot file generated in temp directory")
-	}
-	tempImagePath := tempFiles[0]
-
-	// Move screenshot to final location
-	if err := os.Rename(tempImagePath, finalImagePath); err != nil {
+	// Move screenshot to final location, converting it to jpeg if needed
+	if err := saveJPEG(capture.ImagePath, s.store, filename); err != nil {
 		return nil, fmt.Errorf("failed to move screenshot: %w", err)
 	}
 
-	// Create the 256x160 icon from the screenshot
-	if err := s.ResizeScreenshot(finalImagePath, finalIconPath, 256, 160); err != nil {
-		slog.Warn("failed to create icon", "error", err, "source", finalImagePath, "dest", finalIconPath)
+	// Create the 256x160 icon from the captured screenshot
+	if err := resizeFile(capture.ImagePath, s.store, iconFilename, 256, 160); err != nil {
+		slog.Warn("failed to create icon", "error", err, "source", capture.ImagePath, "dest", iconFilename)
 		// Continue without icon - this is not a fatal error
 	}
 
-	// Read and parse the JSON file that was written directly to final location
-	jsonData, err := os.ReadFile(finalJSONPath)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read JSON file: %w", err)
+	title := capture.Title
+	if title == "" {
+		title = url // fallback to URL if title is empty
 	}
 
-	// Parse the JSON output to extract metadata
-	var goWitnessData GoWitnessOutput
-	if err := json.Unmarshal(jsonData, &goWitnessData); err != nil {
-		slog.Error("failed to parse JSON output", "error", err, "output", string(jsonData))
-		// Continue with fallback title
-		goWitnessData.Title = url
+	meta := screenshotMeta{URL: url, Title: title, Backend: s.backend.Name(), HTML: capture.HTML}
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return nil, err
 	}
-
-	title := goWitnessData.Title
-	if title == "" {
-		title = url // fallback to URL if title is empty
+	if _, err := vfs.WriteFile(s.store, jsonFilename, bytes.NewReader(data)); err != nil {
+		return nil, fmt.Errorf("failed to write JSON file: %w", err)
 	}
 
+	finalImagePath := s.path(filename)
+	finalJSONPath := s.path(jsonFilename)
 	result := &ScreenshotResult{
 		ScreenshotPath: finalImagePath,
-		IconPath:       finalIconPath,
+		IconPath:       s.path(iconFilename),
 		JSONPath:       finalJSONPath,
 		Title:          title,
 		Filename:       filename,
 		IconFilename:   iconFilename,
 	}
 
-	slog.Info("screenshot taken", "url", url, "path", finalImagePath, "jsonPath", finalJSONPath, "title", title)
+	slog.Info("screenshot taken", "url", url, "backend", s.backend.Name(), "path", finalImagePath, "jsonPath", finalJSONPath, "title", title)
 	return result, nil
 }
 
+// saveJPEG copies the image at src to name in store, re-encoding it as a
+// jpeg if it is in another format.
+func saveJPEG(src string, store vfs.WritableFS, name string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	switch strings.ToLower(filepath.Ext(src)) {
+	case ".jpg", ".jpeg":
+		_, err := vfs.WriteFile(store, name, f)
+		return err
+	}
+
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return fmt.Errorf("failed to decode screenshot: %w", err)
+	}
+
+	out, err := store.Create(name)
+	if err != nil {
+		return err
+	}
+	if err := jpeg.Encode(out, img, &jpeg.Options{Quality: 90}); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
 // DeleteScreenshot removes a screenshot file and its associated JSON metadata
 func (s *ScreenshotService) DeleteScreenshot(screenshotPath string) error {
-	if !s.enabled || screenshotPath == "" {
+	if !s.enabled || screenshotPath == "" || s.store == nil {
 		return nil
 	}
 
@@ -184,28 +216,49 @@ func (s *ScreenshotService) DeleteScreenshot(screenshotPath string) error {
 	if !strings.HasPrefix(screenshotPath, s.screenshotDir) {
 		return fmt.Errorf("screenshot path outside of configured directory")
 	}
+	name := filepath.Base(screenshotPath)
 
 	// Delete the screenshot image
-	if err := os.Remove(screenshotPath); err != nil && !os.IsNotExist(err) {
+	if err := s.store.Remove(name); err != nil && !errors.Is(err, fs.ErrNotExist) {
 		return fmt.Errorf("failed to delete screenshot: %w", err)
 	}
 
 	// Delete the associated icon file
-	iconPath := strings.TrimSuffix(screenshotPath, ".jpg") + "-256x160.jpg"
-	if err := os.Remove(iconPath); err != nil && !os.IsNotExist(err) {
-		slog.Warn("failed to delete icon", "path", iconPath, "error", err)
+	iconName := strings.TrimSuffix(name, ".jpg") + "-256x160.jpg"
+	if err := s.store.Remove(iconName); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		slog.Warn("failed to delete icon", "path", iconName, "error", err)
 	}
 
 	// Delete the associated JSON file
-	jsonPath := strings.TrimSuffix(screenshotPath, ".jpg") + ".json"
-	if err := os.Remove(jsonPath); err != nil && !os.IsNotExist(err) {
-		slog.Warn("failed to delete JSON metadata", "path", jsonPath, "error", err)
+	jsonName := strings.TrimSuffix(name, ".jpg") + ".json"
+	if err := s.store.Remove(jsonName); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		slog.Warn("failed to delete JSON metadata", "path", jsonName, "error", err)
 	}
 
-	slog.Info("screenshot deleted", "path", screenshotPath, "jsonPath", jsonPath)
+	slog.Info("screenshot deleted", "path", screenshotPath, "jsonPath", jsonName)
 	return nil
 }
 
+// GetDescription extracts the meta description from the JSON metadata
+// saved with the screenshot at screenshotPath.  A missing file has no
+// description.
+func (s *ScreenshotService) GetDescription(screenshotPath string) (string, error) {
+	if screenshotPath == "" || s.store == nil {
+		return "", nil
+	}
+	jsonName := strings.TrimSuffix(filepath.Base(screenshotPath), ".jpg") + ".json"
+	file, err := s.store.Open(jsonName)
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to open JSON file %s: %w", jsonName, err)
+	}
+	defer file.Close()
+
+	return GetDescriptionFromReader(file)
+}
+
 // GetWebPath returns the web-accessible path for a screenshot
 func (s *ScreenshotService) GetWebPath(screenshotPath string) string {
 	if screenshotPath == "" {
@@ -214,6 +267,9 @@ func (s *ScreenshotService) GetWebPath(screenshotPath string) string {
 
 	// Convert absolute filesystem path to relative web path
 	relPath, err := filepath.Rel(s.screenshotDir, screenshotPath)
+	if s.screenshotDir == "" {
+		relPath, err = screenshotPath, nil
+	}
 	if err != nil {
 		slog.Error("failed to get relative path", "error", err, "path", screenshotPath)
 		return ""
@@ -228,16 +284,39 @@ func (s *ScreenshotService) ResizeScreenshot(sourcePath, destPath string, width,
 	if !s.enabled {
 		return fmt.Errorf("screenshot service is disabled")
 	}
+	if s.store == nil {
+		return fmt.Errorf("screenshot directory not configured")
+	}
 
 	// Open the source image
-	srcFile, err := os.Open(sourcePath)
+	srcFile, err := s.store.Open(filepath.Base(sourcePath))
 	if err != nil {
 		return fmt.Errorf("failed to open source image: %w", err)
 	}
 	defer srcFile.Close()
 
+	if err := resize(srcFile, s.store, filepath.Base(destPath), width, height); err != nil {
+		return err
+	}
+	slog.Info("screenshot resized", "source", sourcePath, "dest", destPath, "width", width, "height", height)
+	return nil
+}
+
+// resizeFile resizes the image at the local path src into name in store.
+func resizeFile(src string, store vfs.WritableFS, name string, width, height int) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("failed to open source image: %w", err)
+	}
+	defer f.Close()
+	return resize(f, store, name, width, height)
+}
+
+// resize scales the image read from r to width x height and saves it to
+// name in store as a jpeg.
+func resize(r io.Reader, store vfs.WritableFS, name string, width, height int) error {
 	// Decode the source image
-	srcImg, _, err := image.Decode(srcFile)
+	srcImg, _, err := image.Decode(r)
 	if err != nil {
 		return fmt.Errorf("failed to decode source image: %w", err)
 	}
@@ -248,23 +327,16 @@ func (s *ScreenshotService) ResizeScreenshot(sourcePath, destPath string, width,
 	// Resize the image using high-quality BiLinear scaling
 	draw.BiLinear.Scale(dstImg, dstImg.Bounds(), srcImg, srcImg.Bounds(), draw.Over, nil)
 
-	// Ensure destination directory exists
-	if err := os.MkdirAll(filepath.Dir(destPath), 0755); err != nil {
-		return fmt.Errorf("failed to create destination directory: %w", err)
-	}
-
 	// Create the destination file
-	dstFile, err := os.Create(destPath)
+	dstFile, err := store.Create(name)
 	if err != nil {
 		return fmt.Errorf("failed to create destination file: %w", err)
 	}
-	defer dstFile.Close()
 
 	// Encode and save the resized image as JPEG
 	if err := jpeg.Encode(dstFile, dstImg, &jpeg.Options{Quality: 85}); err != nil {
+		dstFile.Close()
 		return fmt.Errorf("failed to encode resized image: %w", err)
 	}
-
-	slog.Info("screenshot resized", "source", sourcePath, "dest", destPath, "width", width, "height", height)
-	return nil
+	return dstFile.Close()
 }
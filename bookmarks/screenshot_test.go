@@ -7,6 +7,8 @@ import (
 	"os"
 	"path/filepath"
 	"testing"
+
+	"github.com/jmoiron/monet/conf"
 )
 
 func TestResizeScreenshot(t *testing.T) {
@@ -47,7 +49,10 @@ func TestResizeScreenshot(t *testing.T) {
 	sourceFile.Close()
 
 	// Create screenshot service
-	service := NewScreenshotService("/tmp", "", true)
+	service, err := NewScreenshotService("/tmp", conf.Default().Bookmarks)
+	if err != nil {
+		t.Fatalf("NewScreenshotService failed: %v", err)
+	}
 
 	// Test the resize function
 	err = service.ResizeScreenshot(sourcePath, destPath, 16, 16)
@@ -84,10 +89,15 @@ func TestResizeScreenshot(t *testing.T) {
 
 func TestResizeScreenshotDisabled(t *testing.T) {
 	// Create screenshot service with disabled state
-	service := NewScreenshotService("/tmp", "", false)
+	cfg := conf.Default().Bookmarks
+	cfg.ScreenshotBackend = ""
+	service, err := NewScreenshotService("/tmp", cfg)
+	if err != nil {
+		t.Fatalf("NewScreenshotService failed: %v", err)
+	}
 
 	// Test should return error when service is disabled
-	err := service.ResizeScreenshot("/tmp/nonexistent.jpg", "/tmp/output.jpg", 16, 16)
+	err = service.ResizeScreenshot("/tmp/nonexistent.jpg", "/tmp/output.jpg", 16, 16)
 	if err == nil {
 		t.Error("Expected error when service is disabled, got nil")
 	}
@@ -99,10 +109,13 @@ func TestResizeScreenshotDisabled(t *testing.T) {
 }
 
 func TestResizeScreenshotInvalidSource(t *testing.T) {
-	service := NewScreenshotService("/tmp", "", true)
+	service, err := NewScreenshotService("/tmp", conf.Default().Bookmarks)
+	if err != nil {
+		t.Fatalf("NewScreenshotService failed: %v", err)
+	}
 
 	// Test with non-existent source file
-	err := service.ResizeScreenshot("/tmp/nonexistent.jpg", "/tmp/output.jpg", 16, 16)
+	err = service.ResizeScreenshot("/tmp/nonexistent.jpg", "/tmp/output.jpg", 16, 16)
 	if err == nil {
 		t.Error("Expected error with non-existent source file, got nil")
 	}
@@ -0,0 +1,67 @@
+package bookmarks
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/jmoiron/monet/stream"
+)
+
+// StreamEvent returns the activity stream event for the bookmark.
+func (b *Bookmark) StreamEvent() (*stream.Event, error) {
+	event, err := stream.NewBookmarkEvent(stream.BookmarkData{
+		ID:          b.ID,
+		URL:         b.URL,
+		Title:       b.Title,
+		Description: b.Description,
+		SiteName:    b.SiteName,
+		ImageURL:    b.ImageURL,
+		Tags:        b.Tags,
+	})
+	if err != nil {
+		return nil, err
+	}
+	event.Timestamp = b.PublishedAt
+	if event.Timestamp.Unix() <= 0 {
+		event.Timestamp = time.Now()
+	}
+	return event, nil
+}
+
+// SyncStream publishes b to the activity stream if it is published, and
+// removes it from the stream if it isn't.
+func (s *BookmarkService) SyncStream(b *Bookmark) error {
+	events := stream.NewEventService(s.db)
+	if b.Published == 0 {
+		return events.DeleteByTypeAndSourceID(stream.EventTypeBookmark, b.ID)
+	}
+	event, err := b.StreamEvent()
+	if err != nil {
+		return err
+	}
+	return events.Upsert(event)
+}
+
+// syncStream is SyncStream for saves, which shouldn't fail because the
+// stream couldn't be updated.
+func (s *BookmarkService) syncStream(b *Bookmark) {
+	if err := s.SyncStream(b); err != nil {
+		slog.Warn("syncing bookmark to stream", "id", b.ID, "err", err)
+	}
+}
+
+// SyncStreamAll publishes every published bookmark to the activity stream,
+// returning the number of bookmarks synced.
+func (s *BookmarkService) SyncStreamAll() (int, error) {
+	bookmarks, err := s.Select("WHERE published > 0 ORDER BY published_at ASC")
+	if err != nil {
+		return 0, err
+	}
+	for i := range bookmarks {
+		if err := s.SyncStream(&bookmarks[i]); err != nil {
+			return i, fmt.Errorf("syncing bookmark %s: %w", bookmarks[i].ID, err)
+		}
+	}
+	return len(bookmarks), nil
+}
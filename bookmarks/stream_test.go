@@ -0,0 +1,84 @@
+package bookmarks
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jmoiron/monet/stream"
+	"github.com/jmoiron/sqlx"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStreamSync(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	conn, err := sqlx.Connect("sqlite3", ":memory:")
+	require.NoError(err)
+	require.NoError(NewApp(conn).Migrate())
+	require.NoError(stream.NewApp(conn).Migrate())
+	serv := NewBookmarkService(conn)
+	events := stream.NewEventService(conn)
+
+	count := func() int {
+		n, err := events.CountByType(stream.EventTypeBookmark)
+		require.NoError(err)
+		return n
+	}
+
+	// unpublished bookmarks stay out of the stream
+	b := &Bookmark{URL: "https://example.com/post", Title: "A <b>post</b>", Description: "about things"}
+	require.NoError(serv.Insert(b))
+	assert.Equal(0, count())
+
+	published := time.Date(2026, 5, 1, 12, 0, 0, 0, time.UTC)
+	b.Published = 1
+	b.PublishedAt = published
+	b.SiteName = "Example"
+	require.NoError(serv.Save(b))
+	assert.Equal(1, count())
+
+	event, err := events.GetByTypeAndSourceID(stream.EventTypeBookmark, b.ID)
+	require.NoError(err)
+	assert.Equal("A <b>post</b>", event.Title)
+	assert.Equal("https://example.com/post", event.Url)
+	assert.True(published.Equal(event.Timestamp))
+	assert.Contains(event.SummaryRendered, `class="entry bookmark"`)
+	assert.Contains(event.SummaryRendered, "A &lt;b&gt;post&lt;/b&gt;")
+	assert.Contains(event.SummaryRendered, "Example")
+	assert.Contains(event.SummaryRendered, "about things")
+
+	// updates replace the event rather than adding another
+	b.Title = "A better post"
+	require.NoError(serv.Save(b))
+	assert.Equal(1, count())
+	event, err = events.GetByTypeAndSourceID(stream.EventTypeBookmark, b.ID)
+	require.NoError(err)
+	assert.Equal("A better post", event.Title)
+	assert.Contains(event.SummaryRendered, "A better post")
+
+	updated, err := events.RerenderByType(stream.EventTypeBookmark, nil)
+	require.NoError(err)
+	assert.Equal(1, updated)
+
+	b.Published = 0
+	require.NoError(serv.Save(b))
+	assert.Equal(0, count())
+
+	b.Published = 1
+	require.NoError(serv.Save(b))
+	assert.Equal(1, count())
+	require.NoError(serv.DeleteByID(b.ID))
+	assert.Equal(0, count())
+
+	// backfill existing bookmarks
+	require.NoError(serv.Insert(&Bookmark{URL: "https://example.com/one", Published: 1}))
+	_, err = conn.Exec(`DELETE FROM event`)
+	require.NoError(err)
+	n, err := serv.SyncStreamAll()
+	require.NoError(err)
+	assert.Equal(1, n)
+	assert.Equal(1, count())
+}
@@ -0,0 +1,97 @@
+package bookmarks
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// NormalizeTag lowercases tag and replaces whitespace with dashes, so that
+// tags can be stored space separated and used in urls.
+func NormalizeTag(tag string) string {
+	return strings.Join(strings.Fields(strings.ToLower(tag)), "-")
+}
+
+// NormalizeTags normalizes tags, dropping empty tags and duplicates.
+func NormalizeTags(tags []string) []string {
+	var norm []string
+	seen := map[string]bool{}
+	for _, t := range tags {
+		t = NormalizeTag(t)
+		if len(t) == 0 || seen[t] {
+			continue
+		}
+		seen[t] = true
+		norm = append(norm, t)
+	}
+	return norm
+}
+
+// ParseTags parses a comma separated list of tags.
+func ParseTags(s string) []string {
+	return NormalizeTags(strings.Split(s, ","))
+}
+
+// loadTags sets b's tags from its denormalized tags column.
+func (b *Bookmark) loadTags() {
+	b.Tags = strings.Fields(b.TagsText)
+}
+
+// updateTags updates the tags for bookmark b.  b should have an ID.
+// updateTags does not commit or rollback the passed in transaction.
+func updateTags(tx *sqlx.Tx, b *Bookmark) error {
+	if _, err := tx.Exec(`DELETE FROM bookmark_tag WHERE bookmark_id=?`, b.ID); err != nil {
+		return err
+	}
+
+	if len(b.Tags) == 0 {
+		return nil
+	}
+
+	var (
+		tags []string
+		args []any
+	)
+	for _, tag := range b.Tags {
+		tags = append(tags, "(?, ?)")
+		args = append(args, b.ID, tag)
+	}
+
+	q := fmt.Sprintf(`INSERT INTO bookmark_tag (bookmark_id, tag) VALUES %s`, strings.Join(tags, ", "))
+	_, err := tx.Exec(q, args...)
+	return err
+}
+
+// A TagCount is a tag and the number of bookmarks that have it.
+type TagCount struct {
+	Tag   string
+	Count int
+}
+
+// Tags returns every tag with the number of bookmarks that have it, by
+// name.  If published is true, only published bookmarks are counted.
+func (s *BookmarkService) Tags(published bool) ([]TagCount, error) {
+	q := `SELECT t.tag, count(*) AS count FROM bookmark_tag t
+		JOIN bookmark b ON b.id = t.bookmark_id`
+	if published {
+		q += ` WHERE b.published > 0`
+	}
+	q += ` GROUP BY t.tag ORDER BY t.tag`
+
+	var tags []TagCount
+	err := s.db.Select(&tags, q)
+	return tags, err
+}
+
+// TagsWithPrefix returns up to limit tags starting with prefix, most used
+// first.
+func (s *BookmarkService) TagsWithPrefix(prefix string, limit int) ([]string, error) {
+	prefix = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(NormalizeTag(prefix))
+	q := `SELECT tag FROM bookmark_tag WHERE tag LIKE ? ESCAPE '\'
+		GROUP BY tag ORDER BY count(*) DESC, tag LIMIT ?`
+
+	var tags []string
+	err := s.db.Select(&tags, q, prefix+"%", limit)
+	return tags, err
+}
@@ -0,0 +1,133 @@
+package bookmarks
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"testing/fstest"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-sprout/sprout"
+	"github.com/jmoiron/monet/app"
+	"github.com/jmoiron/monet/mtr"
+	"github.com/jmoiron/sqlx"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTags(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	assert.Equal([]string{"go", "data-bases"}, ParseTags(" Go, data  Bases,,go "))
+
+	conn, err := sqlx.Connect("sqlite3", ":memory:")
+	require.NoError(err)
+	require.NoError(NewApp(conn).Migrate())
+
+	serv := NewBookmarkService(conn)
+	add := func(url, title string, published int, tags ...string) *Bookmark {
+		b := &Bookmark{URL: url, Title: title, Published: published, Tags: tags}
+		require.NoError(serv.Insert(b))
+		return b
+	}
+	a := add("https://example.com/a", "Sqlite internals", 1, "go", "sqlite")
+	add("https://example.com/b", "Postgres internals", 1, "postgres")
+	add("https://example.com/c", "Go generics", 1, "go")
+	add("https://example.com/d", "Draft", 0, "go", "sqlite")
+
+	b, err := serv.GetByID(a.ID)
+	require.NoError(err)
+	assert.Equal([]string{"go", "sqlite"}, b.Tags)
+
+	// tags alone
+	count, err := serv.SearchCount("", []string{"go"})
+	require.NoError(err)
+	assert.Equal(2, count)
+
+	// every tag must match
+	found, err := serv.Search("", []string{"go", "sqlite"}, 10, 0)
+	require.NoError(err)
+	require.Len(found, 1)
+	assert.Equal(a.ID, found[0].ID)
+	assert.Equal([]string{"go", "sqlite"}, found[0].Tags)
+
+	// tags combined with a query
+	found, err = serv.Search(`"internals"`, []string{"go"}, 10, 0)
+	require.NoError(err)
+	require.Len(found, 1)
+	assert.Equal(a.ID, found[0].ID)
+
+	// tags are indexed for full text search
+	count, err = serv.SearchCount(`"postgres"`, nil)
+	require.NoError(err)
+	assert.Equal(1, count)
+
+	// editing tags updates the tag table and the index
+	b.Tags = []string{"databases"}
+	require.NoError(serv.Save(b))
+	count, err = serv.SearchCount("", []string{"sqlite"})
+	require.NoError(err)
+	assert.Equal(0, count)
+	count, err = serv.SearchCount(`"databases"`, nil)
+	require.NoError(err)
+	assert.Equal(1, count)
+
+	tags, err := serv.Tags(true)
+	require.NoError(err)
+	assert.Equal([]TagCount{{"databases", 1}, {"go", 1}, {"postgres", 1}}, tags)
+
+	suggestions, err := serv.TagsWithPrefix("G", 10)
+	require.NoError(err)
+	assert.Equal([]string{"go"}, suggestions)
+
+	// deleting a bookmark removes its tags
+	require.NoError(serv.DeleteByID(b.ID))
+	tags, err = serv.Tags(false)
+	require.NoError(err)
+	assert.Equal([]TagCount{{"go", 2}, {"postgres", 1}, {"sqlite", 1}}, tags)
+}
+
+func TestTagPages(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	conn, err := sqlx.Connect("sqlite3", ":memory:")
+	require.NoError(err)
+	a := NewApp(conn).WithBaseURL("/bookmarks/")
+	require.NoError(a.Migrate())
+
+	serv := NewBookmarkService(conn)
+	require.NoError(serv.Insert(&Bookmark{URL: "https://example.com/a", Title: "Sqlite internals", Published: 1, Tags: []string{"go"}}))
+	require.NoError(serv.Insert(&Bookmark{URL: "https://example.com/b", Title: "Postgres internals", Published: 1}))
+
+	reg := mtr.NewRegistry()
+	reg.AddBaseFS("base", "base.html", fstest.MapFS{"base.html": {Data: []byte(`{{.body}}`)}})
+	// admin templates use functions registered by other apps
+	reg.Handler.AddRegistry(mtr.NewSproutRegistry("test", sprout.FunctionMap{
+		"fmtTimestamp": app.FmtTimestamp,
+	}))
+	a.Register(reg)
+	require.NoError(reg.Build())
+
+	r := chi.NewRouter()
+	r.Use(mtr.AddRegistryMiddleware(reg))
+	a.Bind(r)
+
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w
+	}
+
+	for _, path := range []string{"/bookmarks/tag/go", "/bookmarks/?tag=go", "/bookmarks/?tag=go&q=+"} {
+		w := get(path)
+		assert.Equal(http.StatusOK, w.Code, path)
+		assert.Contains(w.Body.String(), "Sqlite internals", path)
+		assert.NotContains(w.Body.String(), "Postgres internals", path)
+	}
+	w := get("/bookmarks/tag/go?q=postgres")
+	assert.Equal(http.StatusOK, w.Code)
+	assert.NotContains(w.Body.String(), "internals")
+}
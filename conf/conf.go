@@ -14,6 +14,136 @@ type configKey struct{}
 type FSSConfig struct {
 	Paths map[string]string
 	URLs  map[string]string
+	// Buckets are named filesystems stored in S3-compatible buckets. A
+	// bucket without an entry in URLs is served from the bucket's own URL.
+	Buckets map[string]BucketConfig
+	// Policies limit what can be uploaded to each named filesystem.
+	Policies map[string]PolicyConfig
+}
+
+// PolicyConfig limits the files uploaded to a filesystem.  Sizes are
+// strings like "32MiB" or "2GB".
+type PolicyConfig struct {
+	// MaxSize is the largest file accepted; the default is 64MiB, and
+	// "unlimited" accepts files of any size.
+	MaxSize string
+	// AllowedTypes are the MIME types accepted, eg. "image/*" or
+	// "application/pdf", detected from the file's content.  Any type is
+	// accepted if empty.
+	AllowedTypes []string
+	// Quota is the most space the filesystem may use; empty is unlimited.
+	Quota string
+	// Lowercase and Restrict sanitize filenames by lowercasing them and by
+	// replacing anything but ASCII letters, digits, '.', '-' and '_'.
+	Lowercase bool
+	Restrict  bool
+	// MaxNameLength is the longest filename allowed; longer names are
+	// shortened.
+	MaxNameLength int
+}
+
+// BucketConfig configures a filesystem in an S3-compatible object store.
+type BucketConfig struct {
+	// Endpoint is the URL of the S3 API, eg. "http://localhost:9000".
+	Endpoint  string
+	Region    string
+	Bucket    string
+	Prefix    string
+	AccessKey string
+	SecretKey string
+	// PathStyle addresses buckets as endpoint/bucket; needed by MinIO.
+	PathStyle bool
+	// SignURLs makes the URL mapper return presigned URLs, for buckets
+	// that aren't publicly readable.
+	SignURLs bool
+	// URLExpiry is how many seconds signed URLs are valid for.
+	URLExpiry int
+	// Timeout is how many seconds a request to the bucket may stall for.
+	Timeout int
+}
+
+// LinkCheckConfig controls the outbound link checker.
+type LinkCheckConfig struct {
+	// Interval is the number of hours between checks of a link; 0 disables
+	// the background checker.
+	Interval int
+	// Concurrency is the number of links checked at the same time.
+	Concurrency int
+	// HostDelay is the minimum number of milliseconds between two requests
+	// to the same host.
+	HostDelay int
+	// Timeout is the per-request timeout in seconds.
+	Timeout   int
+	UserAgent string
+	// ArchivePrefix is prepended to a URL to form its archived copy.
+	ArchivePrefix string
+}
+
+// BookmarksConfig controls how bookmarks are screenshotted.
+type BookmarksConfig struct {
+	// ScreenshotBackend is "gowitness", "command" or "fake"; empty disables
+	// screenshots.
+	ScreenshotBackend string
+	// GowitnessPath is the gowitness binary used by the "gowitness" backend.
+	GowitnessPath string
+	// ScreenshotCommand is the command line run by the "command" backend.
+	// The arguments {url}, {output}, {width}, {height} and {script} are
+	// replaced before it is run; the command must write an image to {output}.
+	ScreenshotCommand []string
+	// ScreenshotFormat is the image extension the command writes, eg. "png".
+	ScreenshotFormat string
+	// WindowWidth and WindowHeight are the browser window size in pixels.
+	WindowWidth  int
+	WindowHeight int
+	// ScriptPath is a javascript file run on each page before it's captured,
+	// eg. to dismiss cookie banners.  Empty runs no script.
+	ScriptPath string
+	// ScreenshotTimeout is how many seconds a screenshot may take.
+	ScreenshotTimeout int
+	// TrackingParams are query parameters removed from bookmarked urls when
+	// checking for duplicates.  A trailing * matches any suffix.
+	TrackingParams []string
+}
+
+// ImageSize is a named width that uploaded images are scaled down to.
+type ImageSize struct {
+	Name  string
+	Width int
+}
+
+// UploadsConfig controls how uploaded images are processed.
+type UploadsConfig struct {
+	// Derivatives are the smaller copies made of each uploaded image.
+	// Images are never scaled up, so small images get fewer derivatives.
+	Derivatives []ImageSize
+	// Quality is the jpeg quality of derivatives.
+	Quality int
+	// Sizes is the sizes attribute used for responsive images.
+	Sizes string
+	// Collisions maps filesystem names to what happens when an upload's
+	// name is taken by a different file: "rename" (the default) saves it
+	// under a free name and "reject" refuses it.
+	Collisions map[string]string
+	// Reconcile are the filesystems compared with the upload table, as well
+	// as any that have uploads in them.
+	Reconcile []string
+	// TusDir is the local directory resumable uploads are kept in until
+	// they're complete; the default is in the system temp directory.
+	TusDir string
+	// TusExpiry is how many hours a resumable upload is kept after it was
+	// last written to.
+	TusExpiry int
+	// StripEXIF removes the location and identifying tags, like serial
+	// numbers, from uploaded jpegs before they're saved.
+	StripEXIF bool
+	// AutoRotate re-encodes uploaded jpegs that aren't upright according
+	// to their EXIF orientation.
+	AutoRotate bool
+	// PostFolder is the folder files uploaded to a post are put in, where
+	// {year}, {month} and {slug} are replaced with the post's creation
+	// year and month and its slug.  If empty, they're put in the root of
+	// the filesystem.
+	PostFolder string
 }
 
 // A Config holds options for the running website.
@@ -33,6 +163,10 @@ type Config struct {
 
 	// Paths are named full paths to directories for things like media, uploads, etc
 	FSS FSSConfig
+
+	LinkCheck LinkCheckConfig
+	Bookmarks BookmarksConfig
+	Uploads   UploadsConfig
 }
 
 // String returns the config as a string.
@@ -89,6 +223,41 @@ func Default() *Config {
 	c.TemplatePaths = []string{"./templates"}
 	c.SessionSecret = "SET-IN-CONFIG-FILE"
 	c.TemplatePreCompile = true
+	c.LinkCheck = LinkCheckConfig{
+		Interval:      24 * 7,
+		Concurrency:   4,
+		HostDelay:     1000,
+		Timeout:       15,
+		UserAgent:     "monet-linkcheck/1.0",
+		ArchivePrefix: "https://web.archive.org/web/",
+	}
+	c.Bookmarks = BookmarksConfig{
+		ScreenshotBackend: "gowitness",
+		GowitnessPath:     "gowitness",
+		ScreenshotFormat:  "png",
+		WindowWidth:       1280,
+		// gowitness needs a 939px window for an 800px high screenshot
+		WindowHeight:      939,
+		ScriptPath:        "./bookmarks/accept.js",
+		ScreenshotTimeout: 90,
+		TrackingParams: []string{
+			"utm_*", "fbclid", "gclid", "dclid", "gbraid", "wbraid", "msclkid",
+			"mc_cid", "mc_eid", "igshid", "yclid", "_hsenc", "_hsmi", "ref_src",
+		},
+	}
+	c.Uploads = UploadsConfig{
+		Derivatives: []ImageSize{
+			{Name: "thumbnail", Width: 320},
+			{Name: "medium", Width: 800},
+			{Name: "large", Width: 1600},
+		},
+		Quality: 85,
+		// the site is 720px wide
+		Sizes:      "(max-width: 720px) 100vw, 720px",
+		Reconcile:  []string{"uploads", "blog-files"},
+		StripEXIF:  true,
+		PostFolder: "{year}/{slug}",
+	}
 
 	/*
 		if path := os.Getenv("MONET_CONFIG_PATH"); len(path) > 0 {
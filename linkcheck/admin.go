@@ -0,0 +1,178 @@
+package linkcheck
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/jmoiron/monet/app"
+	"github.com/jmoiron/monet/blog"
+	"github.com/jmoiron/monet/bookmarks"
+	"github.com/jmoiron/monet/conf"
+	"github.com/jmoiron/monet/db"
+	"github.com/jmoiron/monet/mtr"
+	"github.com/jmoiron/monet/pages"
+)
+
+type Admin struct {
+	db     db.DB
+	cfg    conf.LinkCheckConfig
+	links  *LinkService
+	runner *Runner
+}
+
+func NewAdmin(database db.DB, cfg conf.LinkCheckConfig, runner *Runner) *Admin {
+	return &Admin{
+		db:     database,
+		cfg:    cfg,
+		links:  NewLinkService(database),
+		runner: runner,
+	}
+}
+
+func (a *Admin) Bind(r chi.Router) {
+	r.Get("/links/", a.report)
+	r.Post("/links/run", a.run)
+	r.Post("/links/archive/{id:[0-9]+}", a.archive)
+}
+
+func (a *Admin) Panels(r *http.Request) ([]string, error) {
+	counts, err := a.links.Counts()
+	if err != nil {
+		return nil, err
+	}
+
+	var b bytes.Buffer
+	reg := mtr.RegistryFromContext(r.Context())
+	if err := reg.Render(&b, "linkcheck/admin/panel.html", mtr.Ctx{
+		"title":     "Links",
+		"fullUrl":   "/admin/links/",
+		"counts":    counts,
+		"isRunning": a.runner.IsRunning(),
+	}); err != nil {
+		return nil, err
+	}
+	return []string{b.String()}, nil
+}
+
+func (a *Admin) report(w http.ResponseWriter, r *http.Request) {
+	reports, err := a.links.Problems()
+	if err != nil {
+		app.Http500("loading link report", w, err)
+		return
+	}
+
+	var broken, redirected []Report
+	for _, rep := range reports {
+		if rep.Broken() {
+			broken = append(broken, rep)
+		} else {
+			redirected = append(redirected, rep)
+		}
+	}
+
+	reg := mtr.RegistryFromContext(r.Context())
+	if err := reg.RenderWithBase(w, "admin-base", "linkcheck/admin/report.html", mtr.Ctx{
+		"title":      "Links",
+		"broken":     broken,
+		"redirected": redirected,
+		"isRunning":  a.runner.IsRunning(),
+		"archive":    a.cfg.ArchivePrefix,
+	}); err != nil {
+		slog.Error("rendering link report", "err", err)
+	}
+}
+
+func (a *Admin) run(w http.ResponseWriter, r *http.Request) {
+	go func() {
+		if err := a.runner.Run(context.Background(), true); err != nil {
+			slog.Error("checking links", "err", err)
+		}
+	}()
+	http.Redirect(w, r, "/admin/links/", http.StatusSeeOther)
+}
+
+// archive replaces the link in a report with its archived copy in the
+// post or page that references it.  Bookmarks keep their url, and record
+// the archived copy alongside it.
+func (a *Admin) archive(w http.ResponseWriter, r *http.Request) {
+	refID, _ := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	rep, err := a.links.GetReport(refID)
+	if err != nil {
+		app.Http404(w)
+		return
+	}
+
+	archived := a.cfg.ArchivePrefix + rep.URL
+	if err := a.replace(rep, archived); err != nil {
+		app.Http500("replacing link", w, err)
+		return
+	}
+	if err := a.links.DeleteRef(refID); err != nil {
+		app.Http500("removing link reference", w, err)
+		return
+	}
+	slog.Info("replaced link with archive", "item", rep.ItemType, "id", rep.ItemID, "url", rep.URL)
+	http.Redirect(w, r, "/admin/links/", http.StatusSeeOther)
+}
+
+func (a *Admin) replace(rep *Report, archived string) error {
+	switch rep.ItemType {
+	case ItemPost:
+		id, _ := strconv.Atoi(rep.ItemID)
+		serv := blog.NewPostService(a.db)
+		p, err := serv.Get(id)
+		if err != nil {
+			return err
+		}
+		p.Content = replaceLink(p.Content, rep.URL, archived)
+		return serv.Save(p)
+	case ItemPage:
+		id, _ := strconv.Atoi(rep.ItemID)
+		serv := pages.NewPageService(a.db)
+		p, err := serv.GetByID(id)
+		if err != nil {
+			return err
+		}
+		p.Content = replaceLink(p.Content, rep.URL, archived)
+		return serv.Save(p)
+	case ItemBookmark:
+		// the bookmark keeps its url, and links to the archived copy too
+		return bookmarks.NewBookmarkService(a.db).SetArchiveURL(rep.ItemID, archived)
+	}
+	return fmt.Errorf("unknown item type %q", rep.ItemType)
+}
+
+// replaceLink replaces links to url in content with archived.  Only whole
+// link targets are replaced, so longer URLs that start with url, and links
+// that already point at the archived copy, are left alone.
+func replaceLink(content, url, archived string) string {
+	var b strings.Builder
+	last := 0
+	for i := 0; i <= len(content)-len(url); {
+		j := strings.Index(content[i:], url)
+		if j < 0 {
+			break
+		}
+		start, end := i+j, i+j+len(url)
+		if (start == 0 || isLinkBoundary(content[start-1])) && (end == len(content) || isLinkBoundary(content[end])) {
+			b.WriteString(content[last:start])
+			b.WriteString(archived)
+			last = end
+		}
+		i = end
+	}
+	b.WriteString(content[last:])
+	return b.String()
+}
+
+// isLinkBoundary returns true for characters that can surround a link in
+// markdown or html.
+func isLinkBoundary(c byte) bool {
+	return strings.IndexByte("()<>\"' \t\r\n", c) >= 0
+}
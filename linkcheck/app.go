@@ -0,0 +1,63 @@
+// Package linkcheck periodically checks the outbound links in posts, pages
+// and bookmarks and reports the ones that are broken or redirected.
+package linkcheck
+
+import (
+	"embed"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-sprout/sprout"
+	"github.com/jmoiron/monet/app"
+	"github.com/jmoiron/monet/conf"
+	"github.com/jmoiron/monet/db"
+	"github.com/jmoiron/monet/db/monarch"
+	"github.com/jmoiron/monet/mtr"
+)
+
+//go:embed linkcheck/admin/*
+var templates embed.FS
+
+type App struct {
+	db     db.DB
+	cfg    conf.LinkCheckConfig
+	runner *Runner
+}
+
+func NewApp(db db.DB) *App {
+	return (&App{db: db}).WithConfig(conf.Default().LinkCheck)
+}
+
+// WithConfig sets the checker configuration.
+func (a *App) WithConfig(cfg conf.LinkCheckConfig) *App {
+	a.cfg = cfg
+	a.runner = NewRunner(a.db, cfg)
+	return a
+}
+
+func (a *App) Name() string { return "linkcheck" }
+
+func (a *App) Register(reg *mtr.Registry) {
+	reg.Handler.AddRegistry(
+		mtr.NewSproutRegistry("linkcheck", sprout.FunctionMap{
+			"fmtTimestamp": app.FmtTimestamp,
+		}),
+	)
+	reg.AddAllFS(templates)
+}
+
+func (a *App) Migrate() error {
+	manager, err := monarch.NewManager(a.db)
+	if err != nil {
+		return err
+	}
+	return manager.Upgrade(linkMigrations)
+}
+
+func (a *App) GetAdmin() (app.Admin, error) {
+	return NewAdmin(a.db, a.cfg, a.runner), nil
+}
+
+// Bind starts the background checker; the link checker has no public pages.
+func (a *App) Bind(r chi.Router) {
+	a.runner.Start()
+}
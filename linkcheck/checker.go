@@ -0,0 +1,218 @@
+package linkcheck
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/monet/conf"
+)
+
+const maxRedirects = 10
+
+// Result is the outcome of checking a single URL.
+type Result struct {
+	URL string
+	// Status is the status code of the final response, 0 if no
+	// response was received.
+	Status int
+	// FinalURL is set to the last location in a redirect chain.
+	FinalURL  string
+	Error     string
+	CheckedAt time.Time
+}
+
+// A Checker checks URLs with a bounded number of concurrent requests,
+// waiting at least HostDelay between two requests to the same host.
+type Checker struct {
+	client      *http.Client
+	userAgent   string
+	concurrency int
+	hostDelay   time.Duration
+
+	mu   sync.Mutex
+	next map[string]time.Time
+}
+
+// NewChecker returns a Checker configured by cfg.
+func NewChecker(cfg conf.LinkCheckConfig) *Checker {
+	concurrency := cfg.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	return &Checker{
+		client: &http.Client{
+			Timeout: time.Duration(cfg.Timeout) * time.Second,
+			// redirects are followed by hand so each hop can be recorded
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		userAgent:   cfg.UserAgent,
+		concurrency: concurrency,
+		hostDelay:   time.Duration(cfg.HostDelay) * time.Millisecond,
+		next:        map[string]time.Time{},
+	}
+}
+
+// CheckAll checks every url and calls fn with each result.  fn is never
+// called concurrently.
+func (c *Checker) CheckAll(ctx context.Context, urls []string, fn func(Result)) {
+	var (
+		wg  sync.WaitGroup
+		mu  sync.Mutex
+		sem = make(chan struct{}, c.concurrency)
+	)
+
+	for _, u := range urls {
+		select {
+		case <-ctx.Done():
+			wg.Wait()
+			return
+		case sem <- struct{}{}:
+		}
+
+		wg.Add(1)
+		go func(u string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			res := c.Check(ctx, u)
+			mu.Lock()
+			fn(res)
+			mu.Unlock()
+		}(u)
+	}
+	wg.Wait()
+}
+
+// Check checks a single URL, following redirects.  A HEAD request is tried
+// first; servers that refuse HEAD are retried with GET.
+func (c *Checker) Check(ctx context.Context, rawURL string) Result {
+	res := Result{URL: rawURL, CheckedAt: time.Now()}
+
+	current := rawURL
+	for hop := 0; ; hop++ {
+		if hop > maxRedirects {
+			res.Error = "too many redirects"
+			return res
+		}
+
+		resp, err := c.do(ctx, http.MethodHead, current)
+		if err != nil || retryWithGet(resp.StatusCode) {
+			resp, err = c.do(ctx, http.MethodGet, current)
+		}
+		if err != nil {
+			res.Status = 0
+			res.Error = err.Error()
+			return res
+		}
+
+		res.Status = resp.StatusCode
+		if !isRedirect(resp.StatusCode) {
+			if current != rawURL {
+				res.FinalURL = current
+			}
+			return res
+		}
+
+		loc := resp.Header.Get("Location")
+		if loc == "" {
+			res.Error = "redirect without location"
+			return res
+		}
+		next, err := resolve(current, loc)
+		if err != nil {
+			res.Error = err.Error()
+			return res
+		}
+		current = next
+	}
+}
+
+func (c *Checker) do(ctx context.Context, method, rawURL string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(c.userAgent) > 0 {
+		req.Header.Set("User-Agent", c.userAgent)
+	}
+
+	if err := c.wait(ctx, req.URL.Host); err != nil {
+		return nil, err
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		var uerr *url.Error
+		if errors.As(err, &uerr) {
+			return nil, uerr.Err
+		}
+		return nil, err
+	}
+	// only the status and headers are interesting
+	resp.Body.Close()
+	return resp, nil
+}
+
+// wait blocks until a request to host is allowed.
+func (c *Checker) wait(ctx context.Context, host string) error {
+	if c.hostDelay <= 0 {
+		return nil
+	}
+
+	c.mu.Lock()
+	now := time.Now()
+	at := c.next[host]
+	if at.Before(now) {
+		at = now
+	}
+	c.next[host] = at.Add(c.hostDelay)
+	c.mu.Unlock()
+
+	d := time.Until(at)
+	if d <= 0 {
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+func retryWithGet(status int) bool {
+	switch status {
+	case http.StatusMethodNotAllowed, http.StatusForbidden, http.StatusNotImplemented:
+		return true
+	}
+	return false
+}
+
+func isRedirect(status int) bool {
+	switch status {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	}
+	return false
+}
+
+func resolve(base, ref string) (string, error) {
+	b, err := url.Parse(base)
+	if err != nil {
+		return "", err
+	}
+	r, err := url.Parse(ref)
+	if err != nil {
+		return "", fmt.Errorf("bad redirect location %q: %w", ref, err)
+	}
+	return b.ResolveReference(r).String(), nil
+}
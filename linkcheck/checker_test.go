@@ -0,0 +1,179 @@
+package linkcheck
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/monet/bookmarks"
+	"github.com/jmoiron/monet/conf"
+	"github.com/jmoiron/sqlx"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestServer(t *testing.T) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ok", func(w http.ResponseWriter, r *http.Request) {})
+	mux.HandleFunc("/missing", http.NotFound)
+	mux.HandleFunc("/moved", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/ok", http.StatusMovedPermanently)
+	})
+	mux.HandleFunc("/loop", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/loop", http.StatusFound)
+	})
+	mux.HandleFunc("/nohead", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	})
+	ts := httptest.NewServer(mux)
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func testConfig() conf.LinkCheckConfig {
+	cfg := conf.Default().LinkCheck
+	cfg.HostDelay = 0
+	return cfg
+}
+
+func TestCheck(t *testing.T) {
+	assert := assert.New(t)
+	ts := newTestServer(t)
+	c := NewChecker(testConfig())
+	ctx := context.Background()
+
+	res := c.Check(ctx, ts.URL+"/ok")
+	assert.Equal(http.StatusOK, res.Status)
+	assert.Empty(res.FinalURL)
+	assert.Empty(res.Error)
+
+	res = c.Check(ctx, ts.URL+"/missing")
+	assert.Equal(http.StatusNotFound, res.Status)
+
+	res = c.Check(ctx, ts.URL+"/moved")
+	assert.Equal(http.StatusOK, res.Status)
+	assert.Equal(ts.URL+"/ok", res.FinalURL)
+
+	res = c.Check(ctx, ts.URL+"/loop")
+	assert.Equal("too many redirects", res.Error)
+
+	res = c.Check(ctx, ts.URL+"/nohead")
+	assert.Equal(http.StatusOK, res.Status)
+
+	ts.Close()
+	res = c.Check(ctx, ts.URL+"/ok")
+	assert.Equal(0, res.Status)
+	assert.NotEmpty(res.Error)
+}
+
+func TestCheckAll(t *testing.T) {
+	ts := newTestServer(t)
+	cfg := testConfig()
+	cfg.Concurrency = 2
+	c := NewChecker(cfg)
+
+	urls := []string{ts.URL + "/ok", ts.URL + "/missing", ts.URL + "/moved"}
+	var checked []string
+	c.CheckAll(context.Background(), urls, func(r Result) {
+		checked = append(checked, r.URL)
+	})
+	assert.ElementsMatch(t, urls, checked)
+}
+
+func TestExtractLinks(t *testing.T) {
+	doc := `<p><a href="https://example.com/">one</a> <a href="/local">two</a>
+	<img src="http://example.com/img.png"> <a href="https://example.com/">again</a>
+	<a href="mailto:me@example.com">mail</a></p>`
+	assert.Equal(t, []string{"https://example.com/", "http://example.com/img.png"}, ExtractLinks(doc))
+}
+
+func TestReplaceLink(t *testing.T) {
+	archive := "https://web.archive.org/web/"
+	content := "[a](https://example.com) and [b](https://web.archive.org/web/https://example.com)"
+	assert.Equal(t,
+		"[a](https://web.archive.org/web/https://example.com) and [b](https://web.archive.org/web/https://example.com)",
+		replaceLink(content, "https://example.com", archive+"https://example.com"))
+
+	// longer urls starting with the broken one are different links
+	content = `[a](https://example.com/page) <a href="https://example.com">b</a> <https://example.com>`
+	assert.Equal(t,
+		`[a](https://example.com/page) <a href="`+archive+`https://example.com">b</a> <`+archive+`https://example.com>`,
+		replaceLink(content, "https://example.com", archive+"https://example.com"))
+}
+
+func TestLinkService(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	db, err := sqlx.Connect("sqlite3", ":memory:")
+	require.NoError(err)
+	t.Cleanup(func() { db.Close() })
+	require.NoError(NewApp(db).Migrate())
+
+	serv := NewLinkService(db)
+	require.NoError(serv.SetItems([]Item{
+		{Type: ItemPost, ID: "1", Title: "post", Links: []string{"https://a.com", "https://b.com"}},
+		{Type: ItemBookmark, ID: "x", Title: "bookmark", Links: []string{"https://b.com"}},
+	}))
+
+	stale, err := serv.Stale(time.Now())
+	require.NoError(err)
+	assert.Len(stale, 2)
+
+	require.NoError(serv.Record(Result{URL: "https://a.com", Status: 404, CheckedAt: time.Now()}))
+	require.NoError(serv.Record(Result{URL: "https://b.com", Status: 200, FinalURL: "https://c.com", CheckedAt: time.Now()}))
+
+	problems, err := serv.Problems()
+	require.NoError(err)
+	assert.Len(problems, 3)
+
+	counts, err := serv.Counts()
+	require.NoError(err)
+	assert.Equal(&Counts{Total: 2, Broken: 1, Redirected: 1}, counts)
+
+	// dropping the post removes the reference and the now unused link
+	require.NoError(serv.SetItems([]Item{
+		{Type: ItemBookmark, ID: "x", Title: "bookmark", Links: []string{"https://b.com"}},
+	}))
+	counts, err = serv.Counts()
+	require.NoError(err)
+	assert.Equal(&Counts{Total: 1, Broken: 0, Redirected: 1}, counts)
+
+	problems, err = serv.Problems()
+	require.NoError(err)
+	require.Len(problems, 1)
+	rep, err := serv.GetReport(problems[0].RefID)
+	require.NoError(err)
+	assert.Equal("https://b.com", rep.URL)
+	assert.True(rep.Redirected())
+}
+
+func TestArchiveBookmark(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	db, err := sqlx.Connect("sqlite3", ":memory:")
+	require.NoError(err)
+	t.Cleanup(func() { db.Close() })
+	require.NoError(bookmarks.NewApp(db).Migrate())
+
+	serv := bookmarks.NewBookmarkService(db)
+	b := &bookmarks.Bookmark{URL: "https://example.com/gone", Title: "gone"}
+	require.NoError(serv.Insert(b))
+
+	// the bookmark keeps its url, and links to the archived copy
+	a := NewAdmin(db, conf.Default().LinkCheck, nil)
+	archived := "https://web.archive.org/web/https://example.com/gone"
+	rep := &Report{ItemType: ItemBookmark, ItemID: b.ID, Link: Link{URL: b.URL}}
+	require.NoError(a.replace(rep, archived))
+
+	b, err = serv.GetByID(b.ID)
+	require.NoError(err)
+	assert.Equal("https://example.com/gone", b.URL)
+	assert.Equal(archived, b.ArchiveURL)
+}
@@ -0,0 +1,52 @@
+package linkcheck
+
+import (
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// ExtractLinks returns the absolute http(s) URLs linked to or embedded by
+// the given HTML, in document order and without duplicates.
+func ExtractLinks(doc string) []string {
+	var links []string
+	seen := map[string]bool{}
+
+	z := html.NewTokenizer(strings.NewReader(doc))
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			return links
+		}
+		if tt != html.StartTagToken && tt != html.SelfClosingTagToken {
+			continue
+		}
+
+		tok := z.Token()
+		var attr string
+		switch tok.Data {
+		case "a":
+			attr = "href"
+		case "img":
+			attr = "src"
+		default:
+			continue
+		}
+
+		for _, a := range tok.Attr {
+			if a.Key != attr {
+				continue
+			}
+			u := strings.TrimSpace(a.Val)
+			if !isExternal(u) || seen[u] {
+				continue
+			}
+			seen[u] = true
+			links = append(links, u)
+		}
+	}
+}
+
+func isExternal(u string) bool {
+	return strings.HasPrefix(u, "http://") || strings.HasPrefix(u, "https://")
+}
@@ -0,0 +1,187 @@
+package linkcheck
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/monet/db"
+	"github.com/jmoiron/monet/db/monarch"
+	"github.com/jmoiron/sqlx"
+)
+
+var linkMigrations = monarch.Set{
+	Name: "linkcheck",
+	Migrations: []monarch.Migration{
+		{
+			Up: `CREATE TABLE IF NOT EXISTS link (
+				id integer PRIMARY KEY,
+				url text NOT NULL UNIQUE,
+				status integer NOT NULL DEFAULT 0,
+				final_url text NOT NULL DEFAULT '',
+				error text NOT NULL DEFAULT '',
+				checked_at integer NOT NULL DEFAULT 0
+			);`,
+			Down: `DROP TABLE link;`,
+		}, {
+			Up: `CREATE TABLE IF NOT EXISTS link_ref (
+				id integer PRIMARY KEY,
+				link_id integer NOT NULL,
+				item_type text NOT NULL,
+				item_id text NOT NULL,
+				item_title text NOT NULL DEFAULT '',
+				item_url text NOT NULL DEFAULT '',
+				FOREIGN KEY (link_id) REFERENCES link(id) ON DELETE CASCADE
+			);`,
+			Down: `DROP TABLE link_ref;`,
+		}, {
+			Up:   `CREATE UNIQUE INDEX IF NOT EXISTS link_ref_item ON link_ref (link_id, item_type, item_id);`,
+			Down: `DROP INDEX link_ref_item;`,
+		},
+	},
+}
+
+// Item types that can contain outbound links.
+const (
+	ItemPost     = "post"
+	ItemPage     = "page"
+	ItemBookmark = "bookmark"
+)
+
+// A Link is an external URL and the result of its last check.
+type Link struct {
+	ID        int64
+	URL       string
+	Status    int
+	FinalURL  string `db:"final_url"`
+	Error     string
+	CheckedAt int64 `db:"checked_at"`
+}
+
+// Broken is true if the last check failed or returned an error status.
+func (l *Link) Broken() bool {
+	return l.CheckedAt > 0 && (l.Error != "" || l.Status >= 400)
+}
+
+// Redirected is true if the last check ended up at a different URL.
+func (l *Link) Redirected() bool {
+	return l.FinalURL != "" && l.FinalURL != l.URL
+}
+
+// An Item is a piece of content (post, page, bookmark) and the links in it.
+type Item struct {
+	Type  string
+	ID    string
+	Title string
+	// AdminURL is where the item can be edited
+	AdminURL string
+	Links    []string
+}
+
+// A Report is a reference to a problematic link from an item.
+type Report struct {
+	RefID     int64  `db:"ref_id"`
+	ItemType  string `db:"item_type"`
+	ItemID    string `db:"item_id"`
+	ItemTitle string `db:"item_title"`
+	ItemURL   string `db:"item_url"`
+	Link
+}
+
+type LinkService struct {
+	db db.DB
+}
+
+func NewLinkService(db db.DB) *LinkService {
+	return &LinkService{db: db}
+}
+
+// SetItems replaces the link references with the links found in items.
+// Links that are no longer referenced by anything are removed.
+func (s *LinkService) SetItems(items []Item) error {
+	return db.With(s.db, func(tx *sqlx.Tx) error {
+		if _, err := tx.Exec(`DELETE FROM link_ref`); err != nil {
+			return err
+		}
+		for _, item := range items {
+			for _, url := range item.Links {
+				if _, err := tx.Exec(`INSERT INTO link (url) VALUES (?) ON CONFLICT (url) DO NOTHING`, url); err != nil {
+					return fmt.Errorf("insert link: %w", err)
+				}
+				_, err := tx.Exec(`INSERT INTO link_ref (link_id, item_type, item_id, item_title, item_url)
+					SELECT id, ?, ?, ?, ? FROM link WHERE url=?
+					ON CONFLICT DO NOTHING`,
+					item.Type, item.ID, item.Title, item.AdminURL, url)
+				if err != nil {
+					return fmt.Errorf("insert link_ref: %w", err)
+				}
+			}
+		}
+		_, err := tx.Exec(`DELETE FROM link WHERE id NOT IN (SELECT link_id FROM link_ref)`)
+		return err
+	})
+}
+
+// Stale returns links that have not been checked since before.
+func (s *LinkService) Stale(before time.Time) ([]Link, error) {
+	var links []Link
+	err := s.db.Select(&links, `SELECT * FROM link WHERE checked_at < ? ORDER BY checked_at, id`, before.Unix())
+	return links, err
+}
+
+// Record saves the result of a check.
+func (s *LinkService) Record(r Result) error {
+	_, err := s.db.Exec(`UPDATE link SET status=?, final_url=?, error=?, checked_at=? WHERE url=?`,
+		r.Status, r.FinalURL, r.Error, r.CheckedAt.Unix(), r.URL)
+	return err
+}
+
+// Problems returns all references to broken or redirected links.
+func (s *LinkService) Problems() ([]Report, error) {
+	var reports []Report
+	err := s.db.Select(&reports, `SELECT
+			r.id AS ref_id, r.item_type, r.item_id, r.item_title, r.item_url, l.*
+		FROM link_ref r JOIN link l ON l.id = r.link_id
+		WHERE l.checked_at > 0 AND (l.status >= 400 OR l.error != '' OR (l.final_url != '' AND l.final_url != l.url))
+		ORDER BY r.item_type, r.item_title, l.url`)
+	return reports, err
+}
+
+// GetReport returns the report for a single reference.
+func (s *LinkService) GetReport(refID int64) (*Report, error) {
+	var r Report
+	err := s.db.Get(&r, `SELECT
+			r.id AS ref_id, r.item_type, r.item_id, r.item_title, r.item_url, l.*
+		FROM link_ref r JOIN link l ON l.id = r.link_id
+		WHERE r.id=?`, refID)
+	if err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// DeleteRef removes a single reference, eg. after the link has been replaced.
+func (s *LinkService) DeleteRef(refID int64) error {
+	_, err := s.db.Exec(`DELETE FROM link_ref WHERE id=?`, refID)
+	return err
+}
+
+// Counts summarizes the state of all known links.
+type Counts struct {
+	Total      int
+	Broken     int
+	Redirected int
+}
+
+// Counts returns the number of known, broken, and redirected links.
+func (s *LinkService) Counts() (*Counts, error) {
+	var c Counts
+	err := s.db.Get(&c, `SELECT
+		count(*) AS total,
+		coalesce(sum(checked_at > 0 AND (status >= 400 OR error != '')), 0) AS broken,
+		coalesce(sum(checked_at > 0 AND final_url != '' AND final_url != url), 0) AS redirected
+	FROM link`)
+	if err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
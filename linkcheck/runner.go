@@ -0,0 +1,182 @@
+package linkcheck
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/monet/blog"
+	"github.com/jmoiron/monet/bookmarks"
+	"github.com/jmoiron/monet/conf"
+	"github.com/jmoiron/monet/db"
+	"github.com/jmoiron/monet/pages"
+)
+
+// A Runner periodically collects links from posts, pages and bookmarks and
+// checks the ones that have not been checked recently.
+type Runner struct {
+	db      db.DB
+	cfg     conf.LinkCheckConfig
+	links   *LinkService
+	checker *Checker
+
+	startOnce sync.Once
+
+	mu      sync.Mutex
+	running bool
+}
+
+func NewRunner(database db.DB, cfg conf.LinkCheckConfig) *Runner {
+	return &Runner{
+		db:      database,
+		cfg:     cfg,
+		links:   NewLinkService(database),
+		checker: NewChecker(cfg),
+	}
+}
+
+// Start the background checker if an interval is configured.
+func (r *Runner) Start() {
+	if r.cfg.Interval <= 0 {
+		return
+	}
+	r.startOnce.Do(func() {
+		go r.loop()
+	})
+}
+
+func (r *Runner) loop() {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for ; ; <-ticker.C {
+		if err := r.Run(context.Background(), false); err != nil {
+			slog.Error("checking links", "err", err)
+		}
+	}
+}
+
+func (r *Runner) IsRunning() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.running
+}
+
+func (r *Runner) begin() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.running {
+		return false
+	}
+	r.running = true
+	return true
+}
+
+func (r *Runner) end() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.running = false
+}
+
+// Run refreshes the set of known links and checks them.  Unless all is
+// true, only links not checked within the configured interval are checked.
+func (r *Runner) Run(ctx context.Context, all bool) error {
+	if !r.begin() {
+		return fmt.Errorf("link check is already running")
+	}
+	defer r.end()
+
+	items, err := r.collect()
+	if err != nil {
+		return err
+	}
+	if err := r.links.SetItems(items); err != nil {
+		return fmt.Errorf("updating links: %w", err)
+	}
+
+	before := time.Now().Add(-time.Duration(r.cfg.Interval) * time.Hour)
+	if all {
+		before = time.Now()
+	}
+	stale, err := r.links.Stale(before)
+	if err != nil {
+		return err
+	}
+
+	urls := make([]string, 0, len(stale))
+	for _, l := range stale {
+		urls = append(urls, l.URL)
+	}
+
+	slog.Info("checking links", "items", len(items), "links", len(urls))
+	r.checker.CheckAll(ctx, urls, func(res Result) {
+		if err := r.links.Record(res); err != nil {
+			slog.Error("recording link check", "url", res.URL, "err", err)
+		}
+	})
+	return nil
+}
+
+// collect returns every item that may contain outbound links.
+func (r *Runner) collect() ([]Item, error) {
+	var items []Item
+
+	posts, err := blog.NewPostService(r.db).Select("")
+	if err != nil {
+		return nil, fmt.Errorf("loading posts: %w", err)
+	}
+	for _, p := range posts {
+		items = append(items, Item{
+			Type:     ItemPost,
+			ID:       fmt.Sprint(p.ID),
+			Title:    p.Title,
+			AdminURL: "/admin/posts/edit/" + p.Slug,
+			Links:    ExtractLinks(p.ContentRendered),
+		})
+	}
+
+	pageList, err := pages.NewPageService(r.db).GetAll()
+	if err != nil {
+		return nil, fmt.Errorf("loading pages: %w", err)
+	}
+	for _, p := range pageList {
+		title := p.Title
+		if title == "" {
+			title = p.Path()
+		}
+		items = append(items, Item{
+			Type:     ItemPage,
+			ID:       fmt.Sprint(p.ID),
+			Title:    title,
+			AdminURL: fmt.Sprintf("/admin/pages/edit/%d", p.ID),
+			Links:    ExtractLinks(p.ContentRendered),
+		})
+	}
+
+	bms, err := bookmarks.NewBookmarkService(r.db).Select("")
+	if err != nil {
+		return nil, fmt.Errorf("loading bookmarks: %w", err)
+	}
+	for _, b := range bms {
+		links := []string{}
+		// bookmarks whose page has been archived elsewhere are dealt with
+		if isExternal(b.URL) && b.ArchiveURL == "" {
+			links = append(links, b.URL)
+		}
+		title := b.Title
+		if title == "" {
+			title = b.URL
+		}
+		items = append(items, Item{
+			Type:     ItemBookmark,
+			ID:       b.ID,
+			Title:    title,
+			AdminURL: "/admin/bookmarks/edit/" + b.ID,
+			Links:    links,
+		})
+	}
+
+	return items, nil
+}
@@ -10,7 +10,9 @@ import (
 	"net/http"
 	"os"
 	"strings"
+	"time"
 
+	"github.com/dustin/go-humanize"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 
@@ -22,6 +24,7 @@ import (
 	"github.com/jmoiron/monet/conf"
 	"github.com/jmoiron/monet/db"
 	"github.com/jmoiron/monet/db/monarch"
+	"github.com/jmoiron/monet/linkcheck"
 	"github.com/jmoiron/monet/mtr"
 	"github.com/jmoiron/monet/pages"
 	"github.com/jmoiron/monet/pkg/hotswap"
@@ -51,6 +54,10 @@ type options struct {
 	LoadEvents string
 	LoadPages  string
 
+	SyncBookmarks bool
+	HashUploads   bool
+	Reconcile     string
+
 	ShowMigration bool
 	Downgrade     string
 }
@@ -110,10 +117,40 @@ func main() {
 	config := die(loadConfig(opts.ConfigPath))("loading config")
 
 	// set up filesystems
+	buckets := make(map[string]*vfs.S3FS, len(config.FSS.Buckets))
+	for name, bc := range config.FSS.Buckets {
+		buckets[name] = die(vfs.NewS3FS(vfs.S3Options{
+			Endpoint:  bc.Endpoint,
+			Region:    bc.Region,
+			Bucket:    bc.Bucket,
+			Prefix:    bc.Prefix,
+			AccessKey: bc.AccessKey,
+			SecretKey: bc.SecretKey,
+			PathStyle: bc.PathStyle,
+			URLExpiry: time.Duration(bc.URLExpiry) * time.Second,
+			Timeout:   time.Duration(bc.Timeout) * time.Second,
+		}))("loading bucket", "name", name)
+		if config.FSS.URLs == nil {
+			config.FSS.URLs = make(map[string]string)
+		}
+		if _, ok := config.FSS.URLs[name]; !ok {
+			config.FSS.URLs[name] = buckets[name].PublicURL("")
+		}
+	}
+
 	fss := vfs.NewRegistry(vfs.NewURLMapper(config.FSS.URLs))
 	for name, path := range config.FSS.Paths {
 		must(fss.AddPath(name, path), "loading paths")
 	}
+	for name, bucket := range buckets {
+		must(fss.Add(name, bucket), "loading buckets")
+		if config.FSS.Buckets[name].SignURLs {
+			fss.Mapper().SetSigner(name, bucket)
+		}
+	}
+	for name, pc := range config.FSS.Policies {
+		fss.SetPolicy(name, die(uploadPolicy(pc))("loading upload policy", "name", name))
+	}
 
 	static := die(fs.Sub(static, "static"))("initializing static fs")
 	staticAlt := try(fss.Get("static"))("initializing alternative static path")
@@ -140,12 +177,14 @@ func main() {
 	var (
 		authApp      = auth.NewApp(config, dbh)
 		adminApp     = admin.NewApp(dbh, authApp.Sessions).WithBaseURL("/admin/")
-		blogApp      = blog.NewApp(dbh, fss).WithBaseURL("/blog/")
-		bookmarksApp = bookmarks.NewApp(dbh).WithBaseURL("/bookmarks/").WithFSS(fss)
+		blogApp      = blog.NewApp(dbh, fss).WithBaseURL("/blog/").WithUploads(config.Uploads)
+		bookmarksApp = bookmarks.NewApp(dbh).WithBaseURL("/bookmarks/").WithFSS(fss).WithConfig(config.Bookmarks)
 		streamApp    = stream.NewApp(dbh).WithBaseURL("/stream/")
+		linksApp     = linkcheck.NewApp(dbh).WithConfig(config.LinkCheck)
 		pagesApp     = pages.NewApp(dbh)
-		uploadApp    = uploads.NewApp(dbh, fss)
+		uploadApp    = uploads.NewApp(dbh, fss).WithConfig(config.Uploads)
 	)
+	defer uploadApp.Stop()
 
 	// pages should be last as it binds to /*
 
@@ -153,7 +192,7 @@ func main() {
 	// be migrated before some of the other apps. It would be an
 	// interesting challenge for this to be determined automatically
 	// but probably not necessary
-	apps := []app.App{authApp, adminApp, uploadApp, blogApp, bookmarksApp, streamApp, pagesApp}
+	apps := []app.App{authApp, adminApp, uploadApp, blogApp, bookmarksApp, streamApp, linksApp, pagesApp}
 
 	reg := mtr.NewRegistry()
 	reg.AddBaseFS("base", "templates/base.html", templates)
@@ -164,10 +203,10 @@ func main() {
 		app.Register(reg)
 	}
 
-	adminOrder := []app.App{authApp, adminApp, blogApp, bookmarksApp, streamApp, pagesApp, uploadApp}
+	adminOrder := []app.App{authApp, adminApp, blogApp, bookmarksApp, streamApp, pagesApp, uploadApp, linksApp}
 	adminApp.Collect(adminOrder...)
 
-	if runUtil(&opts, dbh) {
+	if runUtil(&opts, config, dbh, fss) {
 		return
 	}
 
@@ -228,6 +267,10 @@ func main() {
 	if config.Debug {
 		allPaths := fss.Mapper().GetMap()
 		for name, path := range allPaths {
+			// buckets and CDNs serve themselves
+			if strings.Contains(path, "://") {
+				continue
+			}
 			fsys, err := fss.Get(name)
 			if err != nil {
 				slog.Warn("failed to get filesystem for debug serving", "name", name, "error", err)
@@ -362,6 +405,37 @@ func loadConfig(path string) (*conf.Config, error) {
 	return cfg, nil
 }
 
+// uploadPolicy returns the vfs.Policy configured by pc.
+func uploadPolicy(pc conf.PolicyConfig) (*vfs.Policy, error) {
+	p := &vfs.Policy{
+		AllowedTypes: pc.AllowedTypes,
+		Filenames: vfs.FilenameRules{
+			Lowercase: pc.Lowercase,
+			Restrict:  pc.Restrict,
+			MaxLength: pc.MaxNameLength,
+		},
+	}
+	switch pc.MaxSize {
+	case "":
+	case "unlimited":
+		p.MaxSize = -1
+	default:
+		n, err := humanize.ParseBytes(pc.MaxSize)
+		if err != nil {
+			return nil, fmt.Errorf("MaxSize: %w", err)
+		}
+		p.MaxSize = int64(n)
+	}
+	if pc.Quota != "" {
+		n, err := humanize.ParseBytes(pc.Quota)
+		if err != nil {
+			return nil, fmt.Errorf("Quota: %w", err)
+		}
+		p.Quota = int64(n)
+	}
+	return p, nil
+}
+
 func parseOpts(opts *options) {
 	pflag.StringVarP(&opts.ConfigPath, "config", "c", os.Getenv(cfgEnvVar), "path to a json config file")
 	pflag.BoolVarP(&opts.Debug, "debug", "d", false, "enable debug mode")
@@ -370,12 +444,16 @@ func parseOpts(opts *options) {
 	pflag.StringVar(&opts.LoadPosts, "load-posts", "", "load posts from json")
 	pflag.StringVar(&opts.LoadEvents, "load-events", "", "load events from json")
 	pflag.StringVar(&opts.LoadPages, "load-pages", "", "load pages from json")
+	pflag.BoolVar(&opts.SyncBookmarks, "sync-bookmarks", false, "publish all published bookmarks to the stream")
+	pflag.BoolVar(&opts.HashUploads, "hash-uploads", false, "hash uploads stored before deduplication")
+	pflag.StringVar(&opts.Reconcile, "reconcile", "", "compare uploads with their files: report, adopt untracked files or prune missing ones")
+	pflag.Lookup("reconcile").NoOptDefVal = "report"
 	pflag.BoolVar(&opts.ShowMigration, "migrations", false, "show migration state for each application")
 	pflag.StringVar(&opts.Downgrade, "downgrade", "", "downgrade an app by one migration version")
 	pflag.Parse()
 }
 
-func runUtil(opts *options, db db.DB) bool {
+func runUtil(opts *options, config *conf.Config, db db.DB, fss vfs.Registry) bool {
 	switch {
 	case len(opts.AddUser) > 0:
 		if err := addUser(db, opts.AddUser); err != nil {
@@ -393,8 +471,84 @@ func runUtil(opts *options, db db.DB) bool {
 		if err := loadPages(db, opts.LoadPages); err != nil {
 			fmt.Printf("ERror: %s\n", err)
 		}
+	case opts.SyncBookmarks:
+		n, err := bookmarks.NewBookmarkService(db).SyncStreamAll()
+		if err != nil {
+			fmt.Printf("Error: %s\n", err)
+		}
+		fmt.Printf("Synced %d bookmarks to the stream\n", n)
+	case opts.HashUploads:
+		n, err := uploads.NewUploadService(db).WithConfig(config.Uploads).BackfillHashes(fss)
+		if err != nil {
+			fmt.Printf("Error: %s\n", err)
+		}
+		fmt.Printf("Hashed %d uploads\n", n)
+	case len(opts.Reconcile) > 0:
+		if err := reconcileUploads(db, fss, config.Uploads, opts.Reconcile); err != nil {
+			fmt.Printf("Error: %s\n", err)
+		}
 	default:
 		return false
 	}
 	return true
 }
+
+// reconcileUploads reports the drift between the upload table and the
+// filesystems reconciled by cfg, and adopts untracked files or prunes uploads whose files are
+// missing if action asks for it.  Unreferenced uploads are only reported;
+// delete them from the admin.
+func reconcileUploads(db db.DB, fss vfs.Registry, cfg conf.UploadsConfig, action string) error {
+	if action != "report" && action != "adopt" && action != "prune" {
+		return fmt.Errorf("unknown reconcile action %q", action)
+	}
+	serv := uploads.NewUploadService(db).WithConfig(cfg)
+	rec, err := serv.Reconcile(fss)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Untracked files (%d):\n", len(rec.Untracked))
+	for _, f := range rec.Untracked {
+		fmt.Printf("  %s/%s\n", f.FilesystemName, f.Filename)
+		if action != "adopt" {
+			continue
+		}
+		fsys, err := fss.GetWritable(f.FilesystemName)
+		if err != nil {
+			return err
+		}
+		upload, err := serv.Adopt(fsys, f.FilesystemName, f.Filename)
+		if err != nil {
+			fmt.Printf("    failed to adopt: %s\n", err)
+			continue
+		}
+		serv.GenerateDerivatives(upload, fsys)
+		fmt.Printf("    adopted as upload %d\n", upload.ID)
+	}
+
+	fmt.Printf("Missing files (%d):\n", len(rec.Missing))
+	for _, m := range rec.Missing {
+		fmt.Printf("  %s/%s (upload %d)\n", m.FilesystemName, m.Filename, m.ID)
+		for _, c := range m.Candidates {
+			fmt.Printf("    could be %s\n", c.Filename)
+		}
+		if action != "prune" {
+			continue
+		}
+		fsys, err := fss.GetWritable(m.FilesystemName)
+		if err != nil {
+			return err
+		}
+		if err := serv.Purge(fsys, m.ID); err != nil {
+			fmt.Printf("    failed to prune: %s\n", err)
+			continue
+		}
+		fmt.Printf("    pruned\n")
+	}
+
+	fmt.Printf("Unreferenced uploads (%d):\n", len(rec.Unreferenced))
+	for _, u := range rec.Unreferenced {
+		fmt.Printf("  %s/%s (upload %d)\n", u.FilesystemName, u.Filename, u.ID)
+	}
+	return nil
+}
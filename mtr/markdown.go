@@ -0,0 +1,71 @@
+package mtr
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/text"
+)
+
+// An ImageHook returns extra attributes for an image in rendered markdown,
+// eg. a srcset for an image that has smaller copies.  It returns nil for
+// images that it doesn't know about.
+type ImageHook func(src string) map[string]string
+
+var imageHooks struct {
+	mu    sync.RWMutex
+	names []string
+	hooks []ImageHook
+}
+
+// SetImageHook sets the hook called name, which is consulted for each image
+// rendered by RenderMarkdown.  Setting a name again replaces its hook.  The
+// first hook to return attributes for an image wins.
+func SetImageHook(name string, h ImageHook) {
+	imageHooks.mu.Lock()
+	defer imageHooks.mu.Unlock()
+	for i, n := range imageHooks.names {
+		if n == name {
+			imageHooks.hooks[i] = h
+			return
+		}
+	}
+	imageHooks.names = append(imageHooks.names, name)
+	imageHooks.hooks = append(imageHooks.hooks, h)
+}
+
+func imageAttrs(src string) map[string]string {
+	imageHooks.mu.RLock()
+	defer imageHooks.mu.RUnlock()
+	for _, h := range imageHooks.hooks {
+		if attrs := h(src); attrs != nil {
+			return attrs
+		}
+	}
+	return nil
+}
+
+// imageTransformer sets the attributes returned by the image hooks on
+// images; goldmark's renderer then writes them out.
+type imageTransformer struct{}
+
+func (imageTransformer) Transform(doc *ast.Document, reader text.Reader, pc parser.Context) {
+	ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		img, ok := n.(*ast.Image)
+		if !entering || !ok {
+			return ast.WalkContinue, nil
+		}
+		attrs := imageAttrs(string(img.Destination))
+		names := make([]string, 0, len(attrs))
+		for name := range attrs {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			img.SetAttributeString(name, []byte(attrs[name]))
+		}
+		return ast.WalkSkipChildren, nil
+	})
+}
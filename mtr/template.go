@@ -11,6 +11,7 @@ import (
 	"io"
 	"io/fs"
 	"log/slog"
+	"sort"
 	gostrings "strings"
 	"sync"
 
@@ -22,7 +23,9 @@ import (
 	"github.com/go-sprout/sprout/registry/strings"
 	"github.com/yuin/goldmark"
 	"github.com/yuin/goldmark/extension"
+	"github.com/yuin/goldmark/parser"
 	"github.com/yuin/goldmark/renderer/html"
+	"github.com/yuin/goldmark/util"
 )
 
 type regKey struct{}
@@ -65,6 +68,9 @@ type Registry struct {
 	// synchronized set of deferred templates
 	dts []deferredTemplate
 	mu  sync.Mutex
+	// funcs is the function map built by Build, used to parse templates
+	// that are not known until runtime
+	funcs template.FuncMap
 
 	// Handler is a sprout handler.
 	Handler sprout.Handler
@@ -150,6 +156,7 @@ func (r *Registry) Build() error {
 	var errs []error
 
 	fns := r.Handler.Build()
+	r.funcs = fns
 	slog.Debug("dts", "len", len(r.dts))
 
 	for _, t := range r.dts {
@@ -216,19 +223,44 @@ func (r *Registry) Render(w io.Writer, name string, ctx Ctx) error {
 	return c.Execute(w, r.DefaultCtx.Union(ctx))
 }
 
+// Has returns true if a template called name has been built.
+func (r *Registry) Has(name string) bool {
+	return r.tmpl.get(name) != nil
+}
+
+// Names returns the sorted names of built templates that start with prefix.
+func (r *Registry) Names(prefix string) []string {
+	return r.tmpl.names(prefix)
+}
+
+// Parse parses text as a template with the registry's functions.  It can
+// be used for templates that are not known until runtime, eg. those
+// stored in a database.  Registry.Build must be called first.
+func (r *Registry) Parse(name, text string) (*template.Template, error) {
+	r.mu.Lock()
+	fns := r.funcs
+	r.mu.Unlock()
+	return template.New(name).Funcs(fns).Parse(text)
+}
+
 // RenderWithBase renders the template 'name' with the base template 'base' to the writer,
 // using the provided context.  The base template template will receive the child template's
 // content as 'body', which it should incorporate into its structure.
 func (r *Registry) RenderWithBase(w io.Writer, base, name string, ctx Ctx) error {
-	baseTpl := r.base.get(base)
 	content := r.tmpl.get(name)
+	if content == nil {
+		return fmt.Errorf("could not find template '%s'", name)
+	}
+	return r.RenderTemplateWithBase(w, base, content, ctx)
+}
 
+// RenderTemplateWithBase is like RenderWithBase, but renders the template
+// content, eg. one that was created with Parse.
+func (r *Registry) RenderTemplateWithBase(w io.Writer, base string, content *template.Template, ctx Ctx) error {
+	baseTpl := r.base.get(base)
 	if baseTpl == nil {
 		return fmt.Errorf("could not find base template '%s'", base)
 	}
-	if content == nil {
-		return fmt.Errorf("could not find template '%s'", name)
-	}
 
 	var s bytes.Buffer
 	err := content.Execute(&s, r.DefaultCtx.Union(ctx))
@@ -255,6 +287,9 @@ func RegistryFromContext(ctx context.Context) *Registry {
 func RenderMarkdown(source string) string {
 	parser := goldmark.New(
 		goldmark.WithExtensions(extension.GFM),
+		goldmark.WithParserOptions(
+			parser.WithASTTransformers(util.Prioritized(imageTransformer{}, 500)),
+		),
 		goldmark.WithRendererOptions(
 			html.WithUnsafe(),
 		),
@@ -288,6 +323,19 @@ func (r *registry) get(name string) *template.Template {
 	return r.reg[name]
 }
 
+func (r *registry) names(prefix string) []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var names []string
+	for name := range r.reg {
+		if gostrings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
 func newRegistry() *registry {
 	return &registry{reg: make(map[string]*template.Template, 10)}
 }
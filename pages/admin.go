@@ -6,6 +6,7 @@ import (
 	"log/slog"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/jmoiron/monet/app"
@@ -15,18 +16,30 @@ import (
 
 type Admin struct {
 	db      db.DB
+	routes  *routeTable
 	BaseURL string
 }
 
 func NewPageAdmin(db db.DB) *Admin {
 	return &Admin{db: db}
 }
+
+func (a *Admin) withRoutes(t *routeTable) *Admin {
+	a.routes = t
+	return a
+}
+
+// service returns a PageService that keeps the app's routes up to date.
+func (a *Admin) service() *PageService {
+	return NewPageService(a.db).withRoutes(a.routes)
+}
 func (a *Admin) Bind(r chi.Router) {
 	r.Get("/pages/", a.list)
 	r.Get("/pages/{page:[0-9]+}", a.list)
 	r.Get("/pages/add/", a.add)
 	r.Get("/pages/edit/{id:\\d+}", a.edit)
 	r.Get("/pages/delete/{id:\\d+}", a.del)
+	r.Get("/pages/preview/{id:\\d+}", a.preview)
 
 	r.Post("/pages/add/", a.add)
 	r.Post("/pages/edit/{id:\\d+}", a.save)
@@ -65,8 +78,15 @@ func (a *Admin) Panels(r *http.Request) ([]string, error) {
 }
 
 func (a *Admin) list(w http.ResponseWriter, r *http.Request) {
-	var count int
-	if err := a.db.Get(&count, "SELECT count(*) FROM page;"); err != nil {
+	if err := r.ParseForm(); err != nil {
+		slog.Error("parsing form", "err", err)
+	}
+
+	query := r.Form.Get("q")
+	svc := a.service()
+
+	count, err := svc.SearchCount(query, QueryAll)
+	if err != nil {
 		app.Http500("getting count", w, err)
 		return
 	}
@@ -75,8 +95,7 @@ func (a *Admin) list(w http.ResponseWriter, r *http.Request) {
 	paginator := mtr.NewPaginator(adminPageSize, count)
 	page := paginator.Page(app.GetIntParam(r, "page", 1))
 
-	var pages []Page
-	err := a.db.Select(&pages, `SELECT * FROM page ORDER BY updated_at DESC LIMIT ? OFFSET ?`, adminPageSize, page.StartOffset)
+	pages, err := svc.Search(query, QueryAll, adminPageSize, page.StartOffset)
 	if err != nil {
 		slog.Error("looking up pages", "error", err)
 		app.Http404(w)
@@ -86,6 +105,7 @@ func (a *Admin) list(w http.ResponseWriter, r *http.Request) {
 	reg := mtr.RegistryFromContext(r.Context())
 	err = reg.RenderWithBase(w, "admin-base", "pages/admin/page-list.html", mtr.Ctx{
 		"pages":      pages,
+		"query":      query,
 		"pagination": paginator.Render(reg, page),
 	})
 
@@ -101,7 +121,7 @@ func (a *Admin) del(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	svc := NewPageService(a.db)
+	svc := a.service()
 	if err := svc.DeleteByID(id); err != nil {
 		app.Http500("deleting", w, err)
 	}
@@ -110,7 +130,7 @@ func (a *Admin) del(w http.ResponseWriter, r *http.Request) {
 }
 
 func (a *Admin) edit(w http.ResponseWriter, r *http.Request) {
-	svc := NewPageService(a.db)
+	svc := a.service()
 	id := app.GetIntParam(r, "id", -1)
 	p, err := svc.GetByID(id)
 	if err != nil {
@@ -121,10 +141,46 @@ func (a *Admin) edit(w http.ResponseWriter, r *http.Request) {
 	a.showEdit(w, r, p)
 }
 
+// preview renders a page as it would be published, including drafts.
+func (a *Admin) preview(w http.ResponseWriter, r *http.Request) {
+	p, err := a.service().GetByID(app.GetIntParam(r, "id", -1))
+	if err != nil {
+		app.Http404(w)
+		return
+	}
+
+	routes := a.routes
+	if routes == nil {
+		routes = newRouteTable()
+	}
+	reg := mtr.RegistryFromContext(r.Context())
+	if err := render(w, reg, p, pageContext(p, routes)); err != nil {
+		slog.Error("rendering preview", "err", err)
+	}
+}
+
 func (a *Admin) showEdit(w http.ResponseWriter, r *http.Request, p *Page) {
+	a.showEditErr(w, r, p, nil)
+}
+
+func (a *Admin) showEditErr(w http.ResponseWriter, r *http.Request, p *Page, formErr error) {
+	parents, err := a.service().GetAll()
+	if err != nil {
+		app.Http500("loading pages", w, err)
+		return
+	}
+
+	var msg string
+	if formErr != nil {
+		msg = formErr.Error()
+	}
+
 	reg := mtr.RegistryFromContext(r.Context())
-	err := reg.RenderWithBase(w, "admin-base", "pages/page-edit.html", mtr.Ctx{
-		"page": p,
+	err = reg.RenderWithBase(w, "admin-base", "pages/page-edit.html", mtr.Ctx{
+		"page":    p,
+		"parents": parents,
+		"layouts": Layouts(reg),
+		"error":   msg,
 	})
 
 	if err != nil {
@@ -148,10 +204,18 @@ func (a *Admin) add(w http.ResponseWriter, r *http.Request) {
 	// save a new page
 	r.ParseForm()
 	p := &Page{
+		Title:   r.FormValue("title"),
 		Content: r.FormValue("content"),
 		URL:     r.FormValue("url"),
 	}
-	svc := NewPageService(a.db)
+	readPublishedForm(r, p)
+	readNavForm(r, p)
+	readLayoutForm(r, p)
+	if err := checkTemplate(r, p); err != nil {
+		a.showEditErr(w, r, p, err)
+		return
+	}
+	svc := a.service()
 	if err := svc.Insert(p); err != nil {
 		app.Http500("inserting new page", w, err)
 		return
@@ -165,7 +229,7 @@ func (a *Admin) save(w http.ResponseWriter, r *http.Request) {
 	r.ParseForm()
 	id, _ := strconv.Atoi(r.FormValue("id"))
 
-	svc := NewPageService(a.db)
+	svc := a.service()
 	p, err := svc.GetByID(id)
 	if err != nil {
 		app.Http500("saving non-existant page", w, err)
@@ -173,7 +237,15 @@ func (a *Admin) save(w http.ResponseWriter, r *http.Request) {
 	}
 
 	p.URL = r.FormValue("url")
+	p.Title = r.FormValue("title")
 	p.Content = r.FormValue("content")
+	readPublishedForm(r, p)
+	readNavForm(r, p)
+	readLayoutForm(r, p)
+	if err := checkTemplate(r, p); err != nil {
+		a.showEditErr(w, r, p, err)
+		return
+	}
 
 	if err = svc.Save(p); err != nil {
 		app.Http500("saving page", w, err)
@@ -182,3 +254,48 @@ func (a *Admin) save(w http.ResponseWriter, r *http.Request) {
 
 	a.showEdit(w, r, p)
 }
+
+// readPublishedForm reads the published toggle from the form, setting the
+// publish time when a page is first published.
+func readPublishedForm(r *http.Request, p *Page) {
+	published, _ := strconv.Atoi(r.FormValue("published"))
+	if published == p.Published {
+		return
+	}
+	p.Published = published
+	if published == 0 {
+		p.PublishedAt = time.Time{}
+	} else {
+		p.PublishedAt = time.Now()
+	}
+}
+
+// readNavForm reads the page's position in the hierarchy from the form.
+func readNavForm(r *http.Request, p *Page) {
+	p.ParentID, _ = strconv.Atoi(r.FormValue("parent"))
+	p.SortOrder, _ = strconv.Atoi(r.FormValue("sortOrder"))
+	p.ShowInNav = r.FormValue("showInNav") == "on"
+}
+
+// readLayoutForm reads the page's layout, includes and metadata from the form.
+func readLayoutForm(r *http.Request, p *Page) {
+	p.Layout = r.FormValue("layout")
+	p.Template = r.FormValue("template")
+	p.CSS = r.FormValue("css")
+	p.JS = r.FormValue("js")
+	p.Description = r.FormValue("description")
+	p.OgImage = r.FormValue("ogImage")
+	p.NoIndex = r.FormValue("noindex") == "on"
+}
+
+// checkTemplate returns an error if p's custom template does not parse.
+func checkTemplate(r *http.Request, p *Page) error {
+	if len(p.Template) == 0 {
+		return nil
+	}
+	reg := mtr.RegistryFromContext(r.Context())
+	if _, err := reg.Parse("page", p.Template); err != nil {
+		return fmt.Errorf("custom template: %w", err)
+	}
+	return nil
+}
@@ -4,11 +4,13 @@ import (
 	"embed"
 	"fmt"
 	"html/template"
+	"io"
 	"log/slog"
 	"net/http"
 	"strings"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/go-sprout/sprout"
 	"github.com/jmoiron/monet/app"
 	"github.com/jmoiron/monet/db"
 	"github.com/jmoiron/monet/db/monarch"
@@ -18,17 +20,33 @@ import (
 //go:embed pages/*
 var pageTemplates embed.FS
 
+const (
+	// DefaultLayout is the template pages are rendered with by default.
+	DefaultLayout = "pages/page.html"
+	// templates under layoutPrefix can be chosen as a page's layout
+	layoutPrefix = "pages/layouts/"
+)
+
 type App struct {
-	db db.DB
+	db     db.DB
+	routes *routeTable
 }
 
 func NewApp(db db.DB) *App {
-	return &App{db: db}
+	return &App{db: db, routes: newRouteTable()}
 }
 
 func (a *App) Name() string { return "pages" }
 
 func (a *App) Register(reg *mtr.Registry) {
+	reg.Handler.AddRegistry(
+		mtr.NewSproutRegistry("pages", sprout.FunctionMap{
+			// siteNav returns the pages that are shown in the site menu
+			"siteNav": func() []*Page {
+				return a.routes.Nav()
+			},
+		}),
+	)
 	reg.AddAllFS(pageTemplates)
 }
 
@@ -41,48 +59,104 @@ func (a *App) Migrate() error {
 }
 
 func (a *App) GetAdmin() (app.Admin, error) {
-	return NewPageAdmin(a.db), nil
+	return NewPageAdmin(a.db).withRoutes(a.routes), nil
 }
 
+// Bind serves pages from the router's NotFound handler, so that any route
+// registered by another app takes precedence over a page with the same URL.
+// Pages are looked up in an in-memory route table that is refreshed whenever
+// a page is added, saved or deleted.
 func (a *App) Bind(r chi.Router) {
-	// Dynamic paths that check the database on each request
-	r.Get("/notes/*", a.page)
-	r.Get("/essays/*", a.page)
-
-	// Register static routes for pages outside dynamic paths
-	serv := NewPageService(a.db)
-	pages, err := serv.GetAll()
-	if err != nil {
+	if err := a.routes.Load(a.db); err != nil {
 		slog.Error("failed to load pages for routing", "err", err)
-		return
 	}
+	r.NotFound(a.notFound)
+}
 
-	for _, p := range pages {
-		url := "/" + p.URL
-		// Skip pages in dynamic paths
-		if strings.HasPrefix(url, "/notes/") || strings.HasPrefix(url, "/essays/") {
-			continue
-		}
-		// Register static route for this page
-		r.Get(url, a.page)
+func (a *App) notFound(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		app.Http404(w)
+		return
+	}
+	if a.routes.Has(r.URL.Path) {
+		a.page(w, r)
+		return
 	}
+	if section := a.routes.Section(r.URL.Path); len(section) > 0 {
+		a.section(w, r, section)
+		return
+	}
+	app.Http404(w)
 }
 
-// dynamicPage handles requests to /notes/* and /essays/* by checking the database
+// page renders the page at the request's path.
 func (a *App) page(w http.ResponseWriter, r *http.Request) {
 	url := strings.TrimLeft(r.URL.Path, "/")
 	serv := NewPageService(a.db)
 
 	p, err := serv.GetByURL(url)
-	if err != nil {
+	if err != nil || p.Published == 0 {
 		app.Http404(w)
 		return
 	}
 
 	reg := mtr.RegistryFromContext(r.Context())
-	err = reg.RenderWithBase(w, "base", "pages/page.html", mtr.Ctx{
-		"title": fmt.Sprintf(p.Title),
-		"page":  template.HTML(p.ContentRendered),
+	if err := render(w, reg, p, pageContext(p, a.routes)); err != nil {
+		slog.Error("rendering template", "err", err)
+	}
+}
+
+// pageContext returns the template context for rendering p.
+func pageContext(p *Page, routes *routeTable) mtr.Ctx {
+	return mtr.Ctx{
+		"title":         p.Title,
+		"page":          template.HTML(p.ContentRendered),
+		"p":             p,
+		"breadcrumbs":   routes.Breadcrumbs(p.ID),
+		"children":      routes.Children(p.ID),
+		"css":           p.Stylesheets(),
+		"js":            p.Scripts(),
+		"noindex":       p.NoIndex,
+		"ogTitle":       p.Title,
+		"ogDescription": p.Description,
+		"ogImage":       p.OgImage,
+	}
+}
+
+// render p with its custom template or layout.  Pages with a custom template
+// that does not parse, or with an unknown layout, use the default layout.
+func render(w io.Writer, reg *mtr.Registry, p *Page, ctx mtr.Ctx) error {
+	if len(p.Template) > 0 {
+		t, err := reg.Parse(fmt.Sprintf("page-%d", p.ID), p.Template)
+		if err == nil {
+			return reg.RenderTemplateWithBase(w, "base", t, ctx)
+		}
+		slog.Error("parsing page template", "id", p.ID, "err", err)
+	}
+	return reg.RenderWithBase(w, "base", layoutOrDefault(reg, p.Layout), ctx)
+}
+
+// Layouts returns the names of the layouts that pages can be rendered with.
+func Layouts(reg *mtr.Registry) []string {
+	return append([]string{DefaultLayout}, reg.Names(layoutPrefix)...)
+}
+
+func layoutOrDefault(reg *mtr.Registry, layout string) string {
+	if strings.HasPrefix(layout, layoutPrefix) && reg.Has(layout) {
+		return layout
+	}
+	return DefaultLayout
+}
+
+// section renders an index of the pages under a path that has no page of
+// its own, eg. "/notes/".
+func (a *App) section(w http.ResponseWriter, r *http.Request, pages []*Page) {
+	name := strings.Trim(r.URL.Path, "/")
+	reg := mtr.RegistryFromContext(r.Context())
+	err := reg.RenderWithBase(w, "base", "pages/section.html", mtr.Ctx{
+		"title": name,
+		"name":  name,
+		"pages": pages,
 	})
 
 	if err != nil {
@@ -0,0 +1,215 @@
+package pages
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"testing/fstest"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/jmoiron/monet/mtr"
+	"github.com/jmoiron/sqlx"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestApp(t *testing.T) (*App, http.Handler) {
+	db, err := sqlx.Connect("sqlite3", ":memory:")
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+
+	a := NewApp(db)
+	require.NoError(t, a.Migrate())
+
+	reg := mtr.NewRegistry()
+	reg.AddBaseFS("base", "base.html", fstest.MapFS{"base.html": {Data: []byte(
+		`{{range .css}}<link href="{{.}}">{{end}}{{if .noindex}}<noindex>{{end}}{{.body}}`)}})
+	reg.AddPathFS("pages/page.html", pageTemplates)
+	reg.AddPathFS("pages/section.html", pageTemplates)
+	reg.AddPathFS("pages/layouts/landing.html", pageTemplates)
+	require.NoError(t, reg.Build())
+
+	r := chi.NewRouter()
+	r.Use(mtr.AddRegistryMiddleware(reg))
+	r.Get("/blog/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("blog"))
+	})
+	a.Bind(r)
+	return a, r
+}
+
+func get(h http.Handler, path string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+	return w
+}
+
+func TestDynamicRoutes(t *testing.T) {
+	assert := assert.New(t)
+	a, h := newTestApp(t)
+
+	assert.Equal(http.StatusNotFound, get(h, "/about").Code)
+
+	// pages added after Bind are served without rebinding
+	admin, err := a.GetAdmin()
+	require.NoError(t, err)
+	serv := admin.(*Admin).service()
+
+	p := &Page{URL: "/about", Content: "hello", Published: 1}
+	require.NoError(t, serv.Insert(p))
+	w := get(h, "/about")
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Contains(w.Body.String(), "<p>hello</p>")
+
+	// changing the url moves the page
+	p.URL = "/notes/about"
+	require.NoError(t, serv.Save(p))
+	assert.Equal(http.StatusNotFound, get(h, "/about").Code)
+	assert.Equal(http.StatusOK, get(h, "/notes/about").Code)
+
+	require.NoError(t, serv.DeleteByID(p.ID))
+	assert.Equal(http.StatusNotFound, get(h, "/notes/about").Code)
+
+	// routes registered by other apps take precedence
+	require.NoError(t, serv.Insert(&Page{URL: "/blog/", Content: "shadowed", Published: 1}))
+	assert.Equal("blog", get(h, "/blog/").Body.String())
+}
+
+func TestHierarchy(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	a, h := newTestApp(t)
+	serv := NewPageService(a.db).withRoutes(a.routes)
+
+	notes := &Page{URL: "/notes", Content: "notes", ShowInNav: true, SortOrder: 2, Published: 1}
+	require.NoError(serv.Insert(notes))
+	about := &Page{URL: "/about", Content: "about", ShowInNav: true, SortOrder: 1, Published: 1}
+	require.NoError(serv.Insert(about))
+	golang := &Page{URL: "/notes/go", Content: "go", ParentID: notes.ID, SortOrder: 2, Published: 1}
+	require.NoError(serv.Insert(golang))
+	sql := &Page{URL: "/notes/sql", Content: "sql", ParentID: notes.ID, SortOrder: 1, Published: 1}
+	require.NoError(serv.Insert(sql))
+	channels := &Page{URL: "/notes/go/channels", Content: "chan", ParentID: golang.ID, Published: 1}
+	require.NoError(serv.Insert(channels))
+
+	var nav []string
+	for _, p := range a.routes.Nav() {
+		nav = append(nav, p.Label())
+	}
+	assert.Equal([]string{"about", "notes"}, nav)
+
+	var children []string
+	for _, p := range a.routes.Children(notes.ID) {
+		children = append(children, p.Path())
+	}
+	assert.Equal([]string{"/notes/sql", "/notes/go"}, children)
+
+	crumbs := a.routes.Breadcrumbs(channels.ID)
+	require.Len(crumbs, 2)
+	assert.Equal(notes.ID, crumbs[0].ID)
+	assert.Equal(golang.ID, crumbs[1].ID)
+
+	body := get(h, "/notes").Body.String()
+	assert.Contains(body, `<a href="/notes/sql">sql</a>`)
+	body = get(h, "/notes/go/channels").Body.String()
+	assert.Contains(body, `<a href="/notes/go">go</a>`)
+
+	// a page cannot become its own ancestor
+	notes.ParentID = channels.ID
+	assert.Error(serv.Save(notes))
+	notes.ParentID = 0
+
+	// children of a deleted page move up to its parent
+	require.NoError(serv.DeleteByID(golang.ID))
+	kids, err := serv.GetChildren(notes.ID)
+	require.NoError(err)
+	assert.Len(kids, 2)
+
+	// sections without a page of their own get an index
+	require.NoError(serv.Insert(&Page{URL: "/essays/one", Content: "one", Published: 1}))
+	w := get(h, "/essays/")
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Contains(w.Body.String(), `<a href="/essays/one">one</a>`)
+	assert.Equal(http.StatusNotFound, get(h, "/missing/").Code)
+}
+
+func TestLayouts(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	a, h := newTestApp(t)
+	serv := NewPageService(a.db).withRoutes(a.routes)
+
+	p := &Page{URL: "/launch", Content: "hello", CSS: "/static/a.css\n\n/static/b.css", NoIndex: true, Published: 1}
+	require.NoError(serv.Insert(p))
+	body := get(h, "/launch").Body.String()
+	assert.Contains(body, `<link href="/static/a.css"><link href="/static/b.css"><noindex>`)
+	assert.NotContains(body, "landing")
+
+	p.Layout = "pages/layouts/landing.html"
+	require.NoError(serv.Save(p))
+	assert.Contains(get(h, "/launch").Body.String(), `class="page-content landing"`)
+
+	// only templates under the layouts prefix can be used
+	p.Layout = "pages/section.html"
+	require.NoError(serv.Save(p))
+	assert.NotContains(get(h, "/launch").Body.String(), "landing")
+
+	p.Template = `<main>{{.page}}</main>`
+	require.NoError(serv.Save(p))
+	assert.Contains(get(h, "/launch").Body.String(), "<main><p>hello</p>\n</main>")
+
+	// broken templates fall back to the layout
+	p.Template = `{{.page`
+	require.NoError(serv.Save(p))
+	w := get(h, "/launch")
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Contains(w.Body.String(), "<p>hello</p>")
+}
+
+func TestDraftsAndSearch(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	a, h := newTestApp(t)
+	serv := NewPageService(a.db).withRoutes(a.routes)
+
+	draft := &Page{URL: "/colophon", Title: "Colophon", Content: "set in lora"}
+	require.NoError(serv.Insert(draft))
+	assert.Equal(http.StatusNotFound, get(h, "/colophon").Code)
+
+	p, err := serv.GetByID(draft.ID)
+	require.NoError(err)
+	assert.Equal("Colophon", p.Title)
+
+	require.NoError(serv.Insert(&Page{URL: "/uses", Title: "Uses", Content: "a lora typeface", Published: 1}))
+
+	for _, c := range []struct {
+		query  string
+		filter int
+		count  int
+	}{
+		{"lora", QueryAll, 2},
+		{"lora", QueryPublished, 1},
+		{"lora", QueryUnpublished, 1},
+		{"colophon", QueryAll, 1},
+		{"", QueryAll, 2},
+		{"", QueryPublished, 1},
+	} {
+		count, err := serv.SearchCount(c.query, c.filter)
+		require.NoError(err)
+		assert.Equal(c.count, count, c.query)
+		pages, err := serv.Search(c.query, c.filter, 10, 0)
+		require.NoError(err)
+		assert.Len(pages, c.count, c.query)
+	}
+
+	draft.Published = 1
+	require.NoError(serv.Save(draft))
+	w := get(h, "/colophon")
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Equal("Colophon", a.routes.urls["colophon"].Label())
+
+	count, err := serv.SearchCount("lora", QueryPublished)
+	require.NoError(err)
+	assert.Equal(2, count)
+}
@@ -2,6 +2,7 @@ package pages
 
 import (
 	"fmt"
+	"log/slog"
 	"strings"
 	"time"
 
@@ -24,10 +25,83 @@ var pageMigrations = monarch.Set{
 				updated_at datetime DEFAULT (strftime('%s', 'now'))
 			);`,
 			Down: `DROP TABLE page;`,
+		}, {
+			Up:   `ALTER TABLE page ADD COLUMN parent_id integer NOT NULL DEFAULT 0;`,
+			Down: `ALTER TABLE page DROP COLUMN parent_id;`,
+		}, {
+			Up:   `ALTER TABLE page ADD COLUMN sort_order integer NOT NULL DEFAULT 0;`,
+			Down: `ALTER TABLE page DROP COLUMN sort_order;`,
+		}, {
+			Up:   `ALTER TABLE page ADD COLUMN show_in_nav integer NOT NULL DEFAULT 0;`,
+			Down: `ALTER TABLE page DROP COLUMN show_in_nav;`,
+		}, {
+			Up: `ALTER TABLE page ADD COLUMN layout text NOT NULL DEFAULT '';
+				ALTER TABLE page ADD COLUMN template text NOT NULL DEFAULT '';
+				ALTER TABLE page ADD COLUMN css text NOT NULL DEFAULT '';
+				ALTER TABLE page ADD COLUMN js text NOT NULL DEFAULT '';`,
+			Down: `ALTER TABLE page DROP COLUMN layout;
+				ALTER TABLE page DROP COLUMN template;
+				ALTER TABLE page DROP COLUMN css;
+				ALTER TABLE page DROP COLUMN js;`,
+		}, {
+			Up: `ALTER TABLE page ADD COLUMN description text NOT NULL DEFAULT '';
+				ALTER TABLE page ADD COLUMN og_image text NOT NULL DEFAULT '';
+				ALTER TABLE page ADD COLUMN noindex integer NOT NULL DEFAULT 0;`,
+			Down: `ALTER TABLE page DROP COLUMN description;
+				ALTER TABLE page DROP COLUMN og_image;
+				ALTER TABLE page DROP COLUMN noindex;`,
+		}, {
+			Up:   `ALTER TABLE page ADD COLUMN title text NOT NULL DEFAULT '';`,
+			Down: `ALTER TABLE page DROP COLUMN title;`,
+		}, {
+			// pages that predate drafts were all live, so publish them
+			Up: `ALTER TABLE page ADD COLUMN published integer NOT NULL DEFAULT 0;
+				ALTER TABLE page ADD COLUMN published_at datetime DEFAULT 0;
+				UPDATE page SET published=1, published_at=updated_at;`,
+			Down: `ALTER TABLE page DROP COLUMN published;
+				ALTER TABLE page DROP COLUMN published_at;`,
+		}, {
+			Up: `CREATE VIRTUAL TABLE page_fts USING fts5(
+				id, url, title, content, published,
+				content='page',
+				content_rowid='id',
+				tokenize="trigram"
+			)`,
+			Down: `DROP TABLE page_fts;`,
+		}, {
+			Up:   `INSERT INTO page_fts(page_fts) VALUES ('rebuild');`,
+			Down: `DELETE FROM page_fts;`,
+		}, {
+			Up: `CREATE TRIGGER page_i AFTER INSERT ON page BEGIN
+				INSERT INTO page_fts (rowid, id, url, title, content, published) VALUES
+					(new.id, new.id, new.url, new.title, new.content, new.published);
+			END;`,
+			Down: `DROP TRIGGER page_i;`,
+		}, {
+			Up: `CREATE TRIGGER page_d AFTER DELETE ON page BEGIN
+				INSERT INTO page_fts (page_fts, rowid, id, url, title, content, published) VALUES
+					('delete', old.id, old.id, old.url, old.title, old.content, old.published);
+			END;`,
+			Down: `DROP TRIGGER page_d;`,
+		}, {
+			Up: `CREATE TRIGGER page_u AFTER UPDATE ON page BEGIN
+				INSERT INTO page_fts (page_fts, rowid, id, url, title, content, published) VALUES
+					('delete', old.id, old.id, old.url, old.title, old.content, old.published);
+				INSERT INTO page_fts (rowid, id, url, title, content, published) VALUES
+					(new.id, new.id, new.url, new.title, new.content, new.published);
+			END;`,
+			Down: `DROP TRIGGER page_u;`,
 		},
 	},
 }
 
+// Query filter constants for search functionality
+const (
+	QueryAll         = -1 // Search all pages regardless of published status
+	QueryUnpublished = 0  // Search draft pages only
+	QueryPublished   = 1  // Search published pages only
+)
+
 type Page struct {
 	ID              int
 	URL             string
@@ -36,6 +110,60 @@ type Page struct {
 	ContentRendered string    `db:"content_rendered"`
 	CreatedAt       time.Time `db:"created_at"`
 	UpdatedAt       time.Time `db:"updated_at"`
+	PublishedAt     time.Time `db:"published_at"`
+	// Published is 1 for live pages and 0 for drafts.
+	Published int
+	// ParentID is the id of this page's parent, or 0 for top level pages.
+	ParentID  int  `db:"parent_id"`
+	SortOrder int  `db:"sort_order"`
+	ShowInNav bool `db:"show_in_nav"`
+
+	// Layout is the name of a registered template to render the page with;
+	// if empty, DefaultLayout is used.
+	Layout string
+	// Template is the source of a custom template for this page; if set it
+	// takes precedence over Layout.
+	Template string
+	// CSS and JS are newline separated lists of stylesheets and scripts to
+	// include on this page.
+	CSS         string
+	JS          string
+	Description string
+	OgImage     string `db:"og_image"`
+	NoIndex     bool   `db:"noindex"`
+}
+
+// Stylesheets returns the page's CSS includes.
+func (p *Page) Stylesheets() []string { return splitLines(p.CSS) }
+
+// Scripts returns the page's JS includes.
+func (p *Page) Scripts() []string { return splitLines(p.JS) }
+
+func splitLines(s string) []string {
+	var lines []string
+	for _, line := range strings.Split(s, "\n") {
+		if line = strings.TrimSpace(line); len(line) > 0 {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// Label is the text used for this page in menus and breadcrumbs.
+func (p *Page) Label() string {
+	if len(p.Title) > 0 {
+		return p.Title
+	}
+	url := strings.TrimSuffix(p.URL, "/")
+	if i := strings.LastIndex(url, "/"); i >= 0 {
+		url = url[i+1:]
+	}
+	return url
+}
+
+// Path is the absolute URL path of the page.
+func (p *Page) Path() string {
+	return "/" + p.URL
 }
 
 func (p *Page) preSave() {
@@ -47,16 +175,63 @@ func (p *Page) preSave() {
 }
 
 type PageService struct {
-	db db.DB
+	db     db.DB
+	routes *routeTable
 }
 
 func NewPageService(db db.DB) *PageService {
 	return &PageService{db: db}
 }
 
+// withRoutes sets a route table to refresh when pages are modified.
+func (s *PageService) withRoutes(t *routeTable) *PageService {
+	s.routes = t
+	return s
+}
+
+// refresh reloads the route table after a successful modification.
+func (s *PageService) refresh(err error) error {
+	if err != nil || s.routes == nil {
+		return err
+	}
+	if rerr := s.routes.Load(s.db); rerr != nil {
+		slog.Error("refreshing page routes", "err", rerr)
+	}
+	return nil
+}
+
+// DeleteByID deletes a page.  Its children are moved up to its parent.
 func (s *PageService) DeleteByID(id int) error {
-	_, err := s.db.Exec("DELETE FROM page WHERE id=?", id)
-	return err
+	return s.refresh(db.With(s.db, func(tx *sqlx.Tx) error {
+		_, err := tx.Exec(`UPDATE page SET parent_id=(SELECT parent_id FROM page WHERE id=?) WHERE parent_id=?`, id, id)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("DELETE FROM page WHERE id=?", id)
+		return err
+	}))
+}
+
+// GetChildren returns the pages whose parent is id in menu order.
+func (s *PageService) GetChildren(id int) ([]Page, error) {
+	var pages []Page
+	err := s.db.Select(&pages, `SELECT * FROM page WHERE parent_id=? ORDER BY sort_order, url`, id)
+	return pages, err
+}
+
+// checkParent returns an error if p's parent would make it its own ancestor.
+func (s *PageService) checkParent(p *Page) error {
+	seen := map[int]bool{p.ID: true}
+	for parent := p.ParentID; parent > 0; {
+		if seen[parent] {
+			return fmt.Errorf("page %d cannot be a descendant of itself", p.ID)
+		}
+		seen[parent] = true
+		if err := s.db.Get(&parent, `SELECT parent_id FROM page WHERE id=?`, parent); err != nil {
+			return fmt.Errorf("parent %d: %w", parent, err)
+		}
+	}
+	return nil
 }
 
 func (s *PageService) GetAll() ([]Page, error) {
@@ -85,12 +260,19 @@ func (s *PageService) GetByID(id int) (*Page, error) {
 
 func (s *PageService) Insert(p *Page) error {
 	q := `INSERT INTO page
-		(url, content, content_rendered) VALUES
-		(:url, :content, :content_rendered);
+		(url, title, content, content_rendered, published, published_at,
+		 parent_id, sort_order, show_in_nav,
+		 layout, template, css, js, description, og_image, noindex) VALUES
+		(:url, :title, :content, :content_rendered, :published, :published_at,
+		 :parent_id, :sort_order, :show_in_nav,
+		 :layout, :template, :css, :js, :description, :og_image, :noindex);
 	`
 	p.preSave()
+	if err := s.checkParent(p); err != nil {
+		return err
+	}
 
-	return db.With(s.db, func(tx *sqlx.Tx) error {
+	return s.refresh(db.With(s.db, func(tx *sqlx.Tx) error {
 		stmt, err := tx.PrepareNamed(q)
 		if err != nil {
 			return err
@@ -110,7 +292,7 @@ func (s *PageService) Insert(p *Page) error {
 		p.ID = int(id)
 
 		return nil
-	})
+	}))
 
 }
 
@@ -122,11 +304,18 @@ func (s *PageService) Save(p *Page) error {
 	}
 
 	p.preSave()
+	if err := s.checkParent(p); err != nil {
+		return err
+	}
 
-	return db.With(s.db, func(tx *sqlx.Tx) error {
+	return s.refresh(db.With(s.db, func(tx *sqlx.Tx) error {
 		q := `UPDATE page SET
-			url=:url, content=:content, content_rendered=:content_rendered,
-			updated_at=:updated_at
+			url=:url, title=:title, content=:content, content_rendered=:content_rendered,
+			updated_at=:updated_at, published=:published, published_at=:published_at,
+			parent_id=:parent_id, sort_order=:sort_order,
+			show_in_nav=:show_in_nav, layout=:layout, template=:template,
+			css=:css, js=:js, description=:description, og_image=:og_image,
+			noindex=:noindex
 		WHERE id=:id`
 		update, err := tx.PrepareNamed(q)
 		if err != nil {
@@ -135,14 +324,14 @@ func (s *PageService) Save(p *Page) error {
 		defer update.Close()
 		_, err = update.Exec(p)
 		return err
-	})
+	}))
 }
 
-// InsertArchive inserts a page from an archive
+// InsertArchive inserts a page from an archive.  Archived pages are live.
 // NOTE: archived pages do not have timestamps or titles so we're ignoring those
 func (s *PageService) InsertArchive(p *Page) error {
-	q := `INSERT INTO page (url, content, content_rendered) VALUES
-			(:url, :content, :content_rendered);`
+	q := `INSERT INTO page (url, content, content_rendered, published, published_at) VALUES
+			(:url, :content, :content_rendered, 1, strftime('%s', 'now'));`
 
 	stmt, err := s.db.PrepareNamed(q)
 	if err != nil {
@@ -152,3 +341,51 @@ func (s *PageService) InsertArchive(p *Page) error {
 	_, err = stmt.Exec(p)
 	return err
 }
+
+// Search performs a full-text search on pages with ternary published filter.
+// publishedFilter: QueryAll, QueryUnpublished, or QueryPublished
+func (s *PageService) Search(query string, publishedFilter int, limit, offset int) ([]Page, error) {
+	var pages []Page
+	if strings.TrimSpace(query) == "" {
+		q, args := `SELECT * FROM page`, []any{}
+		if publishedFilter != QueryAll {
+			q += ` WHERE published=?`
+			args = append(args, publishedFilter)
+		}
+		q += ` ORDER BY updated_at DESC LIMIT ? OFFSET ?`
+		err := s.db.Select(&pages, q, append(args, limit, offset)...)
+		return pages, err
+	}
+
+	q, args := `SELECT page.* FROM page JOIN page_fts ON page_fts.rowid = page.id
+		WHERE page_fts MATCH ?`, []any{db.SafeQuery(query)}
+	if publishedFilter != QueryAll {
+		q += ` AND page.published=?`
+		args = append(args, publishedFilter)
+	}
+	q += ` ORDER BY rank LIMIT ? OFFSET ?`
+	err := s.db.Select(&pages, q, append(args, limit, offset)...)
+	return pages, err
+}
+
+// SearchCount returns the count of pages matching the search query.
+func (s *PageService) SearchCount(query string, publishedFilter int) (int, error) {
+	var count int
+	if strings.TrimSpace(query) == "" {
+		q, args := `SELECT count(*) FROM page`, []any{}
+		if publishedFilter != QueryAll {
+			q += ` WHERE published=?`
+			args = append(args, publishedFilter)
+		}
+		err := s.db.Get(&count, q, args...)
+		return count, err
+	}
+
+	q, args := `SELECT count(*) FROM page_fts WHERE page_fts MATCH ?`, []any{db.SafeQuery(query)}
+	if publishedFilter != QueryAll {
+		q += ` AND published=?`
+		args = append(args, publishedFilter)
+	}
+	err := s.db.Get(&count, q, args...)
+	return count, err
+}
@@ -0,0 +1,136 @@
+package pages
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/jmoiron/monet/db"
+)
+
+// A routeTable is the in-memory set of pages that the pages app serves,
+// along with their hierarchy.  It is refreshed whenever a PageService that
+// carries it adds, changes or removes a page, so new pages are reachable
+// without a restart.
+type routeTable struct {
+	mu       sync.RWMutex
+	urls     map[string]*Page
+	ids      map[int]*Page
+	children map[int][]*Page
+}
+
+func newRouteTable() *routeTable {
+	return &routeTable{
+		urls:     map[string]*Page{},
+		ids:      map[int]*Page{},
+		children: map[int][]*Page{},
+	}
+}
+
+// Load replaces the table with the published pages currently in db.  Page
+// content is not kept in memory.
+func (t *routeTable) Load(db db.DB) error {
+	var pages []*Page
+	q := `SELECT id, url, title, parent_id, sort_order, show_in_nav
+		FROM page WHERE published=1 ORDER BY sort_order, url`
+	if err := db.Select(&pages, q); err != nil {
+		return err
+	}
+
+	urls := make(map[string]*Page, len(pages))
+	ids := make(map[int]*Page, len(pages))
+	children := map[int][]*Page{}
+	for _, p := range pages {
+		urls[p.URL] = p
+		ids[p.ID] = p
+	}
+	for _, p := range pages {
+		parent := p.ParentID
+		if _, ok := ids[parent]; !ok {
+			parent = 0
+		}
+		children[parent] = append(children[parent], p)
+	}
+
+	t.mu.Lock()
+	t.urls, t.ids, t.children = urls, ids, children
+	t.mu.Unlock()
+	return nil
+}
+
+// Has returns true if path is the URL of a page.
+func (t *routeTable) Has(path string) bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.urls[strings.TrimLeft(path, "/")] != nil
+}
+
+// Nav returns the pages that should be shown in the site navigation.
+func (t *routeTable) Nav() []*Page {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	var nav []*Page
+	for _, p := range t.ids {
+		if p.ShowInNav {
+			nav = append(nav, p)
+		}
+	}
+	sortPages(nav)
+	return nav
+}
+
+// Children returns the children of the page id in menu order.
+func (t *routeTable) Children(id int) []*Page {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.children[id]
+}
+
+// Breadcrumbs returns the ancestors of the page id, starting at the root.
+func (t *routeTable) Breadcrumbs(id int) []*Page {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	var crumbs []*Page
+	seen := map[int]bool{id: true}
+	p := t.ids[id]
+	for p != nil && p.ParentID > 0 && !seen[p.ParentID] {
+		seen[p.ParentID] = true
+		p = t.ids[p.ParentID]
+		if p != nil {
+			crumbs = append([]*Page{p}, crumbs...)
+		}
+	}
+	return crumbs
+}
+
+// Section returns the pages below the directory path, eg. all pages under
+// "/notes/", in menu order.  It's used to index sections without a page.
+func (t *routeTable) Section(path string) []*Page {
+	prefix := strings.Trim(path, "/") + "/"
+	if prefix == "/" {
+		return nil
+	}
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	var pages []*Page
+	for url, p := range t.urls {
+		if strings.HasPrefix(url, prefix) {
+			pages = append(pages, p)
+		}
+	}
+	sortPages(pages)
+	return pages
+}
+
+func sortPages(pages []*Page) {
+	sort.Slice(pages, func(i, j int) bool {
+		if pages[i].SortOrder != pages[j].SortOrder {
+			return pages[i].SortOrder < pages[j].SortOrder
+		}
+		return pages[i].URL < pages[j].URL
+	})
+}
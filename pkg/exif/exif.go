@@ -0,0 +1,651 @@
+// Package exif reads, strips and applies the EXIF metadata of JPEG images.
+//
+// Only the tags that describe how a photo was taken are read; see Info.
+package exif
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"math"
+	"strings"
+	"time"
+)
+
+// ErrNoEXIF is returned by Decode for images without EXIF metadata.
+var ErrNoEXIF = errors.New("exif: no exif metadata")
+
+// Info is the metadata of a photo.
+type Info struct {
+	Make  string
+	Model string
+	Lens  string
+	// ExposureTime is in seconds, eg. "1/125" or "2".
+	ExposureTime string
+	FNumber      float64
+	ISO          int
+	// FocalLength is in mm.
+	FocalLength float64
+	// Taken is when the photo was taken, in the camera's local time if it
+	// didn't record its offset from UTC.
+	Taken time.Time
+	// Orientation is how the image must be transformed to be upright, from
+	// 1 (it already is) to 8.
+	Orientation int
+
+	HasLocation bool
+	Latitude    float64
+	Longitude   float64
+}
+
+// Camera returns the make and model of the camera, without repeating the
+// make if the model already includes it.
+func (i *Info) Camera() string {
+	if i.Make == "" || strings.HasPrefix(strings.ToLower(i.Model), strings.ToLower(i.Make)) {
+		return i.Model
+	}
+	return strings.TrimSpace(i.Make + " " + i.Model)
+}
+
+// tags
+const (
+	tagMake             = 0x010F
+	tagModel            = 0x0110
+	tagOrientation      = 0x0112
+	tagDateTime         = 0x0132
+	tagExifIFD          = 0x8769
+	tagGPSIFD           = 0x8825
+	tagExposureTime     = 0x829A
+	tagFNumber          = 0x829D
+	tagISO              = 0x8827
+	tagDateTimeOriginal = 0x9003
+	tagOffsetTime       = 0x9011
+	tagFocalLength      = 0x920A
+	tagMakerNote        = 0x927C
+	tagImageUniqueID    = 0xA420
+	tagCameraOwnerName  = 0xA430
+	tagBodySerialNumber = 0xA431
+	tagLensMake         = 0xA433
+	tagLensModel        = 0xA434
+	tagLensSerialNumber = 0xA435
+	tagCameraSerial     = 0xC62F
+
+	tagGPSLatitudeRef  = 1
+	tagGPSLatitude     = 2
+	tagGPSLongitudeRef = 3
+	tagGPSLongitude    = 4
+)
+
+// sensitive tags identify the photographer or their camera, and are
+// removed by Strip along with the location.
+var sensitive = map[uint16]bool{
+	tagGPSIFD:           true,
+	tagMakerNote:        true,
+	tagImageUniqueID:    true,
+	tagCameraOwnerName:  true,
+	tagBodySerialNumber: true,
+	tagLensSerialNumber: true,
+	tagCameraSerial:     true,
+}
+
+// Decode reads the EXIF metadata of the JPEG image data.
+func Decode(data []byte) (*Info, error) {
+	t, err := findTIFF(data)
+	if err != nil {
+		return nil, err
+	}
+
+	info := &Info{Orientation: 1}
+	ifd0, _, err := t.ifd(t.first())
+	if err != nil {
+		return nil, err
+	}
+	var dateTime, original, offset string
+	for _, e := range ifd0 {
+		switch e.tag {
+		case tagMake:
+			info.Make = t.string(e)
+		case tagModel:
+			info.Model = t.string(e)
+		case tagOrientation:
+			if o := t.uint(e); o >= 1 && o <= 8 {
+				info.Orientation = o
+			}
+		case tagDateTime:
+			dateTime = t.string(e)
+		case tagExifIFD:
+			sub, _, err := t.ifd(uint32(t.uint(e)))
+			if err != nil {
+				continue
+			}
+			for _, e := range sub {
+				switch e.tag {
+				case tagExposureTime:
+					if r := t.rationals(e); len(r) > 0 {
+						info.ExposureTime = r[0].exposure()
+					}
+				case tagFNumber:
+					info.FNumber = t.float(e)
+				case tagISO:
+					info.ISO = t.uint(e)
+				case tagDateTimeOriginal:
+					original = t.string(e)
+				case tagOffsetTime:
+					offset = t.string(e)
+				case tagFocalLength:
+					info.FocalLength = t.float(e)
+				case tagLensModel:
+					info.Lens = t.string(e)
+				}
+			}
+		case tagGPSIFD:
+			sub, _, err := t.ifd(uint32(t.uint(e)))
+			if err != nil {
+				continue
+			}
+			info.decodeGPS(t, sub)
+		}
+	}
+
+	if original == "" {
+		original = dateTime
+	}
+	info.Taken = parseTime(original, offset)
+	return info, nil
+}
+
+func (i *Info) decodeGPS(t *tiff, entries []entry) {
+	var latRef, lonRef string
+	var lat, lon []rational
+	for _, e := range entries {
+		switch e.tag {
+		case tagGPSLatitudeRef:
+			latRef = t.string(e)
+		case tagGPSLatitude:
+			lat = t.rationals(e)
+		case tagGPSLongitudeRef:
+			lonRef = t.string(e)
+		case tagGPSLongitude:
+			lon = t.rationals(e)
+		}
+	}
+	if len(lat) != 3 || len(lon) != 3 {
+		return
+	}
+	i.HasLocation = true
+	i.Latitude = degrees(lat, latRef == "S")
+	i.Longitude = degrees(lon, lonRef == "W")
+}
+
+// degrees converts degrees, minutes and seconds to decimal degrees.
+func degrees(dms []rational, negative bool) float64 {
+	d := dms[0].float() + dms[1].float()/60 + dms[2].float()/3600
+	if negative {
+		d = -d
+	}
+	return d
+}
+
+func parseTime(s, offset string) time.Time {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return time.Time{}
+	}
+	if offset != "" {
+		if t, err := time.Parse("2006:01:02 15:04:05-07:00", s+offset); err == nil {
+			return t
+		}
+	}
+	t, _ := time.Parse("2006:01:02 15:04:05", s)
+	return t
+}
+
+// Strip returns a copy of the JPEG image data without its location and the
+// tags that identify who took it, like serial numbers and the camera
+// owner's name.  XMP and IPTC metadata, which can also hold the location,
+// are removed entirely.
+func Strip(data []byte) ([]byte, error) {
+	segs, err := segments(data)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, 0, len(data))
+	out = append(out, data[:2]...)
+	for _, s := range segs {
+		switch {
+		case s.isXMP(data), s.isIPTC(data):
+			continue
+		case s.isEXIF(data):
+			seg := append([]byte{}, data[s.start:s.end]...)
+			t, err := newTIFF(seg[s.payload-s.start+6:])
+			if err != nil {
+				return nil, err
+			}
+			if err := t.strip(); err != nil {
+				return nil, err
+			}
+			out = append(out, seg...)
+		default:
+			out = append(out, data[s.start:s.end]...)
+		}
+	}
+	if len(segs) > 0 {
+		out = append(out, data[segs[len(segs)-1].end:]...)
+	}
+	return out, nil
+}
+
+// strip removes the sensitive entries from each IFD, and zeroes the GPS IFD.
+func (t *tiff) strip() error {
+	off := t.first()
+	for i := 0; off != 0 && i < 4; i++ {
+		entries, next, err := t.ifd(off)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if e.tag == tagExifIFD {
+				if err := t.removeEntries(uint32(t.uint(e))); err != nil {
+					return err
+				}
+			}
+			if e.tag == tagGPSIFD {
+				t.zeroIFD(uint32(t.uint(e)))
+			}
+		}
+		if err := t.removeEntries(off); err != nil {
+			return err
+		}
+		// the next IFD's offset moves with the entries
+		_, next, _ = t.ifd(off)
+		off = next
+	}
+	return nil
+}
+
+// removeEntries removes the sensitive entries of the IFD at off, zeroing
+// their values.  Entries are only moved within the IFD, so the offsets of
+// other values stay the same.
+func (t *tiff) removeEntries(off uint32) error {
+	entries, next, err := t.ifd(off)
+	if err != nil {
+		return err
+	}
+	var kept [][]byte
+	for _, e := range entries {
+		if sensitive[e.tag] {
+			t.zeroValue(e)
+			continue
+		}
+		kept = append(kept, append([]byte{}, t.b[e.pos:e.pos+12]...))
+	}
+	if len(kept) == len(entries) {
+		return nil
+	}
+
+	pos := int(off)
+	end := pos + 2 + 12*len(entries) + 4
+	t.bo.PutUint16(t.b[pos:], uint16(len(kept)))
+	pos += 2
+	for _, k := range kept {
+		pos += copy(t.b[pos:], k)
+	}
+	t.bo.PutUint32(t.b[pos:], next)
+	clear(t.b[pos+4 : end])
+	return nil
+}
+
+// zeroIFD zeroes the IFD at off and its values.
+func (t *tiff) zeroIFD(off uint32) {
+	entries, _, err := t.ifd(off)
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		t.zeroValue(e)
+	}
+	clear(t.b[off : int(off)+2+12*len(entries)+4])
+}
+
+// zeroValue zeroes the value of e, if it is stored outside of the entry.
+func (t *tiff) zeroValue(e entry) {
+	if v, ok := t.value(e); ok && e.size() > 4 {
+		clear(v)
+	}
+}
+
+// Orient returns img transformed so that it's upright, according to an
+// EXIF orientation.
+func Orient(img image.Image, orientation int) image.Image {
+	if orientation < 2 || orientation > 8 {
+		return img
+	}
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			var sx, sy int
+			switch orientation {
+			case 2:
+				sx, sy = w-1-x, y
+			case 3:
+				sx, sy = w-1-x, h-1-y
+			case 4:
+				sx, sy = x, h-1-y
+			case 5:
+				sx, sy = y, x
+			case 6:
+				sx, sy = y, h-1-x
+			case 7:
+				sx, sy = w-1-y, h-1-x
+			case 8:
+				sx, sy = w-1-y, x
+			}
+			dst.Set(x, y, img.At(b.Min.X+sx, b.Min.Y+sy))
+		}
+	}
+	return dst
+}
+
+// AutoRotate returns the JPEG image data re-encoded with quality so that
+// it's upright, with its orientation reset.  Its EXIF metadata and color
+// profile are kept.  Images that are already upright are returned as is.
+func AutoRotate(data []byte, quality int) ([]byte, error) {
+	info, err := Decode(data)
+	if err != nil || info.Orientation <= 1 {
+		return data, nil
+	}
+	img, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("exif: %w", err)
+	}
+	var enc bytes.Buffer
+	if err := jpeg.Encode(&enc, Orient(img, info.Orientation), &jpeg.Options{Quality: quality}); err != nil {
+		return nil, fmt.Errorf("exif: %w", err)
+	}
+
+	segs, err := segments(data)
+	if err != nil {
+		return nil, err
+	}
+	out := append([]byte{}, data[:2]...)
+	for _, s := range segs {
+		if !s.isEXIF(data) && !s.isICC(data) {
+			continue
+		}
+		seg := append([]byte{}, data[s.start:s.end]...)
+		if s.isEXIF(data) {
+			if t, err := newTIFF(seg[s.payload-s.start+6:]); err == nil {
+				t.setOrientation(1)
+			}
+		}
+		out = append(out, seg...)
+	}
+	// the encoder's output starts with its own SOI marker
+	return append(out, enc.Bytes()[2:]...), nil
+}
+
+// setOrientation sets the orientation tag of IFD0, if it has one.
+func (t *tiff) setOrientation(o uint16) {
+	entries, _, err := t.ifd(t.first())
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		if e.tag == tagOrientation && e.typ == typeShort {
+			t.bo.PutUint16(t.b[e.pos+8:], o)
+		}
+	}
+}
+
+// A segment is a marker segment of a JPEG, from its marker at start to end.
+type segment struct {
+	marker     byte
+	start, end int
+	// payload is where the data after the segment's length starts.
+	payload int
+}
+
+func (s segment) hasPrefix(data []byte, prefix string) bool {
+	return bytes.HasPrefix(data[s.payload:s.end], []byte(prefix))
+}
+
+func (s segment) isEXIF(data []byte) bool {
+	return s.marker == 0xE1 && s.hasPrefix(data, "Exif\x00\x00") && s.end-s.payload > 14
+}
+
+func (s segment) isXMP(data []byte) bool {
+	return s.marker == 0xE1 && s.hasPrefix(data, "http://ns.adobe.com/")
+}
+
+func (s segment) isIPTC(data []byte) bool {
+	return s.marker == 0xED && s.hasPrefix(data, "Photoshop 3.0")
+}
+
+func (s segment) isICC(data []byte) bool {
+	return s.marker == 0xE2 && s.hasPrefix(data, "ICC_PROFILE\x00")
+}
+
+// segments returns the marker segments of the JPEG data that come before
+// its image data.
+func segments(data []byte) ([]segment, error) {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return nil, errors.New("exif: not a jpeg")
+	}
+	var segs []segment
+	for pos := 2; pos+4 <= len(data); {
+		if data[pos] != 0xFF {
+			return nil, errors.New("exif: invalid jpeg marker")
+		}
+		marker := data[pos+1]
+		if marker == 0xFF {
+			pos++ // fill byte
+			continue
+		}
+		if marker == 0xDA || marker == 0xD9 {
+			break // the image data follows
+		}
+		length := int(binary.BigEndian.Uint16(data[pos+2:]))
+		end := pos + 2 + length
+		if length < 2 || end > len(data) {
+			return nil, errors.New("exif: truncated jpeg segment")
+		}
+		segs = append(segs, segment{marker: marker, start: pos, end: end, payload: pos + 4})
+		pos = end
+	}
+	return segs, nil
+}
+
+// findTIFF returns the TIFF structure holding the EXIF metadata of the
+// JPEG data.
+func findTIFF(data []byte) (*tiff, error) {
+	segs, err := segments(data)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range segs {
+		if s.isEXIF(data) {
+			return newTIFF(data[s.payload+6 : s.end])
+		}
+	}
+	return nil, ErrNoEXIF
+}
+
+// field types
+const (
+	typeByte      = 1
+	typeASCII     = 2
+	typeShort     = 3
+	typeLong      = 4
+	typeRational  = 5
+	typeUndefined = 7
+	typeSLong     = 9
+	typeSRational = 10
+)
+
+var typeSizes = map[uint16]int{
+	typeByte: 1, typeASCII: 1, typeShort: 2, typeLong: 4, typeRational: 8,
+	typeUndefined: 1, typeSLong: 4, typeSRational: 8,
+}
+
+// A tiff is the TIFF structure EXIF metadata is stored in.  Offsets are
+// from its start.
+type tiff struct {
+	b  []byte
+	bo binary.ByteOrder
+}
+
+func newTIFF(b []byte) (*tiff, error) {
+	if len(b) < 8 {
+		return nil, errors.New("exif: truncated tiff header")
+	}
+	t := &tiff{b: b}
+	switch string(b[:2]) {
+	case "II":
+		t.bo = binary.LittleEndian
+	case "MM":
+		t.bo = binary.BigEndian
+	default:
+		return nil, errors.New("exif: invalid byte order")
+	}
+	if t.bo.Uint16(b[2:]) != 42 {
+		return nil, errors.New("exif: invalid tiff header")
+	}
+	return t, nil
+}
+
+// first returns the offset of IFD0.
+func (t *tiff) first() uint32 {
+	return t.bo.Uint32(t.b[4:])
+}
+
+// An entry is a tag in an IFD, at pos.
+type entry struct {
+	tag   uint16
+	typ   uint16
+	count uint32
+	pos   int
+}
+
+func (e entry) size() int {
+	return typeSizes[e.typ] * int(e.count)
+}
+
+// ifd returns the entries of the IFD at off, and the offset of the next.
+func (t *tiff) ifd(off uint32) ([]entry, uint32, error) {
+	if off < 8 || int(off)+2 > len(t.b) {
+		return nil, 0, errors.New("exif: invalid ifd offset")
+	}
+	n := int(t.bo.Uint16(t.b[off:]))
+	end := int(off) + 2 + 12*n
+	if end+4 > len(t.b) {
+		return nil, 0, errors.New("exif: truncated ifd")
+	}
+	entries := make([]entry, n)
+	for i := range entries {
+		pos := int(off) + 2 + 12*i
+		entries[i] = entry{
+			tag:   t.bo.Uint16(t.b[pos:]),
+			typ:   t.bo.Uint16(t.b[pos+2:]),
+			count: t.bo.Uint32(t.b[pos+4:]),
+			pos:   pos,
+		}
+	}
+	return entries, t.bo.Uint32(t.b[end:]), nil
+}
+
+// value returns the bytes of e's value.
+func (t *tiff) value(e entry) ([]byte, bool) {
+	size := e.size()
+	if size == 0 {
+		return nil, false
+	}
+	if size <= 4 {
+		return t.b[e.pos+8 : e.pos+8+size], true
+	}
+	off := int(t.bo.Uint32(t.b[e.pos+8:]))
+	if off < 0 || off+size > len(t.b) {
+		return nil, false
+	}
+	return t.b[off : off+size], true
+}
+
+func (t *tiff) string(e entry) string {
+	v, ok := t.value(e)
+	if !ok || (e.typ != typeASCII && e.typ != typeUndefined) {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimRight(string(v), "\x00"))
+}
+
+func (t *tiff) uint(e entry) int {
+	v, ok := t.value(e)
+	if !ok {
+		return 0
+	}
+	switch e.typ {
+	case typeShort:
+		return int(t.bo.Uint16(v))
+	case typeLong, typeSLong:
+		return int(t.bo.Uint32(v))
+	case typeByte:
+		return int(v[0])
+	}
+	return 0
+}
+
+// A rational is a fraction.
+type rational struct{ num, den int64 }
+
+func (r rational) float() float64 {
+	if r.den == 0 {
+		return 0
+	}
+	return float64(r.num) / float64(r.den)
+}
+
+// exposure formats r as an exposure time.
+func (r rational) exposure() string {
+	f := r.float()
+	switch {
+	case f <= 0:
+		return ""
+	case f < 1:
+		return fmt.Sprintf("1/%d", int64(math.Round(1/f)))
+	}
+	return fmt.Sprintf("%g", math.Round(f*10)/10)
+}
+
+func (t *tiff) rationals(e entry) []rational {
+	v, ok := t.value(e)
+	if !ok || (e.typ != typeRational && e.typ != typeSRational) {
+		return nil
+	}
+	rs := make([]rational, e.count)
+	for i := range rs {
+		num, den := t.bo.Uint32(v[8*i:]), t.bo.Uint32(v[8*i+4:])
+		if e.typ == typeSRational {
+			rs[i] = rational{int64(int32(num)), int64(int32(den))}
+		} else {
+			rs[i] = rational{int64(num), int64(den)}
+		}
+	}
+	return rs
+}
+
+func (t *tiff) float(e entry) float64 {
+	if rs := t.rationals(e); len(rs) > 0 {
+		return rs[0].float()
+	}
+	return float64(t.uint(e))
+}
@@ -0,0 +1,237 @@
+package exif
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testEntry struct {
+	tag, typ uint16
+	count    uint32
+	value    []byte
+}
+
+func ascii(tag uint16, s string) testEntry {
+	return testEntry{tag, typeASCII, uint32(len(s) + 1), append([]byte(s), 0)}
+}
+
+func short(tag, v uint16) testEntry {
+	return testEntry{tag, typeShort, 1, binary.BigEndian.AppendUint16(nil, v)}
+}
+
+func long(tag uint16, v uint32) testEntry {
+	return testEntry{tag, typeLong, 1, binary.BigEndian.AppendUint32(nil, v)}
+}
+
+func rationals(tag uint16, vs ...uint32) testEntry {
+	var b []byte
+	for _, v := range vs {
+		b = binary.BigEndian.AppendUint32(b, v)
+	}
+	return testEntry{tag, typeRational, uint32(len(vs) / 2), b}
+}
+
+// buildTIFF lays out big endian IFDs one after the other, each followed by
+// the values that don't fit in its entries.  Entries whose value is nil
+// point to the IFD with the index in their count.
+func buildTIFF(ifds ...[]testEntry) []byte {
+	offsets := make([]uint32, len(ifds))
+	off := uint32(8)
+	for i, ifd := range ifds {
+		offsets[i] = off
+		off += uint32(2 + 12*len(ifd) + 4)
+		for _, e := range ifd {
+			if len(e.value) > 4 {
+				off += uint32(len(e.value))
+			}
+		}
+	}
+
+	b := []byte("MM\x00\x2a\x00\x00\x00\x08")
+	for i, ifd := range ifds {
+		data := offsets[i] + uint32(2+12*len(ifd)+4)
+		var values []byte
+		b = binary.BigEndian.AppendUint16(b, uint16(len(ifd)))
+		for _, e := range ifd {
+			b = binary.BigEndian.AppendUint16(b, e.tag)
+			if e.value == nil {
+				b = binary.BigEndian.AppendUint16(b, typeLong)
+				b = binary.BigEndian.AppendUint32(b, 1)
+				b = binary.BigEndian.AppendUint32(b, offsets[e.count])
+				continue
+			}
+			b = binary.BigEndian.AppendUint16(b, e.typ)
+			b = binary.BigEndian.AppendUint32(b, e.count)
+			if len(e.value) > 4 {
+				b = binary.BigEndian.AppendUint32(b, data+uint32(len(values)))
+				values = append(values, e.value...)
+			} else {
+				b = append(b, e.value...)
+				b = append(b, make([]byte, 4-len(e.value))...)
+			}
+		}
+		b = append(b, 0, 0, 0, 0)
+		b = append(b, values...)
+	}
+	return b
+}
+
+// testJPEG returns a w x h jpeg whose left half is black and right half
+// white, with tiff as its EXIF metadata and an XMP segment.
+func testJPEG(t *testing.T, w, h int, tiff []byte) []byte {
+	img := image.NewGray(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := w / 2; x < w; x++ {
+			img.Set(x, y, color.White)
+		}
+	}
+	var buf bytes.Buffer
+	require.NoError(t, jpeg.Encode(&buf, img, &jpeg.Options{Quality: 100}))
+	enc := buf.Bytes()
+
+	app1 := func(payload []byte) []byte {
+		seg := []byte{0xFF, 0xE1}
+		seg = binary.BigEndian.AppendUint16(seg, uint16(len(payload)+2))
+		return append(seg, payload...)
+	}
+	out := append([]byte{}, enc[:2]...)
+	out = append(out, app1(append([]byte("Exif\x00\x00"), tiff...))...)
+	out = append(out, app1([]byte("http://ns.adobe.com/xap/1.0/\x00<x:xmpmeta/>"))...)
+	return append(out, enc[2:]...)
+}
+
+func testTIFF(orientation uint16) []byte {
+	return buildTIFF(
+		[]testEntry{
+			ascii(tagMake, "Canon"),
+			ascii(tagModel, "Canon EOS R6"),
+			short(tagOrientation, orientation),
+			{tag: tagExifIFD, count: 1},
+			{tag: tagGPSIFD, count: 2},
+		},
+		[]testEntry{
+			rationals(tagExposureTime, 1, 250),
+			rationals(tagFNumber, 28, 10),
+			short(tagISO, 400),
+			ascii(tagDateTimeOriginal, "2024:06:01 18:30:05"),
+			ascii(tagOffsetTime, "+02:00"),
+			rationals(tagFocalLength, 35, 1),
+			ascii(tagBodySerialNumber, "SN12345678"),
+			ascii(tagLensModel, "RF35mm F1.8 MACRO IS STM"),
+		},
+		[]testEntry{
+			ascii(tagGPSLatitudeRef, "N"),
+			rationals(tagGPSLatitude, 52, 1, 30, 1, 36, 1),
+			ascii(tagGPSLongitudeRef, "W"),
+			rationals(tagGPSLongitude, 1, 1, 15, 1, 0, 1),
+			long(6, 12),
+		},
+	)
+}
+
+func TestDecode(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	info, err := Decode(testJPEG(t, 8, 4, testTIFF(1)))
+	require.NoError(err)
+	assert.Equal("Canon EOS R6", info.Camera())
+	assert.Equal("RF35mm F1.8 MACRO IS STM", info.Lens)
+	assert.Equal("1/250", info.ExposureTime)
+	assert.Equal(2.8, info.FNumber)
+	assert.Equal(400, info.ISO)
+	assert.Equal(35.0, info.FocalLength)
+	assert.Equal(1, info.Orientation)
+	assert.True(info.Taken.Equal(time.Date(2024, 6, 1, 16, 30, 5, 0, time.UTC)))
+	assert.True(info.HasLocation)
+	assert.InDelta(52.51, info.Latitude, 0.0001)
+	assert.InDelta(-1.25, info.Longitude, 0.0001)
+
+	_, err = Decode(testJPEG(t, 8, 4, nil)[:2])
+	assert.Error(err)
+	var buf bytes.Buffer
+	require.NoError(jpeg.Encode(&buf, image.NewGray(image.Rect(0, 0, 4, 4)), nil))
+	_, err = Decode(buf.Bytes())
+	assert.ErrorIs(err, ErrNoEXIF)
+}
+
+func TestStrip(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	data := testJPEG(t, 8, 4, testTIFF(6))
+	stripped, err := Strip(data)
+	require.NoError(err)
+
+	info, err := Decode(stripped)
+	require.NoError(err)
+	assert.False(info.HasLocation)
+	assert.Equal("Canon EOS R6", info.Camera())
+	assert.Equal("1/250", info.ExposureTime)
+	assert.Equal(6, info.Orientation)
+	assert.NotContains(string(stripped), "SN12345678")
+	assert.NotContains(string(stripped), "xmpmeta")
+
+	// the image itself is untouched
+	img, err := jpeg.Decode(bytes.NewReader(stripped))
+	require.NoError(err)
+	assert.Equal(image.Pt(8, 4), img.Bounds().Size())
+}
+
+func TestAutoRotate(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	// 6 needs rotating 90 degrees clockwise, so the black left half ends
+	// up on top
+	data, err := AutoRotate(testJPEG(t, 16, 8, testTIFF(6)), 100)
+	require.NoError(err)
+	info, err := Decode(data)
+	require.NoError(err)
+	assert.Equal(1, info.Orientation)
+	assert.Equal("Canon EOS R6", info.Camera())
+
+	img, err := jpeg.Decode(bytes.NewReader(data))
+	require.NoError(err)
+	assert.Equal(image.Pt(8, 16), img.Bounds().Size())
+	top, _, _, _ := img.At(4, 2).RGBA()
+	bottom, _, _, _ := img.At(4, 13).RGBA()
+	assert.Less(top, uint32(0x2000))
+	assert.Greater(bottom, uint32(0xe000))
+
+	// upright images are left alone
+	upright := testJPEG(t, 16, 8, testTIFF(1))
+	data, err = AutoRotate(upright, 100)
+	require.NoError(err)
+	assert.Equal(upright, data)
+}
+
+func TestOrient(t *testing.T) {
+	assert := assert.New(t)
+
+	// a 3x2 image with a marked top left corner
+	img := image.NewGray(image.Rect(0, 0, 3, 2))
+	img.SetGray(0, 0, color.Gray{255})
+	corners := map[int]image.Point{
+		1: {0, 0}, 2: {2, 0}, 3: {2, 1}, 4: {0, 1},
+		5: {0, 0}, 6: {1, 0}, 7: {1, 2}, 8: {0, 2},
+	}
+	for o, want := range corners {
+		out := Orient(img, o)
+		size := image.Pt(3, 2)
+		if o >= 5 {
+			size = image.Pt(2, 3)
+		}
+		assert.Equal(size, out.Bounds().Size(), "orientation %d", o)
+		r, _, _, _ := out.At(want.X, want.Y).RGBA()
+		assert.Equal(uint32(0xffff), r, "orientation %d", o)
+	}
+}
@@ -0,0 +1,215 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/monet/db/monarch"
+	"github.com/jmoiron/sqlx"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func setupTestDB(t *testing.T) *sqlx.DB {
+	t.Helper()
+	db, err := sqlx.Connect("sqlite3", ":memory:")
+	require.NoError(t, err)
+	// each connection to :memory: is a separate database
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+
+	manager, err := monarch.NewManager(db)
+	require.NoError(t, err)
+	require.NoError(t, manager.Upgrade(Migrations()))
+
+	return db
+}
+
+func TestEnqueueDedupes(t *testing.T) {
+	assert := assert.New(t)
+	q := NewQueue(setupTestDB(t))
+
+	a, err := q.Enqueue("screenshot", "1")
+	require.NoError(t, err)
+	assert.Equal(StatusPending, a.Status)
+	assert.Equal(DefaultMaxAttempts, a.MaxAttempts)
+
+	b, err := q.Enqueue("screenshot", "1")
+	require.NoError(t, err)
+	assert.Equal(a.ID, b.ID)
+
+	c, err := q.Enqueue("archive", "1")
+	require.NoError(t, err)
+	assert.NotEqual(a.ID, c.ID)
+
+	// once a job is finished, the same payload can be enqueued again
+	require.NoError(t, q.Complete(a))
+	d, err := q.Enqueue("screenshot", "1")
+	require.NoError(t, err)
+	assert.NotEqual(a.ID, d.ID)
+}
+
+func TestClaim(t *testing.T) {
+	assert := assert.New(t)
+	q := NewQueue(setupTestDB(t))
+
+	_, err := q.Claim("screenshot")
+	assert.ErrorIs(err, ErrNoJob)
+
+	first, _ := q.Enqueue("screenshot", "1")
+	q.Enqueue("screenshot", "2")
+	q.Enqueue("other", "3")
+
+	job, err := q.Claim("screenshot")
+	require.NoError(t, err)
+	assert.Equal(first.ID, job.ID)
+	assert.Equal(StatusRunning, job.Status)
+	assert.Equal(1, job.Attempts)
+
+	job, err = q.Claim("screenshot")
+	require.NoError(t, err)
+	assert.Equal("2", job.Payload)
+
+	// the other queue's job isn't claimed
+	_, err = q.Claim("screenshot")
+	assert.ErrorIs(err, ErrNoJob)
+}
+
+func TestFailBackoff(t *testing.T) {
+	assert := assert.New(t)
+	q := NewQueue(setupTestDB(t))
+
+	q.Enqueue("screenshot", "1")
+	job, err := q.Claim("screenshot")
+	require.NoError(t, err)
+
+	before := time.Now()
+	require.NoError(t, q.Fail(job, errors.New("boom")))
+	job, err = q.Get(job.ID)
+	require.NoError(t, err)
+	assert.Equal(StatusPending, job.Status)
+	assert.Equal("boom", job.LastError)
+	assert.GreaterOrEqual(job.RunAt, before.Add(Backoff(1)).Unix())
+
+	// not ready until the backoff expires
+	_, err = q.Claim("screenshot")
+	assert.ErrorIs(err, ErrNoJob)
+
+	// out of attempts
+	job.Attempts = job.MaxAttempts
+	require.NoError(t, q.Fail(job, errors.New("boom")))
+	job, _ = q.Get(job.ID)
+	assert.Equal(StatusFailed, job.Status)
+
+	// retry resets attempts and makes it ready immediately
+	require.NoError(t, q.Retry(job.ID))
+	job, err = q.Claim("screenshot")
+	require.NoError(t, err)
+	assert.Equal(1, job.Attempts)
+	assert.Error(q.Retry(job.ID), "running jobs can't be retried")
+}
+
+func TestBackoff(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal(30*time.Second, Backoff(1))
+	assert.Equal(time.Minute, Backoff(2))
+	assert.Equal(2*time.Minute, Backoff(3))
+	assert.Equal(time.Hour, Backoff(20))
+}
+
+func TestRequeueAndPrune(t *testing.T) {
+	assert := assert.New(t)
+	q := NewQueue(setupTestDB(t))
+
+	q.Enqueue("a", "1")
+	q.Enqueue("a", "2")
+	running, _ := q.Claim("a")
+	done, _ := q.Claim("a")
+	require.NoError(t, q.Complete(done))
+
+	n, err := q.Requeue()
+	require.NoError(t, err)
+	assert.Equal(1, n)
+	job, _ := q.Get(running.ID)
+	assert.Equal(StatusPending, job.Status)
+
+	n, err = q.Prune(time.Now().Add(time.Minute))
+	require.NoError(t, err)
+	assert.Equal(1, n)
+	_, err = q.Get(done.ID)
+	assert.Error(err)
+
+	counts, err := q.Counts()
+	require.NoError(t, err)
+	assert.Equal([]Count{{Queue: "a", Status: StatusPending, Count: 1}}, counts)
+}
+
+func TestPoolRunOne(t *testing.T) {
+	assert := assert.New(t)
+	q := NewQueue(setupTestDB(t))
+	p := NewPool(q, 1)
+
+	var seen []string
+	p.Handle("ok", 0, func(ctx context.Context, job *Job) error {
+		seen = append(seen, job.Payload)
+		return nil
+	})
+	p.Handle("slow", 10*time.Millisecond, func(ctx context.Context, job *Job) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	p.Handle("panic", 0, func(ctx context.Context, job *Job) error {
+		panic("oops")
+	})
+
+	ok, _ := p.Enqueue("ok", "1")
+	slow, _ := p.Enqueue("slow", "2")
+	bad, _ := p.Enqueue("panic", "3")
+
+	for {
+		ran, err := p.RunOne(context.Background())
+		require.NoError(t, err)
+		if !ran {
+			break
+		}
+	}
+
+	assert.Equal([]string{"1"}, seen)
+	job, _ := q.Get(ok.ID)
+	assert.Equal(StatusDone, job.Status)
+
+	job, _ = q.Get(slow.ID)
+	assert.Equal(StatusPending, job.Status)
+	assert.Contains(job.LastError, "timed out")
+
+	job, _ = q.Get(bad.ID)
+	assert.Equal(StatusPending, job.Status)
+	assert.Contains(job.LastError, "panic: oops")
+}
+
+func TestPoolStart(t *testing.T) {
+	q := NewQueue(setupTestDB(t))
+	p := NewPool(q, 2)
+	p.PollInterval = 10 * time.Millisecond
+
+	done := make(chan string, 1)
+	p.Handle("ok", time.Second, func(ctx context.Context, job *Job) error {
+		done <- job.Payload
+		return nil
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	p.Start(ctx)
+
+	p.Enqueue("ok", "hello")
+	select {
+	case payload := <-done:
+		assert.Equal(t, "hello", payload)
+	case <-time.After(2 * time.Second):
+		t.Fatal("job did not run")
+	}
+}
@@ -0,0 +1,29 @@
+package jobs
+
+import "github.com/jmoiron/monet/db/monarch"
+
+// Migrations returns the database migrations for the job queue
+func Migrations() monarch.Set {
+	return monarch.Set{
+		Name: "jobs",
+		Migrations: []monarch.Migration{
+			{
+				Up: `CREATE TABLE IF NOT EXISTS job (
+					id INTEGER PRIMARY KEY AUTOINCREMENT,
+					queue TEXT NOT NULL,
+					payload TEXT NOT NULL DEFAULT '',
+					status TEXT NOT NULL DEFAULT 'pending',
+					attempts INTEGER NOT NULL DEFAULT 0,
+					max_attempts INTEGER NOT NULL DEFAULT 5,
+					last_error TEXT NOT NULL DEFAULT '',
+					run_at INTEGER NOT NULL,
+					locked_at INTEGER NOT NULL DEFAULT 0,
+					created_at INTEGER NOT NULL,
+					updated_at INTEGER NOT NULL
+				);
+				CREATE INDEX IF NOT EXISTS idx_job_claim ON job(status, queue, run_at);`,
+				Down: `DROP TABLE job`,
+			},
+		},
+	}
+}
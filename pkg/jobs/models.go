@@ -0,0 +1,56 @@
+package jobs
+
+import "time"
+
+// Job statuses.  Pending jobs are waiting to run, either for the first time
+// or to be retried.  Failed jobs have used all of their attempts.
+const (
+	StatusPending = "pending"
+	StatusRunning = "running"
+	StatusDone    = "done"
+	StatusFailed  = "failed"
+)
+
+// A Job is a unit of work on a named queue.  Times are unix timestamps.
+type Job struct {
+	ID          int64  `db:"id" json:"id"`
+	Queue       string `db:"queue" json:"queue"`
+	Payload     string `db:"payload" json:"payload"`
+	Status      string `db:"status" json:"status"`
+	Attempts    int    `db:"attempts" json:"attempts"`
+	MaxAttempts int    `db:"max_attempts" json:"max_attempts"`
+	LastError   string `db:"last_error" json:"last_error"`
+	RunAt       int64  `db:"run_at" json:"run_at"`
+	LockedAt    int64  `db:"locked_at" json:"locked_at"`
+	CreatedAt   int64  `db:"created_at" json:"created_at"`
+	UpdatedAt   int64  `db:"updated_at" json:"updated_at"`
+}
+
+// Finished returns true if the job will not run again.
+func (j *Job) Finished() bool {
+	return j.Status == StatusDone || j.Status == StatusFailed
+}
+
+// A Count is the number of jobs on a queue with a status.
+type Count struct {
+	Queue  string `db:"queue"`
+	Status string `db:"status"`
+	Count  int    `db:"count"`
+}
+
+// Backoff returns how long to wait before retrying a job that has failed
+// attempts times: 30s, doubling up to an hour.
+func Backoff(attempts int) time.Duration {
+	const (
+		base = 30 * time.Second
+		max  = time.Hour
+	)
+	d := base
+	for i := 1; i < attempts && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d
+}
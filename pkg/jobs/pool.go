@@ -0,0 +1,187 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// A Handler runs a job.  If it returns an error the job is retried with
+// backoff until it runs out of attempts.  The context is cancelled when the
+// job's timeout expires or the pool is stopped.
+type Handler func(ctx context.Context, job *Job) error
+
+type handler struct {
+	fn      Handler
+	timeout time.Duration
+}
+
+// A Pool runs jobs from a Queue with a fixed number of workers.  Workers poll
+// the queue, and are woken early when a job is enqueued through the pool.
+type Pool struct {
+	queue    *Queue
+	workers  int
+	handlers map[string]handler
+	names    []string
+
+	// PollInterval is how often idle workers check for jobs that are ready,
+	// such as retries whose backoff has expired.
+	PollInterval time.Duration
+	// Retention is how long finished jobs are kept before they are pruned.
+	Retention time.Duration
+
+	wake chan struct{}
+	once sync.Once
+	mu   sync.RWMutex
+}
+
+// NewPool returns a pool that runs jobs from queue with workers workers.
+func NewPool(queue *Queue, workers int) *Pool {
+	if workers < 1 {
+		workers = 1
+	}
+	return &Pool{
+		queue:        queue,
+		workers:      workers,
+		handlers:     make(map[string]handler),
+		PollInterval: 5 * time.Second,
+		Retention:    7 * 24 * time.Hour,
+		wake:         make(chan struct{}, workers),
+	}
+}
+
+// Queue returns the pool's queue.
+func (p *Pool) Queue() *Queue {
+	return p.queue
+}
+
+// Handle runs jobs on the named queue with fn.  Each run is cancelled after
+// timeout; a timeout of 0 means no timeout.
+func (p *Pool) Handle(name string, timeout time.Duration, fn Handler) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.handlers[name]; !ok {
+		p.names = append(p.names, name)
+	}
+	p.handlers[name] = handler{fn: fn, timeout: timeout}
+}
+
+// Enqueue a job on the named queue and wake a worker to run it.
+func (p *Pool) Enqueue(name, payload string) (*Job, error) {
+	job, err := p.queue.Enqueue(name, payload)
+	if err != nil {
+		return nil, err
+	}
+	p.Notify()
+	return job, nil
+}
+
+// Notify wakes an idle worker.
+func (p *Pool) Notify() {
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Start the pool's workers, which run until ctx is cancelled.  Jobs left
+// running by a previous process are requeued first.  It is safe to call
+// Start more than once.
+func (p *Pool) Start(ctx context.Context) {
+	p.once.Do(func() {
+		if n, err := p.queue.Requeue(); err != nil {
+			slog.Error("requeueing jobs", "err", err)
+		} else if n > 0 {
+			slog.Info("requeued interrupted jobs", "count", n)
+		}
+		if n, err := p.queue.Prune(time.Now().Add(-p.Retention)); err != nil {
+			slog.Error("pruning jobs", "err", err)
+		} else if n > 0 {
+			slog.Info("pruned finished jobs", "count", n)
+		}
+
+		for i := 0; i < p.workers; i++ {
+			go p.work(ctx)
+		}
+	})
+}
+
+func (p *Pool) work(ctx context.Context) {
+	ticker := time.NewTicker(p.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		// drain the queue before waiting again
+		for {
+			ran, err := p.RunOne(ctx)
+			if err != nil {
+				slog.Error("claiming job", "err", err)
+			}
+			if !ran || ctx.Err() != nil {
+				break
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-p.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// RunOne claims and runs a single job, returning false if none was ready.
+func (p *Pool) RunOne(ctx context.Context) (bool, error) {
+	p.mu.RLock()
+	names := append([]string(nil), p.names...)
+	p.mu.RUnlock()
+
+	job, err := p.queue.Claim(names...)
+	if errors.Is(err, ErrNoJob) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	p.mu.RLock()
+	h := p.handlers[job.Queue]
+	p.mu.RUnlock()
+
+	start := time.Now()
+	if err := p.run(ctx, h, job); err != nil {
+		slog.Warn("job failed", "queue", job.Queue, "id", job.ID, "payload", job.Payload,
+			"attempt", job.Attempts, "err", err)
+		if ferr := p.queue.Fail(job, err); ferr != nil {
+			return true, ferr
+		}
+		return true, nil
+	}
+
+	slog.Info("job done", "queue", job.Queue, "id", job.ID, "payload", job.Payload, "elapsed", time.Since(start))
+	return true, p.queue.Complete(job)
+}
+
+// run job with h, converting timeouts and panics into errors.
+func (p *Pool) run(ctx context.Context, h handler, job *Job) (err error) {
+	if h.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, h.timeout)
+		defer cancel()
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+
+	err = h.fn(ctx, job)
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		err = fmt.Errorf("timed out after %s: %w", h.timeout, err)
+	}
+	return err
+}
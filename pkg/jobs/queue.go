@@ -0,0 +1,178 @@
+package jobs
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/monet/db"
+	"github.com/jmoiron/sqlx"
+)
+
+// DefaultMaxAttempts is the number of times a job is run before it fails.
+const DefaultMaxAttempts = 5
+
+// A Queue stores jobs in the database.  Jobs are claimed atomically, so more
+// than one worker can pull from the same queue.
+type Queue struct {
+	db db.DB
+}
+
+// NewQueue returns a Queue that stores jobs in db.
+func NewQueue(db db.DB) *Queue {
+	return &Queue{db: db}
+}
+
+// Enqueue a job on queue with payload.  If a job with the same queue and
+// payload is already pending or running, that job is returned instead.
+func (q *Queue) Enqueue(queue, payload string) (*Job, error) {
+	var job Job
+	err := q.db.Get(&job, `SELECT * FROM job WHERE queue=? AND payload=? AND status IN (?, ?) LIMIT 1`,
+		queue, payload, StatusPending, StatusRunning)
+	if err == nil {
+		return &job, nil
+	}
+
+	now := time.Now().Unix()
+	err = q.db.Get(&job, `INSERT INTO job (queue, payload, status, max_attempts, run_at, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?) RETURNING *`,
+		queue, payload, StatusPending, DefaultMaxAttempts, now, now, now)
+	if err != nil {
+		return nil, fmt.Errorf("enqueue %s job: %w", queue, err)
+	}
+	return &job, nil
+}
+
+// Get the job id.
+func (q *Queue) Get(id int64) (*Job, error) {
+	var job Job
+	if err := q.db.Get(&job, `SELECT * FROM job WHERE id=?`, id); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// ErrNoJob is returned by Claim when no jobs are ready to run.
+var ErrNoJob = errors.New("no job ready")
+
+// Claim the next job that is ready to run on one of queues and mark it as
+// running.  If none are ready, ErrNoJob is returned.
+func (q *Queue) Claim(queues ...string) (*Job, error) {
+	if len(queues) == 0 {
+		return nil, ErrNoJob
+	}
+	now := time.Now().Unix()
+	query, args, err := sqlx.In(`UPDATE job SET status=?, attempts=attempts+1, locked_at=?, updated_at=?
+		WHERE id = (
+			SELECT id FROM job WHERE status=? AND run_at <= ? AND queue IN (?)
+			ORDER BY run_at, id LIMIT 1
+		) RETURNING *`, StatusRunning, now, now, StatusPending, now, queues)
+	if err != nil {
+		return nil, err
+	}
+
+	var job Job
+	if err := q.db.Get(&job, query, args...); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNoJob
+		}
+		return nil, err
+	}
+	return &job, nil
+}
+
+// Complete marks job as done.
+func (q *Queue) Complete(job *Job) error {
+	job.Status = StatusDone
+	job.LastError = ""
+	return q.update(job)
+}
+
+// Fail records that job failed with cause.  If it has attempts left it is
+// scheduled to be retried after a backoff, otherwise it is marked failed.
+func (q *Queue) Fail(job *Job, cause error) error {
+	job.LastError = cause.Error()
+	if job.Attempts >= job.MaxAttempts {
+		job.Status = StatusFailed
+	} else {
+		job.Status = StatusPending
+		job.RunAt = time.Now().Add(Backoff(job.Attempts)).Unix()
+	}
+	return q.update(job)
+}
+
+func (q *Queue) update(job *Job) error {
+	job.LockedAt = 0
+	job.UpdatedAt = time.Now().Unix()
+	_, err := q.db.Exec(`UPDATE job SET status=?, last_error=?, run_at=?, locked_at=?, updated_at=? WHERE id=?`,
+		job.Status, job.LastError, job.RunAt, job.LockedAt, job.UpdatedAt, job.ID)
+	return err
+}
+
+// Retry resets the job id so that it runs again now with a full set of
+// attempts.  Running jobs cannot be retried.
+func (q *Queue) Retry(id int64) error {
+	now := time.Now().Unix()
+	res, err := q.db.Exec(`UPDATE job SET status=?, attempts=0, last_error='', run_at=?, updated_at=?
+		WHERE id=? AND status != ?`, StatusPending, now, now, id, StatusRunning)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("job %d is running or does not exist", id)
+	}
+	return nil
+}
+
+// Delete the job id.
+func (q *Queue) Delete(id int64) error {
+	_, err := q.db.Exec(`DELETE FROM job WHERE id=?`, id)
+	return err
+}
+
+// List the most recently updated jobs, or only those with status if it is
+// not empty.
+func (q *Queue) List(status string, limit, offset int) ([]*Job, error) {
+	var jobs []*Job
+	var err error
+	if status == "" {
+		err = q.db.Select(&jobs, `SELECT * FROM job ORDER BY updated_at DESC, id DESC LIMIT ? OFFSET ?`, limit, offset)
+	} else {
+		err = q.db.Select(&jobs, `SELECT * FROM job WHERE status=? ORDER BY updated_at DESC, id DESC LIMIT ? OFFSET ?`,
+			status, limit, offset)
+	}
+	return jobs, err
+}
+
+// Counts returns the number of jobs in each queue and status.
+func (q *Queue) Counts() ([]Count, error) {
+	var counts []Count
+	err := q.db.Select(&counts, `SELECT queue, status, count(*) AS count FROM job
+		GROUP BY queue, status ORDER BY queue, status`)
+	return counts, err
+}
+
+// Requeue returns jobs left running, eg. by a process that exited while they
+// were in progress, to pending.  It should only be called before any workers
+// have started.
+func (q *Queue) Requeue() (int, error) {
+	now := time.Now().Unix()
+	res, err := q.db.Exec(`UPDATE job SET status=?, locked_at=0, run_at=?, updated_at=? WHERE status=?`,
+		StatusPending, now, now, StatusRunning)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+// Prune deletes jobs that finished successfully before t.
+func (q *Queue) Prune(t time.Time) (int, error) {
+	res, err := q.db.Exec(`DELETE FROM job WHERE status=? AND updated_at < ?`, StatusDone, t.Unix())
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
@@ -19,8 +19,8 @@ func ExampleUploader() {
 	// Create a registry with the URL mapper
 	registry := vfs.NewRegistry(urlMapper)
 
-	// Add a filesystem path for uploads
-	err := registry.AddPath("uploads", "/tmp/uploads")
+	// Add a filesystem for uploads; registry.AddPath would add a directory
+	err := registry.Add("uploads", vfs.NewMemFS())
 	if err != nil {
 		panic(err)
 	}
@@ -55,7 +55,7 @@ func ExampleNewUploader() {
 	urlMapper := vfs.NewURLMapper(urlMap)
 
 	registry := vfs.NewRegistry(urlMapper)
-	registry.AddPath("uploads", "/tmp/uploads")
+	registry.Add("uploads", vfs.NewMemFS())
 
 	// Get the filesystem
 	fs, _ := registry.Get("uploads")
@@ -0,0 +1,178 @@
+package vfs
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"testing/fstest"
+	"time"
+)
+
+// MemFS is an in-memory WritableFS, eg. for tests.  The zero value is an
+// empty filesystem ready to use.
+type MemFS struct {
+	mu    sync.RWMutex
+	files fstest.MapFS
+}
+
+// NewMemFS returns an empty MemFS.
+func NewMemFS() *MemFS {
+	return &MemFS{}
+}
+
+// snapshot returns a copy of the filesystem that can be read without
+// holding the lock.  File data is never modified in place, so it's shared.
+func (m *MemFS) snapshot() fstest.MapFS {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	snap := make(fstest.MapFS, len(m.files))
+	for name, f := range m.files {
+		c := *f
+		snap[name] = &c
+	}
+	return snap
+}
+
+func (m *MemFS) Open(name string) (fs.File, error) {
+	return m.snapshot().Open(name)
+}
+
+func (m *MemFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	return m.snapshot().ReadDir(name)
+}
+
+func (m *MemFS) Stat(name string) (fs.FileInfo, error) {
+	return m.snapshot().Stat(name)
+}
+
+func (m *MemFS) Create(name string) (io.WriteCloser, error) {
+	if !fs.ValidPath(name) || name == "." {
+		return nil, &fs.PathError{Op: "create", Path: name, Err: fs.ErrInvalid}
+	}
+	if err := m.checkParent("create", name); err != nil {
+		return nil, err
+	}
+	if info, err := m.Stat(name); err == nil && info.IsDir() {
+		return nil, &fs.PathError{Op: "create", Path: name, Err: fs.ErrExist}
+	}
+	// like os.Create, the file exists (and is empty) until it's written
+	m.write(name, nil)
+	return &memFile{m: m, name: name}, nil
+}
+
+func (m *MemFS) Remove(name string) error {
+	info, err := m.Stat(name)
+	if err != nil {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	}
+	if info.IsDir() {
+		if entries, _ := m.ReadDir(name); len(entries) > 0 {
+			return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrInvalid}
+		}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.files, name)
+	return nil
+}
+
+func (m *MemFS) Rename(oldname, newname string) error {
+	if _, err := m.Stat(oldname); err != nil {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: fs.ErrNotExist}
+	}
+	if !fs.ValidPath(newname) || newname == "." {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: fs.ErrInvalid}
+	}
+	if err := m.checkParent("rename", newname); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	// move the file or directory along with anything under it
+	var names []string
+	for name := range m.files {
+		if name == oldname || strings.HasPrefix(name, oldname+"/") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		m.files[newname+strings.TrimPrefix(name, oldname)] = m.files[name]
+		delete(m.files, name)
+	}
+	return nil
+}
+
+func (m *MemFS) MkdirAll(name string, perm fs.FileMode) error {
+	if !fs.ValidPath(name) {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: fs.ErrInvalid}
+	}
+	if name == "." {
+		return nil
+	}
+	if info, err := m.Stat(name); err == nil {
+		if !info.IsDir() {
+			return &fs.PathError{Op: "mkdir", Path: name, Err: fs.ErrExist}
+		}
+		return nil
+	}
+	if err := m.MkdirAll(path.Dir(name), perm); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.files == nil {
+		m.files = fstest.MapFS{}
+	}
+	m.files[name] = &fstest.MapFile{Mode: fs.ModeDir | perm.Perm(), ModTime: time.Now()}
+	return nil
+}
+
+// checkParent returns an error if the directory that name would be in
+// doesn't exist.
+func (m *MemFS) checkParent(op, name string) error {
+	dir := path.Dir(name)
+	if dir == "." {
+		return nil
+	}
+	info, err := m.Stat(dir)
+	if err != nil || !info.IsDir() {
+		return &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	return nil
+}
+
+func (m *MemFS) write(name string, data []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.files == nil {
+		m.files = fstest.MapFS{}
+	}
+	m.files[name] = &fstest.MapFile{Data: data, Mode: 0644, ModTime: time.Now()}
+}
+
+// a memFile buffers writes and stores them in its MemFS when it's closed.
+type memFile struct {
+	bytes.Buffer
+	m      *MemFS
+	name   string
+	closed bool
+}
+
+func (f *memFile) Close() error {
+	if f.closed {
+		return fs.ErrClosed
+	}
+	f.closed = true
+	f.m.write(f.name, f.Bytes())
+	return nil
+}
+
+var _ WritableFS = &MemFS{}
@@ -0,0 +1,74 @@
+package vfs
+
+import (
+	"io"
+	"io/fs"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// CleanPath returns name as a clean slash-separated path relative to the
+// root of a filesystem, eg. "2024/my-post/photo.jpg".  Backslashes are
+// treated as separators and leading slashes are dropped, so "" and "/" are
+// the root, ".".  Names with ".." elements are invalid rather than
+// resolved, so that a path can never escape its filesystem.
+func CleanPath(name string) (string, error) {
+	var elems []string
+	for _, elem := range strings.Split(strings.ReplaceAll(name, "\\", "/"), "/") {
+		switch elem {
+		case "", ".":
+			continue
+		case "..":
+			return "", &fs.PathError{Op: "clean", Path: name, Err: fs.ErrInvalid}
+		}
+		elems = append(elems, elem)
+	}
+	if len(elems) == 0 {
+		return ".", nil
+	}
+	clean := strings.Join(elems, "/")
+	if !fs.ValidPath(clean) {
+		return "", &fs.PathError{Op: "clean", Path: name, Err: fs.ErrInvalid}
+	}
+	return clean, nil
+}
+
+// SanitizeDir returns the folder dir with each of its elements cleaned by
+// the policy's filename rules, or "" for the root.  Folders with ".."
+// elements are refused.
+func (p *Policy) SanitizeDir(dir string) (string, error) {
+	invalid := &PolicyError{
+		Code:    ErrCodeInvalidFilename,
+		Message: "Invalid folder",
+		Status:  http.StatusBadRequest,
+	}
+	clean, err := CleanPath(dir)
+	if err != nil {
+		return "", invalid
+	}
+	if clean == "." {
+		return "", nil
+	}
+	elems := strings.Split(clean, "/")
+	for i, elem := range elems {
+		if elems[i], err = p.SanitizeFilename(elem); err != nil {
+			return "", invalid
+		}
+	}
+	return path.Join(elems...), nil
+}
+
+// ApplyIn is Apply for a file being uploaded into the folder dir, which is
+// sanitized with SanitizeDir.  The name returned includes the folder.
+func (p *Policy) ApplyIn(fsys fs.FS, dir, filename string, r io.Reader) (string, io.Reader, error) {
+	dir, err := p.SanitizeDir(dir)
+	if err != nil {
+		return "", nil, err
+	}
+	name, body, err := p.Apply(fsys, filename, r)
+	if err != nil {
+		return "", nil, err
+	}
+	return path.Join(dir, name), body, nil
+}
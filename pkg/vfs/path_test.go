@@ -0,0 +1,78 @@
+package vfs_test
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/jmoiron/monet/pkg/vfs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCleanPath(t *testing.T) {
+	assert := assert.New(t)
+
+	for in, want := range map[string]string{
+		"":                 ".",
+		"/":                ".",
+		"photo.jpg":        "photo.jpg",
+		"/2024/post/a.jpg": "2024/post/a.jpg",
+		`2024\post\a.jpg`:  "2024/post/a.jpg",
+		"2024//./a.jpg":    "2024/a.jpg",
+	} {
+		got, err := vfs.CleanPath(in)
+		assert.NoError(err, in)
+		assert.Equal(want, got, in)
+	}
+	for _, in := range []string{"..", "../etc/passwd", "2024/../../x", `..\x`} {
+		_, err := vfs.CleanPath(in)
+		assert.Error(err, in)
+	}
+}
+
+func TestSanitizeDir(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	p := &vfs.Policy{Filenames: vfs.FilenameRules{Lowercase: true, Restrict: true}}
+	dir, err := p.SanitizeDir("/2024/My Post/")
+	require.NoError(err)
+	assert.Equal("2024/my-post", dir)
+	dir, err = p.SanitizeDir("")
+	require.NoError(err)
+	assert.Equal("", dir)
+	_, err = p.SanitizeDir("2024/../..")
+	var perr *vfs.PolicyError
+	require.ErrorAs(err, &perr)
+	assert.Equal(vfs.ErrCodeInvalidFilename, perr.Code)
+
+	name, r, err := p.ApplyIn(vfs.NewMemFS(), "2024/My Post", "../Cover.JPG", strings.NewReader("jpg"))
+	require.NoError(err)
+	assert.Equal("2024/my-post/cover.jpg", name)
+	data, err := io.ReadAll(r)
+	require.NoError(err)
+	assert.Equal("jpg", string(data))
+}
+
+func TestNestedURLs(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	m := vfs.NewURLMapper(map[string]string{
+		"uploads": "/static/uploads/",
+		"cdn":     "https://cdn.example.com/files/",
+	})
+	for _, c := range []struct{ fs, path, want string }{
+		{"uploads", "2024/post/a.jpg", "/static/uploads/2024/post/a.jpg"},
+		{"uploads", "/a.jpg", "/static/uploads/a.jpg"},
+		{"uploads", "../../etc/passwd", "/static/uploads/etc/passwd"},
+		{"uploads", "", "/static/uploads"},
+		{"cdn", "2024/post/a.jpg", "https://cdn.example.com/files/2024/post/a.jpg"},
+		{"cdn", "2024/../../a.jpg", "https://cdn.example.com/files/a.jpg"},
+	} {
+		got, err := m.GetURL(c.fs, c.path)
+		require.NoError(err)
+		assert.Equal(c.want, got, c.path)
+	}
+}
@@ -0,0 +1,327 @@
+package vfs
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+	"unicode"
+
+	"github.com/dustin/go-humanize"
+)
+
+// DefaultMaxSize is the largest file accepted by filesystems whose policy
+// doesn't set one.
+const DefaultMaxSize = 64 << 20
+
+// sniffLen is how much of an upload is read to detect its type.
+const sniffLen = 512
+
+// A Policy limits what can be uploaded to a filesystem.
+type Policy struct {
+	// MaxSize is the largest file accepted, in bytes.  0 uses DefaultMaxSize
+	// and a negative size accepts files of any size.
+	MaxSize int64
+	// AllowedTypes are the MIME types accepted, eg. "image/png", or "image/*"
+	// for any image.  The type is detected from the file's content rather
+	// than its extension.  If empty, any type is accepted.
+	AllowedTypes []string
+	// Quota is the most space, in bytes, the filesystem's files may use.  0
+	// is unlimited.
+	Quota int64
+	// Filenames are the rules names of uploads are sanitized with.
+	Filenames FilenameRules
+
+	// usage returns the space used by the filesystem's files; see WithUsage.
+	usage func() (int64, error)
+}
+
+// WithUsage returns a copy of the policy whose quota is checked against the
+// space returned by usage, such as the recorded sizes of a filesystem's
+// uploads, rather than by adding up the sizes of its files on each upload.
+func (p *Policy) WithUsage(usage func() (int64, error)) *Policy {
+	cp := *p
+	cp.usage = usage
+	return &cp
+}
+
+// used returns the space used by the files in fsys.
+func (p *Policy) used(fsys fs.FS) (int64, error) {
+	if p.usage != nil {
+		return p.usage()
+	}
+	return Usage(fsys)
+}
+
+// FilenameRules say how the names of uploaded files are sanitized.  Path
+// elements, control characters and leading dots are always removed.
+type FilenameRules struct {
+	// Lowercase lowercases names.
+	Lowercase bool
+	// Restrict replaces characters other than ASCII letters, digits, '.',
+	// '-' and '_' with '-'.
+	Restrict bool
+	// MaxLength is the longest name allowed, in bytes; longer names are
+	// shortened, keeping their extension.
+	MaxLength int
+}
+
+// PolicyError codes.
+const (
+	ErrCodeTooLarge        = "too_large"
+	ErrCodeTypeNotAllowed  = "type_not_allowed"
+	ErrCodeQuotaExceeded   = "quota_exceeded"
+	ErrCodeInvalidFilename = "invalid_filename"
+)
+
+// A PolicyError is an upload refused by a Policy.  It is written to clients
+// as JSON by WritePolicyError.
+type PolicyError struct {
+	Code    string `json:"code"`
+	Message string `json:"error"`
+	// Limit is the size or quota exceeded, in bytes.
+	Limit int64 `json:"limit,omitempty"`
+	// Type is the detected type of a file that isn't allowed.
+	Type    string   `json:"type,omitempty"`
+	Allowed []string `json:"allowed,omitempty"`
+	Status  int      `json:"-"`
+}
+
+func (e *PolicyError) Error() string { return e.Message }
+
+// WritePolicyError writes err as a JSON response if it is, or wraps, a
+// PolicyError, and returns true if it was written.
+func WritePolicyError(w http.ResponseWriter, err error) bool {
+	var perr *PolicyError
+	if !errors.As(err, &perr) {
+		return false
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(perr.Status)
+	json.NewEncoder(w).Encode(struct {
+		Success bool `json:"success"`
+		*PolicyError
+	}{false, perr})
+	return true
+}
+
+// SanitizeFilename returns name cleaned by the policy's filename rules.
+func (p *Policy) SanitizeFilename(name string) (string, error) {
+	name = path.Base(strings.ReplaceAll(name, "\\", "/"))
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case unicode.IsControl(r):
+			return -1
+		case p.Filenames.Restrict && !isSafeRune(r):
+			return '-'
+		case p.Filenames.Lowercase:
+			return unicode.ToLower(r)
+		}
+		return r
+	}, name)
+	name = strings.TrimLeft(strings.TrimSpace(name), ".")
+	if p.Filenames.Restrict {
+		for strings.Contains(name, "--") {
+			name = strings.ReplaceAll(name, "--", "-")
+		}
+	}
+
+	if max := p.Filenames.MaxLength; max > 0 && len(name) > max {
+		ext := path.Ext(name)
+		if len(ext) >= max {
+			ext = ""
+		}
+		base := strings.TrimSuffix(name, ext)
+		base = strings.ToValidUTF8(base[:max-len(ext)], "")
+		name = base + ext
+	}
+
+	if name == "" || name == "/" {
+		return "", &PolicyError{
+			Code:    ErrCodeInvalidFilename,
+			Message: "Invalid filename",
+			Status:  http.StatusBadRequest,
+		}
+	}
+	return name, nil
+}
+
+func isSafeRune(r rune) bool {
+	return r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r) || r == '.' || r == '-' || r == '_')
+}
+
+// Check returns a reader of r that enforces the policy's size, type and
+// quota limits on a file being uploaded to fsys.  The type is checked
+// before Check returns; the size and quota are checked as the file is read,
+// and reads fail with a PolicyError once either is exceeded.
+func (p *Policy) Check(fsys fs.FS, r io.Reader) (io.Reader, error) {
+	br := bufio.NewReaderSize(r, sniffLen)
+	if len(p.AllowedTypes) > 0 {
+		head, err := br.Peek(sniffLen)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		typ := http.DetectContentType(head)
+		if t, _, err := mime.ParseMediaType(typ); err == nil {
+			typ = t
+		}
+		if !p.Allows(typ) {
+			return nil, &PolicyError{
+				Code:    ErrCodeTypeNotAllowed,
+				Message: fmt.Sprintf("Files of type %s are not allowed", typ),
+				Type:    typ,
+				Allowed: p.AllowedTypes,
+				Status:  http.StatusUnsupportedMediaType,
+			}
+		}
+	}
+
+	lr := &limitReader{r: br, n: p.MaxFileSize()}
+	if lr.n >= 0 {
+		lr.err = tooLarge(lr.n)
+	}
+	if p.Quota > 0 {
+		used, err := p.used(fsys)
+		if err != nil {
+			return nil, err
+		}
+		if remaining := p.Quota - used; lr.n < 0 || remaining < lr.n {
+			lr.n, lr.err = max(remaining, 0), overQuota(p.Quota)
+		}
+	}
+	if lr.n < 0 {
+		return br, nil
+	}
+	return lr, nil
+}
+
+// CheckSize returns a PolicyError if a file of size bytes is too large for
+// the policy, or would take fsys over its quota.
+func (p *Policy) CheckSize(fsys fs.FS, size int64) error {
+	if limit := p.MaxFileSize(); limit >= 0 && size > limit {
+		return tooLarge(limit)
+	}
+	if p.Quota > 0 {
+		used, err := p.used(fsys)
+		if err != nil {
+			return err
+		}
+		if used+size > p.Quota {
+			return overQuota(p.Quota)
+		}
+	}
+	return nil
+}
+
+// MaxFileSize returns the largest file the policy accepts, or -1 if files
+// can be any size.
+func (p *Policy) MaxFileSize() int64 {
+	switch {
+	case p.MaxSize == 0:
+		return DefaultMaxSize
+	case p.MaxSize < 0:
+		return -1
+	}
+	return p.MaxSize
+}
+
+func tooLarge(limit int64) *PolicyError {
+	return &PolicyError{
+		Code:    ErrCodeTooLarge,
+		Message: fmt.Sprintf("Files larger than %s are not allowed", humanize.IBytes(uint64(limit))),
+		Limit:   limit,
+		Status:  http.StatusRequestEntityTooLarge,
+	}
+}
+
+func overQuota(quota int64) *PolicyError {
+	return &PolicyError{
+		Code:    ErrCodeQuotaExceeded,
+		Message: fmt.Sprintf("Upload would exceed the quota of %s", humanize.IBytes(uint64(quota))),
+		Limit:   quota,
+		Status:  http.StatusInsufficientStorage,
+	}
+}
+
+// Allows returns true if files of the MIME type typ are allowed.
+func (p *Policy) Allows(typ string) bool {
+	if len(p.AllowedTypes) == 0 {
+		return true
+	}
+	for _, allowed := range p.AllowedTypes {
+		if allowed == typ || allowed == "*/*" {
+			return true
+		}
+		if prefix, ok := strings.CutSuffix(allowed, "/*"); ok && strings.HasPrefix(typ, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Apply sanitizes the filename of a file being uploaded to fsys and checks
+// its content against the policy, returning the name to save it as and the
+// reader to save it from.
+func (p *Policy) Apply(fsys fs.FS, filename string, r io.Reader) (string, io.Reader, error) {
+	name, err := p.SanitizeFilename(filename)
+	if err != nil {
+		return "", nil, err
+	}
+	body, err := p.Check(fsys, r)
+	if err != nil {
+		return "", nil, err
+	}
+	return name, body, nil
+}
+
+// Usage returns the total size of the files in fsys.
+func Usage(fsys fs.FS) (int64, error) {
+	var total int64
+	err := fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		total += info.Size()
+		return nil
+	})
+	return total, err
+}
+
+// A limitReader reads at most n bytes from r, and then fails with err if
+// there is more to read.
+type limitReader struct {
+	r   io.Reader
+	n   int64
+	err error
+}
+
+func (l *limitReader) Read(p []byte) (int, error) {
+	if l.n <= 0 {
+		// the limit is only exceeded if there is more to read
+		var b [1]byte
+		n, err := l.r.Read(b[:])
+		if n > 0 {
+			return 0, l.err
+		}
+		return 0, err
+	}
+	if int64(len(p)) > l.n {
+		p = p[:l.n]
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	return n, err
+}
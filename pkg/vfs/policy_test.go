@@ -0,0 +1,118 @@
+package vfs_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/jmoiron/monet/pkg/vfs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSanitizeFilename(t *testing.T) {
+	assert := assert.New(t)
+
+	p := &vfs.Policy{}
+	for in, want := range map[string]string{
+		"photo.jpg":          "photo.jpg",
+		"../../etc/passwd":   "passwd",
+		`C:\Users\me\My.png`: "My.png",
+		".hidden":            "hidden",
+		"tab\there.txt":      "tabhere.txt",
+	} {
+		got, err := p.SanitizeFilename(in)
+		assert.NoError(err, in)
+		assert.Equal(want, got, in)
+	}
+	for _, in := range []string{"", ".", "..", "/", "..."} {
+		_, err := p.SanitizeFilename(in)
+		var perr *vfs.PolicyError
+		if assert.ErrorAs(err, &perr, in) {
+			assert.Equal(vfs.ErrCodeInvalidFilename, perr.Code)
+		}
+	}
+
+	p.Filenames = vfs.FilenameRules{Lowercase: true, Restrict: true, MaxLength: 12}
+	got, err := p.SanitizeFilename("My Holiday Photo (1).JPG")
+	assert.NoError(err)
+	assert.Equal("my-holid.jpg", got)
+	got, err = p.SanitizeFilename("Café Menu.pdf")
+	assert.NoError(err)
+	assert.Equal("caf-menu.pdf", got)
+}
+
+func TestPolicyCheck(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	png := append([]byte("\x89PNG\r\n\x1a\n"), bytes.Repeat([]byte{0}, 100)...)
+	fsys := vfs.NewMemFS()
+
+	// types are detected from the content, not the name
+	p := &vfs.Policy{AllowedTypes: []string{"image/*"}}
+	r, err := p.Check(fsys, bytes.NewReader(png))
+	require.NoError(err)
+	data, err := io.ReadAll(r)
+	require.NoError(err)
+	assert.Equal(png, data)
+
+	_, err = p.Check(fsys, strings.NewReader("#!/bin/sh\nrm -rf /\n"))
+	var perr *vfs.PolicyError
+	require.ErrorAs(err, &perr)
+	assert.Equal(vfs.ErrCodeTypeNotAllowed, perr.Code)
+	assert.Equal("text/plain", perr.Type)
+	assert.Equal(http.StatusUnsupportedMediaType, perr.Status)
+
+	// files of exactly the max size are allowed
+	p = &vfs.Policy{MaxSize: 108}
+	r, err = p.Check(fsys, bytes.NewReader(png))
+	require.NoError(err)
+	_, err = io.ReadAll(r)
+	assert.NoError(err)
+	p.MaxSize = 50
+	r, err = p.Check(fsys, bytes.NewReader(png))
+	require.NoError(err)
+	_, err = vfs.WriteFile(fsys, "big.png", r)
+	require.ErrorAs(err, &perr)
+	assert.Equal(vfs.ErrCodeTooLarge, perr.Code)
+	assert.Equal(int64(50), perr.Limit)
+
+	// the quota counts the files already in the filesystem
+	fsys = vfs.NewMemFS()
+	_, err = vfs.WriteFile(fsys, "a.png", bytes.NewReader(png))
+	require.NoError(err)
+	p = &vfs.Policy{Quota: 200}
+	r, err = p.Check(fsys, bytes.NewReader(png))
+	require.NoError(err)
+	_, err = io.ReadAll(r)
+	require.ErrorAs(err, &perr)
+	assert.Equal(vfs.ErrCodeQuotaExceeded, perr.Code)
+
+	// errors are written as JSON
+	w := httptest.NewRecorder()
+	assert.False(vfs.WritePolicyError(w, errors.New("other")))
+	assert.True(vfs.WritePolicyError(w, err))
+	assert.Equal(http.StatusInsufficientStorage, w.Code)
+	var resp map[string]any
+	require.NoError(json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(false, resp["success"])
+	assert.Equal(vfs.ErrCodeQuotaExceeded, resp["code"])
+	assert.Equal(float64(200), resp["limit"])
+
+	// the space used can come from elsewhere, rather than the files
+	calls := 0
+	p = (&vfs.Policy{Quota: 200}).WithUsage(func() (int64, error) {
+		calls++
+		return 150, nil
+	})
+	assert.NoError(p.CheckSize(vfs.NewMemFS(), 50))
+	require.ErrorAs(p.CheckSize(vfs.NewMemFS(), 51), &perr)
+	assert.Equal(vfs.ErrCodeQuotaExceeded, perr.Code)
+	assert.Equal(2, calls)
+}
@@ -18,27 +18,35 @@ type Registry interface {
 	AddPath(name, path string) error
 	Add(name string, x fs.FS) error
 	Get(name string) (fs.FS, error)
+	GetWritable(name string) (WritableFS, error)
 	GetPath(name string) (string, error)
 	Remove(name string) error
 
 	Mapper() URLMapper
 
+	// Upload policies of filesystems; filesystems without one get a zero
+	// Policy, with the default limits.
+	SetPolicy(name string, p *Policy)
+	Policy(name string) *Policy
+
 	// Uploader creates an uploader for the named filesystem
 	CreateUploader(name string) (*Uploader, error)
 }
 
 type registry struct {
-	mu  sync.RWMutex
-	fss map[string]fs.FS
-	m   URLMapper
+	mu       sync.RWMutex
+	fss      map[string]fs.FS
+	policies map[string]*Policy
+	m        URLMapper
 }
 
 // NewRegistry creates a new VFS registry with the provided URL mapper. If the
 // mapper is nil, then url routing will not be available.
 func NewRegistry(m URLMapper) Registry {
 	return &registry{
-		fss: make(map[string]fs.FS),
-		m:   m,
+		fss:      make(map[string]fs.FS),
+		policies: make(map[string]*Policy),
+		m:        m,
 	}
 }
 
@@ -94,6 +102,16 @@ func (r *registry) Get(name string) (fs.FS, error) {
 	return x, nil
 }
 
+// GetWritable returns the filesystem for the given name if it can be
+// written to.  Filesystems added with AddPath are always writable.
+func (r *registry) GetWritable(name string) (WritableFS, error) {
+	x, err := r.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	return asWritable(name, x)
+}
+
 // Remove removes the filesystem with the given name
 func (r *registry) Remove(name string) error {
 	r.mu.Lock()
@@ -105,7 +123,25 @@ func (r *registry) Remove(name string) error {
 	return nil
 }
 
-// CreateUploader creates an uploader for the named filesystem
+// SetPolicy sets the upload policy of the named filesystem.
+func (r *registry) SetPolicy(name string, p *Policy) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.policies[name] = p
+}
+
+// Policy returns the upload policy of the named filesystem.
+func (r *registry) Policy(name string) *Policy {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if p, ok := r.policies[name]; ok {
+		return p
+	}
+	return &Policy{}
+}
+
+// CreateUploader creates an uploader for the named filesystem, which
+// enforces its upload policy.
 func (r *registry) CreateUploader(name string) (*Uploader, error) {
 	fs, err := r.Get(name)
 	if err != nil {
@@ -121,7 +157,12 @@ func (r *registry) CreateUploader(name string) (*Uploader, error) {
 		return nil, fmt.Errorf("CreateUploader: failed to get URL prefix: %w", err)
 	}
 
-	return NewUploader(fs, urlPrefix)
+	u, err := NewUploader(fs, urlPrefix)
+	if err != nil {
+		return nil, err
+	}
+	u.SetPolicy(r.Policy(name))
+	return u, nil
 }
 
 // A PathFS is an FS that corresponds to a particular path.
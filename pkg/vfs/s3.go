@@ -0,0 +1,647 @@
+package vfs
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MinPartSize is the smallest part S3 accepts in a multipart upload, and
+// so the most that an S3FS buffers of a file being written.
+const MinPartSize = 5 << 20
+
+// S3Options configure an S3FS.
+type S3Options struct {
+	// Endpoint is the URL of the S3 API, eg. "https://s3.us-east-1.amazonaws.com"
+	// or "http://localhost:9000" for a local MinIO.
+	Endpoint string
+	Region   string
+	Bucket   string
+	// Prefix is prepended to the key of every file, so that several
+	// filesystems can share a bucket.
+	Prefix    string
+	AccessKey string
+	SecretKey string
+	// PathStyle addresses the bucket as endpoint/bucket rather than as
+	// bucket.endpoint; MinIO and most local stand-ins need it.
+	PathStyle bool
+	// URLExpiry is how long signed URLs are valid for.
+	URLExpiry time.Duration
+	// PartSize is the size of the parts of multipart uploads; files smaller
+	// than this are uploaded in a single request.
+	PartSize int
+	// Timeout is how long a request may wait for a response, or go without
+	// any of its body arriving, before it's abandoned.  Defaults to a minute.
+	Timeout time.Duration
+	// Client is the http client used; http.DefaultClient if nil.
+	Client *http.Client
+}
+
+// S3FS is a WritableFS stored in a bucket of an S3-compatible object store.
+// Object stores have no directories: a directory exists if any key has it
+// as a prefix, and MkdirAll does nothing.
+type S3FS struct {
+	opts     S3Options
+	endpoint *url.URL
+	signer   *sigV4
+	client   *http.Client
+}
+
+// NewS3FS returns an S3FS for the bucket described by opts.
+func NewS3FS(opts S3Options) (*S3FS, error) {
+	if opts.Bucket == "" {
+		return nil, fmt.Errorf("s3: no bucket configured")
+	}
+	endpoint, err := url.Parse(opts.Endpoint)
+	if err != nil || endpoint.Host == "" {
+		return nil, fmt.Errorf("s3: invalid endpoint %q", opts.Endpoint)
+	}
+	if opts.Region == "" {
+		opts.Region = "us-east-1"
+	}
+	if opts.PartSize < MinPartSize {
+		opts.PartSize = MinPartSize
+	}
+	if opts.URLExpiry <= 0 {
+		opts.URLExpiry = time.Hour
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = time.Minute
+	}
+	opts.Prefix = strings.Trim(opts.Prefix, "/")
+	client := opts.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &S3FS{
+		opts:     opts,
+		endpoint: endpoint,
+		signer:   &sigV4{accessKey: opts.AccessKey, secretKey: opts.SecretKey, region: opts.Region, service: "s3"},
+		client:   client,
+	}, nil
+}
+
+// key returns the object key for the fs path name.
+func (s *S3FS) key(name string) string {
+	if name == "." {
+		name = ""
+	}
+	if s.opts.Prefix == "" {
+		return name
+	}
+	if name == "" {
+		return s.opts.Prefix
+	}
+	return s.opts.Prefix + "/" + name
+}
+
+// objectURL returns the URL of key; an empty key is the bucket itself.
+func (s *S3FS) objectURL(key string) *url.URL {
+	u := *s.endpoint
+	base := strings.TrimSuffix(u.Path, "/")
+	if s.opts.PathStyle {
+		u.Path = base + "/" + s.opts.Bucket + "/" + key
+	} else {
+		u.Host = s.opts.Bucket + "." + u.Host
+		u.Path = base + "/" + key
+	}
+	u.RawPath = ""
+	return &u
+}
+
+// PublicURL returns the unsigned URL of the file name, which can be used
+// for buckets that allow public reads.
+func (s *S3FS) PublicURL(name string) string {
+	return s.objectURL(s.key(strings.TrimPrefix(name, "/"))).String()
+}
+
+// SignURL returns a presigned URL for the file name that expires after
+// the configured URLExpiry.  It implements URLSigner.
+func (s *S3FS) SignURL(name string) (string, error) {
+	u := s.objectURL(s.key(strings.TrimPrefix(name, "/")))
+	return s.signer.presign(u, s.opts.URLExpiry, time.Now()).String(), nil
+}
+
+// do makes a signed request for key; body may be nil.  The request is
+// cancelled if it stalls for longer than the timeout, so the response's
+// body must be closed.
+func (s *S3FS) do(method, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	u := s.objectURL(key)
+	u.RawQuery = canonicalQuery(query)
+
+	var r io.Reader
+	payloadHash := emptyPayloadHash
+	if body != nil {
+		r = bytes.NewReader(body)
+		payloadHash = hashHex(body)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	timer := time.AfterFunc(s.opts.Timeout, cancel)
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), r)
+	if err != nil {
+		timer.Stop()
+		cancel()
+		return nil, err
+	}
+	for k, vs := range header {
+		req.Header[k] = vs
+	}
+	if body != nil {
+		req.ContentLength = int64(len(body))
+	}
+	s.signer.sign(req, payloadHash, time.Now())
+	resp, err := s.client.Do(req)
+	if err != nil {
+		timer.Stop()
+		cancel()
+		return nil, err
+	}
+	resp.Body = &idleBody{ReadCloser: resp.Body, timer: timer, timeout: s.opts.Timeout, cancel: cancel}
+	return resp, nil
+}
+
+// idleBody is a response body whose request is cancelled when its timer
+// fires.  Each read restarts the timer, so large files can take as long as
+// they need as long as they keep arriving.
+type idleBody struct {
+	io.ReadCloser
+	timer   *time.Timer
+	timeout time.Duration
+	cancel  context.CancelFunc
+}
+
+func (b *idleBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.timer.Reset(b.timeout)
+	return n, err
+}
+
+func (b *idleBody) Close() error {
+	b.timer.Stop()
+	b.cancel()
+	return b.ReadCloser.Close()
+}
+
+// s3Error is the error document returned by failed S3 requests.
+type s3Error struct {
+	Status  int    `xml:"-"`
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func (e *s3Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("s3: %s", http.StatusText(e.Status))
+	}
+	return fmt.Sprintf("s3: %s: %s", e.Code, e.Message)
+}
+
+// call makes a request with do and checks its response.
+func (s *S3FS) call(op, name, method, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	resp, err := s.do(method, key, query, header, body)
+	return check(op, name, resp, err)
+}
+
+// check returns an error for unsuccessful responses, closing their body.
+// Missing objects are reported as fs.ErrNotExist.
+func check(op, name string, resp *http.Response, err error) (*http.Response, error) {
+	if err != nil {
+		return nil, &fs.PathError{Op: op, Path: name, Err: err}
+	}
+	if resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	e := &s3Error{Status: resp.StatusCode}
+	xml.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(e)
+	return nil, &fs.PathError{Op: op, Path: name, Err: e}
+}
+
+func (s *S3FS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	info, err := s.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		entries, err := s.ReadDir(name)
+		if err != nil {
+			return nil, err
+		}
+		return &s3Dir{info: info, entries: entries}, nil
+	}
+	return &s3File{fs: s, name: name, info: info.(*s3FileInfo)}, nil
+}
+
+func (s *S3FS) Stat(name string) (fs.FileInfo, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrInvalid}
+	}
+	if name != "." {
+		resp, err := s.call("stat", name, http.MethodHead, s.key(name), nil, nil, nil)
+		if err == nil {
+			resp.Body.Close()
+			modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+			return &s3FileInfo{name: path.Base(name), size: resp.ContentLength, modTime: modTime}, nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+	}
+
+	// a directory exists if anything is under it; the root always exists
+	list, err := s.list(name, "", 1)
+	if err != nil {
+		return nil, err
+	}
+	if name != "." && len(list.Contents) == 0 && len(list.CommonPrefixes) == 0 {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+	return &s3FileInfo{name: path.Base(name), dir: true}, nil
+}
+
+// listResult is the response to a ListObjectsV2 request.
+type listResult struct {
+	Contents []struct {
+		Key          string    `xml:"Key"`
+		Size         int64     `xml:"Size"`
+		LastModified time.Time `xml:"LastModified"`
+	} `xml:"Contents"`
+	CommonPrefixes []struct {
+		Prefix string `xml:"Prefix"`
+	} `xml:"CommonPrefixes"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// list lists the keys directly under the directory name.
+func (s *S3FS) list(name, token string, max int) (*listResult, error) {
+	prefix := s.key(name)
+	if prefix != "" {
+		prefix += "/"
+	}
+	q := url.Values{"list-type": {"2"}, "prefix": {prefix}, "delimiter": {"/"}}
+	if token != "" {
+		q.Set("continuation-token", token)
+	}
+	if max > 0 {
+		q.Set("max-keys", strconv.Itoa(max))
+	}
+	resp, err := s.call("readdir", name, http.MethodGet, "", q, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var list listResult
+	if err := xml.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	return &list, nil
+}
+
+func (s *S3FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+	}
+	prefix := s.key(name)
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	var entries []fs.DirEntry
+	token := ""
+	for {
+		list, err := s.list(name, token, 0)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range list.Contents {
+			base := strings.TrimPrefix(c.Key, prefix)
+			if base == "" {
+				continue
+			}
+			entries = append(entries, fs.FileInfoToDirEntry(&s3FileInfo{name: base, size: c.Size, modTime: c.LastModified}))
+		}
+		for _, p := range list.CommonPrefixes {
+			base := strings.TrimSuffix(strings.TrimPrefix(p.Prefix, prefix), "/")
+			entries = append(entries, fs.FileInfoToDirEntry(&s3FileInfo{name: base, dir: true}))
+		}
+		if !list.IsTruncated || list.NextContinuationToken == "" {
+			break
+		}
+		token = list.NextContinuationToken
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+// Create returns a writer that streams to the object name.  Up to PartSize
+// bytes are buffered; larger files are sent as a multipart upload, one part
+// at a time.  Nothing is visible until the writer is closed.
+func (s *S3FS) Create(name string) (io.WriteCloser, error) {
+	if !fs.ValidPath(name) || name == "." {
+		return nil, &fs.PathError{Op: "create", Path: name, Err: fs.ErrInvalid}
+	}
+	return &s3Writer{fs: s, name: name}, nil
+}
+
+func (s *S3FS) Remove(name string) error {
+	info, err := s.Stat(name)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		// directories vanish with their last file
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrInvalid}
+	}
+	resp, err := s.call("remove", name, http.MethodDelete, s.key(name), nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// Rename copies the object oldname to newname and deletes oldname.  Only
+// files can be renamed.
+func (s *S3FS) Rename(oldname, newname string) error {
+	if !fs.ValidPath(newname) || newname == "." {
+		return &fs.PathError{Op: "rename", Path: newname, Err: fs.ErrInvalid}
+	}
+	info, err := s.Stat(oldname)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return &fs.PathError{Op: "rename", Path: oldname, Err: fs.ErrInvalid}
+	}
+
+	header := http.Header{"X-Amz-Copy-Source": {uriEncode("/"+s.opts.Bucket+"/"+s.key(oldname), false)}}
+	resp, err := s.call("rename", oldname, http.MethodPut, s.key(newname), nil, header, nil)
+	if err != nil {
+		return err
+	}
+	// a copy can fail after a 200 response; the error is in the body
+	var e s3Error
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+	if xml.Unmarshal(body, &e) == nil && e.Code != "" {
+		return &fs.PathError{Op: "rename", Path: oldname, Err: &e}
+	}
+	return s.Remove(oldname)
+}
+
+// MkdirAll does nothing, as object stores don't have directories.
+func (s *S3FS) MkdirAll(name string, perm fs.FileMode) error {
+	if !fs.ValidPath(name) {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: fs.ErrInvalid}
+	}
+	return nil
+}
+
+type s3FileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+func (i *s3FileInfo) Name() string       { return i.name }
+func (i *s3FileInfo) Size() int64        { return i.size }
+func (i *s3FileInfo) ModTime() time.Time { return i.modTime }
+func (i *s3FileInfo) IsDir() bool        { return i.dir }
+func (i *s3FileInfo) Sys() any           { return nil }
+func (i *s3FileInfo) Mode() fs.FileMode {
+	if i.dir {
+		return fs.ModeDir | 0755
+	}
+	return 0644
+}
+
+// An s3File reads an object.  It can seek, so that it can be served with
+// http.FileServer; each seek starts a new ranged GET on the next read.
+type s3File struct {
+	fs     *S3FS
+	name   string
+	info   *s3FileInfo
+	body   io.ReadCloser
+	offset int64
+}
+
+func (f *s3File) Stat() (fs.FileInfo, error) { return f.info, nil }
+
+func (f *s3File) Read(p []byte) (int, error) {
+	if f.offset >= f.info.size {
+		return 0, io.EOF
+	}
+	if f.body == nil {
+		var header http.Header
+		if f.offset > 0 {
+			header = http.Header{"Range": {fmt.Sprintf("bytes=%d-", f.offset)}}
+		}
+		resp, err := f.fs.call("read", f.name, http.MethodGet, f.fs.key(f.name), nil, header, nil)
+		if err != nil {
+			return 0, err
+		}
+		f.body = resp.Body
+	}
+	n, err := f.body.Read(p)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *s3File) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.info.size
+	}
+	if offset < 0 {
+		return 0, &fs.PathError{Op: "seek", Path: f.name, Err: fs.ErrInvalid}
+	}
+	if offset != f.offset && f.body != nil {
+		f.body.Close()
+		f.body = nil
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *s3File) Close() error {
+	if f.body != nil {
+		return f.body.Close()
+	}
+	return nil
+}
+
+// s3Dir is an open directory, which can only be listed.
+type s3Dir struct {
+	info    fs.FileInfo
+	entries []fs.DirEntry
+}
+
+func (d *s3Dir) Stat() (fs.FileInfo, error) { return d.info, nil }
+func (d *s3Dir) Read([]byte) (int, error)   { return 0, fs.ErrInvalid }
+func (d *s3Dir) Close() error               { return nil }
+
+func (d *s3Dir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if n <= 0 {
+		entries := d.entries
+		d.entries = nil
+		return entries, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	n = min(n, len(d.entries))
+	entries := d.entries[:n]
+	d.entries = d.entries[n:]
+	return entries, nil
+}
+
+// An s3Writer uploads an object, buffering at most one part at a time.
+type s3Writer struct {
+	fs       *S3FS
+	name     string
+	buf      bytes.Buffer
+	uploadID string
+	parts    []completePart
+	err      error
+	closed   bool
+}
+
+type completePart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+func (w *s3Writer) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	if w.closed {
+		return 0, fs.ErrClosed
+	}
+	n, _ := w.buf.Write(p)
+	for w.buf.Len() >= w.fs.opts.PartSize {
+		if err := w.flushPart(w.buf.Next(w.fs.opts.PartSize)); err != nil {
+			w.abort(err)
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// flushPart uploads part as the next part of a multipart upload, starting
+// the upload if needed.
+func (w *s3Writer) flushPart(part []byte) error {
+	key := w.fs.key(w.name)
+	if w.uploadID == "" {
+		resp, err := w.fs.call("create", w.name, http.MethodPost, key, url.Values{"uploads": {""}}, nil, nil)
+		if err != nil {
+			return err
+		}
+		var initiated struct {
+			UploadID string `xml:"UploadId"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&initiated)
+		resp.Body.Close()
+		if err != nil {
+			return &fs.PathError{Op: "create", Path: w.name, Err: err}
+		}
+		w.uploadID = initiated.UploadID
+	}
+
+	number := len(w.parts) + 1
+	q := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {w.uploadID}}
+	resp, err := w.fs.call("write", w.name, http.MethodPut, key, q, nil, part)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	w.parts = append(w.parts, completePart{PartNumber: number, ETag: resp.Header.Get("ETag")})
+	return nil
+}
+
+// abort records err and abandons any multipart upload in progress.
+func (w *s3Writer) abort(err error) {
+	w.err = err
+	if w.uploadID == "" {
+		return
+	}
+	resp, _ := w.fs.call("abort", w.name, http.MethodDelete, w.fs.key(w.name), url.Values{"uploadId": {w.uploadID}}, nil, nil)
+	if resp != nil {
+		resp.Body.Close()
+	}
+}
+
+func (w *s3Writer) Close() error {
+	if w.closed {
+		return fs.ErrClosed
+	}
+	w.closed = true
+	if w.err != nil {
+		return w.err
+	}
+
+	key := w.fs.key(w.name)
+	if w.uploadID == "" {
+		resp, err := w.fs.call("create", w.name, http.MethodPut, key, nil, nil, w.buf.Bytes())
+		if err != nil {
+			return err
+		}
+		return resp.Body.Close()
+	}
+
+	if w.buf.Len() > 0 {
+		if err := w.flushPart(w.buf.Bytes()); err != nil {
+			w.abort(err)
+			return err
+		}
+	}
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name       `xml:"CompleteMultipartUpload"`
+		Parts   []completePart `xml:"Part"`
+	}{Parts: w.parts})
+	if err != nil {
+		return err
+	}
+	resp, err := w.fs.call("close", w.name, http.MethodPost, key, url.Values{"uploadId": {w.uploadID}}, nil, body)
+	if err != nil {
+		w.abort(err)
+		return err
+	}
+	// like copies, completing can fail after a 200 response
+	var e s3Error
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+	if xml.Unmarshal(data, &e) == nil && e.Code != "" {
+		w.abort(&e)
+		return &fs.PathError{Op: "close", Path: w.name, Err: &e}
+	}
+	return nil
+}
+
+var (
+	_ WritableFS    = &S3FS{}
+	_ fs.ReadDirFS  = &S3FS{}
+	_ fs.StatFS     = &S3FS{}
+	_ io.ReadSeeker = &s3File{}
+	_ URLSigner     = &S3FS{}
+)
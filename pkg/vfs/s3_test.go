@@ -0,0 +1,258 @@
+package vfs
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeS3 is a path-style S3 server holding a single bucket in memory.  It
+// implements just enough of the API for S3FS.
+type fakeS3 struct {
+	bucket string
+
+	mu      sync.Mutex
+	objects map[string][]byte
+	uploads map[string]map[int][]byte
+	parts   int
+}
+
+func newFakeS3(bucket string) *fakeS3 {
+	return &fakeS3{bucket: bucket, objects: map[string][]byte{}, uploads: map[string]map[int][]byte{}}
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), sigAlgorithm) {
+		http.Error(w, "unsigned", http.StatusForbidden)
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	key := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/"+f.bucket), "/")
+	q := r.URL.Query()
+	body, _ := io.ReadAll(r.Body)
+
+	switch {
+	case r.Method == http.MethodGet && key == "":
+		f.list(w, q.Get("prefix"), q.Get("delimiter"))
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		data, ok := f.objects[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		http.ServeContent(w, r, key, time.Unix(0, 0), bytes.NewReader(data))
+	case r.Method == http.MethodPost && q.Has("uploads"):
+		id := fmt.Sprintf("upload-%d", len(f.uploads)+1)
+		f.uploads[id] = map[int][]byte{}
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><UploadId>%s</UploadId></InitiateMultipartUploadResult>", id)
+	case r.Method == http.MethodPost && q.Has("uploadId"):
+		var complete struct {
+			Parts []completePart `xml:"Part"`
+		}
+		xml.Unmarshal(body, &complete)
+		var data []byte
+		for _, p := range complete.Parts {
+			data = append(data, f.uploads[q.Get("uploadId")][p.PartNumber]...)
+		}
+		f.objects[key] = data
+		delete(f.uploads, q.Get("uploadId"))
+		fmt.Fprint(w, "<CompleteMultipartUploadResult/>")
+	case r.Method == http.MethodPut && q.Has("uploadId"):
+		var n int
+		fmt.Sscan(q.Get("partNumber"), &n)
+		f.uploads[q.Get("uploadId")][n] = body
+		f.parts++
+		w.Header().Set("ETag", fmt.Sprintf(`"%d"`, n))
+	case r.Method == http.MethodPut && r.Header.Get("X-Amz-Copy-Source") != "":
+		src := strings.TrimPrefix(r.Header.Get("X-Amz-Copy-Source"), "/"+f.bucket+"/")
+		f.objects[key] = f.objects[src]
+		fmt.Fprint(w, "<CopyObjectResult/>")
+	case r.Method == http.MethodPut:
+		f.objects[key] = body
+	case r.Method == http.MethodDelete && q.Has("uploadId"):
+		delete(f.uploads, q.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "unsupported", http.StatusNotImplemented)
+	}
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, prefix, delimiter string) {
+	var res listResult
+	seen := map[string]bool{}
+	var keys []string
+	for k := range f.objects {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if !strings.HasPrefix(k, prefix) {
+			continue
+		}
+		rest := strings.TrimPrefix(k, prefix)
+		if i := strings.Index(rest, delimiter); delimiter != "" && i >= 0 {
+			p := prefix + rest[:i+1]
+			if !seen[p] {
+				seen[p] = true
+				res.CommonPrefixes = append(res.CommonPrefixes, struct {
+					Prefix string `xml:"Prefix"`
+				}{p})
+			}
+			continue
+		}
+		res.Contents = append(res.Contents, struct {
+			Key          string    `xml:"Key"`
+			Size         int64     `xml:"Size"`
+			LastModified time.Time `xml:"LastModified"`
+		}{Key: k, Size: int64(len(f.objects[k]))})
+	}
+	xml.NewEncoder(w).Encode(struct {
+		XMLName xml.Name `xml:"ListBucketResult"`
+		*listResult
+	}{listResult: &res})
+}
+
+func TestS3FS(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	fake := newFakeS3("media")
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	s3, err := NewS3FS(S3Options{
+		Endpoint:  srv.URL,
+		Bucket:    "media",
+		Prefix:    "uploads/",
+		AccessKey: "key",
+		SecretKey: "secret",
+		PathStyle: true,
+	})
+	require.NoError(err)
+
+	n, err := WriteFile(s3, "a.txt", strings.NewReader("hello world"))
+	require.NoError(err)
+	assert.Equal(int64(11), n)
+	assert.Contains(fake.objects, "uploads/a.txt")
+
+	data, err := fs.ReadFile(s3, "a.txt")
+	require.NoError(err)
+	assert.Equal("hello world", string(data))
+
+	info, err := s3.Stat("a.txt")
+	require.NoError(err)
+	assert.Equal(int64(11), info.Size())
+	assert.False(info.IsDir())
+
+	// files can be read from an offset with ranged requests
+	f, err := s3.Open("a.txt")
+	require.NoError(err)
+	_, err = f.(io.Seeker).Seek(6, io.SeekStart)
+	require.NoError(err)
+	data, err = io.ReadAll(f)
+	require.NoError(err)
+	assert.Equal("world", string(data))
+	f.Close()
+
+	// directories exist if anything is in them
+	require.NoError(s3.MkdirAll("sub", 0755))
+	_, err = WriteFile(s3, "sub/b.txt", strings.NewReader("b"))
+	require.NoError(err)
+	info, err = s3.Stat("sub")
+	require.NoError(err)
+	assert.True(info.IsDir())
+
+	entries, err := fs.ReadDir(s3, ".")
+	require.NoError(err)
+	require.Len(entries, 2)
+	assert.Equal("a.txt", entries[0].Name())
+	assert.Equal("sub", entries[1].Name())
+	assert.True(entries[1].IsDir())
+
+	require.NoError(s3.Rename("a.txt", "c.txt"))
+	_, err = s3.Stat("a.txt")
+	assert.ErrorIs(err, fs.ErrNotExist)
+	data, err = fs.ReadFile(s3, "c.txt")
+	require.NoError(err)
+	assert.Equal("hello world", string(data))
+
+	require.NoError(s3.Remove("sub/b.txt"))
+	_, err = s3.Stat("sub")
+	assert.ErrorIs(err, fs.ErrNotExist)
+	assert.ErrorIs(s3.Remove("sub/b.txt"), fs.ErrNotExist)
+
+	_, err = s3.Create("../escape.txt")
+	assert.Error(err)
+
+	// urls are signed for private buckets, and public otherwise
+	assert.Equal(srv.URL+"/media/uploads/c.txt", s3.PublicURL("c.txt"))
+	signed, err := s3.SignURL("c.txt")
+	require.NoError(err)
+	assert.Contains(signed, "X-Amz-Signature=")
+	assert.True(strings.HasPrefix(signed, srv.URL+"/media/uploads/c.txt?"))
+
+	// the mapper can point at a cdn, or sign through the bucket
+	m := NewURLMapper(map[string]string{"uploads": "https://cdn.example.com/uploads/"})
+	u, err := m.GetURL("uploads", "c.txt")
+	require.NoError(err)
+	assert.Equal("https://cdn.example.com/uploads/c.txt", u)
+	m.SetSigner("uploads", s3)
+	u, err = m.GetURL("uploads", "c.txt")
+	require.NoError(err)
+	assert.Contains(u, "X-Amz-Signature=")
+}
+
+func TestS3FSMultipart(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	fake := newFakeS3("media")
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	s3, err := NewS3FS(S3Options{Endpoint: srv.URL, Bucket: "media", PathStyle: true})
+	require.NoError(err)
+
+	// files larger than a part are streamed a part at a time
+	data := bytes.Repeat([]byte("0123456789abcdef"), MinPartSize/16*2+100)
+	n, err := WriteFile(s3, "big.bin", bytes.NewReader(data))
+	require.NoError(err)
+	assert.Equal(int64(len(data)), n)
+	assert.Equal(3, fake.parts)
+	assert.Empty(fake.uploads)
+	assert.Equal(data, fake.objects["big.bin"])
+}
+
+func TestS3FSTimeout(t *testing.T) {
+	stall := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-stall
+	}))
+	defer srv.Close()
+	defer close(stall)
+
+	s3, err := NewS3FS(S3Options{Endpoint: srv.URL, Bucket: "media", PathStyle: true, Timeout: 50 * time.Millisecond})
+	require.NoError(t, err)
+
+	start := time.Now()
+	_, err = s3.Stat("stalled.jpg")
+	assert.Error(t, err)
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
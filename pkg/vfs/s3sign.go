@@ -0,0 +1,169 @@
+package vfs
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// S3 requests are authenticated with AWS signature version 4, which every
+// S3-compatible store (MinIO, R2, B2, etc.) also accepts.
+// See https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-authenticating-requests.html
+
+const (
+	sigAlgorithm     = "AWS4-HMAC-SHA256"
+	sigDateFormat    = "20060102T150405Z"
+	unsignedPayload  = "UNSIGNED-PAYLOAD"
+	emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+type sigV4 struct {
+	accessKey string
+	secretKey string
+	region    string
+	service   string
+}
+
+func hashHex(b []byte) string {
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// uriEncode encodes s as SigV4 requires: everything but unreserved
+// characters is percent encoded, and '/' is kept if encodeSlash is false.
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func canonicalQuery(q url.Values) string {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		vals := append([]string(nil), q[k]...)
+		sort.Strings(vals)
+		for _, v := range vals {
+			parts = append(parts, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// signedHeaderNames returns the lowercased names of the headers of r that
+// are signed: host, range, content-type, content-md5 and any x-amz- header.
+func signedHeaderNames(h http.Header) []string {
+	names := []string{"host"}
+	for k := range h {
+		lk := strings.ToLower(k)
+		switch {
+		case lk == "range", lk == "content-type", lk == "content-md5", strings.HasPrefix(lk, "x-amz-"):
+			names = append(names, lk)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (s *sigV4) scope(t time.Time) string {
+	return t.Format("20060102") + "/" + s.region + "/" + s.service + "/aws4_request"
+}
+
+func (s *sigV4) signature(t time.Time, canonicalRequest string) string {
+	toSign := strings.Join([]string{
+		sigAlgorithm,
+		t.Format(sigDateFormat),
+		s.scope(t),
+		hashHex([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), t.Format("20060102"))
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, s.service)
+	key = hmacSHA256(key, "aws4_request")
+	return hex.EncodeToString(hmacSHA256(key, toSign))
+}
+
+func canonicalRequest(method string, u *url.URL, query url.Values, host string, h http.Header, names []string, payloadHash string) string {
+	var headers strings.Builder
+	for _, name := range names {
+		v := host
+		if name != "host" {
+			v = strings.Join(h.Values(name), ",")
+		}
+		headers.WriteString(name + ":" + strings.TrimSpace(v) + "\n")
+	}
+	path := u.EscapedPath()
+	if p, err := url.PathUnescape(path); err == nil {
+		path = uriEncode(p, false)
+	}
+	if path == "" {
+		path = "/"
+	}
+	return strings.Join([]string{
+		method,
+		path,
+		canonicalQuery(query),
+		headers.String(),
+		strings.Join(names, ";"),
+		payloadHash,
+	}, "\n")
+}
+
+// sign adds the x-amz-date, x-amz-content-sha256 and Authorization headers
+// to r.  payloadHash is the hex sha256 of the body, or unsignedPayload.
+func (s *sigV4) sign(r *http.Request, payloadHash string, t time.Time) {
+	t = t.UTC()
+	r.Header.Set("X-Amz-Date", t.Format(sigDateFormat))
+	r.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	names := signedHeaderNames(r.Header)
+	creq := canonicalRequest(r.Method, r.URL, r.URL.Query(), r.URL.Host, r.Header, names, payloadHash)
+	r.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		sigAlgorithm, s.accessKey, s.scope(t), strings.Join(names, ";"), s.signature(t, creq)))
+}
+
+// presign returns a copy of u with query parameters that allow a GET of it
+// without credentials until expires has passed.
+func (s *sigV4) presign(u *url.URL, expires time.Duration, t time.Time) *url.URL {
+	t = t.UTC()
+	signed := *u
+	q := u.Query()
+	q.Set("X-Amz-Algorithm", sigAlgorithm)
+	q.Set("X-Amz-Credential", s.accessKey+"/"+s.scope(t))
+	q.Set("X-Amz-Date", t.Format(sigDateFormat))
+	q.Set("X-Amz-Expires", fmt.Sprint(int(expires.Seconds())))
+	q.Set("X-Amz-SignedHeaders", "host")
+
+	creq := canonicalRequest(http.MethodGet, u, q, u.Host, nil, []string{"host"}, unsignedPayload)
+	q.Set("X-Amz-Signature", s.signature(t, creq))
+	signed.RawQuery = canonicalQuery(q)
+	return &signed
+}
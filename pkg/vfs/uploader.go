@@ -5,36 +5,46 @@ import (
 	"io"
 	"io/fs"
 	"net/http"
-	"os"
-	"path/filepath"
+	"path"
 	"strings"
 )
 
 // Uploader handles file uploads and serves uploaded files
 type Uploader struct {
-	fs        fs.FS
+	fs        WritableFS
 	urlPrefix string
-	basePath  string // physical path for writing files
+	policy    *Policy
 }
 
 // NewUploader creates a new uploader with the given filesystem and URL prefix
 func NewUploader(filesystem fs.FS, urlPrefix string) (*Uploader, error) {
-	var basePath string
-
-	// Try to get the base path if this is a PathFS
-	if pfs, ok := filesystem.(PathFS); ok {
-		basePath = pfs.Path()
-	} else {
-		return nil, fmt.Errorf("uploader requires a PathFS to write files")
+	w, ok := filesystem.(WritableFS)
+	if !ok {
+		return nil, fmt.Errorf("uploader requires a WritableFS to write files")
 	}
 
 	return &Uploader{
-		fs:        filesystem,
+		fs:        w,
 		urlPrefix: strings.TrimSuffix(urlPrefix, "/"),
-		basePath:  basePath,
+		policy:    &Policy{},
 	}, nil
 }
 
+// FS returns the filesystem that files are uploaded to.
+func (u *Uploader) FS() WritableFS {
+	return u.fs
+}
+
+// Policy returns the policy that uploads are checked against.
+func (u *Uploader) Policy() *Policy {
+	return u.policy
+}
+
+// SetPolicy sets the policy that uploads are checked against.
+func (u *Uploader) SetPolicy(p *Policy) {
+	u.policy = p
+}
+
 // ServeHTTP implements http.Handler for serving uploaded files (GET requests)
 func (u *Uploader) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if r.Method == http.MethodGet {
@@ -87,41 +97,38 @@ func (u *Uploader) handleGet(w http.ResponseWriter, r *http.Request) {
 }
 
 func (u *Uploader) handlePost(w http.ResponseWriter, r *http.Request) {
-	// Parse the multipart form
-	err := r.ParseMultipartForm(32 << 20) // 32MB max
-	if err != nil {
-		http.Error(w, "Failed to parse form: "+err.Error(), http.StatusBadRequest)
-		return
-	}
-
-	file, header, err := r.FormFile("file")
+	// Stream the file from the form rather than buffering it
+	file, name, err := FormFile(r, "file")
 	if err != nil {
 		http.Error(w, "Failed to get file from form: "+err.Error(), http.StatusBadRequest)
 		return
 	}
 	defer file.Close()
 
-	// Clean the filename
-	filename := filepath.Base(header.Filename)
-	if filename == "" || filename == "." {
-		http.Error(w, "Invalid filename", http.StatusBadRequest)
+	// Clean the filename and check the file against the policy; files can
+	// be uploaded into a folder, which is created if needed
+	filename, body, err := u.policy.ApplyIn(u.fs, r.URL.Query().Get("dir"), name, file)
+	if WritePolicyError(w, err) {
 		return
 	}
-
-	// Create the full path for the new file
-	destPath := filepath.Join(u.basePath, filename)
-
-	// Create the destination file
-	destFile, err := os.Create(destPath)
 	if err != nil {
-		http.Error(w, "Failed to create file: "+err.Error(), http.StatusInternalServerError)
+		http.Error(w, "Failed to read file: "+err.Error(), http.StatusBadRequest)
 		return
 	}
-	defer destFile.Close()
+	if dir := path.Dir(filename); dir != "." {
+		if err := u.fs.MkdirAll(dir, 0755); err != nil {
+			http.Error(w, "Failed to create folder: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
 
-	// Copy the uploaded file to the destination
-	_, err = io.Copy(destFile, file)
+	// Copy the uploaded file to the filesystem
+	_, err = WriteFile(u.fs, filename, body)
 	if err != nil {
+		u.fs.Remove(filename)
+		if WritePolicyError(w, err) {
+			return
+		}
 		http.Error(w, "Failed to save file: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -140,11 +147,34 @@ func (u *Uploader) GetFileURL(filename string) string {
 // DeleteFile removes a file from the uploader's filesystem
 func (u *Uploader) DeleteFile(filename string) error {
 	// Clean the filename to prevent path traversal
-	filename = filepath.Base(filename)
-	if filename == "" || filename == "." {
+	filename, err := CleanPath(filename)
+	if err != nil || filename == "." {
 		return fmt.Errorf("invalid filename")
 	}
 
-	filePath := filepath.Join(u.basePath, filename)
-	return os.Remove(filePath)
+	return u.fs.Remove(filename)
+}
+
+// FormFile returns the file uploaded in the multipart form field named
+// field, and its filename.  Unlike http.Request.FormFile the file isn't
+// buffered; it is read straight from the request body, so any other form
+// values must be sent before it.
+func FormFile(r *http.Request, field string) (io.ReadCloser, string, error) {
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return nil, "", err
+	}
+	for {
+		part, err := mr.NextPart()
+		if err != nil {
+			if err == io.EOF {
+				err = http.ErrMissingFile
+			}
+			return nil, "", err
+		}
+		if part.FormName() == field && part.FileName() != "" {
+			return part, part.FileName(), nil
+		}
+		part.Close()
+	}
 }
@@ -2,7 +2,9 @@ package vfs
 
 import (
 	"fmt"
-	"path/filepath"
+	"path"
+	"strings"
+	"sync"
 )
 
 // A URLMapper maps VFS names to URL routes.
@@ -22,11 +24,21 @@ type URLMapper interface {
 
 	// GetMap returns a copy of the internal URL map, eg. for iterating over.
 	GetMap() map[string]string
+
+	// SetSigner makes GetURL return URLs signed by s for the filesystem name,
+	// eg. for private buckets.  A nil signer removes it.
+	SetSigner(name string, s URLSigner)
+}
+
+// A URLSigner signs URLs for paths in a filesystem that can't be served
+// publicly, such as an S3FS with a private bucket.
+type URLSigner interface {
+	SignURL(path string) (string, error)
 }
 
 // NewURLMapper returns a new URLMapper for the given map of names to prefixes.
 func NewURLMapper(mapping map[string]string) URLMapper {
-	return &urlMapper{urlMap: mapping}
+	return &urlMapper{urlMap: mapping, signers: map[string]URLSigner{}}
 }
 
 // A urlMapper maps filesystems to URLs, so eg. the "images" filesystem
@@ -34,6 +46,9 @@ func NewURLMapper(mapping map[string]string) URLMapper {
 // to create canonical URLs independent of their physical location.
 type urlMapper struct {
 	urlMap map[string]string
+
+	mu      sync.RWMutex
+	signers map[string]URLSigner
 }
 
 func (u *urlMapper) GetPrefix(name string) (string, error) {
@@ -43,13 +58,42 @@ func (u *urlMapper) GetPrefix(name string) (string, error) {
 	return "", fmt.Errorf("no URLs mapped for fs '%s'", name)
 }
 
-// GetURL gets a URL for the path anchored at name.
-func (u *urlMapper) GetURL(name, path string) (string, error) {
+// GetURL gets a URL for the path anchored at name.  Paths can be nested,
+// eg. "2024/my-post/photo.jpg", and are cleaned so that they can't climb out
+// of the prefix.  Prefixes can be absolute URLs, eg. for a CDN.  Paths in
+// filesystems with a signer are signed; the prefix itself never is.
+func (u *urlMapper) GetURL(name, p string) (string, error) {
 	prefix, err := u.GetPrefix(name)
 	if err != nil {
 		return "", err
 	}
-	return filepath.Join(prefix, path), nil
+	p = strings.TrimPrefix(path.Clean("/"+strings.ReplaceAll(p, "\\", "/")), "/")
+
+	u.mu.RLock()
+	signer := u.signers[name]
+	u.mu.RUnlock()
+	if signer != nil && len(p) > 0 {
+		return signer.SignURL(p)
+	}
+
+	// path.Join would turn "https://" into "https:/"
+	if strings.Contains(prefix, "://") {
+		if len(p) == 0 {
+			return prefix, nil
+		}
+		return strings.TrimSuffix(prefix, "/") + "/" + p, nil
+	}
+	return path.Join(prefix, p), nil
+}
+
+func (u *urlMapper) SetSigner(name string, s URLSigner) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if s == nil {
+		delete(u.signers, name)
+		return
+	}
+	u.signers[name] = s
 }
 
 func (u *urlMapper) GetMap() map[string]string {
@@ -0,0 +1,109 @@
+package vfs
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// A WritableFS is an FS that files can also be written to.  Names are
+// slash-separated paths relative to the root of the filesystem, as they
+// are for fs.FS.
+type WritableFS interface {
+	fs.FS
+	// Create creates or truncates the named file.  The file is complete
+	// once the returned writer is closed.
+	Create(name string) (io.WriteCloser, error)
+	// Remove removes the named file or empty directory.
+	Remove(name string) error
+	// Rename renames oldname to newname, replacing newname if it exists.
+	Rename(oldname, newname string) error
+	// Stat returns a FileInfo describing the named file.
+	Stat(name string) (fs.FileInfo, error)
+	// MkdirAll creates the named directory along with any missing parents.
+	MkdirAll(name string, perm fs.FileMode) error
+}
+
+// WriteFile writes the contents of r to the named file in w, returning the
+// number of bytes written.
+func WriteFile(w WritableFS, name string, r io.Reader) (int64, error) {
+	f, err := w.Create(name)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return n, err
+}
+
+// NewOSFS returns a WritableFS for the directory at path.
+func NewOSFS(path string) WritableFS {
+	return &pathFS{FS: os.DirFS(path), path: path}
+}
+
+// osPath returns the path on disk of name, which must be a valid fs path.
+func (p *pathFS) osPath(op, name string) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	return filepath.Join(p.path, filepath.FromSlash(name)), nil
+}
+
+func (p *pathFS) Create(name string) (io.WriteCloser, error) {
+	path, err := p.osPath("create", name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Create(path)
+}
+
+func (p *pathFS) Remove(name string) error {
+	path, err := p.osPath("remove", name)
+	if err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+func (p *pathFS) Rename(oldname, newname string) error {
+	oldpath, err := p.osPath("rename", oldname)
+	if err != nil {
+		return err
+	}
+	newpath, err := p.osPath("rename", newname)
+	if err != nil {
+		return err
+	}
+	return os.Rename(oldpath, newpath)
+}
+
+func (p *pathFS) Stat(name string) (fs.FileInfo, error) {
+	path, err := p.osPath("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Stat(path)
+}
+
+func (p *pathFS) MkdirAll(name string, perm fs.FileMode) error {
+	path, err := p.osPath("mkdir", name)
+	if err != nil {
+		return err
+	}
+	return os.MkdirAll(path, perm)
+}
+
+// asWritable returns x as a WritableFS, or an error naming the filesystem
+// if it can't be written to.
+func asWritable(name string, x fs.FS) (WritableFS, error) {
+	if w, ok := x.(WritableFS); ok {
+		return w, nil
+	}
+	return nil, fmt.Errorf("fs '%s' is not writable", name)
+}
+
+var _ WritableFS = &pathFS{}
@@ -0,0 +1,80 @@
+package vfs_test
+
+import (
+	"io/fs"
+	"strings"
+	"testing"
+
+	"github.com/jmoiron/monet/pkg/vfs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWritableFS(t *testing.T) {
+	impls := map[string]func(t *testing.T) vfs.WritableFS{
+		"os":  func(t *testing.T) vfs.WritableFS { return vfs.NewOSFS(t.TempDir()) },
+		"mem": func(t *testing.T) vfs.WritableFS { return vfs.NewMemFS() },
+	}
+
+	for name, newFS := range impls {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+			w := newFS(t)
+
+			n, err := vfs.WriteFile(w, "a.txt", strings.NewReader("hello"))
+			require.NoError(err)
+			assert.Equal(int64(5), n)
+
+			data, err := fs.ReadFile(w, "a.txt")
+			require.NoError(err)
+			assert.Equal("hello", string(data))
+
+			info, err := w.Stat("a.txt")
+			require.NoError(err)
+			assert.Equal(int64(5), info.Size())
+			assert.False(info.IsDir())
+
+			// files can't be created in missing directories
+			_, err = vfs.WriteFile(w, "sub/b.txt", strings.NewReader("b"))
+			assert.Error(err)
+			require.NoError(w.MkdirAll("sub/dir", 0755))
+			_, err = vfs.WriteFile(w, "sub/b.txt", strings.NewReader("b"))
+			require.NoError(err)
+			info, err = w.Stat("sub/dir")
+			require.NoError(err)
+			assert.True(info.IsDir())
+
+			entries, err := fs.ReadDir(w, ".")
+			require.NoError(err)
+			require.Len(entries, 2)
+			assert.Equal("a.txt", entries[0].Name())
+			assert.Equal("sub", entries[1].Name())
+
+			require.NoError(w.Rename("a.txt", "c.txt"))
+			_, err = w.Stat("a.txt")
+			assert.ErrorIs(err, fs.ErrNotExist)
+			data, err = fs.ReadFile(w, "c.txt")
+			require.NoError(err)
+			assert.Equal("hello", string(data))
+
+			require.NoError(w.Rename("sub", "moved"))
+			data, err = fs.ReadFile(w, "moved/b.txt")
+			require.NoError(err)
+			assert.Equal("b", string(data))
+
+			// non-empty directories can't be removed
+			assert.Error(w.Remove("moved"))
+			require.NoError(w.Remove("moved/b.txt"))
+			require.NoError(w.Remove("moved/dir"))
+			require.NoError(w.Remove("moved"))
+			require.NoError(w.Remove("c.txt"))
+			assert.ErrorIs(w.Remove("c.txt"), fs.ErrNotExist)
+
+			// names are relative to the root of the filesystem
+			_, err = w.Create("../escape.txt")
+			assert.Error(err)
+			assert.Error(w.Remove("/etc/passwd"))
+		})
+	}
+}
@@ -510,36 +510,43 @@ $(function() {
         container.append(spinner);
         console.log(container);
 
-        // Make fetch call to screenshot API
-        fetch(`/admin/bookmarks/ss/${id}`)
+        var restore = (error) => {
+            console.error("Screenshot failed:", error);
+            $.flash(`Screenshot failed: ${error}`, "error");
+            container.html("");
+            container.append($this);
+        };
+
+        // screenshots are taken by a background job; poll it until it
+        // finishes, then reload to show the screenshot and updated fields
+        var poll = (job) => {
+            fetch(`/admin/bookmarks/jobs/${job}`)
+                .then(response => response.json())
+                .then(data => {
+                    if (data.status === "done") {
+                        window.location.reload();
+                    } else if (data.status === "failed") {
+                        restore(data.last_error);
+                    } else if (data.status === "pending" && data.attempts > 0) {
+                        restore(`${data.last_error} (will retry)`);
+                    } else {
+                        setTimeout(() => poll(job), 2000);
+                    }
+                })
+                .catch(restore);
+        };
+
+        fetch(`/admin/bookmarks/ss/${id}`, {method: "POST"})
             .then(response => response.json())
             .then(data => {
                 console.log("Screenshot response:", data);
                 if (data.success) {
-                    // Update title if provided
-                    if (data.title && data.title.length > 0) {
-                        $("#title").val(data.title);
-                    }
-                    // Update description if provided
-                    if (data.description && data.description.length > 0) {
-                        $("#description").val(data.description);
-                    }
-                    
-                    // Refresh the page to show the screenshot and updated fields
-                    window.location.reload();
+                    poll(data.job);
                 } else {
-                    // Show error and restore camera icon
-                    console.error("Screenshot failed:", data.error);
-                    container.html("");
-                    container.append($this);
+                    restore(data.error);
                 }
             })
-            .catch(error => {
-                console.error("Screenshot failed:", error);
-                // Restore the camera icon even on error
-                container.html("");
-                container.append($this);
-            });
+            .catch(restore);
     });
 
     // Clear default values before form submission
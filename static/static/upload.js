@@ -11,7 +11,10 @@ $(() => {
             url: '/admin/uploads/upload',
             multiple: true,
             accept: '*',
-            maxFileSize: 64 * 1024 * 1024, // 64MB
+            maxFileSize: 0, // 0 leaves it to the filesystem's upload policy
+            tus: null, // url of a tus endpoint used for files larger than chunkSize
+            chunkSize: 8 * 1024 * 1024, // 8MB
+            retries: 5, // times a tus upload is resumed after network errors
             dragOverClass: 'drag-over',
             progressContainer: null, // Auto-create if null
             onSuccess: function(response, filename) {
@@ -128,7 +131,7 @@ $(() => {
 
                 // Filter files by size
                 const validFiles = files.filter(file => {
-                    if (file.size > settings.maxFileSize) {
+                    if (settings.maxFileSize && file.size > settings.maxFileSize) {
                         settings.onError('File too large: ' + file.name, file.name);
                         return false;
                     }
@@ -153,14 +156,15 @@ $(() => {
                     const $progressItem = createProgressItem(file.name, uploadId);
                     $progressContainer.find('.upload-progress-list').append($progressItem);
 
-                    uploadFile(file, uploadId)
+                    const upload = settings.tus && file.size > settings.chunkSize ? tusUpload : uploadFile;
+                    upload(file, uploadId)
                         .then(response => {
                             updateProgressItem(uploadId, 100, 'success', settings.text.complete);
                             successful++;
                             settings.onSuccess(response, file.name);
                         })
                         .catch(error => {
-                            updateProgressItem(uploadId, 0, 'error', settings.text.error);
+                            updateProgressItem(uploadId, 0, 'error', settings.text.error + ': ' + error.message);
                             failed++;
                             settings.onError(error, file.name);
                         })
@@ -200,7 +204,7 @@ $(() => {
                                 reject(new Error('Invalid response format'));
                             }
                         } else {
-                            reject(new Error('HTTP ' + xhr.status + ': ' + xhr.statusText));
+                            reject(responseError(xhr));
                         }
                     });
 
@@ -213,6 +217,113 @@ $(() => {
                 });
             }
 
+            // responseError returns an error describing a failed request
+            function responseError(xhr) {
+                if ((xhr.getResponseHeader('Content-Type') || '').startsWith('application/json')) {
+                    // refused by the filesystem's upload policy
+                    let message = 'HTTP ' + xhr.status + ': ' + xhr.statusText;
+                    try {
+                        const response = JSON.parse(xhr.responseText);
+                        message = response.error || message;
+                        if (response.allowed) {
+                            message += ' (allowed: ' + response.allowed.join(', ') + ')';
+                        }
+                    } catch (e) {}
+                    return new Error(message);
+                }
+                if (xhr.status === 409) {
+                    // the name is taken and the filesystem rejects collisions
+                    return new Error(xhr.responseText.trim());
+                }
+                return new Error('HTTP ' + xhr.status + ': ' + xhr.statusText);
+            }
+
+            // tusRequest makes a tus protocol request, resolving with the xhr
+            // once it has loaded and rejecting on network errors.
+            function tusRequest(method, url, headers, body, onProgress) {
+                return new Promise((resolve, reject) => {
+                    const xhr = new XMLHttpRequest();
+                    xhr.open(method, url);
+                    xhr.setRequestHeader('Tus-Resumable', '1.0.0');
+                    Object.entries(headers || {}).forEach(([k, v]) => xhr.setRequestHeader(k, v));
+                    if (onProgress) {
+                        xhr.upload.addEventListener('progress', e => onProgress(e.loaded));
+                    }
+                    xhr.addEventListener('load', () => resolve(xhr));
+                    xhr.addEventListener('error', () => reject(new Error('Network error')));
+                    xhr.send(body || null);
+                });
+            }
+
+            // tusUpload uploads file in chunks with the tus protocol.  The
+            // upload's url is remembered, so uploading the same file again,
+            // even after a reload, resumes where the last attempt stopped.
+            async function tusUpload(file, uploadId) {
+                const key = ['tus', settings.tus, file.name, file.size, file.lastModified].join(':');
+                const progress = sent => {
+                    const percentComplete = (sent / file.size) * 100;
+                    updateProgressItem(uploadId, percentComplete, '', settings.text.uploading + ' ' + Math.round(percentComplete) + '%');
+                };
+
+                let url = localStorage.getItem(key);
+                let offset = null;
+                if (url) {
+                    const xhr = await tusRequest('HEAD', url);
+                    if (xhr.status === 200) {
+                        offset = parseInt(xhr.getResponseHeader('Upload-Offset'), 10);
+                    }
+                }
+                if (offset === null) {
+                    const xhr = await tusRequest('POST', settings.tus, {
+                        'Upload-Length': file.size,
+                        'Upload-Metadata': 'filename ' + btoa(unescape(encodeURIComponent(file.name)))
+                    });
+                    if (xhr.status !== 201) {
+                        throw responseError(xhr);
+                    }
+                    url = xhr.getResponseHeader('Location');
+                    localStorage.setItem(key, url);
+                    offset = 0;
+                }
+
+                for (let retries = 0; ; ) {
+                    let xhr;
+                    try {
+                        xhr = await tusRequest('PATCH', url, {
+                            'Upload-Offset': offset,
+                            'Content-Type': 'application/offset+octet-stream'
+                        }, file.slice(offset, offset + settings.chunkSize), sent => progress(offset + sent));
+                    } catch (e) {
+                        if (++retries > settings.retries) {
+                            throw e;
+                        }
+                        // wait, then ask the server where to resume from
+                        await new Promise(resolve => setTimeout(resolve, 1000 * retries));
+                        const head = await tusRequest('HEAD', url).catch(() => null);
+                        if (head && head.status === 200) {
+                            offset = parseInt(head.getResponseHeader('Upload-Offset'), 10);
+                        }
+                        continue;
+                    }
+                    if (xhr.status !== 204) {
+                        localStorage.removeItem(key);
+                        throw responseError(xhr);
+                    }
+                    retries = 0;
+                    offset = parseInt(xhr.getResponseHeader('Upload-Offset'), 10);
+                    progress(offset);
+                    if (offset >= file.size) {
+                        localStorage.removeItem(key);
+                        return {
+                            success: true,
+                            id: parseInt(xhr.getResponseHeader('Upload-Id'), 10),
+                            filename: xhr.getResponseHeader('Upload-Filename'),
+                            url: xhr.getResponseHeader('Upload-Url')
+                        };
+                    }
+                }
+            }
+
             function createProgressItem(filename, uploadId) {
                 return $(`
                     <div class="progress-item" data-upload-id="${uploadId}">
@@ -232,7 +232,7 @@ func (a *App) search(w http.ResponseWriter, r *http.Request, query string, typeF
 
 func streamTypeFilter(value string) string {
 	switch value {
-	case "github", "bluesky", "twitter", "bitbucket":
+	case "github", "bluesky", "twitter", "bitbucket", EventTypeBookmark:
 		return value
 	default:
 		return ""
@@ -250,6 +250,7 @@ func (a *App) streamFrontendTypes(query, selected string) []map[string]any {
 		{Value: "github", Icon: "fa-brands fa-github", Label: "GitHub only"},
 		{Value: "twitter", Icon: "fa-brands fa-twitter", Label: "Twitter only"},
 		{Value: "bitbucket", Icon: "fa-brands fa-bitbucket", Label: "Bitbucket only"},
+		{Value: EventTypeBookmark, Icon: "fa-solid fa-bookmark", Label: "Bookmarks only"},
 	}
 
 	out := make([]map[string]any, 0, len(items))
@@ -0,0 +1,80 @@
+package stream
+
+import (
+	"bytes"
+	"encoding/json"
+	"html/template"
+	"strings"
+)
+
+// EventTypeBookmark is the event type of published bookmarks.
+const EventTypeBookmark = "bookmark"
+
+const bookmarkSummaryLimit = 280
+
+var bookmarkSummaryTemplate = template.Must(template.ParseFS(templates, "stream/summary-bookmark.html"))
+
+// BookmarkData is the event data stored for a published bookmark.
+type BookmarkData struct {
+	ID          string   `json:"id"`
+	URL         string   `json:"url"`
+	Title       string   `json:"title"`
+	Description string   `json:"description"`
+	SiteName    string   `json:"site_name,omitempty"`
+	ImageURL    string   `json:"image_url,omitempty"`
+	Tags        []string `json:"tags,omitempty"`
+}
+
+// RenderBookmarkSummary renders the stream summary for a bookmark.
+func RenderBookmarkSummary(d BookmarkData) (string, error) {
+	title := strings.TrimSpace(d.Title)
+	if title == "" {
+		title = d.URL
+	}
+	description := strings.Join(strings.Fields(d.Description), " ")
+	if rs := []rune(description); len(rs) > bookmarkSummaryLimit {
+		description = string(rs[:bookmarkSummaryLimit]) + "..."
+	}
+
+	var buf bytes.Buffer
+	err := bookmarkSummaryTemplate.Execute(&buf, map[string]any{
+		"url":         d.URL,
+		"title":       title,
+		"site_name":   d.SiteName,
+		"description": description,
+	})
+	return buf.String(), err
+}
+
+// NewBookmarkEvent returns the stream event for a published bookmark, keyed
+// by the bookmark's ID.
+func NewBookmarkEvent(d BookmarkData) (*Event, error) {
+	data, err := json.Marshal(d)
+	if err != nil {
+		return nil, err
+	}
+	summary, err := RenderBookmarkSummary(d)
+	if err != nil {
+		return nil, err
+	}
+	title := d.Title
+	if title == "" {
+		title = d.URL
+	}
+	return &Event{
+		Title:           title,
+		SourceId:        d.ID,
+		Type:            EventTypeBookmark,
+		Url:             d.URL,
+		Data:            string(data),
+		SummaryRendered: summary,
+	}, nil
+}
+
+func renderStoredBookmarkSummary(data string) (string, error) {
+	var d BookmarkData
+	if err := json.Unmarshal([]byte(data), &d); err != nil {
+		return "", err
+	}
+	return RenderBookmarkSummary(d)
+}
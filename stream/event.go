@@ -235,7 +235,7 @@ func (s *EventService) RerenderByType(eventType string, settings map[string]stri
 
 	updated := 0
 	for _, event := range events {
-		evaluation, err := sources.Reevaluate(event.Type, event.Url, event.Data, settings)
+		evaluation, err := reevaluate(event, settings)
 		if err != nil {
 			return updated, fmt.Errorf("rerender event %d: %w", event.Id, err)
 		}
@@ -247,6 +247,25 @@ func (s *EventService) RerenderByType(eventType string, settings map[string]stri
 	return updated, nil
 }
 
+// reevaluate re-renders an event's summary.  Bookmark events are rendered
+// by the stream rather than by a source module.
+func reevaluate(event *Event, settings map[string]string) (*sources.Evaluation, error) {
+	if event.Type == EventTypeBookmark {
+		summary, err := renderStoredBookmarkSummary(event.Data)
+		if err != nil {
+			return nil, err
+		}
+		return &sources.Evaluation{SummaryRendered: summary, Hidden: event.Hidden}, nil
+	}
+	return sources.Reevaluate(event.Type, event.Url, event.Data, settings)
+}
+
+// DeleteByTypeAndSourceID deletes the event for sourceID, if there is one.
+func (s *EventService) DeleteByTypeAndSourceID(eventType, sourceID string) error {
+	_, err := s.db.Exec(`DELETE FROM event WHERE type=? AND source_id=?`, eventType, sourceID)
+	return err
+}
+
 func (s *EventService) DeleteMissingByType(eventType string, keepSourceIDs []string) (int64, error) {
 	if len(keepSourceIDs) == 0 {
 		res, err := s.db.Exec(`DELETE FROM event WHERE type=?`, eventType)
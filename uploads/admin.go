@@ -2,11 +2,12 @@ package uploads
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
+	"log/slog"
 	"net/http"
-	"os"
-	"path/filepath"
+	"net/url"
+	"path"
 	"regexp"
 	"strconv"
 	"strings"
@@ -14,6 +15,7 @@ import (
 	"github.com/dustin/go-humanize"
 	"github.com/go-chi/chi/v5"
 	"github.com/jmoiron/monet/app"
+	"github.com/jmoiron/monet/conf"
 	"github.com/jmoiron/monet/db"
 	"github.com/jmoiron/monet/mtr"
 	"github.com/jmoiron/monet/pkg/vfs"
@@ -31,26 +33,45 @@ type Admin struct {
 	db       db.DB
 	service  *UploadService
 	registry vfs.Registry
+	tus      *TusHandler
 }
 
 // NewUploadsAdmin creates a new uploads admin
 func NewUploadsAdmin(database db.DB, registry vfs.Registry) *Admin {
 	return &Admin{
 		db:       database,
-		service:  NewUploadService(database),
+		service:  NewUploadService(database).WithMapper(mapperOf(registry)),
 		registry: registry,
+		tus:      NewTusHandler(database, registry),
 	}
 }
 
+// withConfig sets the config of the admin's uploads and resumable uploads.
+func (a *Admin) withConfig(cfg conf.UploadsConfig) *Admin {
+	a.service.WithConfig(cfg)
+	a.tus.WithConfig(cfg)
+	return a
+}
+
 // Bind sets up the admin routes
 func (a *Admin) Bind(r chi.Router) {
 	r.Route("/uploads", func(r chi.Router) {
 		r.Get("/", a.list)
 		r.Get("/fs/{filesystem}", a.listFilesystem)
+		r.Post("/fs/{filesystem}/mkdir", a.createFolder)
 		r.Get("/delete/{id}", a.deleteUpload)
 		r.Post("/rename/{id}", a.renameUpload)
+		r.Post("/move/{id}", a.moveUpload)
+		r.Get("/refs/{id}", a.uploadRefs)
+		r.Post("/derivatives/{id}", a.regenerateDerivatives)
 		r.Post("/upload", a.uploadFile)
 		r.Post("/upload/{filesystem}", a.uploadFileToFilesystem)
+		r.Route("/tus/{filesystem}", a.tus.Bind)
+		r.Get("/reconcile", a.reconcile)
+		r.Post("/reconcile/adopt", a.adoptFile)
+		r.Post("/reconcile/remove", a.removeFile)
+		r.Post("/reconcile/relink/{id}", a.relinkUpload)
+		r.Post("/reconcile/purge/{id}", a.purgeUpload)
 	})
 }
 
@@ -107,27 +128,63 @@ func (a *Admin) listFilesystem(w http.ResponseWriter, r *http.Request) {
 	a.renderList(w, r, filesystem, title)
 }
 
-// renderList renders the upload list page
+// renderList renders the upload list page.  Uploads in a filesystem are
+// browsed a folder at a time, the one in the "dir" query parameter.
 func (a *Admin) renderList(w http.ResponseWriter, r *http.Request, filesystem, title string) {
+	var dir string
+	if filesystem != "" {
+		clean, err := vfs.CleanPath(r.URL.Query().Get("dir"))
+		if err != nil {
+			http.Error(w, "Invalid folder", http.StatusBadRequest)
+			return
+		}
+		if clean != "." {
+			dir = clean
+		}
+	}
+
 	// Get total count for pagination
-	totalCount, err := a.service.Count(filesystem)
+	var totalCount int
+	var err error
+	if filesystem != "" {
+		totalCount, err = a.service.CountDir(filesystem, dir)
+	} else {
+		totalCount, err = a.service.Count(filesystem)
+	}
 	if err != nil {
 		http.Error(w, "Failed to count uploads: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 
 	// Create paginator and get current page
-	paginator := mtr.NewPaginator(adminPageSize, totalCount)
-	pageNum := app.GetIntParam(r, "page", 1)
+	paginator := mtr.NewPaginator(adminPageSize, totalCount).WithLinkFn(func(p int) string {
+		return "?" + dirQuery(dir, p)
+	})
+	// pages are in the query, alongside the folder
+	pageNum := 1
+	if n, err := strconv.Atoi(r.URL.Query().Get("page")); err == nil && n > 0 {
+		pageNum = n
+	}
 	page := paginator.Page(pageNum)
 
 	// Get uploads for this page
-	uploads, err := a.service.List(filesystem, adminPageSize, page.StartOffset)
+	var uploads []*Upload
+	if filesystem != "" {
+		uploads, err = a.service.ListDir(filesystem, dir, adminPageSize, page.StartOffset)
+	} else {
+		uploads, err = a.service.List(filesystem, adminPageSize, page.StartOffset)
+	}
 	if err != nil {
 		http.Error(w, "Failed to get uploads: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	refs, err := BuildRefIndex(a.db, a.service.mapper)
+	if err != nil {
+		http.Error(w, "Failed to find references: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
 	// Transform uploads for template with file URLs
 	var uploadItems []map[string]interface{}
 	for _, upload := range uploads {
@@ -136,24 +193,75 @@ func (a *Admin) renderList(w http.ResponseWriter, r *http.Request, filesystem, t
 			fileURL = "#" // Fallback if URL generation fails
 		}
 
+		used, err := a.service.ReferencesIn(refs, upload)
+		if err != nil {
+			slog.Warn("Failed to find references", "upload", upload.ID, "error", err)
+		}
+		meta, err := a.service.EXIF(upload.ID)
+		if err != nil {
+			slog.Warn("Failed to get exif", "upload", upload.ID, "error", err)
+		}
+
+		// within a folder, the folder goes without saying
+		name := upload.Filename
+		if filesystem != "" {
+			name = path.Base(name)
+		}
+
 		uploadItems = append(uploadItems, map[string]interface{}{
 			"ID":             upload.ID,
 			"FilesystemName": upload.FilesystemName,
 			"Filename":       upload.Filename,
+			"Name":           name,
+			"Folder":         strings.TrimSuffix(dirPrefix(path.Dir(upload.Filename)), "/"),
 			"Size":           upload.Size,
 			"SizeHuman":      humanize.Bytes(uint64(upload.Size)),
 			"CreatedAt":      upload.CreatedAt,
 			"FileURL":        fileURL,
 			"FilesystemURL":  fmt.Sprintf("/admin/uploads/fs/%s", upload.FilesystemName),
 			"IsImage":        imageFileRegex.MatchString(strings.ToLower(upload.Filename)),
+			"IsDerivable":    IsDerivable(upload.Filename),
+			"RefCount":       len(used),
+			"EXIF":           meta,
 		})
 	}
 
+	// Folders in this one, and the path to it
+	var folders, crumbs []map[string]string
+	if filesystem != "" {
+		fsys, _ := a.registry.Get(filesystem)
+		names, err := a.service.Folders(fsys, filesystem, dir)
+		if err != nil {
+			http.Error(w, "Failed to list folders: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		base := fmt.Sprintf("/admin/uploads/fs/%s", filesystem)
+		for _, name := range names {
+			folders = append(folders, map[string]string{
+				"Name": name,
+				"URL":  base + "?" + dirQuery(path.Join(dir, name), 0),
+			})
+		}
+		crumbs = append(crumbs, map[string]string{"Name": filesystem, "URL": base})
+		if dir != "" {
+			elems := strings.Split(dir, "/")
+			for i, elem := range elems {
+				crumbs = append(crumbs, map[string]string{
+					"Name": elem,
+					"URL":  base + "?" + dirQuery(path.Join(elems[:i+1]...), 0),
+				})
+			}
+		}
+	}
+
 	reg := mtr.RegistryFromContext(r.Context())
 	err = reg.RenderWithBase(w, "admin-base", "uploads/admin/upload-list.html", mtr.Ctx{
 		"title":      title,
 		"uploads":    uploadItems,
 		"filesystem": filesystem,
+		"dir":        dir,
+		"folders":    folders,
+		"crumbs":     crumbs,
 		"pagination": paginator.Render(reg, page),
 	})
 
@@ -163,6 +271,41 @@ func (a *Admin) renderList(w http.ResponseWriter, r *http.Request, filesystem, t
 	}
 }
 
+// dirQuery returns the query string of page p of the folder dir, leaving
+// out the root folder and the first page.
+func dirQuery(dir string, p int) string {
+	q := url.Values{}
+	if dir != "" {
+		q.Set("dir", dir)
+	}
+	if p > 1 {
+		q.Set("page", strconv.Itoa(p))
+	}
+	return q.Encode()
+}
+
+// createFolder makes the folder "name" in the folder "dir" of a filesystem,
+// and shows it.
+func (a *Admin) createFolder(w http.ResponseWriter, r *http.Request) {
+	filesystem := chi.URLParam(r, "filesystem")
+	fsys, err := a.registry.GetWritable(filesystem)
+	if err != nil {
+		http.Error(w, "Failed to get filesystem: "+err.Error(), http.StatusNotFound)
+		return
+	}
+	dir, err := a.registry.Policy(filesystem).SanitizeDir(path.Join(r.FormValue("dir"), r.FormValue("name")))
+	if err != nil || dir == "" {
+		http.Error(w, "Invalid folder", http.StatusBadRequest)
+		return
+	}
+	if err := fsys.MkdirAll(dir, 0755); err != nil {
+		http.Error(w, "Failed to create folder: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	slog.Info("created folder", "filesystem", filesystem, "dir", dir)
+	http.Redirect(w, r, fmt.Sprintf("/admin/uploads/fs/%s?%s", filesystem, dirQuery(dir, 0)), http.StatusSeeOther)
+}
+
 // deleteUpload handles delete requests from the admin interface
 func (a *Admin) deleteUpload(w http.ResponseWriter, r *http.Request) {
 	idStr := chi.URLParam(r, "id")
@@ -187,6 +330,13 @@ func (a *Admin) deleteUpload(w http.ResponseWriter, r *http.Request) {
 		// File deletion could be added later if needed
 	}
 
+	// Derivatives are only ever reached through the record, so remove them
+	if fsys, err := a.registry.GetWritable(upload.FilesystemName); err == nil {
+		if err := a.service.DeleteDerivativeFiles(id, fsys); err != nil {
+			slog.Warn("Failed to delete derivatives", "id", id, "error", err)
+		}
+	}
+
 	// Delete from database
 	err = a.service.Delete(id)
 	if err != nil {
@@ -219,66 +369,50 @@ func (a *Admin) uploadFileToFilesystem(w http.ResponseWriter, r *http.Request) {
 
 // handleFileUpload processes a file upload using the uploads library
 func (a *Admin) handleFileUpload(w http.ResponseWriter, r *http.Request, filesystemName string) {
-	// Parse the multipart form
-	err := r.ParseMultipartForm(64 << 20) // 64MiB max
-	if err != nil {
-		http.Error(w, "Failed to parse form: "+err.Error(), http.StatusBadRequest)
-		return
-	}
-
-	file, header, err := r.FormFile("file")
+	// Stream the file from the form rather than buffering it
+	file, name, err := vfs.FormFile(r, "file")
 	if err != nil {
 		http.Error(w, "Failed to get file from form: "+err.Error(), http.StatusBadRequest)
 		return
 	}
 	defer file.Close()
 
-	// Clean the filename
-	filename := filepath.Base(header.Filename)
-	if filename == "" || filename == "." {
-		http.Error(w, "Invalid filename", http.StatusBadRequest)
-		return
-	}
-
 	// Get the filesystem
-	fs, err := a.registry.Get(filesystemName)
+	fsys, err := a.registry.GetWritable(filesystemName)
 	if err != nil {
 		http.Error(w, "Failed to get filesystem: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	// Get the base path
-	var basePath string
-	if pfs, ok := fs.(vfs.PathFS); ok {
-		basePath = pfs.Path()
-	} else {
-		http.Error(w, "Filesystem "+filesystemName+" is not writable", http.StatusInternalServerError)
+	// Clean the filename and check the file against the policy
+	filename, body, err := a.service.Policy(a.registry, filesystemName).ApplyIn(fsys, r.URL.Query().Get("dir"), name, file)
+	if vfs.WritePolicyError(w, err) {
 		return
 	}
-
-	// Create the full path for the new file
-	destPath := filepath.Join(basePath, filename)
-
-	// Create the destination file
-	destFile, err := os.Create(destPath)
 	if err != nil {
-		http.Error(w, "Failed to create file: "+err.Error(), http.StatusInternalServerError)
+		http.Error(w, "Failed to read file: "+err.Error(), http.StatusBadRequest)
 		return
 	}
-	defer destFile.Close()
 
-	// Copy the uploaded file to the destination and track size
-	bytesWritten, err := io.Copy(destFile, file)
+	// Save the file, reusing an existing upload with the same content
+	upload, existing, err := a.service.Store(fsys, filesystemName, filename, body)
+	if vfs.WritePolicyError(w, err) {
+		return
+	}
+	if errors.Is(err, ErrNameTaken) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
 	if err != nil {
 		http.Error(w, "Failed to save file: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	// Create database record with file size
-	upload, err := a.service.Create(filesystemName, filename, bytesWritten)
-	if err != nil {
-		http.Error(w, "Failed to create upload record: "+err.Error(), http.StatusInternalServerError)
-		return
+	// Make smaller copies of images; the upload is still usable without them
+	if !existing {
+		if _, err := a.service.GenerateDerivatives(upload, fsys); err != nil {
+			slog.Warn("Failed to generate derivatives", "filename", upload.Filename, "error", err)
+		}
 	}
 
 	// Get file URL for response
@@ -295,12 +429,46 @@ func (a *Admin) handleFileUpload(w http.ResponseWriter, r *http.Request, filesys
 		"size":       upload.Size,
 		"created_at": upload.CreatedAt,
 		"url":        fileURL,
+		"duplicate":  existing,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
 }
 
+// regenerateDerivatives remakes the derivatives of an image upload, eg. after
+// the configured sizes have changed.
+func (a *Admin) regenerateDerivatives(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid upload ID", http.StatusBadRequest)
+		return
+	}
+
+	upload, err := a.service.GetByID(id)
+	if err != nil {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return
+	}
+
+	fsys, err := a.registry.GetWritable(upload.FilesystemName)
+	if err != nil {
+		http.Error(w, "Failed to get filesystem: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := a.service.GenerateDerivatives(upload, fsys); err != nil {
+		app.Http500("generating derivatives", w, err)
+		return
+	}
+
+	referer := r.Header.Get("Referer")
+	if referer == "" || !strings.Contains(referer, "/admin/uploads") {
+		referer = "/admin/uploads/"
+	}
+	http.Redirect(w, r, referer, http.StatusSeeOther)
+}
+
 // renameUpload handles renaming an upload file
 func (a *Admin) renameUpload(w http.ResponseWriter, r *http.Request) {
 	idStr := chi.URLParam(r, "id")
@@ -317,7 +485,7 @@ func (a *Admin) renameUpload(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Clean the filename
-	newFilename = filepath.Base(newFilename)
+	newFilename = path.Base(strings.ReplaceAll(newFilename, "\\", "/"))
 	if newFilename == "" || newFilename == "." {
 		http.Error(w, "Invalid filename", http.StatusBadRequest)
 		return
@@ -329,45 +497,35 @@ func (a *Admin) renameUpload(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Upload not found", http.StatusNotFound)
 		return
 	}
+	// Files are renamed within their folder; moveUpload moves them
+	newFilename = path.Join(path.Dir(upload.Filename), newFilename)
 
 	// Get the filesystem
-	fs, err := a.registry.Get(upload.FilesystemName)
+	fsys, err := a.registry.GetWritable(upload.FilesystemName)
 	if err != nil {
 		http.Error(w, "Failed to get filesystem: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	// Get the base path
-	var basePath string
-	if pfs, ok := fs.(vfs.PathFS); ok {
-		basePath = pfs.Path()
-	} else {
-		http.Error(w, "Filesystem "+upload.FilesystemName+" is not writable", http.StatusInternalServerError)
-		return
-	}
-
-	// Create the old and new file paths
-	oldPath := filepath.Join(basePath, upload.Filename)
-	newPath := filepath.Join(basePath, newFilename)
-
 	// Check if new filename already exists
-	if _, err := os.Stat(newPath); err == nil {
+	if _, err := fsys.Stat(newFilename); err == nil {
 		http.Error(w, "A file with that name already exists", http.StatusConflict)
 		return
 	}
 
 	// Rename the file on filesystem
-	err = os.Rename(oldPath, newPath)
+	err = fsys.Rename(upload.Filename, newFilename)
 	if err != nil {
 		http.Error(w, "Failed to rename file: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	// Update the database record
-	err = a.service.UpdateFilename(id, newFilename)
+	// Update the database record, and the references to it if asked
+	rewrite := r.FormValue("rewrite") != ""
+	rewritten, err := a.service.RenameFilename(id, newFilename, rewrite)
 	if err != nil {
 		// Try to rename the file back if database update fails
-		os.Rename(newPath, oldPath)
+		fsys.Rename(newFilename, upload.Filename)
 		http.Error(w, "Failed to update database: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -375,11 +533,85 @@ func (a *Admin) renameUpload(w http.ResponseWriter, r *http.Request) {
 	// Return success
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
-		"success":  true,
-		"filename": newFilename,
+		"success":   true,
+		"filename":  newFilename,
+		"rewritten": rewritten,
+	})
+}
+
+// moveUpload moves an upload and its derivatives to the folder "dir" of its
+// filesystem, which is created if needed.
+func (a *Admin) moveUpload(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid upload ID", http.StatusBadRequest)
+		return
+	}
+	upload, err := a.service.GetByID(id)
+	if err != nil {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return
+	}
+	fsys, err := a.registry.GetWritable(upload.FilesystemName)
+	if err != nil {
+		http.Error(w, "Failed to get filesystem: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	dir, err := a.registry.Policy(upload.FilesystemName).SanitizeDir(r.FormValue("dir"))
+	if err != nil {
+		http.Error(w, "Invalid folder", http.StatusBadRequest)
+		return
+	}
+
+	rewrite := r.FormValue("rewrite") != ""
+	moved, rewritten, err := a.service.Move(fsys, id, dir, rewrite)
+	if errors.Is(err, ErrNameTaken) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to move file: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	slog.Info("moved upload", "id", id, "from", upload.Filename, "to", moved.Filename)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":   true,
+		"filename":  moved.Filename,
+		"rewritten": rewritten,
 	})
 }
 
+// uploadRefs shows where an upload is used.
+func (a *Admin) uploadRefs(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid upload ID", http.StatusBadRequest)
+		return
+	}
+	upload, refs, err := a.service.References(id)
+	if err != nil {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return
+	}
+	fileURL, err := a.getFileURL(upload.FilesystemName, upload.Filename)
+	if err != nil {
+		fileURL = "#"
+	}
+
+	reg := mtr.RegistryFromContext(r.Context())
+	err = reg.RenderWithBase(w, "admin-base", "uploads/admin/upload-refs.html", mtr.Ctx{
+		"title":   "Where is " + upload.Filename + " used?",
+		"upload":  upload,
+		"fileURL": fileURL,
+		"refs":    refs,
+	})
+	if err != nil {
+		http.Error(w, "Template error: "+err.Error(), http.StatusInternalServerError)
+	}
+}
+
 // getFileURL generates the public URL for a file
 func (a *Admin) getFileURL(filesystemName, filename string) (string, error) {
 	if a.registry.Mapper() == nil {
@@ -388,3 +620,172 @@ func (a *Admin) getFileURL(filesystemName, filename string) (string, error) {
 
 	return a.registry.Mapper().GetURL(filesystemName, filename)
 }
+
+// reconcile shows the drift between the filesystems and the upload table.
+func (a *Admin) reconcile(w http.ResponseWriter, r *http.Request) {
+	rec, err := a.service.Reconcile(a.registry)
+	if err != nil {
+		http.Error(w, "Failed to reconcile uploads: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var unreferenced []map[string]interface{}
+	for _, upload := range rec.Unreferenced {
+		fileURL, err := a.getFileURL(upload.FilesystemName, upload.Filename)
+		if err != nil {
+			fileURL = "#"
+		}
+		unreferenced = append(unreferenced, map[string]interface{}{
+			"ID":             upload.ID,
+			"FilesystemName": upload.FilesystemName,
+			"Filename":       upload.Filename,
+			"SizeHuman":      humanize.Bytes(uint64(upload.Size)),
+			"CreatedAt":      upload.CreatedAt,
+			"FileURL":        fileURL,
+		})
+	}
+
+	var untracked []map[string]interface{}
+	for _, f := range rec.Untracked {
+		untracked = append(untracked, map[string]interface{}{
+			"FilesystemName": f.FilesystemName,
+			"Filename":       f.Filename,
+			"SizeHuman":      humanize.Bytes(uint64(f.Size)),
+			"ModTime":        f.ModTime,
+		})
+	}
+
+	var missing []map[string]interface{}
+	for _, m := range rec.Missing {
+		missing = append(missing, map[string]interface{}{
+			"ID":             m.ID,
+			"FilesystemName": m.FilesystemName,
+			"Filename":       m.Filename,
+			"SizeHuman":      humanize.Bytes(uint64(m.Size)),
+			"CreatedAt":      m.CreatedAt,
+			"Candidates":     m.Candidates,
+		})
+	}
+
+	reg := mtr.RegistryFromContext(r.Context())
+	err = reg.RenderWithBase(w, "admin-base", "uploads/admin/reconcile.html", mtr.Ctx{
+		"title":        "Reconcile Uploads",
+		"filesystems":  rec.Filesystems,
+		"clean":        rec.Empty(),
+		"untracked":    untracked,
+		"missing":      missing,
+		"unreferenced": unreferenced,
+	})
+	if err != nil {
+		http.Error(w, "Template error: "+err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// reconcileTarget returns the writable filesystem and filename named by
+// the "fs" and "name" values of a reconcile action.
+func (a *Admin) reconcileTarget(r *http.Request) (vfs.WritableFS, string, string, error) {
+	fsName, filename := r.FormValue("fs"), r.FormValue("name")
+	if clean, err := vfs.CleanPath(filename); err != nil || clean != filename || clean == "." {
+		return nil, "", "", fmt.Errorf("invalid filename %q", filename)
+	}
+	fsys, err := a.registry.GetWritable(fsName)
+	return fsys, fsName, filename, err
+}
+
+// adoptFile records an untracked file as an upload.
+func (a *Admin) adoptFile(w http.ResponseWriter, r *http.Request) {
+	fsys, fsName, filename, err := a.reconcileTarget(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	upload, err := a.service.Adopt(fsys, fsName, filename)
+	if err != nil {
+		http.Error(w, "Failed to adopt file: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if _, err := a.service.GenerateDerivatives(upload, fsys); err != nil {
+		slog.Warn("Failed to generate derivatives", "filename", filename, "error", err)
+	}
+	slog.Info("adopted untracked file", "filesystem", fsName, "filename", filename, "id", upload.ID)
+	http.Redirect(w, r, "/admin/uploads/reconcile", http.StatusSeeOther)
+}
+
+// removeFile deletes an untracked file.
+func (a *Admin) removeFile(w http.ResponseWriter, r *http.Request) {
+	fsys, fsName, filename, err := a.reconcileTarget(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// refuse to delete files that were adopted since the report was made
+	if _, err := a.service.GetByFilename(fsName, filename); err == nil {
+		http.Error(w, "File is tracked", http.StatusConflict)
+		return
+	}
+	if err := fsys.Remove(filename); err != nil {
+		http.Error(w, "Failed to delete file: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	slog.Info("deleted untracked file", "filesystem", fsName, "filename", filename)
+	http.Redirect(w, r, "/admin/uploads/reconcile", http.StatusSeeOther)
+}
+
+// relinkUpload points an upload whose file is missing at another file.
+func (a *Admin) relinkUpload(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid upload ID", http.StatusBadRequest)
+		return
+	}
+	upload, err := a.service.GetByID(id)
+	if err != nil {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return
+	}
+	fsys, err := a.registry.GetWritable(upload.FilesystemName)
+	if err != nil {
+		http.Error(w, "Failed to get filesystem: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	filename := r.FormValue("name")
+	if clean, err := vfs.CleanPath(filename); err != nil || clean != filename || clean == "." {
+		http.Error(w, "Invalid filename", http.StatusBadRequest)
+		return
+	}
+	if err := a.service.Relink(fsys, id, filename); err != nil {
+		http.Error(w, "Failed to relink upload: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	upload.Filename = filename
+	if _, err := a.service.GenerateDerivatives(upload, fsys); err != nil {
+		slog.Warn("Failed to generate derivatives", "filename", filename, "error", err)
+	}
+	slog.Info("relinked upload", "id", id, "filename", filename)
+	http.Redirect(w, r, "/admin/uploads/reconcile", http.StatusSeeOther)
+}
+
+// purgeUpload deletes an upload along with whatever is left of its files.
+func (a *Admin) purgeUpload(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid upload ID", http.StatusBadRequest)
+		return
+	}
+	upload, err := a.service.GetByID(id)
+	if err != nil {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return
+	}
+	fsys, err := a.registry.GetWritable(upload.FilesystemName)
+	if err != nil {
+		http.Error(w, "Failed to get filesystem: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := a.service.Purge(fsys, id); err != nil {
+		http.Error(w, "Failed to delete upload: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	slog.Info("purged upload", "id", id, "filesystem", upload.FilesystemName, "filename", upload.Filename)
+	http.Redirect(w, r, "/admin/uploads/reconcile", http.StatusSeeOther)
+}
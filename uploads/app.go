@@ -1,18 +1,21 @@
 package uploads
 
 import (
+	"context"
 	"embed"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"log/slog"
 	"net/http"
-	"os"
-	"path/filepath"
 	"strconv"
+	"sync"
+	"time"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/go-sprout/sprout"
 	"github.com/jmoiron/monet/app"
+	"github.com/jmoiron/monet/conf"
 	"github.com/jmoiron/monet/db"
 	"github.com/jmoiron/monet/db/monarch"
 	"github.com/jmoiron/monet/mtr"
@@ -28,6 +31,10 @@ type App struct {
 	service   *UploadService
 	registry  vfs.Registry
 	uploaders map[string]*TrackedUploader
+	cfg       conf.UploadsConfig
+
+	expireOnce sync.Once
+	stopExpiry context.CancelFunc
 }
 
 // TrackedUploader wraps a VFS uploader with database tracking
@@ -42,12 +49,23 @@ type TrackedUploader struct {
 func NewApp(database db.DB, registry vfs.Registry) *App {
 	return &App{
 		db:        database,
-		service:   NewUploadService(database),
+		service:   NewUploadService(database).WithMapper(mapperOf(registry)),
 		registry:  registry,
 		uploaders: make(map[string]*TrackedUploader),
+		cfg:       conf.Default().Uploads,
 	}
 }
 
+// WithConfig sets the sizes and quality of image derivatives, the
+// collision policy of each filesystem, which filesystems are reconciled,
+// where and for how long resumable uploads are kept and how the EXIF
+// metadata of photos is handled, for the app and its admin.
+func (a *App) WithConfig(cfg conf.UploadsConfig) *App {
+	a.cfg = cfg
+	a.service.WithConfig(cfg)
+	return a
+}
+
 func (a *App) Name() string { return "uploads" }
 
 // CreateUploader creates a tracked uploader for the given filesystem name
@@ -97,89 +115,67 @@ func (t *TrackedUploader) handleGet(w http.ResponseWriter, r *http.Request) {
 
 // handleTrackedPost handles file uploads with database tracking
 func (t *TrackedUploader) handleTrackedPost(w http.ResponseWriter, r *http.Request) {
-	// Parse the multipart form
-	err := r.ParseMultipartForm(64 << 20) // 64MiB max
-	if err != nil {
-		http.Error(w, "Failed to parse form: "+err.Error(), http.StatusBadRequest)
-		return
-	}
-
-	file, header, err := r.FormFile("file")
+	// Stream the file from the form rather than buffering it
+	file, name, err := vfs.FormFile(r, "file")
 	if err != nil {
 		http.Error(w, "Failed to get file from form: "+err.Error(), http.StatusBadRequest)
 		return
 	}
 	defer file.Close()
 
-	// Clean the filename
-	filename := filepath.Base(header.Filename)
-	if filename == "" || filename == "." {
-		http.Error(w, "Invalid filename", http.StatusBadRequest)
+	// Clean the filename and check the file against the policy
+	filename, body, err := t.service.Policy(t.registry, t.filesystemName).ApplyIn(t.FS(), r.URL.Query().Get("dir"), name, file)
+	if vfs.WritePolicyError(w, err) {
 		return
 	}
-
-	// Use the VFS uploader's underlying logic to save the file
-
-	// Get the filesystem to find the base path
-	fs, err := t.registry.Get(t.filesystemName)
 	if err != nil {
-		http.Error(w, "Failed to get filesystem: "+err.Error(), http.StatusInternalServerError)
+		http.Error(w, "Failed to read file: "+err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	// the fs.FS type is read-only, to be writable, it needs to be a PathFS
-	var basePath string
-	if pfs, ok := fs.(vfs.PathFS); !ok {
-		basePath = pfs.Path()
-	} else {
-		http.Error(w, "Unable to determine filesystem path", http.StatusInternalServerError)
+	// Save the file, reusing an existing upload with the same content
+	upload, existing, err := t.service.Store(t.FS(), t.filesystemName, filename, body)
+	if vfs.WritePolicyError(w, err) {
 		return
 	}
-
-	// Create the full path for the new file
-	destPath := filepath.Join(basePath, filename)
-
-	// Create the destination file
-	destFile, err := os.Create(destPath)
-	if err != nil {
-		http.Error(w, "Failed to create file: "+err.Error(), http.StatusInternalServerError)
+	if errors.Is(err, ErrNameTaken) {
+		http.Error(w, err.Error(), http.StatusConflict)
 		return
 	}
-	defer destFile.Close()
-
-	// Copy the uploaded file to the destination and track size
-	bytesWritten, err := io.Copy(destFile, file)
 	if err != nil {
 		http.Error(w, "Failed to save file: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
-
-	// Create database record with file size
-	upload, err := t.service.Create(t.filesystemName, filename, bytesWritten)
-	if err != nil {
-		slog.Error("Failed to create upload record", "error", err)
-		// File was saved but DB record failed - continue anyway
+	if !existing {
+		if _, err := t.service.GenerateDerivatives(upload, t.FS()); err != nil {
+			slog.Warn("Failed to generate derivatives", "filename", upload.Filename, "error", err)
+		}
 	}
 
 	// Return success with the file URL and database info
-	fileURL := t.GetFileURL(filename)
-	response := map[string]interface{}{
-		"success":  true,
-		"filename": filename,
-		"url":      fileURL,
+	fileURL, err := t.registry.Mapper().GetURL(t.filesystemName, upload.Filename)
+	if err != nil {
+		fileURL = t.GetFileURL(upload.Filename)
 	}
-
-	if upload != nil {
-		response["id"] = upload.ID
-		response["created_at"] = upload.CreatedAt
+	response := map[string]interface{}{
+		"success":    true,
+		"id":         upload.ID,
+		"filename":   upload.Filename,
+		"url":        fileURL,
+		"created_at": upload.CreatedAt,
+		"duplicate":  existing,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
 }
 
-// DeleteTracked removes both the file and database record
+// DeleteTracked removes the file, its derivatives and the database record
 func (t *TrackedUploader) DeleteTracked(filename string) error {
+	if upload, err := t.service.GetByFilename(t.filesystemName, filename); err == nil {
+		t.deleteDerivatives(upload.ID)
+	}
+
 	// Delete from filesystem first
 	err := t.DeleteFile(filename)
 	if err != nil {
@@ -196,13 +192,14 @@ func (t *TrackedUploader) DeleteTracked(filename string) error {
 	return nil
 }
 
-// DeleteTrackedByID removes both the file and database record by upload ID
+// DeleteTrackedByID removes the file, its derivatives and the database record by upload ID
 func (t *TrackedUploader) DeleteTrackedByID(id uint64) error {
 	// Get the upload record first
 	upload, err := t.service.GetByID(id)
 	if err != nil {
 		return fmt.Errorf("failed to get upload record: %w", err)
 	}
+	t.deleteDerivatives(id)
 
 	// Delete the file
 	err = t.DeleteFile(upload.Filename)
@@ -220,6 +217,14 @@ func (t *TrackedUploader) DeleteTrackedByID(id uint64) error {
 	return nil
 }
 
+// deleteDerivatives removes the derivative files of an upload; failures
+// are logged, as they shouldn't prevent deleting the upload itself.
+func (t *TrackedUploader) deleteDerivatives(id uint64) {
+	if err := t.service.DeleteDerivativeFiles(id, t.FS()); err != nil {
+		slog.Warn("Failed to delete derivatives", "filesystem", t.filesystemName, "id", id, "error", err)
+	}
+}
+
 // Attach the uploads app to a router (if needed for admin interface)
 func (a *App) Attach(r chi.Router, base string) {
 	r.Route(base, func(r chi.Router) {
@@ -321,19 +326,68 @@ func (a *App) Migrate() error {
 	return nil
 }
 
-// Register registers templates with the template registry
+// Register registers templates with the template registry, along with the
+// uploadImage template function and a markdown hook that both render
+// responsive images for tracked uploads.
 func (a *App) Register(reg *mtr.Registry) {
+	images := NewImages(a.service, a.registry)
+	reg.Handler.AddRegistry(
+		mtr.NewSproutRegistry("uploads", sprout.FunctionMap{
+			"uploadImage": images.Image,
+		}),
+	)
+	mtr.SetImageHook("uploads", images.MarkdownAttrs)
+
 	reg.AddPathFS("uploads/admin/upload-panel.html", uploadTemplates)
 	reg.AddPathFS("uploads/admin/upload-list.html", uploadTemplates)
+	reg.AddPathFS("uploads/admin/reconcile.html", uploadTemplates)
+	reg.AddPathFS("uploads/admin/upload-refs.html", uploadTemplates)
 }
 
-// Bind sets up the HTTP routes for the uploads app
+// Bind sets up the HTTP routes for the uploads app, and starts expiring
+// abandoned resumable uploads until Stop is called.
 func (a *App) Bind(r chi.Router) {
 	// Bind admin routes
 	a.Attach(r, "/uploads")
+	a.expireOnce.Do(func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		a.stopExpiry = cancel
+		go a.expireTus(ctx)
+	})
+}
+
+// Stop stops expiring abandoned resumable uploads.  Binding the app after
+// it's been stopped doesn't restart it.
+func (a *App) Stop() {
+	a.expireOnce.Do(func() {})
+	if a.stopExpiry != nil {
+		a.stopExpiry()
+	}
+}
+
+// expireTus periodically removes resumable uploads that have expired, until
+// ctx is cancelled.
+func (a *App) expireTus(ctx context.Context) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for {
+		n, err := a.service.ExpireTusUploads()
+		if err != nil {
+			slog.Error("expiring resumable uploads", "err", err)
+		} else if n > 0 {
+			slog.Info("expired resumable uploads", "count", n)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
 }
 
 // GetAdmin returns the uploads admin interface
 func (a *App) GetAdmin() (app.Admin, error) {
-	return NewUploadsAdmin(a.db, a.registry), nil
+	return NewUploadsAdmin(a.db, a.registry).withConfig(a.cfg), nil
 }
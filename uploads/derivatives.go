@@ -0,0 +1,211 @@
+package uploads
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io/fs"
+	"log/slog"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/jmoiron/monet/pkg/exif"
+	"github.com/jmoiron/monet/pkg/vfs"
+	"golang.org/x/image/draw"
+)
+
+// derivable images are those we can decode and re-encode; gifs are left
+// alone so that animations survive.
+var derivableRegex = regexp.MustCompile(`(?i)\.(jpe?g|png)$`)
+
+// IsDerivable returns true if derivatives can be made for filename.
+func IsDerivable(filename string) bool {
+	return derivableRegex.MatchString(filename)
+}
+
+// derivativeFilename returns the filename of the derivative of filename
+// that is width pixels wide, eg. "photo.jpg" -> "photo-800w.jpg".
+func derivativeFilename(filename string, width int) string {
+	ext := filepath.Ext(filename)
+	return fmt.Sprintf("%s-%dw%s", strings.TrimSuffix(filename, ext), width, ext)
+}
+
+// derivativeName returns the name of the derivative of the file filename
+// in fsys that is width pixels wide.  It is derivativeFilename, numbered
+// like "photo-800w-1.jpg" if another file or upload already has that name,
+// so that derivatives never overwrite them.  Names in own belong to the
+// upload's current derivatives, which can be replaced.
+func (s *UploadService) derivativeName(fsys vfs.WritableFS, filesystemName, filename string, width int, own map[string]bool) (string, error) {
+	name := derivativeFilename(filename, width)
+	ext := path.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for i := 1; i < 1000; i++ {
+		if own[name] {
+			return name, nil
+		}
+		taken, err := s.nameTaken(fsys, filesystemName, name)
+		if err != nil || !taken {
+			return name, err
+		}
+		name = fmt.Sprintf("%s-%d%s", base, i, ext)
+	}
+	return "", fmt.Errorf("%s: %w", derivativeFilename(filename, width), ErrNameTaken)
+}
+
+// GenerateDerivatives makes a scaled down copy of upload, which is stored in
+// fsys, for each of the service's derivative sizes narrower than the upload,
+// and records them and the upload's dimensions.  Uploads that aren't images
+// have no derivatives.
+func (s *UploadService) GenerateDerivatives(upload *Upload, fsys vfs.WritableFS) ([]*Derivative, error) {
+	if !IsDerivable(upload.Filename) {
+		return nil, nil
+	}
+
+	src, err := decodeImage(fsys, upload.Filename)
+	if err != nil {
+		return nil, err
+	}
+	bounds := src.Bounds()
+	upload.Width, upload.Height = bounds.Dx(), bounds.Dy()
+	_, err = s.db.Exec(`UPDATE upload SET width = ?, height = ? WHERE id = ?`, upload.Width, upload.Height, upload.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to update dimensions for upload ID %d: %w", upload.ID, err)
+	}
+
+	existing, err := s.Derivatives(upload.ID)
+	if err != nil {
+		return nil, err
+	}
+	own := map[string]bool{}
+	for _, d := range existing {
+		own[d.Filename] = true
+	}
+
+	var derivatives []*Derivative
+	for _, size := range s.derivatives {
+		if size.Width <= 0 || size.Width >= upload.Width {
+			continue
+		}
+		d := &Derivative{
+			UploadID: upload.ID,
+			Name:     size.Name,
+			Width:    size.Width,
+			Height:   upload.Height * size.Width / upload.Width,
+		}
+		d.Filename, err = s.derivativeName(fsys, upload.FilesystemName, upload.Filename, size.Width, own)
+		if err != nil {
+			return derivatives, err
+		}
+		d.Size, err = writeDerivative(src, fsys, d.Filename, d.Width, d.Height, s.quality)
+		if err != nil {
+			return derivatives, err
+		}
+
+		q := `INSERT INTO upload_derivative (upload_id, name, filename, width, height, size)
+			VALUES (?, ?, ?, ?, ?, ?)
+			ON CONFLICT (upload_id, name) DO UPDATE SET
+				filename = excluded.filename, width = excluded.width,
+				height = excluded.height, size = excluded.size
+			RETURNING id, created_at`
+		if err := s.db.Get(d, q, d.UploadID, d.Name, d.Filename, d.Width, d.Height, d.Size); err != nil {
+			return derivatives, fmt.Errorf("failed to create derivative record: %w", err)
+		}
+		derivatives = append(derivatives, d)
+	}
+
+	slog.Info("generated derivatives", "upload", upload.Filename, "count", len(derivatives))
+	return derivatives, nil
+}
+
+// Derivatives returns the derivatives of the upload, narrowest first.
+func (s *UploadService) Derivatives(uploadID uint64) ([]*Derivative, error) {
+	var derivatives []*Derivative
+	query := `SELECT * FROM upload_derivative WHERE upload_id = ? ORDER BY width ASC`
+	if err := s.db.Select(&derivatives, query, uploadID); err != nil {
+		return nil, fmt.Errorf("failed to get derivatives for upload ID %d: %w", uploadID, err)
+	}
+	return derivatives, nil
+}
+
+// DeleteDerivativeFiles removes the files of an upload's derivatives from fsys.
+// The records are removed along with the upload's.
+func (s *UploadService) DeleteDerivativeFiles(uploadID uint64, fsys vfs.WritableFS) error {
+	derivatives, err := s.Derivatives(uploadID)
+	if err != nil {
+		return err
+	}
+	for _, d := range derivatives {
+		if err := fsys.Remove(d.Filename); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("failed to delete derivative %s: %w", d.Filename, err)
+		}
+	}
+	return nil
+}
+
+// Srcset returns a srcset attribute value for upload and its derivatives,
+// whose URLs must be set.  The upload itself is the widest candidate.
+func Srcset(upload *Upload, derivatives []*Derivative) string {
+	sorted := make([]*Derivative, len(derivatives))
+	copy(sorted, derivatives)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Width < sorted[j].Width })
+
+	var parts []string
+	for _, d := range sorted {
+		parts = append(parts, fmt.Sprintf("%s %dw", d.URL, d.Width))
+	}
+	if upload.Width > 0 && len(parts) > 0 {
+		parts = append(parts, fmt.Sprintf("%s %dw", upload.URL, upload.Width))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// decodeImage decodes the image name, turning jpegs upright according to
+// their EXIF orientation.
+func decodeImage(fsys fs.FS, name string) (image.Image, error) {
+	data, err := fs.ReadFile(fsys, name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open image: %w", err)
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image: %w", err)
+	}
+	if jpegRegex.MatchString(name) {
+		if info, err := exif.Decode(data); err == nil {
+			img = exif.Orient(img, info.Orientation)
+		}
+	}
+	return img, nil
+}
+
+// writeDerivative scales src to width x height and writes it to name in the
+// format implied by its extension, with quality if it's a jpeg, returning
+// the size of the file.
+func writeDerivative(src image.Image, fsys vfs.WritableFS, name string, width, height, quality int) (int64, error) {
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, src.Bounds(), draw.Over, nil)
+
+	var buf bytes.Buffer
+	var err error
+	if strings.EqualFold(filepath.Ext(name), ".png") {
+		err = png.Encode(&buf, dst)
+	} else {
+		err = jpeg.Encode(&buf, dst, &jpeg.Options{Quality: quality})
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to encode derivative: %w", err)
+	}
+
+	size, err := vfs.WriteFile(fsys, name, &buf)
+	if err != nil {
+		return 0, fmt.Errorf("failed to write derivative: %w", err)
+	}
+	return size, nil
+}
@@ -0,0 +1,171 @@
+package uploads
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"io/fs"
+	"testing"
+
+	"github.com/jmoiron/monet/conf"
+	"github.com/jmoiron/monet/mtr"
+	"github.com/jmoiron/monet/pkg/vfs"
+	"github.com/jmoiron/sqlx"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writePNG(t *testing.T, fsys vfs.WritableFS, name string, width, height int) int64 {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for x := 0; x < width; x++ {
+		img.Set(x, x*height/width, color.RGBA{R: 200, A: 255})
+	}
+	var buf bytes.Buffer
+	require.NoError(t, png.Encode(&buf, img))
+	size, err := vfs.WriteFile(fsys, name, &buf)
+	require.NoError(t, err)
+	return size
+}
+
+func TestDerivatives(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	conn, err := sqlx.Connect("sqlite3", ":memory:")
+	require.NoError(err)
+	require.NoError(NewApp(conn, nil).Migrate())
+
+	fsys := vfs.NewMemFS()
+	registry := vfs.NewRegistry(vfs.NewURLMapper(map[string]string{"uploads": "/i/"}))
+	require.NoError(registry.Add("uploads", fsys))
+	serv := NewUploadService(conn)
+
+	size := writePNG(t, fsys, "photo.png", 1000, 500)
+	upload, err := serv.Create("uploads", "photo.png", size)
+	require.NoError(err)
+
+	derivatives, err := serv.GenerateDerivatives(upload, fsys)
+	require.NoError(err)
+	// the 1600px size is wider than the original, so it's skipped
+	require.Len(derivatives, 2)
+	assert.Equal("thumbnail", derivatives[0].Name)
+	assert.Equal("photo-320w.png", derivatives[0].Filename)
+	assert.Equal(160, derivatives[0].Height)
+	assert.Equal("photo-800w.png", derivatives[1].Filename)
+	for _, d := range derivatives {
+		info, err := fsys.Stat(d.Filename)
+		require.NoError(err)
+		assert.Equal(info.Size(), d.Size)
+		img, err := decodeImage(fsys, d.Filename)
+		require.NoError(err)
+		assert.Equal(d.Width, img.Bounds().Dx())
+	}
+
+	upload, err = serv.GetByID(upload.ID)
+	require.NoError(err)
+	assert.Equal(1000, upload.Width)
+	assert.Equal(500, upload.Height)
+
+	// regenerating replaces the records
+	_, err = serv.GenerateDerivatives(upload, fsys)
+	require.NoError(err)
+	derivatives, err = serv.Derivatives(upload.ID)
+	require.NoError(err)
+	assert.Len(derivatives, 2)
+
+	images := NewImages(serv, registry)
+	srcset := "/i/photo-320w.png 320w, /i/photo-800w.png 800w, /i/photo.png 1000w"
+	tag := string(images.Image("uploads", "photo.png", "a photo"))
+	assert.Contains(tag, `src="/i/photo.png"`)
+	assert.Contains(tag, `alt="a photo"`)
+	assert.Contains(tag, `srcset="`+srcset+`"`)
+	assert.Contains(tag, `sizes="`+conf.Default().Uploads.Sizes+`"`)
+
+	mtr.SetImageHook("uploads", images.MarkdownAttrs)
+	rendered := mtr.RenderMarkdown("![a photo](/i/photo.png) ![elsewhere](https://example.com/photo.png)")
+	assert.Contains(rendered, `srcset="`+srcset+`"`)
+	assert.Contains(rendered, `<img src="https://example.com/photo.png" alt="elsewhere">`)
+
+	// uploads in folders, like those of posts, get a srcset too
+	require.NoError(fsys.MkdirAll("2024/trip", 0755))
+	size = writePNG(t, fsys, "2024/trip/photo.png", 1000, 500)
+	nested, err := serv.Create("uploads", "2024/trip/photo.png", size)
+	require.NoError(err)
+	_, err = serv.GenerateDerivatives(nested, fsys)
+	require.NoError(err)
+	rendered = mtr.RenderMarkdown("![trip](/i/2024/trip/photo.png)")
+	assert.Contains(rendered, `srcset="/i/2024/trip/photo-320w.png 320w, /i/2024/trip/photo-800w.png 800w, /i/2024/trip/photo.png 1000w"`)
+	assert.Nil(images.MarkdownAttrs("/i/2024/../photo.png"))
+
+	// images no wider than the smallest size have no srcset
+	size = writePNG(t, fsys, "icon.png", 64, 64)
+	icon, err := serv.Create("uploads", "icon.png", size)
+	require.NoError(err)
+	derivatives, err = serv.GenerateDerivatives(icon, fsys)
+	require.NoError(err)
+	assert.Empty(derivatives)
+	assert.Equal(`<img src="/i/icon.png" alt="">`, string(images.Image("uploads", "icon.png", "")))
+	assert.Nil(images.MarkdownAttrs("/i/icon.png"))
+
+	// the sizes come from the service's config
+	cfg := conf.UploadsConfig{Derivatives: []conf.ImageSize{{Name: "small", Width: 48}}, Sizes: "48px"}
+	custom := NewUploadService(conn).WithConfig(cfg)
+	derivatives, err = custom.GenerateDerivatives(icon, fsys)
+	require.NoError(err)
+	require.Len(derivatives, 1)
+	assert.Equal("icon-48w.png", derivatives[0].Filename)
+	assert.Contains(string(NewImages(custom, registry).Image("uploads", "icon.png", "")), `sizes="48px"`)
+
+	// other files are left alone
+	notes, err := serv.Create("uploads", "notes.txt", 10)
+	require.NoError(err)
+	derivatives, err = serv.GenerateDerivatives(notes, fsys)
+	require.NoError(err)
+	assert.Empty(derivatives)
+
+	require.NoError(serv.DeleteDerivativeFiles(upload.ID, fsys))
+	require.NoError(serv.Delete(upload.ID))
+	_, err = fsys.Stat("photo-320w.png")
+	assert.ErrorIs(err, fs.ErrNotExist)
+	derivatives, err = serv.Derivatives(upload.ID)
+	require.NoError(err)
+	assert.Empty(derivatives)
+}
+
+func TestDerivativeCollisions(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	conn, err := sqlx.Connect("sqlite3", ":memory:")
+	require.NoError(err)
+	require.NoError(NewApp(conn, nil).Migrate())
+	fsys := vfs.NewMemFS()
+	serv := NewUploadService(conn)
+
+	// an upload, and an untracked file, that have a derivative's name
+	taken, err := serv.Create("uploads", "photo-320w.png", writePNG(t, fsys, "photo-320w.png", 10, 10))
+	require.NoError(err)
+	writePNG(t, fsys, "photo-800w.png", 20, 20)
+
+	upload, err := serv.Create("uploads", "photo.png", writePNG(t, fsys, "photo.png", 1000, 500))
+	require.NoError(err)
+	derivatives, err := serv.GenerateDerivatives(upload, fsys)
+	require.NoError(err)
+	require.Len(derivatives, 2)
+	assert.Equal("photo-320w-1.png", derivatives[0].Filename)
+	assert.Equal("photo-800w-1.png", derivatives[1].Filename)
+	for name, width := range map[string]int{taken.Filename: 10, "photo-800w.png": 20} {
+		img, err := decodeImage(fsys, name)
+		require.NoError(err)
+		assert.Equal(width, img.Bounds().Dx(), name)
+	}
+
+	// regenerating replaces the upload's own derivatives
+	derivatives, err = serv.GenerateDerivatives(upload, fsys)
+	require.NoError(err)
+	assert.Equal("photo-320w-1.png", derivatives[0].Filename)
+	assert.Equal("photo-800w-1.png", derivatives[1].Filename)
+}
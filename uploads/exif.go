@@ -0,0 +1,138 @@
+package uploads
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/monet/pkg/exif"
+)
+
+var jpegRegex = regexp.MustCompile(`(?i)\.jpe?g$`)
+
+// EXIF is the metadata read from an uploaded photo when it was stored.
+type EXIF struct {
+	UploadID     uint64    `db:"upload_id" json:"upload_id"`
+	Camera       string    `db:"camera" json:"camera,omitempty"`
+	Lens         string    `db:"lens" json:"lens,omitempty"`
+	ExposureTime string    `db:"exposure_time" json:"exposure_time,omitempty"`
+	FNumber      float64   `db:"f_number" json:"f_number,omitempty"`
+	ISO          int       `db:"iso" json:"iso,omitempty"`
+	FocalLength  float64   `db:"focal_length" json:"focal_length,omitempty"`
+	TakenAt      time.Time `db:"taken_at" json:"taken_at,omitempty"`
+	Orientation  int       `db:"orientation" json:"orientation"`
+	// HasLocation is set if the photo's location was kept, and
+	// LocationStripped if it was removed before the photo was saved.
+	HasLocation      bool    `db:"has_location" json:"has_location"`
+	Latitude         float64 `db:"latitude" json:"latitude,omitempty"`
+	Longitude        float64 `db:"longitude" json:"longitude,omitempty"`
+	LocationStripped bool    `db:"location_stripped" json:"location_stripped"`
+}
+
+// Exposure returns the exposure settings, eg. "1/125s f/2.8 ISO 100 35mm".
+func (e *EXIF) Exposure() string {
+	var parts []string
+	if e.ExposureTime != "" {
+		parts = append(parts, e.ExposureTime+"s")
+	}
+	if e.FNumber > 0 {
+		parts = append(parts, fmt.Sprintf("f/%g", e.FNumber))
+	}
+	if e.ISO > 0 {
+		parts = append(parts, fmt.Sprintf("ISO %d", e.ISO))
+	}
+	if e.FocalLength > 0 {
+		parts = append(parts, fmt.Sprintf("%gmm", e.FocalLength))
+	}
+	return strings.Join(parts, " ")
+}
+
+// prepareImage reads the EXIF metadata of filename if it's a jpeg, and
+// strips and rotates it as configured.  It returns the reader to save the
+// file from and the EXIF to record for it, which is nil for other files and
+// jpegs without metadata.
+func (s *UploadService) prepareImage(filename string, r io.Reader) (io.Reader, *EXIF, error) {
+	if !jpegRegex.MatchString(filename) {
+		return r, nil, nil
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	info, err := exif.Decode(data)
+	if err != nil {
+		if !errors.Is(err, exif.ErrNoEXIF) {
+			slog.Warn("Failed to read exif", "filename", filename, "error", err)
+		}
+		return bytes.NewReader(data), nil, nil
+	}
+
+	e := &EXIF{
+		Camera:       info.Camera(),
+		Lens:         info.Lens,
+		ExposureTime: info.ExposureTime,
+		FNumber:      info.FNumber,
+		ISO:          info.ISO,
+		FocalLength:  info.FocalLength,
+		TakenAt:      info.Taken,
+		Orientation:  info.Orientation,
+		HasLocation:  info.HasLocation,
+		Latitude:     info.Latitude,
+		Longitude:    info.Longitude,
+	}
+	if s.stripEXIF {
+		stripped, err := exif.Strip(data)
+		if err != nil {
+			// don't save a file that may still have its location
+			return nil, nil, fmt.Errorf("failed to strip exif from %s: %w", filename, err)
+		}
+		data = stripped
+		e.LocationStripped = e.HasLocation
+		e.HasLocation, e.Latitude, e.Longitude = false, 0, 0
+	}
+	if s.autoRotate && e.Orientation > 1 {
+		rotated, err := exif.AutoRotate(data, s.quality)
+		if err != nil {
+			slog.Warn("Failed to rotate image", "filename", filename, "error", err)
+		} else {
+			data = rotated
+			e.Orientation = 1
+		}
+	}
+	return bytes.NewReader(data), e, nil
+}
+
+// EXIF returns the metadata recorded for the upload id, or nil if it has
+// none.
+func (s *UploadService) EXIF(id uint64) (*EXIF, error) {
+	var e EXIF
+	err := s.db.Get(&e, `SELECT upload_id, camera, lens, exposure_time, f_number, iso, focal_length, taken_at,
+		orientation, has_location, latitude, longitude, location_stripped FROM upload_exif WHERE upload_id = ?`, id)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return nil, nil
+	case err != nil:
+		return nil, fmt.Errorf("failed to get exif for upload ID %d: %w", id, err)
+	}
+	return &e, nil
+}
+
+// saveEXIF records e for the upload id.
+func (s *UploadService) saveEXIF(id uint64, e *EXIF) error {
+	e.UploadID = id
+	_, err := s.db.Exec(`INSERT OR REPLACE INTO upload_exif (upload_id, camera, lens, exposure_time, f_number, iso,
+		focal_length, taken_at, orientation, has_location, latitude, longitude, location_stripped)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		e.UploadID, e.Camera, e.Lens, e.ExposureTime, e.FNumber, e.ISO, e.FocalLength, e.TakenAt,
+		e.Orientation, e.HasLocation, e.Latitude, e.Longitude, e.LocationStripped)
+	if err != nil {
+		return fmt.Errorf("failed to save exif for upload ID %d: %w", id, err)
+	}
+	return nil
+}
@@ -0,0 +1,209 @@
+package uploads
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/monet/db"
+	"github.com/jmoiron/monet/pkg/vfs"
+	"github.com/jmoiron/sqlx"
+)
+
+// FolderFor returns the folder that files uploaded to a post with slug,
+// which was created at t, are put in according to template, which is
+// usually the configured PostFolder: eg. "{year}/{slug}" is "2024/my-post".
+// It is "" if template is, for files to be uploaded to the root of the
+// filesystem.
+func FolderFor(template, slug string, t time.Time) string {
+	return strings.NewReplacer(
+		"{year}", t.Format("2006"),
+		"{month}", t.Format("01"),
+		"{slug}", slug,
+	).Replace(template)
+}
+
+// inDir is the condition for an upload to be directly in the folder whose
+// path, with a trailing slash, is the argument passed for it three times.
+// The root's path is "".
+const inDir = `substr(filename, 1, length(?)) = ? AND instr(substr(filename, length(?) + 1), '/') = 0`
+
+// dirPrefix returns the prefix of the names of files in the folder dir.
+func dirPrefix(dir string) string {
+	if dir == "" || dir == "." {
+		return ""
+	}
+	return strings.Trim(dir, "/") + "/"
+}
+
+// ListDir returns the uploads in a filesystem that are directly in the
+// folder dir, or in its root if dir is "", newest first.
+func (s *UploadService) ListDir(filesystemName, dir string, limit, offset int) ([]*Upload, error) {
+	prefix := dirPrefix(dir)
+	var uploads []*Upload
+	query := `SELECT id, filesystem_name, filename, size, created_at, width, height, sha256 FROM upload
+			  WHERE filesystem_name = ? AND ` + inDir + `
+			  ORDER BY created_at DESC LIMIT ? OFFSET ?`
+	err := s.db.Select(&uploads, query, filesystemName, prefix, prefix, prefix, limit, offset)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list uploads in %s/%s: %w", filesystemName, dir, err)
+	}
+	return uploads, nil
+}
+
+// CountDir returns the number of uploads directly in the folder dir of a
+// filesystem.
+func (s *UploadService) CountDir(filesystemName, dir string) (int, error) {
+	prefix := dirPrefix(dir)
+	var count int
+	query := `SELECT COUNT(*) FROM upload WHERE filesystem_name = ? AND ` + inDir
+	if err := s.db.Get(&count, query, filesystemName, prefix, prefix, prefix); err != nil {
+		return 0, fmt.Errorf("failed to count uploads in %s/%s: %w", filesystemName, dir, err)
+	}
+	return count, nil
+}
+
+// Folders returns the names of the folders directly in the folder dir of
+// the filesystem fsys, registered as filesystemName.  These are the folders
+// with uploads in them, as well as any empty ones that fsys has.  Hidden
+// folders are left out.
+func (s *UploadService) Folders(fsys fs.FS, filesystemName, dir string) ([]string, error) {
+	prefix := dirPrefix(dir)
+	var names []string
+	query := `SELECT DISTINCT substr(rest, 1, instr(rest, '/') - 1) FROM (
+				SELECT substr(filename, length(?) + 1) AS rest FROM upload
+				WHERE filesystem_name = ? AND substr(filename, 1, length(?)) = ?
+			  ) WHERE instr(rest, '/') > 0`
+	if err := s.db.Select(&names, query, prefix, filesystemName, prefix, prefix); err != nil {
+		return nil, fmt.Errorf("failed to list folders in %s/%s: %w", filesystemName, dir, err)
+	}
+
+	seen := map[string]bool{}
+	for _, name := range names {
+		seen[name] = true
+	}
+	if fsys != nil {
+		if dir == "" {
+			dir = "."
+		}
+		// object stores only have the folders that have files in them
+		entries, err := fs.ReadDir(fsys, dir)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			slog.Warn("Failed to list folders", "filesystem", filesystemName, "dir", dir, "error", err)
+		}
+		for _, e := range entries {
+			if e.IsDir() && !seen[e.Name()] {
+				seen[e.Name()] = true
+				names = append(names, e.Name())
+			}
+		}
+	}
+
+	var folders []string
+	for _, name := range names {
+		if !strings.HasPrefix(name, ".") {
+			folders = append(folders, name)
+		}
+	}
+	sort.Strings(folders)
+	return folders, nil
+}
+
+// Move moves the upload id and its derivatives into the folder dir of
+// fsys, or its root if dir is "", creating the folder if needed.  A file
+// already in dir with the same name is handled by the filesystem's
+// collision policy.  If rewrite is true, references to the files are
+// rewritten to their new paths.  It returns the moved upload and the number
+// of fields rewritten.
+func (s *UploadService) Move(fsys vfs.WritableFS, id uint64, dir string, rewrite bool) (*Upload, int, error) {
+	upload, err := s.GetByID(id)
+	if err != nil {
+		return nil, 0, err
+	}
+	derivatives, err := s.Derivatives(id)
+	if err != nil {
+		return nil, 0, err
+	}
+	oldName := upload.Filename
+	if path.Join(dir, path.Base(oldName)) == oldName {
+		return upload, 0, nil
+	}
+	idx := &RefIndex{}
+	if rewrite {
+		if idx, err = BuildRefIndex(s.db, s.mapper); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	storeMu.Lock()
+	defer storeMu.Unlock()
+
+	newName, err := s.freeName(fsys, upload.FilesystemName, path.Join(dir, path.Base(oldName)))
+	if err != nil {
+		return nil, 0, err
+	}
+	if dir != "" {
+		if err := fsys.MkdirAll(dir, 0755); err != nil {
+			return nil, 0, fmt.Errorf("failed to create folder %s: %w", dir, err)
+		}
+	}
+
+	// derivatives are named after the upload, so they're renamed with it
+	renames := [][2]string{{oldName, newName}}
+	for _, d := range derivatives {
+		name, err := s.derivativeName(fsys, upload.FilesystemName, newName, d.Width, nil)
+		if err != nil {
+			return nil, 0, err
+		}
+		renames = append(renames, [2]string{d.Filename, name})
+	}
+	var moved [][2]string
+	undo := func() {
+		for _, m := range moved {
+			fsys.Rename(m[1], m[0])
+		}
+	}
+	for i, rn := range renames {
+		err := fsys.Rename(rn[0], rn[1])
+		switch {
+		case err == nil:
+			moved = append(moved, rn)
+		case i > 0 && errors.Is(err, fs.ErrNotExist):
+			slog.Warn("Derivative to move is missing", "filename", rn[0])
+		default:
+			undo()
+			return nil, 0, fmt.Errorf("failed to move %s: %w", rn[0], err)
+		}
+	}
+
+	var count int
+	err = db.With(s.db, func(tx *sqlx.Tx) error {
+		if _, err := tx.Exec(`UPDATE upload SET filename = ? WHERE id = ?`, newName, id); err != nil {
+			return fmt.Errorf("failed to update filename for upload ID %d: %w", id, err)
+		}
+		for i, d := range derivatives {
+			if _, err := tx.Exec(`UPDATE upload_derivative SET filename = ? WHERE id = ?`, renames[i+1][1], d.ID); err != nil {
+				return fmt.Errorf("failed to update derivative %s: %w", d.Filename, err)
+			}
+		}
+		for _, rn := range renames {
+			n, err := idx.RewriteReferences(tx, upload.FilesystemName, rn[0], rn[1])
+			if err != nil {
+				return err
+			}
+			count += n
+		}
+		return nil
+	})
+	if err != nil {
+		undo()
+		return nil, 0, err
+	}
+	upload.Filename = newName
+	return upload, count, nil
+}
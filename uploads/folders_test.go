@@ -0,0 +1,114 @@
+package uploads
+
+import (
+	"io/fs"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/monet/conf"
+	"github.com/jmoiron/monet/pkg/vfs"
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFolders(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	conn, err := sqlx.Connect("sqlite3", ":memory:")
+	require.NoError(err)
+	require.NoError(NewApp(conn, nil).Migrate())
+	_, err = conn.Exec(`CREATE TABLE post (id INTEGER PRIMARY KEY, title TEXT, slug TEXT,
+		content TEXT DEFAULT '', content_rendered TEXT DEFAULT '', og_image TEXT DEFAULT '')`)
+	require.NoError(err)
+
+	fsys := vfs.NewMemFS()
+	serv := NewUploadService(conn)
+
+	// folders are created as files are stored in them
+	for _, name := range []string{"top.txt", "2024/cats/cat.txt", "2024/cats/kitten.txt", "2024/dogs/dog.txt"} {
+		_, _, err := serv.Store(fsys, "uploads", name, strings.NewReader(name))
+		require.NoError(err)
+	}
+	require.NoError(fsys.MkdirAll("2025", 0755))
+	require.NoError(fsys.MkdirAll(".hidden", 0755))
+	data, err := fs.ReadFile(fsys, "2024/cats/cat.txt")
+	require.NoError(err)
+	assert.Equal("2024/cats/cat.txt", string(data))
+
+	folders, err := serv.Folders(fsys, "uploads", "")
+	require.NoError(err)
+	assert.Equal([]string{"2024", "2025"}, folders)
+	folders, err = serv.Folders(fsys, "uploads", "2024")
+	require.NoError(err)
+	assert.Equal([]string{"cats", "dogs"}, folders)
+
+	list, err := serv.ListDir("uploads", "", 10, 0)
+	require.NoError(err)
+	require.Len(list, 1)
+	assert.Equal("top.txt", list[0].Filename)
+	count, err := serv.CountDir("uploads", "2024/cats")
+	require.NoError(err)
+	assert.Equal(2, count)
+	count, err = serv.CountDir("uploads", "2024")
+	require.NoError(err)
+	assert.Equal(0, count)
+
+	// moving a file moves its derivatives and rewrites references to both
+	dog, err := serv.GetByFilename("uploads", "2024/dogs/dog.txt")
+	require.NoError(err)
+	require.NoError(fsys.Rename("2024/dogs/dog.txt", "2024/dogs/dog.jpg"))
+	_, err = conn.Exec(`UPDATE upload SET filename = '2024/dogs/dog.jpg' WHERE id = ?`, dog.ID)
+	require.NoError(err)
+	_, err = vfs.WriteFile(fsys, "2024/dogs/dog-320w.jpg", strings.NewReader("small"))
+	require.NoError(err)
+	_, err = conn.Exec(`INSERT INTO upload_derivative (upload_id, name, filename, width, height, size)
+		VALUES (?, 'thumbnail', '2024/dogs/dog-320w.jpg', 320, 200, 5)`, dog.ID)
+	require.NoError(err)
+	_, err = conn.Exec(`INSERT INTO post (title, slug, content) VALUES (?, ?, ?)`,
+		"Dogs", "dogs", "[![dog](/uploads/2024/dogs/dog-320w.jpg)](/uploads/2024/dogs/dog.jpg)")
+	require.NoError(err)
+
+	moved, n, err := serv.Move(fsys, dog.ID, "pets", true)
+	require.NoError(err)
+	assert.Equal("pets/dog.jpg", moved.Filename)
+	assert.Equal(2, n)
+	_, err = fsys.Stat("pets/dog-320w.jpg")
+	assert.NoError(err)
+	_, err = fsys.Stat("2024/dogs/dog.jpg")
+	assert.ErrorIs(err, fs.ErrNotExist)
+	derivs, err := serv.Derivatives(dog.ID)
+	require.NoError(err)
+	assert.Equal("pets/dog-320w.jpg", derivs[0].Filename)
+	var content string
+	require.NoError(conn.Get(&content, `SELECT content FROM post WHERE slug = 'dogs'`))
+	assert.Equal("[![dog](/uploads/pets/dog-320w.jpg)](/uploads/pets/dog.jpg)", content)
+
+	// names taken in the new folder are handled by the collision policy
+	cat, err := serv.GetByFilename("uploads", "2024/cats/cat.txt")
+	require.NoError(err)
+	_, err = vfs.WriteFile(fsys, "cat.txt", strings.NewReader("another cat"))
+	require.NoError(err)
+	moved, _, err = serv.Move(fsys, cat.ID, "", false)
+	require.NoError(err)
+	assert.Equal("cat-1.txt", moved.Filename)
+
+	// files in folders are reconciled too
+	registry := vfs.NewRegistry(nil)
+	require.NoError(registry.Add("uploads", fsys))
+	rec, err := serv.WithConfig(conf.UploadsConfig{Reconcile: []string{"uploads"}}).Reconcile(registry)
+	require.NoError(err)
+	require.Len(rec.Untracked, 1)
+	assert.Equal("cat.txt", rec.Untracked[0].Filename)
+	assert.Empty(rec.Missing)
+}
+
+func TestFolderFor(t *testing.T) {
+	created := time.Date(2024, 3, 9, 0, 0, 0, 0, time.UTC)
+
+	assert.Equal(t, "2024/my-post", FolderFor("{year}/{slug}", "my-post", created))
+	assert.Equal(t, "posts/2024/03", FolderFor("posts/{year}/{month}", "my-post", created))
+	assert.Equal(t, "", FolderFor("", "my-post", created))
+}
@@ -24,6 +24,59 @@ var uploadMigrations = monarch.Set{
 		}, {
 			Up:   `CREATE INDEX IF NOT EXISTS idx_upload_created_at ON upload(created_at);`,
 			Down: `DROP INDEX idx_upload_created_at;`,
+		}, {
+			Up: `ALTER TABLE upload ADD COLUMN width INTEGER NOT NULL DEFAULT 0;
+				ALTER TABLE upload ADD COLUMN height INTEGER NOT NULL DEFAULT 0;
+				CREATE TABLE IF NOT EXISTS upload_derivative (
+					id INTEGER PRIMARY KEY,
+					upload_id INTEGER NOT NULL REFERENCES upload(id) ON DELETE CASCADE,
+					name TEXT NOT NULL,
+					filename TEXT NOT NULL,
+					width INTEGER NOT NULL DEFAULT 0,
+					height INTEGER NOT NULL DEFAULT 0,
+					size INTEGER DEFAULT 0,
+					created_at datetime DEFAULT (datetime('now')),
+					UNIQUE (upload_id, name)
+				);`,
+			Down: `DROP TABLE upload_derivative;
+				ALTER TABLE upload DROP COLUMN width;
+				ALTER TABLE upload DROP COLUMN height;`,
+		}, {
+			Up: `ALTER TABLE upload ADD COLUMN sha256 TEXT NOT NULL DEFAULT '';
+				CREATE INDEX IF NOT EXISTS idx_upload_sha256 ON upload(filesystem_name, sha256);`,
+			Down: `DROP INDEX idx_upload_sha256;
+				ALTER TABLE upload DROP COLUMN sha256;`,
+		}, {
+			Up: `CREATE TABLE IF NOT EXISTS upload_tus (
+					id TEXT PRIMARY KEY,
+					filesystem_name TEXT NOT NULL,
+					filename TEXT NOT NULL,
+					length INTEGER NOT NULL,
+					received INTEGER NOT NULL DEFAULT 0,
+					metadata TEXT NOT NULL DEFAULT '',
+					upload_id INTEGER NOT NULL DEFAULT 0,
+					created_at datetime DEFAULT (datetime('now')),
+					expires_at datetime NOT NULL
+				);
+				CREATE INDEX IF NOT EXISTS idx_upload_tus_expires_at ON upload_tus(expires_at);`,
+			Down: `DROP TABLE upload_tus;`,
+		}, {
+			Up: `CREATE TABLE IF NOT EXISTS upload_exif (
+					upload_id INTEGER PRIMARY KEY REFERENCES upload(id) ON DELETE CASCADE,
+					camera TEXT NOT NULL DEFAULT '',
+					lens TEXT NOT NULL DEFAULT '',
+					exposure_time TEXT NOT NULL DEFAULT '',
+					f_number REAL NOT NULL DEFAULT 0,
+					iso INTEGER NOT NULL DEFAULT 0,
+					focal_length REAL NOT NULL DEFAULT 0,
+					taken_at datetime,
+					orientation INTEGER NOT NULL DEFAULT 1,
+					has_location INTEGER NOT NULL DEFAULT 0,
+					latitude REAL NOT NULL DEFAULT 0,
+					longitude REAL NOT NULL DEFAULT 0,
+					location_stripped INTEGER NOT NULL DEFAULT 0
+				);`,
+			Down: `DROP TABLE upload_exif;`,
 		},
 	},
 }
@@ -36,4 +89,40 @@ type Upload struct {
 	Size           int64     `db:"size" json:"size"`
 	CreatedAt      time.Time `db:"created_at" json:"created_at"`
 	URL            string    `db:"-" json:"url"` // Not stored in DB, populated when needed
+	// Width and Height are set for images once their derivatives are made
+	Width  int `db:"width" json:"width,omitempty"`
+	Height int `db:"height" json:"height,omitempty"`
+	// SHA256 is the hex digest of the file's content; it's empty for files
+	// uploaded before hashing that haven't been backfilled.
+	SHA256 string `db:"sha256" json:"sha256,omitempty"`
+}
+
+// A TusUpload is a resumable upload in progress.  Its data is kept in the
+// configured TusDir until all Length bytes are received, when it is stored as an
+// Upload in its filesystem.
+type TusUpload struct {
+	ID             string `db:"id"`
+	FilesystemName string `db:"filesystem_name"`
+	Filename       string `db:"filename"`
+	Length         int64  `db:"length"`
+	Received       int64  `db:"received"`
+	// Metadata is the Upload-Metadata header it was created with.
+	Metadata string `db:"metadata"`
+	// UploadID is the upload it was stored as, once complete.
+	UploadID  uint64    `db:"upload_id"`
+	CreatedAt time.Time `db:"created_at"`
+	ExpiresAt time.Time `db:"expires_at"`
+}
+
+// Derivative is a scaled down copy of an uploaded image
+type Derivative struct {
+	ID        uint64    `db:"id" json:"id"`
+	UploadID  uint64    `db:"upload_id" json:"upload_id"`
+	Name      string    `db:"name" json:"name"`
+	Filename  string    `db:"filename" json:"filename"`
+	Width     int       `db:"width" json:"width"`
+	Height    int       `db:"height" json:"height"`
+	Size      int64     `db:"size" json:"size"`
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+	URL       string    `db:"-" json:"url"`
 }
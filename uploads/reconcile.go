@@ -0,0 +1,244 @@
+package uploads
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/monet/pkg/vfs"
+)
+
+// An UntrackedFile is a file in a filesystem without an upload record.
+type UntrackedFile struct {
+	FilesystemName string
+	Filename       string
+	Size           int64
+	ModTime        time.Time
+}
+
+// A MissingUpload is an upload record whose file is gone.  Candidates are
+// untracked files it could be re-linked to, best first.
+type MissingUpload struct {
+	*Upload
+	Candidates []UntrackedFile
+}
+
+// A Reconciliation is the drift between the filesystems and the upload
+// table found by Reconcile.
+type Reconciliation struct {
+	Filesystems []string
+	// Untracked files have no upload record.
+	Untracked []UntrackedFile
+	// Missing uploads have a record but no file.
+	Missing []MissingUpload
+	// Unreferenced uploads aren't attached to or mentioned by any post, page
+	// or bookmark.
+	Unreferenced []*Upload
+}
+
+// Empty returns true if nothing has drifted.
+func (r *Reconciliation) Empty() bool {
+	return len(r.Untracked) == 0 && len(r.Missing) == 0 && len(r.Unreferenced) == 0
+}
+
+// Reconcile compares each reconciled filesystem in registry, including its
+// folders, with the upload table.  The service's configured filesystems are
+// always reconciled, along with any that have uploads recorded in them.  Filesystems that share a directory are
+// treated as one, so that uploads in one don't appear untracked in another.
+func (s *UploadService) Reconcile(registry vfs.Registry) (*Reconciliation, error) {
+	var uploads []*Upload
+	err := s.db.Select(&uploads, `SELECT id, filesystem_name, filename, size, created_at, width, height, sha256
+		FROM upload ORDER BY filesystem_name, filename`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list uploads: %w", err)
+	}
+	var derivatives []*Derivative
+	err = s.db.Select(&derivatives, `SELECT id, upload_id, name, filename, width, height, size, created_at FROM upload_derivative`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list derivatives: %w", err)
+	}
+
+	names := map[string]bool{}
+	for _, name := range s.reconcile {
+		names[name] = true
+	}
+	for _, u := range uploads {
+		names[u.FilesystemName] = true
+	}
+
+	// group filesystems by where they are stored
+	group := func(name string) string {
+		if path, err := registry.GetPath(name); err == nil {
+			return filepath.Clean(path)
+		}
+		return name
+	}
+	tracked := map[string]map[string]bool{}
+	track := func(fsName, filename string) {
+		g := group(fsName)
+		if tracked[g] == nil {
+			tracked[g] = map[string]bool{}
+		}
+		tracked[g][filename] = true
+	}
+	byID := map[uint64]*Upload{}
+	for _, u := range uploads {
+		byID[u.ID] = u
+		track(u.FilesystemName, u.Filename)
+	}
+	derivs := map[uint64][]string{}
+	for _, d := range derivatives {
+		if u, ok := byID[d.UploadID]; ok {
+			track(u.FilesystemName, d.Filename)
+			derivs[u.ID] = append(derivs[u.ID], d.Filename)
+		}
+	}
+
+	rec := &Reconciliation{}
+	present := map[string]map[string]bool{}
+	for name := range names {
+		rec.Filesystems = append(rec.Filesystems, name)
+	}
+	sort.Strings(rec.Filesystems)
+
+	listed := map[string]bool{}
+	roots := map[string]bool{}
+	for _, name := range rec.Filesystems {
+		roots[group(name)] = true
+	}
+	for _, name := range rec.Filesystems {
+		fsys, err := registry.Get(name)
+		if err != nil {
+			slog.Warn("Skipping unknown filesystem", "filesystem", name)
+			continue
+		}
+		g := group(name)
+		if present[g] == nil {
+			present[g] = map[string]bool{}
+		}
+		err = fs.WalkDir(fsys, ".", func(p string, e fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if e.IsDir() {
+				// hidden folders aren't uploads, and filesystems inside this
+				// one are reconciled on their own
+				if p != "." && (strings.HasPrefix(e.Name(), ".") || roots[filepath.Join(g, p)]) {
+					return fs.SkipDir
+				}
+				return nil
+			}
+			present[g][p] = true
+			// files in a shared directory are reported once
+			if tracked[g][p] || listed[g+"/"+p] {
+				return nil
+			}
+			listed[g+"/"+p] = true
+			f := UntrackedFile{FilesystemName: name, Filename: p}
+			if info, err := e.Info(); err == nil {
+				f.Size, f.ModTime = info.Size(), info.ModTime()
+			}
+			rec.Untracked = append(rec.Untracked, f)
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to list %s: %w", name, err)
+		}
+	}
+
+	refs, err := BuildRefIndex(s.db, registry.Mapper())
+	if err != nil {
+		return nil, err
+	}
+	for _, u := range uploads {
+		g := group(u.FilesystemName)
+		if present[g] == nil {
+			continue // not listed
+		}
+		if !present[g][u.Filename] {
+			m := MissingUpload{Upload: u}
+			for _, f := range rec.Untracked {
+				if group(f.FilesystemName) == g && (f.Size == u.Size || f.Filename == u.Filename) {
+					m.Candidates = append(m.Candidates, f)
+				}
+			}
+			rec.Missing = append(rec.Missing, m)
+			continue
+		}
+		if !refs.Used(u, derivs[u.ID]...) {
+			rec.Unreferenced = append(rec.Unreferenced, u)
+		}
+	}
+	return rec, nil
+}
+
+// Adopt records the untracked file filename in fsys as an upload.
+func (s *UploadService) Adopt(fsys vfs.WritableFS, filesystemName, filename string) (*Upload, error) {
+	if _, err := s.GetByFilename(filesystemName, filename); err == nil {
+		return nil, fmt.Errorf("%s/%s is already tracked", filesystemName, filename)
+	}
+	info, err := fsys.Stat(filename)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return nil, fmt.Errorf("%s/%s is a directory", filesystemName, filename)
+	}
+	sum, err := hashFile(fsys, filename)
+	if err != nil {
+		return nil, err
+	}
+	return s.insert(&Upload{
+		FilesystemName: filesystemName,
+		Filename:       filename,
+		Size:           info.Size(),
+		SHA256:         sum,
+	})
+}
+
+// Relink points the upload id, whose file is missing, at filename, which
+// must exist in fsys and not belong to another upload.
+func (s *UploadService) Relink(fsys vfs.WritableFS, id uint64, filename string) error {
+	upload, err := s.GetByID(id)
+	if err != nil {
+		return err
+	}
+	if other, err := s.GetByFilename(upload.FilesystemName, filename); err == nil && other.ID != id {
+		return fmt.Errorf("%s/%s belongs to upload %d", upload.FilesystemName, filename, other.ID)
+	}
+	info, err := fsys.Stat(filename)
+	if err != nil {
+		return err
+	}
+	sum, err := hashFile(fsys, filename)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`UPDATE upload SET filename = ?, size = ?, sha256 = ? WHERE id = ?`, filename, info.Size(), sum, id)
+	if err != nil {
+		return fmt.Errorf("failed to relink upload ID %d: %w", id, err)
+	}
+	return nil
+}
+
+// Purge removes the upload id, its derivatives and their files from fsys.
+// Files that are already gone are ignored, so it can also clean up uploads
+// whose files are missing.
+func (s *UploadService) Purge(fsys vfs.WritableFS, id uint64) error {
+	upload, err := s.GetByID(id)
+	if err != nil {
+		return err
+	}
+	if err := s.DeleteDerivativeFiles(id, fsys); err != nil {
+		return err
+	}
+	if err := fsys.Remove(upload.Filename); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to delete %s: %w", upload.Filename, err)
+	}
+	return s.Delete(id)
+}
@@ -0,0 +1,70 @@
+package uploads
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/jmoiron/monet/pkg/vfs"
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReconcile(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	conn, err := sqlx.Connect("sqlite3", ":memory:")
+	require.NoError(err)
+	require.NoError(NewApp(conn, nil).Migrate())
+	_, err = conn.Exec(`CREATE TABLE post (id INTEGER PRIMARY KEY, content TEXT DEFAULT '')`)
+	require.NoError(err)
+
+	fsys := vfs.NewMemFS()
+	registry := vfs.NewRegistry(vfs.NewURLMapper(map[string]string{"uploads": "/i/"}))
+	require.NoError(registry.Add("uploads", fsys))
+	serv := NewUploadService(conn)
+
+	used, _, err := serv.Store(fsys, "uploads", "used.txt", strings.NewReader("used"))
+	require.NoError(err)
+	unused, _, err := serv.Store(fsys, "uploads", "unused.txt", strings.NewReader("unused"))
+	require.NoError(err)
+	gone, _, err := serv.Store(fsys, "uploads", "gone.txt", strings.NewReader("gone"))
+	require.NoError(err)
+	require.NoError(fsys.Remove("gone.txt"))
+	_, err = vfs.WriteFile(fsys, "stray.txt", strings.NewReader("gone"))
+	require.NoError(err)
+
+	// a longer name containing unused.txt doesn't count as using it
+	_, err = conn.Exec(`INSERT INTO post (content) VALUES (?)`, "see [this](/i/used.txt) and /i/not-unused.txt")
+	require.NoError(err)
+
+	rec, err := serv.Reconcile(registry)
+	require.NoError(err)
+	require.Len(rec.Untracked, 1)
+	assert.Equal("stray.txt", rec.Untracked[0].Filename)
+	require.Len(rec.Missing, 1)
+	assert.Equal(gone.ID, rec.Missing[0].ID)
+	// the stray file is the same size, so it could be the missing one
+	require.Len(rec.Missing[0].Candidates, 1)
+	require.Len(rec.Unreferenced, 1)
+	assert.Equal(unused.ID, rec.Unreferenced[0].ID)
+
+	require.NoError(serv.Relink(fsys, gone.ID, "stray.txt"))
+	require.NoError(serv.Purge(fsys, unused.ID))
+	_, err = vfs.WriteFile(fsys, "new.txt", strings.NewReader("new"))
+	require.NoError(err)
+	adopted, err := serv.Adopt(fsys, "uploads", "new.txt")
+	require.NoError(err)
+	assert.NotEmpty(adopted.SHA256)
+
+	rec, err = serv.Reconcile(registry)
+	require.NoError(err)
+	assert.Empty(rec.Untracked)
+	assert.Empty(rec.Missing)
+	// neither the relinked nor the adopted upload is used by the post
+	assert.Len(rec.Unreferenced, 2)
+	for _, u := range rec.Unreferenced {
+		assert.NotEqual(used.ID, u.ID)
+	}
+}
@@ -0,0 +1,405 @@
+package uploads
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/jmoiron/monet/db"
+	"github.com/jmoiron/monet/mtr"
+	"github.com/jmoiron/monet/pkg/vfs"
+	"github.com/jmoiron/sqlx"
+)
+
+// A refSource is a table of another app whose fields can embed uploads.
+// The tables belong to apps that may not be installed, so sources and
+// fields that don't exist are skipped.
+type refSource struct {
+	Type  string
+	Table string
+	// Titles are the columns shown for an item, first non-empty wins, and
+	// EditKey is the column used in its admin EditURL.
+	Titles  []string
+	EditKey string
+	EditURL string
+	// Fields are the columns that can mention an upload, and Rendered maps
+	// markdown fields to the column they are rendered to.
+	Fields   []string
+	Rendered map[string]string
+	// Paths are fields holding a path to a file in the filesystem PathFS,
+	// rather than text.
+	Paths  []string
+	PathFS string
+}
+
+var refSources = []refSource{
+	{
+		Type: "post", Table: "post", Titles: []string{"title"}, EditKey: "slug", EditURL: "/admin/posts/edit/%s",
+		Fields:   []string{"content", "og_image"},
+		Rendered: map[string]string{"content": "content_rendered"},
+	}, {
+		Type: "page", Table: "page", Titles: []string{"title", "url"}, EditKey: "id", EditURL: "/admin/pages/edit/%s",
+		Fields:   []string{"content", "og_image"},
+		Rendered: map[string]string{"content": "content_rendered"},
+	}, {
+		Type: "bookmark", Table: "bookmark", Titles: []string{"title"}, EditKey: "id", EditURL: "/admin/bookmarks/edit/%s",
+		Fields:   []string{"description", "notes", "image_url"},
+		Rendered: map[string]string{"description": "description_rendered"},
+		Paths:    []string{"screenshot_path", "icon_path"}, PathFS: "screenshots",
+	},
+}
+
+// A Reference is a place where an upload is used.
+type Reference struct {
+	ItemType string
+	ItemID   string
+	Title    string
+	EditURL  string
+	// Field is the column that mentions the upload, or "attachment" for
+	// files attached to posts.
+	Field string
+}
+
+// refItem is the text of one field of an item that can mention uploads.
+type refItem struct {
+	source *refSource
+	id     string
+	title  string
+	edit   string
+	field  string
+	text   string
+	path   bool
+	// rendered is the column field is rendered to, if any.
+	rendered string
+}
+
+// A RefIndex finds where uploads are used by posts, pages and bookmarks.
+// It is a snapshot of their content when it was built.  Text refers to an
+// upload by its URL, so that files with the same name in other folders or
+// filesystems aren't mistaken for it.
+type RefIndex struct {
+	items    []refItem
+	attached map[uint64][]Reference
+	mapper   vfs.URLMapper
+}
+
+// BuildRefIndex loads everything that can refer to an upload.  The URLs of
+// uploads are found with mapper, which can be nil.
+func BuildRefIndex(conn db.DB, mapper vfs.URLMapper) (*RefIndex, error) {
+	idx := &RefIndex{attached: map[uint64][]Reference{}, mapper: mapper}
+
+	if len(columns(conn, "post_file")) > 0 {
+		var rows []struct {
+			UploadID uint64 `db:"upload_id"`
+			ID       string `db:"id"`
+			Title    string `db:"title"`
+			Slug     string `db:"slug"`
+		}
+		err := conn.Select(&rows, `SELECT pf.upload_id, p.id, COALESCE(p.title, '') AS title, COALESCE(p.slug, '') AS slug
+			FROM post_file pf JOIN post p ON p.id = pf.post_id`)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load attachments: %w", err)
+		}
+		for _, r := range rows {
+			idx.attached[r.UploadID] = append(idx.attached[r.UploadID], Reference{
+				ItemType: "post", ItemID: r.ID, Title: r.Title,
+				EditURL: fmt.Sprintf("/admin/posts/edit/%s", r.Slug), Field: "attachment",
+			})
+		}
+	}
+
+	for i := range refSources {
+		src := &refSources[i]
+		cols := columns(conn, src.Table)
+		if !cols["id"] {
+			continue
+		}
+		title := "''"
+		for i := len(src.Titles) - 1; i >= 0; i-- {
+			if cols[src.Titles[i]] {
+				title = fmt.Sprintf("COALESCE(NULLIF(%s, ''), %s)", src.Titles[i], title)
+			}
+		}
+		key := src.EditKey
+		if !cols[key] {
+			key = "id"
+		}
+		var fields []string
+		for _, f := range append(append([]string{}, src.Fields...), src.Paths...) {
+			if cols[f] {
+				fields = append(fields, f)
+			}
+		}
+		for _, f := range fields {
+			rendered := src.Rendered[f]
+			if !cols[rendered] {
+				rendered = ""
+			}
+			var rows []struct {
+				ID      string `db:"id"`
+				Title   string `db:"title"`
+				EditKey string `db:"edit_key"`
+				Text    string `db:"text"`
+			}
+			q := fmt.Sprintf(`SELECT CAST(id AS TEXT) AS id, %s AS title,
+				COALESCE(CAST(%s AS TEXT), '') AS edit_key, %s AS text
+				FROM %s WHERE COALESCE(%s, '') != ''`, title, key, f, src.Table, f)
+			if err := conn.Select(&rows, q); err != nil {
+				return nil, fmt.Errorf("failed to load %s content: %w", src.Type, err)
+			}
+			for _, r := range rows {
+				idx.items = append(idx.items, refItem{
+					source: src, id: r.ID, title: r.Title, edit: fmt.Sprintf(src.EditURL, r.EditKey),
+					field: f, text: r.Text, path: !contains(src.Fields, f),
+					rendered: rendered,
+				})
+			}
+		}
+	}
+	return idx, nil
+}
+
+// columns returns the set of columns in table, which is empty if the
+// table doesn't exist.
+func columns(conn db.DB, table string) map[string]bool {
+	var names []string
+	conn.Select(&names, `SELECT name FROM pragma_table_info(?)`, table)
+	cols := make(map[string]bool, len(names))
+	for _, n := range names {
+		cols[n] = true
+	}
+	return cols
+}
+
+func contains(list []string, s string) bool {
+	for _, x := range list {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+// url returns the URL that text refers to filename in filesystemName by.
+// It's the URL the mapper gives, but never signed, as signatures aren't
+// stable enough to be found in text.  Filesystems without a URL are taken
+// to be served at "/{filesystemName}/".
+func (idx *RefIndex) url(filesystemName, filename string) string {
+	prefix := "/" + filesystemName + "/"
+	if idx.mapper != nil {
+		if p, err := idx.mapper.GetPrefix(filesystemName); err == nil {
+			prefix = p
+		}
+	}
+	return strings.TrimSuffix(prefix, "/") + "/" + filename
+}
+
+// References returns where the upload, or any of its derivatives' files,
+// are used.
+func (idx *RefIndex) References(upload *Upload, derivatives ...string) []Reference {
+	refs := append([]Reference{}, idx.attached[upload.ID]...)
+	names := append([]string{upload.Filename}, derivatives...)
+	for _, item := range idx.items {
+		if idx.mentions(&item, upload.FilesystemName, names) {
+			refs = append(refs, Reference{
+				ItemType: item.source.Type, ItemID: item.id, Title: item.title,
+				EditURL: item.edit, Field: item.field,
+			})
+		}
+	}
+	sort.SliceStable(refs, func(i, j int) bool { return refs[i].ItemType < refs[j].ItemType })
+	return refs
+}
+
+// Used returns true if the upload or one of its derivatives is used.
+func (idx *RefIndex) Used(upload *Upload, derivatives ...string) bool {
+	if len(idx.attached[upload.ID]) > 0 {
+		return true
+	}
+	names := append([]string{upload.Filename}, derivatives...)
+	for _, item := range idx.items {
+		if idx.mentions(&item, upload.FilesystemName, names) {
+			return true
+		}
+	}
+	return false
+}
+
+// mentions returns true if item refers to any of the files names in the
+// filesystem filesystemName.
+func (idx *RefIndex) mentions(item *refItem, filesystemName string, names []string) bool {
+	for _, name := range names {
+		if item.path && item.source.PathFS == filesystemName && isPathTo(item.text, name) {
+			return true
+		}
+		if !item.path && mentions(item.text, idx.url(filesystemName, name)) {
+			return true
+		}
+	}
+	return false
+}
+
+// isPathTo returns true if the path p is the file name, which can be in a
+// folder, eg. "/data/screenshots/2024/shot.jpg" is a path to "2024/shot.jpg".
+func isPathTo(p, name string) bool {
+	return p == name || strings.HasSuffix(p, "/"+name)
+}
+
+// isNameChar returns true for characters that can be part of a URL path,
+// so that a URL isn't found inside a longer one.
+func isNameChar(b byte) bool {
+	r := rune(b)
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '-' || r == '_' || r == '.' || r == '/'
+}
+
+// hostBefore returns true if text has a scheme and host, eg.
+// "https://example.com", right before offset i.
+func hostBefore(text string, i int) bool {
+	j := i
+	for j > 0 && !strings.ContainsRune("/ \t\n\"'()<>[]", rune(text[j-1])) {
+		j--
+	}
+	return j < i && strings.HasSuffix(text[:j], "//")
+}
+
+// mentionAt returns the offsets in text where the URL name appears on its
+// own.  A URL starting with "/" is also found after a host, so that
+// absolute links to the site count too.
+func mentionAt(text, name string) []int {
+	var at []int
+	for i := 0; i <= len(text)-len(name); {
+		j := strings.Index(text[i:], name)
+		if j < 0 {
+			break
+		}
+		start, end := i+j, i+j+len(name)
+		left := start == 0 || !isNameChar(text[start-1]) || (name[0] == '/' && hostBefore(text, start))
+		if left && (end == len(text) || !isNameChar(text[end])) {
+			at = append(at, start)
+		}
+		i = start + 1
+	}
+	return at
+}
+
+// mentions returns true if the URL name appears in text on its own, and not
+// as a part of a longer URL.
+func mentions(text, name string) bool {
+	return len(mentionAt(text, name)) > 0
+}
+
+// replaceMentions replaces each mention of old in text with new.
+func replaceMentions(text, old, new string) (string, int) {
+	at := mentionAt(text, old)
+	if len(at) == 0 {
+		return text, 0
+	}
+	var b strings.Builder
+	last := 0
+	for _, i := range at {
+		b.WriteString(text[last:i])
+		b.WriteString(new)
+		last = i + len(old)
+	}
+	b.WriteString(text[last:])
+	return b.String(), len(at)
+}
+
+// RewriteReferences replaces references to the file oldName in the
+// filesystem filesystemName with newName in every field the index found them
+// in, re-rendering markdown fields, in tx.  It returns the number of fields
+// changed.  Attachments refer to the upload by ID and don't need rewriting.
+func (idx *RefIndex) RewriteReferences(tx sqlx.Execer, filesystemName, oldName, newName string) (int, error) {
+	oldURL, newURL := idx.url(filesystemName, oldName), idx.url(filesystemName, newName)
+	var count int
+	for i := range idx.items {
+		item := &idx.items[i]
+		var text string
+		var n int
+		if item.path {
+			if item.source.PathFS != filesystemName || !isPathTo(item.text, oldName) {
+				continue
+			}
+			text, n = strings.TrimSuffix(item.text, oldName)+newName, 1
+		} else {
+			text, n = replaceMentions(item.text, oldURL, newURL)
+		}
+		if n == 0 {
+			continue
+		}
+
+		set := []string{item.field + " = ?"}
+		args := []any{text}
+		if item.rendered != "" {
+			set = append(set, item.rendered+" = ?")
+			args = append(args, mtr.RenderMarkdown(text))
+		}
+		args = append(args, item.id)
+		q := fmt.Sprintf("UPDATE %s SET %s WHERE id = ?", item.source.Table, strings.Join(set, ", "))
+		if _, err := tx.Exec(q, args...); err != nil {
+			return count, fmt.Errorf("failed to rewrite %s %s: %w", item.source.Type, item.id, err)
+		}
+		// later rewrites in the same transaction see this one
+		item.text = text
+		count++
+	}
+	return count, nil
+}
+
+// References returns where the upload id is used.
+func (s *UploadService) References(id uint64) (*Upload, []Reference, error) {
+	upload, err := s.GetByID(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	idx, err := BuildRefIndex(s.db, s.mapper)
+	if err != nil {
+		return nil, nil, err
+	}
+	refs, err := s.ReferencesIn(idx, upload)
+	return upload, refs, err
+}
+
+// ReferencesIn returns where the upload or its derivatives are used
+// according to idx.
+func (s *UploadService) ReferencesIn(idx *RefIndex, upload *Upload) ([]Reference, error) {
+	derivatives, err := s.Derivatives(upload.ID)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, d := range derivatives {
+		names = append(names, d.Filename)
+	}
+	return idx.References(upload, names...), nil
+}
+
+// RenameFilename updates the filename of the upload id.  If rewrite is
+// true, references to the old filename are rewritten to the new one in the
+// same transaction.  It returns the number of fields rewritten.
+func (s *UploadService) RenameFilename(id uint64, newFilename string, rewrite bool) (int, error) {
+	upload, err := s.GetByID(id)
+	if err != nil {
+		return 0, err
+	}
+	idx := &RefIndex{}
+	if rewrite {
+		if idx, err = BuildRefIndex(s.db, s.mapper); err != nil {
+			return 0, err
+		}
+	}
+
+	var count int
+	err = db.With(s.db, func(tx *sqlx.Tx) error {
+		if _, err := tx.Exec(`UPDATE upload SET filename = ? WHERE id = ?`, newFilename, id); err != nil {
+			return fmt.Errorf("failed to update filename for upload ID %d: %w", id, err)
+		}
+		count, err = idx.RewriteReferences(tx, upload.FilesystemName, upload.Filename, newFilename)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
@@ -0,0 +1,104 @@
+package uploads
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/jmoiron/monet/pkg/vfs"
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReplaceMentions(t *testing.T) {
+	assert := assert.New(t)
+
+	text, n := replaceMentions("![a](/i/cat.jpg) /i/cat.jpg.bak /i/big-cat.jpg [b](/i/cat.jpg)", "/i/cat.jpg", "/i/dog.jpg")
+	assert.Equal(2, n)
+	assert.Equal("![a](/i/dog.jpg) /i/cat.jpg.bak /i/big-cat.jpg [b](/i/dog.jpg)", text)
+
+	// files with the same name in folders aren't mentions, but absolute
+	// links are
+	text, n = replaceMentions("/i/2024/cat.jpg /x/i/cat.jpg <https://example.com/i/cat.jpg>", "/i/cat.jpg", "/i/dog.jpg")
+	assert.Equal(1, n)
+	assert.Equal("/i/2024/cat.jpg /x/i/cat.jpg <https://example.com/i/dog.jpg>", text)
+
+	text, n = replaceMentions("no mentions", "/i/cat.jpg", "/i/dog.jpg")
+	assert.Equal(0, n)
+	assert.Equal("no mentions", text)
+}
+
+func TestRenameReferences(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	conn, err := sqlx.Connect("sqlite3", ":memory:")
+	require.NoError(err)
+	require.NoError(NewApp(conn, nil).Migrate())
+	_, err = conn.Exec(`CREATE TABLE post (id INTEGER PRIMARY KEY, title TEXT, slug TEXT,
+		content TEXT DEFAULT '', content_rendered TEXT DEFAULT '', og_image TEXT DEFAULT '')`)
+	require.NoError(err)
+	_, err = conn.Exec(`CREATE TABLE page (id INTEGER PRIMARY KEY, url TEXT, content TEXT, content_rendered TEXT)`)
+	require.NoError(err)
+
+	fsys := vfs.NewMemFS()
+	serv := NewUploadService(conn)
+	cat, _, err := serv.Store(fsys, "uploads", "cat.jpg", strings.NewReader("meow"))
+	require.NoError(err)
+
+	_, err = conn.Exec(`INSERT INTO post (title, slug, content, og_image) VALUES (?, ?, ?, ?)`,
+		"Cats", "cats", "![cat](/uploads/cat.jpg)", "/uploads/cat.jpg")
+	require.NoError(err)
+	_, err = conn.Exec(`INSERT INTO post (title, slug, content) VALUES (?, ?, ?)`,
+		"Other", "other", "/uploads/cat.jpg.bak")
+	require.NoError(err)
+	_, err = conn.Exec(`INSERT INTO page (url, content) VALUES (?, ?)`, "/about", "[cat](/uploads/cat.jpg)")
+	require.NoError(err)
+	// files with the same name in a folder or another filesystem are different
+	// uploads
+	_, err = conn.Exec(`INSERT INTO post (title, slug, content) VALUES (?, ?, ?)`,
+		"Trip", "trip", "![cat](/blog-files/2024/trip/cat.jpg) ![cat](/uploads/2024/trip/cat.jpg) ![cat](/blog-files/cat.jpg)")
+	require.NoError(err)
+
+	_, refs, err := serv.References(cat.ID)
+	require.NoError(err)
+	require.Len(refs, 3)
+	assert.Equal("page", refs[0].ItemType)
+	assert.Equal("/about", refs[0].Title)
+	assert.Equal("/admin/pages/edit/1", refs[0].EditURL)
+	assert.Equal("post", refs[1].ItemType)
+	assert.Equal("/admin/posts/edit/cats", refs[1].EditURL)
+
+	n, err := serv.RenameFilename(cat.ID, "kitten.jpg", true)
+	require.NoError(err)
+	assert.Equal(3, n)
+
+	var post struct {
+		Content         string `db:"content"`
+		ContentRendered string `db:"content_rendered"`
+		OgImage         string `db:"og_image"`
+	}
+	require.NoError(conn.Get(&post, `SELECT content, content_rendered, og_image FROM post WHERE slug='cats'`))
+	assert.Equal("![cat](/uploads/kitten.jpg)", post.Content)
+	assert.Contains(post.ContentRendered, `src="/uploads/kitten.jpg"`)
+	assert.Equal("/uploads/kitten.jpg", post.OgImage)
+
+	var other string
+	require.NoError(conn.Get(&other, `SELECT content FROM post WHERE slug='other'`))
+	assert.Equal("/uploads/cat.jpg.bak", other)
+	require.NoError(conn.Get(&other, `SELECT content FROM post WHERE slug='trip'`))
+	assert.Equal("![cat](/blog-files/2024/trip/cat.jpg) ![cat](/uploads/2024/trip/cat.jpg) ![cat](/blog-files/cat.jpg)", other)
+
+	upload, refs, err := serv.References(cat.ID)
+	require.NoError(err)
+	assert.Equal("kitten.jpg", upload.Filename)
+	assert.Len(refs, 3)
+
+	// without rewriting, only the upload is renamed
+	n, err = serv.RenameFilename(cat.ID, "cat.jpg", false)
+	require.NoError(err)
+	assert.Equal(0, n)
+	_, refs, err = serv.References(cat.ID)
+	require.NoError(err)
+	assert.Empty(refs)
+}
@@ -0,0 +1,115 @@
+package uploads
+
+import (
+	"fmt"
+	"html/template"
+	"log/slog"
+	"strings"
+
+	"github.com/jmoiron/monet/pkg/vfs"
+)
+
+// Images renders tracked image uploads as responsive <img> tags whose
+// srcset lists the upload's derivatives.
+type Images struct {
+	service  *UploadService
+	registry vfs.Registry
+}
+
+// NewImages returns an Images for the uploads tracked by service.
+func NewImages(service *UploadService, registry vfs.Registry) *Images {
+	return &Images{service: service, registry: registry}
+}
+
+// Image returns an <img> tag for filename in the named filesystem.  If the
+// upload has derivatives, the tag has srcset and sizes attributes.
+func (i *Images) Image(filesystemName, filename, alt string) template.HTML {
+	src, err := i.url(filesystemName, filename)
+	if err != nil {
+		slog.Warn("no url for image", "filesystem", filesystemName, "filename", filename, "err", err)
+		return ""
+	}
+
+	attrs := ""
+	if upload, err := i.service.GetByFilename(filesystemName, filename); err == nil {
+		if srcset := i.srcset(upload); srcset != "" {
+			attrs = fmt.Sprintf(` srcset="%s" sizes="%s"`, template.HTMLEscapeString(srcset), template.HTMLEscapeString(i.service.sizes))
+		}
+	}
+	return template.HTML(fmt.Sprintf(`<img src="%s" alt="%s"%s>`,
+		template.HTMLEscapeString(src), template.HTMLEscapeString(alt), attrs))
+}
+
+// MarkdownAttrs is an mtr.ImageHook that adds srcset and sizes attributes to
+// images in markdown whose src is the URL of a tracked upload.
+func (i *Images) MarkdownAttrs(src string) map[string]string {
+	upload, ok := i.lookupURL(src)
+	if !ok {
+		return nil
+	}
+	srcset := i.srcset(upload)
+	if srcset == "" {
+		return nil
+	}
+	return map[string]string{"srcset": srcset, "sizes": i.service.sizes}
+}
+
+// srcset returns the srcset for upload, or "" if it has no derivatives.
+func (i *Images) srcset(upload *Upload) string {
+	derivatives, err := i.service.Derivatives(upload.ID)
+	if err != nil || len(derivatives) == 0 {
+		return ""
+	}
+	if upload.URL, err = i.url(upload.FilesystemName, upload.Filename); err != nil {
+		return ""
+	}
+	for _, d := range derivatives {
+		if d.URL, err = i.url(upload.FilesystemName, d.Filename); err != nil {
+			return ""
+		}
+	}
+	return Srcset(upload, derivatives)
+}
+
+func (i *Images) url(filesystemName, filename string) (string, error) {
+	if i.registry == nil || i.registry.Mapper() == nil {
+		return "", fmt.Errorf("no URL mapper available")
+	}
+	return i.registry.Mapper().GetURL(filesystemName, filename)
+}
+
+// lookupURL finds the upload served at the local URL src, which can be in
+// a folder.  Several filesystems may share a URL prefix, or have prefixes
+// inside each other's, so all of them are checked.
+func (i *Images) lookupURL(src string) (*Upload, bool) {
+	if i.registry == nil || i.registry.Mapper() == nil || !strings.HasPrefix(src, "/") {
+		return nil, false
+	}
+
+	var where []string
+	var args []any
+	for name, prefix := range i.registry.Mapper().GetMap() {
+		prefix = strings.TrimSuffix(prefix, "/") + "/"
+		rest, ok := strings.CutPrefix(src, prefix)
+		if !ok {
+			continue
+		}
+		filename, err := vfs.CleanPath(rest)
+		if err != nil || filename == "." || filename != rest {
+			continue
+		}
+		where = append(where, "(filesystem_name = ? AND filename = ?)")
+		args = append(args, name, filename)
+	}
+	if len(where) == 0 {
+		return nil, false
+	}
+
+	var upload Upload
+	q := `SELECT id, filesystem_name, filename, size, created_at, width, height, sha256 FROM upload
+		WHERE ` + strings.Join(where, " OR ") + ` ORDER BY id LIMIT 1`
+	if err := i.service.db.Get(&upload, q, args...); err != nil {
+		return nil, false
+	}
+	return &upload, true
+}
@@ -2,30 +2,110 @@ package uploads
 
 import (
 	"fmt"
+	"os"
+	"path/filepath"
+	"time"
 
+	"github.com/jmoiron/monet/conf"
 	"github.com/jmoiron/monet/db"
+	"github.com/jmoiron/monet/pkg/vfs"
 )
 
 // UploadService handles database operations for uploads
 type UploadService struct {
-	db db.DB
+	db     db.DB
+	mapper vfs.URLMapper
+
+	// derivatives are the sizes that uploaded images are scaled down to,
+	// as jpegs of quality.
+	derivatives []conf.ImageSize
+	quality     int
+	// sizes is the sizes attribute of responsive images.
+	sizes string
+	// collisions maps filesystem names to their collision policy.
+	collisions map[string]string
+	// reconcile are the filesystems always compared with the upload table.
+	reconcile []string
+	// tusDir is where resumable uploads are kept until they're complete,
+	// for tusExpiry after they were last written to.
+	tusDir    string
+	tusExpiry time.Duration
+	// stripEXIF removes the location and identifying tags from uploaded
+	// jpegs before they're saved, and autoRotate re-encodes them so that
+	// they're upright.
+	stripEXIF  bool
+	autoRotate bool
 }
 
-// NewUploadService creates a new uploads service
+// NewUploadService creates a new uploads service with the default config
 func NewUploadService(database db.DB) *UploadService {
-	return &UploadService{db: database}
+	s := &UploadService{
+		db:        database,
+		tusDir:    filepath.Join(os.TempDir(), "monet-tus"),
+		tusExpiry: 24 * time.Hour,
+	}
+	return s.WithConfig(conf.Default().Uploads)
+}
+
+// WithConfig sets the sizes and quality of image derivatives, the
+// collision policy of each filesystem, which filesystems are reconciled,
+// where and for how long resumable uploads are kept and how the EXIF
+// metadata of photos is handled from cfg.  Settings other than the EXIF
+// ones keep their current values if they're unset.
+func (s *UploadService) WithConfig(cfg conf.UploadsConfig) *UploadService {
+	if cfg.Derivatives != nil {
+		s.derivatives = cfg.Derivatives
+	}
+	if cfg.Quality > 0 {
+		s.quality = cfg.Quality
+	}
+	if cfg.Sizes != "" {
+		s.sizes = cfg.Sizes
+	}
+	if cfg.Collisions != nil {
+		s.collisions = cfg.Collisions
+	}
+	if cfg.Reconcile != nil {
+		s.reconcile = cfg.Reconcile
+	}
+	if cfg.TusDir != "" {
+		s.tusDir = cfg.TusDir
+	}
+	if cfg.TusExpiry > 0 {
+		s.tusExpiry = time.Duration(cfg.TusExpiry) * time.Hour
+	}
+	s.stripEXIF = cfg.StripEXIF
+	s.autoRotate = cfg.AutoRotate
+	return s
+}
+
+// WithMapper sets the URL mapper used to find references to uploads by
+// their URLs.
+func (s *UploadService) WithMapper(mapper vfs.URLMapper) *UploadService {
+	s.mapper = mapper
+	return s
+}
+
+// mapperOf returns the URL mapper of registry, which can be nil.
+func mapperOf(registry vfs.Registry) vfs.URLMapper {
+	if registry == nil {
+		return nil
+	}
+	return registry.Mapper()
 }
 
 // Create inserts a new upload record into the database
 func (s *UploadService) Create(filesystemName, filename string, size int64) (*Upload, error) {
-	upload := &Upload{
+	return s.insert(&Upload{
 		FilesystemName: filesystemName,
 		Filename:       filename,
 		Size:           size,
-	}
+	})
+}
 
-	query := `INSERT INTO upload (filesystem_name, filename, size) VALUES (?, ?, ?) RETURNING id, created_at`
-	err := s.db.Get(upload, query, upload.FilesystemName, upload.Filename, upload.Size)
+func (s *UploadService) insert(upload *Upload) (*Upload, error) {
+	query := `INSERT INTO upload (filesystem_name, filename, size, sha256) VALUES (?, ?, ?, ?) RETURNING id, created_at`
+	err := s.db.Get(upload, query, upload.FilesystemName, upload.Filename, upload.Size, upload.SHA256)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create upload record: %w", err)
 	}
@@ -36,7 +116,7 @@ func (s *UploadService) Create(filesystemName, filename string, size int64) (*Up
 // GetByID retrieves an upload by its ID
 func (s *UploadService) GetByID(id uint64) (*Upload, error) {
 	var upload Upload
-	query := `SELECT id, filesystem_name, filename, size, created_at FROM upload WHERE id = ?`
+	query := `SELECT id, filesystem_name, filename, size, created_at, width, height, sha256 FROM upload WHERE id = ?`
 	err := s.db.Get(&upload, query, id)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get upload by ID %d: %w", id, err)
@@ -47,7 +127,7 @@ func (s *UploadService) GetByID(id uint64) (*Upload, error) {
 // GetByFilename retrieves an upload by filesystem name and filename
 func (s *UploadService) GetByFilename(filesystemName, filename string) (*Upload, error) {
 	var upload Upload
-	query := `SELECT id, filesystem_name, filename, size, created_at FROM upload
+	query := `SELECT id, filesystem_name, filename, size, created_at, width, height, sha256 FROM upload
 			  WHERE filesystem_name = ? AND filename = ?`
 	err := s.db.Get(&upload, query, filesystemName, filename)
 	if err != nil {
@@ -63,12 +143,12 @@ func (s *UploadService) List(filesystemName string, limit, offset int) ([]*Uploa
 	var args []any
 
 	if filesystemName != "" {
-		query = `SELECT id, filesystem_name, filename, size, created_at FROM upload
+		query = `SELECT id, filesystem_name, filename, size, created_at, width, height, sha256 FROM upload
 				 WHERE filesystem_name = ?
 				 ORDER BY created_at DESC LIMIT ? OFFSET ?`
 		args = []any{filesystemName, limit, offset}
 	} else {
-		query = `SELECT id, filesystem_name, filename, size, created_at FROM upload
+		query = `SELECT id, filesystem_name, filename, size, created_at, width, height, sha256 FROM upload
 				 ORDER BY created_at DESC LIMIT ? OFFSET ?`
 		args = []any{limit, offset}
 	}
@@ -103,8 +183,38 @@ func (s *UploadService) Count(filesystemName string) (int, error) {
 	return count, nil
 }
 
-// Delete removes an upload record from the database by ID
+// Usage returns the space, in bytes, used by the uploads recorded in the
+// named filesystem and their derivatives.
+func (s *UploadService) Usage(filesystemName string) (int64, error) {
+	var used int64
+	err := s.db.Get(&used, `SELECT
+		(SELECT COALESCE(SUM(size), 0) FROM upload WHERE filesystem_name = ?) +
+		(SELECT COALESCE(SUM(d.size), 0) FROM upload_derivative d JOIN upload u ON u.id = d.upload_id
+		 WHERE u.filesystem_name = ?)`, filesystemName, filesystemName)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get usage of %s: %w", filesystemName, err)
+	}
+	return used, nil
+}
+
+// Policy returns the upload policy of the named filesystem in registry.
+// Its quota is checked against the Usage recorded for the filesystem, so
+// that the filesystem isn't walked for each upload.
+func (s *UploadService) Policy(registry vfs.Registry, filesystemName string) *vfs.Policy {
+	return registry.Policy(filesystemName).WithUsage(func() (int64, error) {
+		return s.Usage(filesystemName)
+	})
+}
+
+// Delete removes an upload record and its derivative records from the database by ID
 func (s *UploadService) Delete(id uint64) error {
+	if _, err := s.db.Exec(`DELETE FROM upload_derivative WHERE upload_id = ?`, id); err != nil {
+		return fmt.Errorf("failed to delete derivatives for upload ID %d: %w", id, err)
+	}
+	if _, err := s.db.Exec(`DELETE FROM upload_exif WHERE upload_id = ?`, id); err != nil {
+		return fmt.Errorf("failed to delete exif for upload ID %d: %w", id, err)
+	}
+
 	query := `DELETE FROM upload WHERE id = ?`
 	result, err := s.db.Exec(query, id)
 	if err != nil {
@@ -125,6 +235,17 @@ func (s *UploadService) Delete(id uint64) error {
 
 // DeleteByFilename removes an upload record from the database by filesystem name and filename
 func (s *UploadService) DeleteByFilename(filesystemName, filename string) error {
+	_, err := s.db.Exec(`DELETE FROM upload_derivative WHERE upload_id IN
+		(SELECT id FROM upload WHERE filesystem_name = ? AND filename = ?)`, filesystemName, filename)
+	if err != nil {
+		return fmt.Errorf("failed to delete derivatives for %s/%s: %w", filesystemName, filename, err)
+	}
+	_, err = s.db.Exec(`DELETE FROM upload_exif WHERE upload_id IN
+		(SELECT id FROM upload WHERE filesystem_name = ? AND filename = ?)`, filesystemName, filename)
+	if err != nil {
+		return fmt.Errorf("failed to delete exif for %s/%s: %w", filesystemName, filename, err)
+	}
+
 	query := `DELETE FROM upload WHERE filesystem_name = ? AND filename = ?`
 	result, err := s.db.Exec(query, filesystemName, filename)
 	if err != nil {
@@ -0,0 +1,229 @@
+package uploads
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/jmoiron/monet/pkg/vfs"
+)
+
+// Collision policies say what happens to an upload whose name is taken by
+// a file with different content.
+const (
+	// CollisionRename saves the upload under a free name, eg. "photo-1.jpg".
+	CollisionRename = "rename"
+	// CollisionReject refuses the upload with ErrNameTaken.
+	CollisionReject = "reject"
+)
+
+// ErrNameTaken is returned by Store when the filename is in use and the
+// filesystem's policy is to reject collisions.
+var ErrNameTaken = errors.New("a different file with that name already exists")
+
+// storeMu serializes picking names for uploads, so that two uploads with the
+// same name can't both claim it.
+var storeMu sync.Mutex
+
+// CollisionPolicy returns the collision policy for the filesystem name.
+// Filesystems without one use CollisionRename.
+func (s *UploadService) CollisionPolicy(filesystemName string) string {
+	if p := s.collisions[filesystemName]; p == CollisionReject {
+		return p
+	}
+	return CollisionRename
+}
+
+// Store saves the file read from r as filename in the filesystem fsys,
+// registered as filesystemName, and records it.  The file is hashed as it
+// is written; if the filesystem already has an upload with the same
+// content, the new copy is discarded and that upload is returned with
+// existing set.  If filename is taken by different content, the
+// filesystem's collision policy decides whether a new name is used.
+// Filenames can be in folders, eg. "2024/my-post/photo.jpg", which are
+// created as needed.  The EXIF metadata of jpegs is recorded, after they're
+// stripped and rotated as configured.
+func (s *UploadService) Store(fsys vfs.WritableFS, filesystemName, filename string, r io.Reader) (upload *Upload, existing bool, err error) {
+	r, meta, err := s.prepareImage(filename, r)
+	if err != nil {
+		return nil, false, err
+	}
+
+	// write to a temporary name first, as the final name depends on the hash
+	tmp, err := tempName()
+	if err != nil {
+		return nil, false, err
+	}
+	h := sha256.New()
+	size, err := vfs.WriteFile(fsys, tmp, io.TeeReader(r, h))
+	if err != nil {
+		fsys.Remove(tmp)
+		return nil, false, fmt.Errorf("failed to save file: %w", err)
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+
+	storeMu.Lock()
+	defer storeMu.Unlock()
+
+	dupe, err := s.GetBySHA256(filesystemName, sum)
+	switch {
+	case err == nil:
+		if err := fsys.Remove(tmp); err != nil {
+			slog.Warn("Failed to remove duplicate upload", "filename", tmp, "error", err)
+		}
+		return dupe, true, nil
+	case !errors.Is(err, sql.ErrNoRows):
+		fsys.Remove(tmp)
+		return nil, false, err
+	}
+
+	name, err := s.freeName(fsys, filesystemName, filename)
+	if err != nil {
+		fsys.Remove(tmp)
+		return nil, false, err
+	}
+	if dir := path.Dir(name); dir != "." {
+		if err := fsys.MkdirAll(dir, 0755); err != nil {
+			fsys.Remove(tmp)
+			return nil, false, fmt.Errorf("failed to create folder %s: %w", dir, err)
+		}
+	}
+	if err := fsys.Rename(tmp, name); err != nil {
+		fsys.Remove(tmp)
+		return nil, false, fmt.Errorf("failed to save file: %w", err)
+	}
+
+	upload, err = s.insert(&Upload{
+		FilesystemName: filesystemName,
+		Filename:       name,
+		Size:           size,
+		SHA256:         sum,
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	if meta != nil {
+		if err := s.saveEXIF(upload.ID, meta); err != nil {
+			return nil, false, err
+		}
+	}
+	return upload, false, nil
+}
+
+// GetBySHA256 retrieves the upload in a filesystem with the given content hash.
+func (s *UploadService) GetBySHA256(filesystemName, sum string) (*Upload, error) {
+	var upload Upload
+	query := `SELECT id, filesystem_name, filename, size, created_at, width, height, sha256 FROM upload
+			  WHERE filesystem_name = ? AND sha256 = ? ORDER BY id LIMIT 1`
+	err := s.db.Get(&upload, query, filesystemName, sum)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get upload by hash %s: %w", sum, err)
+	}
+	return &upload, nil
+}
+
+// nameTaken returns true if a file in fsys or an upload in the filesystem
+// filesystemName is called name.
+func (s *UploadService) nameTaken(fsys vfs.WritableFS, filesystemName, name string) (bool, error) {
+	if _, err := fsys.Stat(name); err == nil {
+		return true, nil
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return false, err
+	}
+	var count int
+	err := s.db.Get(&count, `SELECT COUNT(*) FROM upload WHERE filesystem_name = ? AND filename = ?`, filesystemName, name)
+	return count > 0, err
+}
+
+// freeName returns filename if nothing in the filesystem uses it, and
+// otherwise applies the filesystem's collision policy.
+func (s *UploadService) freeName(fsys vfs.WritableFS, filesystemName, filename string) (string, error) {
+	taken := func(name string) (bool, error) {
+		return s.nameTaken(fsys, filesystemName, name)
+	}
+
+	ok, err := taken(filename)
+	if err != nil || !ok {
+		return filename, err
+	}
+	if s.CollisionPolicy(filesystemName) == CollisionReject {
+		return "", fmt.Errorf("%s: %w", filename, ErrNameTaken)
+	}
+
+	ext := path.Ext(filename)
+	base := strings.TrimSuffix(filename, ext)
+	for i := 1; i < 1000; i++ {
+		name := fmt.Sprintf("%s-%d%s", base, i, ext)
+		ok, err := taken(name)
+		if err != nil {
+			return "", err
+		}
+		if !ok {
+			return name, nil
+		}
+	}
+	return "", fmt.Errorf("%s: %w", filename, ErrNameTaken)
+}
+
+// tempName returns a random name for a file being uploaded.
+func tempName() (string, error) {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return ".upload-" + hex.EncodeToString(b[:]), nil
+}
+
+// BackfillHashes hashes the files of uploads that were stored without one.
+// Uploads whose files are missing are skipped.  It returns the number of
+// uploads hashed.
+func (s *UploadService) BackfillHashes(registry vfs.Registry) (int, error) {
+	var uploads []*Upload
+	err := s.db.Select(&uploads, `SELECT id, filesystem_name, filename, size, created_at, width, height, sha256 FROM upload
+		WHERE sha256 = '' ORDER BY id`)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list unhashed uploads: %w", err)
+	}
+
+	var count int
+	for _, upload := range uploads {
+		fsys, err := registry.Get(upload.FilesystemName)
+		if err != nil {
+			slog.Warn("Skipping upload in unknown filesystem", "id", upload.ID, "filesystem", upload.FilesystemName)
+			continue
+		}
+		sum, err := hashFile(fsys, upload.Filename)
+		if err != nil {
+			slog.Warn("Failed to hash upload", "id", upload.ID, "filename", upload.Filename, "error", err)
+			continue
+		}
+		if _, err := s.db.Exec(`UPDATE upload SET sha256 = ? WHERE id = ?`, sum, upload.ID); err != nil {
+			return count, fmt.Errorf("failed to save hash for upload ID %d: %w", upload.ID, err)
+		}
+		count++
+	}
+	return count, nil
+}
+
+// hashFile returns the hex sha256 of the file name in fsys.
+func hashFile(fsys fs.FS, name string) (string, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
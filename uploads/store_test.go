@@ -0,0 +1,191 @@
+package uploads
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/jpeg"
+	"io/fs"
+	"strings"
+	"testing"
+
+	"github.com/jmoiron/monet/conf"
+	"github.com/jmoiron/monet/pkg/exif"
+	"github.com/jmoiron/monet/pkg/vfs"
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStore(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	conn, err := sqlx.Connect("sqlite3", ":memory:")
+	require.NoError(err)
+	require.NoError(NewApp(conn, nil).Migrate())
+
+	fsys := vfs.NewMemFS()
+	serv := NewUploadService(conn)
+
+	first, existing, err := serv.Store(fsys, "uploads", "notes.txt", strings.NewReader("first"))
+	require.NoError(err)
+	assert.False(existing)
+	assert.Equal("notes.txt", first.Filename)
+	assert.Equal(int64(5), first.Size)
+	assert.Equal("a7937b64b8caa58f03721bb6bacf5c78cb235febe0e70b1b84cd99541461a08e", first.SHA256)
+
+	// the same content is deduplicated, whatever its name
+	dupe, existing, err := serv.Store(fsys, "uploads", "copy.txt", strings.NewReader("first"))
+	require.NoError(err)
+	assert.True(existing)
+	assert.Equal(first.ID, dupe.ID)
+	_, err = fsys.Stat("copy.txt")
+	assert.ErrorIs(err, fs.ErrNotExist)
+
+	// different content with a taken name is renamed by default
+	second, existing, err := serv.Store(fsys, "uploads", "notes.txt", strings.NewReader("second"))
+	require.NoError(err)
+	assert.False(existing)
+	assert.Equal("notes-1.txt", second.Filename)
+	data, err := fs.ReadFile(fsys, "notes.txt")
+	require.NoError(err)
+	assert.Equal("first", string(data))
+
+	// or rejected
+	reject := NewUploadService(conn).WithConfig(conf.UploadsConfig{Collisions: map[string]string{"uploads": CollisionReject}})
+	_, _, err = reject.Store(fsys, "uploads", "notes.txt", strings.NewReader("third"))
+	assert.ErrorIs(err, ErrNameTaken)
+
+	// only the two stored files are left, with no temporary files
+	entries, err := fs.ReadDir(fsys, ".")
+	require.NoError(err)
+	assert.Len(entries, 2)
+
+	// files uploaded before hashing can be backfilled
+	_, err = vfs.WriteFile(fsys, "old.txt", strings.NewReader("first"))
+	require.NoError(err)
+	old, err := serv.Create("uploads", "old.txt", 5)
+	require.NoError(err)
+	assert.Empty(old.SHA256)
+
+	registry := vfs.NewRegistry(nil)
+	require.NoError(registry.Add("uploads", fsys))
+	n, err := serv.BackfillHashes(registry)
+	require.NoError(err)
+	assert.Equal(1, n)
+	old, err = serv.GetByID(old.ID)
+	require.NoError(err)
+	assert.Equal(first.SHA256, old.SHA256)
+}
+
+// gpsJPEG returns a jpeg taken by a "Pix" camera at 52.5N 13.4E.
+func gpsJPEG(t *testing.T) []byte {
+	be := binary.BigEndian
+	tiff := []byte("MM\x00\x2a\x00\x00\x00\x08")
+	// IFD0: the model, and the GPS IFD at 38
+	tiff = be.AppendUint16(tiff, 2)
+	tiff = append(tiff, 0x01, 0x10, 0, 2, 0, 0, 0, 4, 'P', 'i', 'x', 0)
+	tiff = append(tiff, 0x88, 0x25, 0, 4, 0, 0, 0, 1, 0, 0, 0, 38)
+	tiff = be.AppendUint32(tiff, 0)
+	// GPS IFD: the latitude and longitude, whose values are at 92 and 116
+	tiff = be.AppendUint16(tiff, 4)
+	tiff = append(tiff, 0, 1, 0, 2, 0, 0, 0, 2, 'N', 0, 0, 0)
+	tiff = append(tiff, 0, 2, 0, 5, 0, 0, 0, 3, 0, 0, 0, 92)
+	tiff = append(tiff, 0, 3, 0, 2, 0, 0, 0, 2, 'E', 0, 0, 0)
+	tiff = append(tiff, 0, 4, 0, 5, 0, 0, 0, 3, 0, 0, 0, 116)
+	tiff = be.AppendUint32(tiff, 0)
+	for _, v := range []uint32{52, 1, 30, 1, 0, 1, 13, 1, 24, 1, 0, 1} {
+		tiff = be.AppendUint32(tiff, v)
+	}
+
+	var buf bytes.Buffer
+	require.NoError(t, jpeg.Encode(&buf, image.NewGray(image.Rect(0, 0, 4, 4)), nil))
+	app1 := be.AppendUint16([]byte{0xFF, 0xE1}, uint16(len(tiff)+8))
+	app1 = append(append(app1, "Exif\x00\x00"...), tiff...)
+	return append(append(buf.Bytes()[:2:2], app1...), buf.Bytes()[2:]...)
+}
+
+func TestStoreEXIF(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	conn, err := sqlx.Connect("sqlite3", ":memory:")
+	require.NoError(err)
+	require.NoError(NewApp(conn, nil).Migrate())
+
+	fsys := vfs.NewMemFS()
+	serv := NewUploadService(conn)
+
+	// the location is removed before the photo is saved
+	upload, _, err := serv.Store(fsys, "uploads", "photo.jpg", bytes.NewReader(gpsJPEG(t)))
+	require.NoError(err)
+	meta, err := serv.EXIF(upload.ID)
+	require.NoError(err)
+	require.NotNil(meta)
+	assert.Equal("Pix", meta.Camera)
+	assert.False(meta.HasLocation)
+	assert.True(meta.LocationStripped)
+	data, err := fs.ReadFile(fsys, "photo.jpg")
+	require.NoError(err)
+	info, err := exif.Decode(data)
+	require.NoError(err)
+	assert.Equal("Pix", info.Model)
+	assert.False(info.HasLocation)
+
+	// or kept and recorded
+	cfg := conf.Default().Uploads
+	cfg.StripEXIF = false
+	upload, _, err = NewUploadService(conn).WithConfig(cfg).Store(fsys, "uploads", "photo.jpg", bytes.NewReader(gpsJPEG(t)))
+	require.NoError(err)
+	assert.Equal("photo-1.jpg", upload.Filename)
+	meta, err = serv.EXIF(upload.ID)
+	require.NoError(err)
+	assert.True(meta.HasLocation)
+	assert.InDelta(52.5, meta.Latitude, 0.0001)
+
+	// files without metadata have none recorded
+	upload, _, err = serv.Store(fsys, "uploads", "notes.txt", strings.NewReader("notes"))
+	require.NoError(err)
+	meta, err = serv.EXIF(upload.ID)
+	assert.NoError(err)
+	assert.Nil(meta)
+
+	require.NoError(serv.Delete(upload.ID - 1))
+	var count int
+	require.NoError(conn.Get(&count, `SELECT COUNT(*) FROM upload_exif`))
+	assert.Equal(1, count)
+}
+
+func TestQuotaUsage(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	conn, err := sqlx.Connect("sqlite3", ":memory:")
+	require.NoError(err)
+	require.NoError(NewApp(conn, nil).Migrate())
+
+	fsys := vfs.NewMemFS()
+	registry := vfs.NewRegistry(nil)
+	require.NoError(registry.Add("uploads", fsys))
+	registry.SetPolicy("uploads", &vfs.Policy{Quota: 20})
+	serv := NewUploadService(conn)
+
+	_, _, err = serv.Store(fsys, "uploads", "a.txt", strings.NewReader("0123456789"))
+	require.NoError(err)
+	_, _, err = serv.Store(fsys, "other", "b.txt", strings.NewReader("0123456789"))
+	require.NoError(err)
+	used, err := serv.Usage("uploads")
+	require.NoError(err)
+	assert.Equal(int64(10), used)
+
+	// the quota is checked against the recorded uploads, so untracked files
+	// in the filesystem don't count
+	_, err = vfs.WriteFile(fsys, "stray.txt", strings.NewReader("0123456789"))
+	require.NoError(err)
+	policy := serv.Policy(registry, "uploads")
+	assert.NoError(policy.CheckSize(fsys, 10))
+	var perr *vfs.PolicyError
+	require.ErrorAs(policy.CheckSize(fsys, 11), &perr)
+	assert.Equal(vfs.ErrCodeQuotaExceeded, perr.Code)
+}
@@ -0,0 +1,513 @@
+package uploads
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/jmoiron/monet/conf"
+	"github.com/jmoiron/monet/db"
+	"github.com/jmoiron/monet/pkg/vfs"
+)
+
+// TusVersion is the version of the tus resumable upload protocol served by
+// TusHandler.
+const TusVersion = "1.0.0"
+
+// tusExtensions are the protocol extensions TusHandler supports.
+const tusExtensions = "creation,creation-with-upload,termination,expiration"
+
+// A TusHandler serves the tus resumable upload protocol for the filesystem
+// named by the "filesystem" URL parameter.  Each upload is written in
+// chunks, with PATCH requests, to a file in the service's tus directory; it
+// can be resumed from wherever the server got to after a connection drops.  Once complete, it
+// is checked against the filesystem's policy and stored as an Upload.
+//
+// See https://tus.io/protocols/resumable-upload for the protocol.
+type TusHandler struct {
+	service  *UploadService
+	registry vfs.Registry
+
+	mu sync.Mutex
+	// busy are uploads being written to, which can't be written to by
+	// another request at the same time.
+	busy map[string]bool
+}
+
+// NewTusHandler creates a tus handler for the filesystems in registry.
+func NewTusHandler(database db.DB, registry vfs.Registry) *TusHandler {
+	return &TusHandler{
+		service:  NewUploadService(database),
+		registry: registry,
+		busy:     make(map[string]bool),
+	}
+}
+
+// WithConfig sets where and for how long resumable uploads are kept, and
+// the config of the uploads they're stored as.
+func (h *TusHandler) WithConfig(cfg conf.UploadsConfig) *TusHandler {
+	h.service.WithConfig(cfg)
+	return h
+}
+
+// Bind sets up the tus routes; it's meant to be used with a route that has
+// a {filesystem} parameter, eg:
+//
+//	r.Route("/tus/{filesystem}", h.Bind)
+func (h *TusHandler) Bind(r chi.Router) {
+	r.Use(tusVersion)
+	r.Options("/", h.options)
+	r.Post("/", h.create)
+	r.Head("/{id:[0-9a-f]+}", h.head)
+	r.Patch("/{id:[0-9a-f]+}", h.patch)
+	r.Delete("/{id:[0-9a-f]+}", h.terminate)
+}
+
+// tusVersion sets the protocol version on every response, and refuses
+// requests for other versions of it.
+func tusVersion(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Tus-Resumable", TusVersion)
+		if r.Method != http.MethodOptions && r.Header.Get("Tus-Resumable") != TusVersion {
+			w.Header().Set("Tus-Version", TusVersion)
+			http.Error(w, "Unsupported tus version", http.StatusPreconditionFailed)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// filesystem returns the writable filesystem named in the request, and its
+// name.
+func (h *TusHandler) filesystem(r *http.Request) (vfs.WritableFS, string, error) {
+	name := chi.URLParam(r, "filesystem")
+	fsys, err := h.registry.GetWritable(name)
+	return fsys, name, err
+}
+
+// options describes the server's tus support.
+func (h *TusHandler) options(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Version", TusVersion)
+	w.Header().Set("Tus-Extension", tusExtensions)
+	if max := h.registry.Policy(chi.URLParam(r, "filesystem")).MaxFileSize(); max >= 0 {
+		w.Header().Set("Tus-Max-Size", strconv.FormatInt(max, 10))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// create starts a new upload of Upload-Length bytes.  The filename is taken
+// from the "filename" or "name" key of Upload-Metadata, and it's put in the
+// folder in the "dir" query parameter.  If the request has a body, it is
+// written as the first chunk.
+func (h *TusHandler) create(w http.ResponseWriter, r *http.Request) {
+	fsys, fsName, err := h.filesystem(r)
+	if err != nil {
+		http.Error(w, "Unknown filesystem", http.StatusNotFound)
+		return
+	}
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		http.Error(w, "Invalid Upload-Length", http.StatusBadRequest)
+		return
+	}
+	meta, err := parseTusMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		http.Error(w, "Invalid Upload-Metadata: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	name := meta["filename"]
+	if name == "" {
+		name = meta["name"]
+	}
+
+	// refuse uploads that are too large before any of them is sent
+	policy := h.service.Policy(h.registry, fsName)
+	filename, err := policy.SanitizeFilename(name)
+	if err == nil {
+		var dir string
+		if dir, err = policy.SanitizeDir(r.URL.Query().Get("dir")); err == nil {
+			filename = path.Join(dir, filename)
+		}
+	}
+	if err == nil {
+		err = policy.CheckSize(fsys, length)
+	}
+	if vfs.WritePolicyError(w, err) {
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to check upload: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	tu, err := h.service.createTus(fsName, filename, length, r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		http.Error(w, "Failed to create upload: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Location", path.Join(r.URL.Path, tu.ID))
+	w.Header().Set("Upload-Expires", tu.ExpiresAt.UTC().Format(http.TimeFormat))
+
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		w.Header().Set("Upload-Offset", "0")
+		w.WriteHeader(http.StatusCreated)
+		return
+	}
+	if !h.lock(tu.ID) {
+		http.Error(w, "Upload is busy", http.StatusLocked)
+		return
+	}
+	defer h.unlock(tu.ID)
+	if h.write(w, r, fsys, tu) {
+		w.WriteHeader(http.StatusCreated)
+	}
+}
+
+// head reports how much of an upload has been received.
+func (h *TusHandler) head(w http.ResponseWriter, r *http.Request) {
+	tu, ok := h.upload(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Upload-Offset", strconv.FormatInt(tu.Received, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(tu.Length, 10))
+	if tu.Metadata != "" {
+		w.Header().Set("Upload-Metadata", tu.Metadata)
+	}
+	if tu.UploadID == 0 {
+		w.Header().Set("Upload-Expires", tu.ExpiresAt.UTC().Format(http.TimeFormat))
+	} else {
+		h.completed(w, tu)
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// patch writes a chunk of an upload at Upload-Offset, which must be how
+// much of it has been received.
+func (h *TusHandler) patch(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		http.Error(w, "Content-Type must be application/offset+octet-stream", http.StatusUnsupportedMediaType)
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		http.Error(w, "Invalid Upload-Offset", http.StatusBadRequest)
+		return
+	}
+	fsys, _, err := h.filesystem(r)
+	if err != nil {
+		http.Error(w, "Unknown filesystem", http.StatusNotFound)
+		return
+	}
+
+	id := chi.URLParam(r, "id")
+	if !h.lock(id) {
+		http.Error(w, "Upload is busy", http.StatusLocked)
+		return
+	}
+	defer h.unlock(id)
+
+	tu, ok := h.upload(w, r)
+	if !ok {
+		return
+	}
+	if offset != tu.Received {
+		w.Header().Set("Upload-Offset", strconv.FormatInt(tu.Received, 10))
+		http.Error(w, "Upload-Offset does not match", http.StatusConflict)
+		return
+	}
+	if h.write(w, r, fsys, tu) {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// terminate abandons an upload.  Completed uploads are kept; only the
+// record of how they were uploaded is removed.
+func (h *TusHandler) terminate(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	if !h.lock(id) {
+		http.Error(w, "Upload is busy", http.StatusLocked)
+		return
+	}
+	defer h.unlock(id)
+
+	tu, ok := h.upload(w, r)
+	if !ok {
+		return
+	}
+	if err := h.service.deleteTus(tu.ID); err != nil {
+		http.Error(w, "Failed to remove upload: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// upload returns the upload named in the request, writing an error if it
+// doesn't exist in the request's filesystem.
+func (h *TusHandler) upload(w http.ResponseWriter, r *http.Request) (*TusUpload, bool) {
+	tu, err := h.service.getTus(chi.URLParam(r, "id"))
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && tu.FilesystemName != chi.URLParam(r, "filesystem")) {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return nil, false
+	}
+	if err != nil {
+		http.Error(w, "Failed to get upload: "+err.Error(), http.StatusInternalServerError)
+		return nil, false
+	}
+	if tu.UploadID == 0 && time.Now().After(tu.ExpiresAt) {
+		http.Error(w, "Upload expired", http.StatusGone)
+		return nil, false
+	}
+	return tu, true
+}
+
+// write appends the request body to the upload, and stores it once it's
+// complete.  It sets the response headers and returns true if the chunk
+// was written; otherwise it writes an error.
+func (h *TusHandler) write(w http.ResponseWriter, r *http.Request, fsys vfs.WritableFS, tu *TusUpload) bool {
+	if tu.UploadID != 0 {
+		http.Error(w, "Upload is already complete", http.StatusForbidden)
+		return false
+	}
+
+	f, err := os.OpenFile(h.service.tusPath(tu.ID), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		http.Error(w, "Failed to open upload: "+err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	// drop anything written after the last recorded offset
+	if err := f.Truncate(tu.Received); err != nil {
+		f.Close()
+		http.Error(w, "Failed to open upload: "+err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	// whatever was received before an error is kept, so the client can
+	// resume from there
+	n, copyErr := io.Copy(f, io.LimitReader(r.Body, tu.Length-tu.Received))
+	if err := f.Close(); copyErr == nil {
+		copyErr = err
+	}
+	tu.Received += n
+	tu.ExpiresAt = time.Now().UTC().Add(h.service.tusExpiry)
+	if err := h.service.updateTus(tu); err != nil {
+		http.Error(w, "Failed to update upload: "+err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	if copyErr != nil {
+		slog.Warn("Resumable upload interrupted", "id", tu.ID, "received", tu.Received, "error", copyErr)
+		http.Error(w, "Failed to write upload: "+copyErr.Error(), http.StatusInternalServerError)
+		return false
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(tu.Received, 10))
+	if tu.Received < tu.Length {
+		w.Header().Set("Upload-Expires", tu.ExpiresAt.UTC().Format(http.TimeFormat))
+		return true
+	}
+
+	upload, err := h.service.completeTus(fsys, h.service.Policy(h.registry, tu.FilesystemName), tu)
+	if err != nil {
+		// a complete upload that can't be stored can't be resumed either
+		if err := h.service.deleteTus(tu.ID); err != nil {
+			slog.Warn("Failed to remove resumable upload", "id", tu.ID, "error", err)
+		}
+		if vfs.WritePolicyError(w, err) {
+			return false
+		}
+		if errors.Is(err, ErrNameTaken) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return false
+		}
+		http.Error(w, "Failed to save file: "+err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	tu.UploadID = upload.ID
+	h.completed(w, tu)
+	return true
+}
+
+// completed sets headers describing the upload a completed tus upload was
+// stored as, so that clients can use it.
+func (h *TusHandler) completed(w http.ResponseWriter, tu *TusUpload) {
+	upload, err := h.service.GetByID(tu.UploadID)
+	if err != nil {
+		return
+	}
+	w.Header().Set("Upload-Id", strconv.FormatUint(upload.ID, 10))
+	w.Header().Set("Upload-Filename", upload.Filename)
+	if mapper := h.registry.Mapper(); mapper != nil {
+		if url, err := mapper.GetURL(upload.FilesystemName, upload.Filename); err == nil {
+			w.Header().Set("Upload-Url", url)
+		}
+	}
+}
+
+func (h *TusHandler) lock(id string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.busy[id] {
+		return false
+	}
+	h.busy[id] = true
+	return true
+}
+
+func (h *TusHandler) unlock(id string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.busy, id)
+}
+
+// parseTusMetadata parses an Upload-Metadata header, a comma separated
+// list of keys and base64 encoded values.
+func parseTusMetadata(header string) (map[string]string, error) {
+	meta := map[string]string{}
+	for _, pair := range strings.Split(header, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		key, value, _ := strings.Cut(pair, " ")
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("value of %s: %w", key, err)
+		}
+		meta[key] = string(decoded)
+	}
+	return meta, nil
+}
+
+// tusPath returns where the data of the upload id is kept.
+func (s *UploadService) tusPath(id string) string {
+	return filepath.Join(s.tusDir, id)
+}
+
+// createTus records a new resumable upload, and creates the file its data
+// is written to.
+func (s *UploadService) createTus(filesystemName, filename string, length int64, metadata string) (*TusUpload, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return nil, err
+	}
+	tu := &TusUpload{
+		ID:             hex.EncodeToString(b[:]),
+		FilesystemName: filesystemName,
+		Filename:       filename,
+		Length:         length,
+		Metadata:       metadata,
+		ExpiresAt:      time.Now().UTC().Add(s.tusExpiry),
+	}
+
+	if err := os.MkdirAll(s.tusDir, 0o755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(s.tusPath(tu.ID), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+
+	_, err = s.db.Exec(`INSERT INTO upload_tus (id, filesystem_name, filename, length, metadata, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?)`, tu.ID, tu.FilesystemName, tu.Filename, tu.Length, tu.Metadata, tu.ExpiresAt)
+	if err != nil {
+		os.Remove(s.tusPath(tu.ID))
+		return nil, fmt.Errorf("failed to create resumable upload: %w", err)
+	}
+	return tu, nil
+}
+
+func (s *UploadService) getTus(id string) (*TusUpload, error) {
+	var tu TusUpload
+	err := s.db.Get(&tu, `SELECT id, filesystem_name, filename, length, received, metadata, upload_id, created_at, expires_at
+		FROM upload_tus WHERE id = ?`, id)
+	if err != nil {
+		return nil, err
+	}
+	return &tu, nil
+}
+
+func (s *UploadService) updateTus(tu *TusUpload) error {
+	_, err := s.db.Exec(`UPDATE upload_tus SET received = ?, upload_id = ?, expires_at = ? WHERE id = ?`,
+		tu.Received, tu.UploadID, tu.ExpiresAt, tu.ID)
+	if err != nil {
+		return fmt.Errorf("failed to update resumable upload %s: %w", tu.ID, err)
+	}
+	return nil
+}
+
+// deleteTus removes a resumable upload and its data.
+func (s *UploadService) deleteTus(id string) error {
+	if err := os.Remove(s.tusPath(id)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if _, err := s.db.Exec(`DELETE FROM upload_tus WHERE id = ?`, id); err != nil {
+		return fmt.Errorf("failed to delete resumable upload %s: %w", id, err)
+	}
+	return nil
+}
+
+// completeTus checks the data of a complete resumable upload against the
+// policy of its filesystem, stores it and records the upload it was stored
+// as.  Its data is removed, but the record is kept until it expires so that
+// clients can find out what became of it.
+func (s *UploadService) completeTus(fsys vfs.WritableFS, policy *vfs.Policy, tu *TusUpload) (*Upload, error) {
+	f, err := os.Open(s.tusPath(tu.ID))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	filename, body, err := policy.ApplyIn(fsys, path.Dir(tu.Filename), path.Base(tu.Filename), f)
+	if err != nil {
+		return nil, err
+	}
+	upload, existing, err := s.Store(fsys, tu.FilesystemName, filename, body)
+	if err != nil {
+		return nil, err
+	}
+	if !existing {
+		if _, err := s.GenerateDerivatives(upload, fsys); err != nil {
+			slog.Warn("Failed to generate derivatives", "filename", upload.Filename, "error", err)
+		}
+	}
+
+	tu.UploadID = upload.ID
+	if err := s.updateTus(tu); err != nil {
+		return nil, err
+	}
+	if err := os.Remove(s.tusPath(tu.ID)); err != nil {
+		slog.Warn("Failed to remove resumable upload data", "id", tu.ID, "error", err)
+	}
+	return upload, nil
+}
+
+// ExpireTusUploads removes resumable uploads that expired, along with their
+// data.  It returns the number removed.
+func (s *UploadService) ExpireTusUploads() (int, error) {
+	var ids []string
+	if err := s.db.Select(&ids, `SELECT id FROM upload_tus WHERE expires_at < ?`, time.Now().UTC()); err != nil {
+		return 0, fmt.Errorf("failed to list expired resumable uploads: %w", err)
+	}
+	for i, id := range ids {
+		if err := s.deleteTus(id); err != nil {
+			return i, err
+		}
+	}
+	return len(ids), nil
+}
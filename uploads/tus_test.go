@@ -0,0 +1,173 @@
+package uploads
+
+import (
+	"context"
+	"encoding/base64"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/jmoiron/monet/conf"
+	"github.com/jmoiron/monet/pkg/vfs"
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTus(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	conn, err := sqlx.Connect("sqlite3", ":memory:")
+	require.NoError(err)
+	conn.SetMaxOpenConns(1)
+	require.NoError(NewApp(conn, nil).Migrate())
+	cfg := conf.UploadsConfig{TusDir: t.TempDir()}
+
+	fsys := vfs.NewMemFS()
+	registry := vfs.NewRegistry(nil)
+	require.NoError(registry.Add("uploads", fsys))
+	registry.SetPolicy("uploads", &vfs.Policy{MaxSize: 100})
+
+	r := chi.NewRouter()
+	r.Route("/tus/{filesystem}", NewTusHandler(conn, registry).WithConfig(cfg).Bind)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	do := func(method, path string, header map[string]string, body string) *http.Response {
+		req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		require.NoError(err)
+		req.Header.Set("Tus-Resumable", TusVersion)
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(err)
+		resp.Body.Close()
+		return resp
+	}
+	chunk := func(offset int) map[string]string {
+		return map[string]string{
+			"Content-Type":  "application/offset+octet-stream",
+			"Upload-Offset": strconv.Itoa(offset),
+		}
+	}
+
+	resp := do("OPTIONS", "/tus/uploads", nil, "")
+	assert.Equal(http.StatusNoContent, resp.StatusCode)
+	assert.Equal("100", resp.Header.Get("Tus-Max-Size"))
+
+	// other versions of the protocol are refused
+	req, _ := http.NewRequest("POST", srv.URL+"/tus/uploads", nil)
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(err)
+	assert.Equal(http.StatusPreconditionFailed, resp.StatusCode)
+
+	// uploads larger than the policy allows are refused up front
+	meta := "filename " + base64.StdEncoding.EncodeToString([]byte("notes.txt"))
+	resp = do("POST", "/tus/uploads", map[string]string{"Upload-Length": "101", "Upload-Metadata": meta}, "")
+	assert.Equal(http.StatusRequestEntityTooLarge, resp.StatusCode)
+	assert.Equal("application/json", resp.Header.Get("Content-Type"))
+
+	resp = do("POST", "/tus/uploads", map[string]string{"Upload-Length": "11", "Upload-Metadata": meta}, "")
+	require.Equal(http.StatusCreated, resp.StatusCode)
+	loc := strings.TrimPrefix(resp.Header.Get("Location"), srv.URL)
+	assert.True(strings.HasPrefix(loc, "/tus/uploads/"))
+	assert.NotEmpty(resp.Header.Get("Upload-Expires"))
+
+	resp = do("PATCH", loc, chunk(0), "hello ")
+	require.Equal(http.StatusNoContent, resp.StatusCode)
+	assert.Equal("6", resp.Header.Get("Upload-Offset"))
+
+	// a client resuming asks where to continue from
+	resp = do("HEAD", loc, nil, "")
+	require.Equal(http.StatusOK, resp.StatusCode)
+	assert.Equal("6", resp.Header.Get("Upload-Offset"))
+	assert.Equal("11", resp.Header.Get("Upload-Length"))
+
+	resp = do("PATCH", loc, chunk(3), "lo world")
+	assert.Equal(http.StatusConflict, resp.StatusCode)
+	resp = do("PATCH", loc, map[string]string{"Upload-Offset": "6"}, "world")
+	assert.Equal(http.StatusUnsupportedMediaType, resp.StatusCode)
+
+	resp = do("PATCH", loc, chunk(6), "world")
+	require.Equal(http.StatusNoContent, resp.StatusCode)
+	assert.Equal("11", resp.Header.Get("Upload-Offset"))
+	assert.Equal("notes.txt", resp.Header.Get("Upload-Filename"))
+	id, err := strconv.ParseUint(resp.Header.Get("Upload-Id"), 10, 64)
+	require.NoError(err)
+
+	data, err := fs.ReadFile(fsys, "notes.txt")
+	require.NoError(err)
+	assert.Equal("hello world", string(data))
+	upload, err := NewUploadService(conn).GetByID(id)
+	require.NoError(err)
+	assert.Equal(int64(11), upload.Size)
+	entries, err := os.ReadDir(cfg.TusDir)
+	require.NoError(err)
+	assert.Empty(entries)
+
+	// a completed upload can't be written to
+	resp = do("PATCH", loc, chunk(11), "!")
+	assert.Equal(http.StatusForbidden, resp.StatusCode)
+
+	// termination removes an unfinished upload and its data
+	resp = do("POST", "/tus/uploads", map[string]string{"Upload-Length": "5", "Upload-Metadata": meta}, "")
+	require.Equal(http.StatusCreated, resp.StatusCode)
+	loc = strings.TrimPrefix(resp.Header.Get("Location"), srv.URL)
+	resp = do("DELETE", loc, nil, "")
+	assert.Equal(http.StatusNoContent, resp.StatusCode)
+	resp = do("HEAD", loc, nil, "")
+	assert.Equal(http.StatusNotFound, resp.StatusCode)
+
+	// abandoned uploads expire
+	resp = do("POST", "/tus/uploads", map[string]string{
+		"Upload-Length": "5", "Upload-Metadata": meta, "Content-Type": "application/offset+octet-stream",
+	}, "ab")
+	require.Equal(http.StatusCreated, resp.StatusCode)
+	assert.Equal("2", resp.Header.Get("Upload-Offset"))
+	loc = strings.TrimPrefix(resp.Header.Get("Location"), srv.URL)
+	_, err = conn.Exec(`UPDATE upload_tus SET expires_at = datetime('now', '-1 day') WHERE upload_id = 0`)
+	require.NoError(err)
+	resp = do("HEAD", loc, nil, "")
+	assert.Equal(http.StatusGone, resp.StatusCode)
+
+	n, err := NewUploadService(conn).WithConfig(cfg).ExpireTusUploads()
+	require.NoError(err)
+	assert.Equal(1, n)
+	entries, err = os.ReadDir(cfg.TusDir)
+	require.NoError(err)
+	assert.Empty(entries)
+}
+
+func TestExpireTusStops(t *testing.T) {
+	conn, err := sqlx.Connect("sqlite3", ":memory:")
+	require.NoError(t, err)
+	a := NewApp(conn, nil)
+	require.NoError(t, a.Migrate())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		a.expireTus(ctx)
+		close(done)
+	}()
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expireTus didn't stop when its context was cancelled")
+	}
+
+	// stopping an app that was never bound keeps it from starting
+	a = NewApp(conn, nil)
+	a.Stop()
+	a.Bind(chi.NewRouter())
+	assert.Nil(t, a.stopExpiry)
+}